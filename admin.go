@@ -0,0 +1,99 @@
+package metcap
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+)
+
+// Admin serves the HTTP admin API for introspection and runtime control of
+// the other modules. It's disabled unless [admin] listen is set, and only
+// endpoints storing data require the [token], so keep it bound to localhost
+// or a management network.
+type Admin struct {
+	Config *AdminConfig
+	Mux    *http.ServeMux
+	Server *http.Server
+	Sock   net.Listener
+	Logger *Logger
+}
+
+func NewAdmin(c *AdminConfig, logger *Logger) *Admin {
+	mux := http.NewServeMux()
+	return &Admin{
+		Config: c,
+		Mux:    mux,
+		Server: &http.Server{Addr: c.Listen, Handler: mux},
+		Logger: logger,
+	}
+}
+
+// Handle registers handler for the pattern, like http.ServeMux
+func (a *Admin) Handle(pattern string, handler http.HandlerFunc) {
+	a.Mux.HandleFunc(pattern, handler)
+}
+
+// HandleAuth registers handler for the pattern, requiring the [token] as
+// bearer token; with no token configured the endpoint is refused
+func (a *Admin) HandleAuth(pattern string, handler http.HandlerFunc) {
+	a.Mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		if a.authorized(w, r) {
+			handler(w, r)
+		}
+	})
+}
+
+// authorized checks the bearer token, refusing the request if it's wrong
+func (a *Admin) authorized(w http.ResponseWriter, r *http.Request) bool {
+	token := []byte("Bearer " + a.Config.Token)
+	if a.Config.Token == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), token) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// HandleJSON registers read-only endpoint returning JSON encoded result of f
+func (a *Admin) HandleJSON(pattern string, f func() interface{}) {
+	a.Mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, f())
+	})
+}
+
+func (a *Admin) Start() error {
+	socks, err := inheritedListeners("admin")
+	var sock net.Listener
+	if len(socks) > 0 {
+		sock = socks[0]
+	} else if err == nil {
+		sock, err = net.Listen("tcp", a.Config.Listen)
+	}
+	if err != nil {
+		a.Logger.Alert("[admin] Couldn't start admin API: %v", err)
+		return err
+	}
+	a.Sock = sock
+	a.Logger.Info("[admin] Serving admin API on %s", a.Config.Listen)
+	go func() {
+		if err := a.Server.Serve(sock); err != nil && err != http.ErrServerClosed {
+			a.Logger.Error("[admin] Admin API failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (a *Admin) Stop() {
+	a.Server.Close()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
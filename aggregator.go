@@ -0,0 +1,296 @@
+package metcap
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Aggregator rolls metrics up into one point per series and interval using
+// per-pattern methods, mirroring carbon's storage-aggregation.conf
+type Aggregator struct {
+	*sync.Mutex
+	Interval time.Duration
+	Rules    []AggregationRule
+	Logger   *Logger
+	Tuples   bool // every rolled up point carries its sum/count/min/max
+	buckets  map[aggregationKey]*aggregationBucket
+}
+
+// AggregationRule is a single section of storage-aggregation.conf
+type AggregationRule struct {
+	Name    string
+	Pattern *regexp.Regexp
+	Method  string
+}
+
+type aggregationKey struct {
+	series string
+	start  int64
+}
+
+type aggregationBucket struct {
+	metric     *Metric
+	method     string
+	count      float64
+	sum        float64
+	min        float64
+	max        float64
+	last       time.Time
+	aggregated bool // got pre-aggregated points
+}
+
+// NewAggregator loads the rules, metrics matching none of them are averaged
+// like in carbon
+func NewAggregator(c *AggregatorConfig, logger *Logger) (*Aggregator, error) {
+	rules, err := readAggregationRules(c.RulesFile)
+	if err != nil {
+		return nil, err
+	}
+	return &Aggregator{
+		Mutex:    &sync.Mutex{},
+		Interval: c.Interval.Duration,
+		Rules:    rules,
+		Logger:   logger,
+		buckets:  make(map[aggregationKey]*aggregationBucket),
+	}, nil
+}
+
+// readAggregationRules parses carbon's INI-like format:
+//
+//	[name]
+//	pattern = \.count$
+//	xFilesFactor = 0
+//	aggregationMethod = sum
+//
+// xFilesFactor is accepted but ignored, there's no notion of expected
+// points per interval in a push pipeline
+func readAggregationRules(rulesFile string) ([]AggregationRule, error) {
+	var rules []AggregationRule
+	if rulesFile == "" {
+		return rules, nil
+	}
+
+	f, err := os.Open(rulesFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rule *AggregationRule
+	lineNum := 0
+	scn := bufio.NewScanner(f)
+	for scn.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scn.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			rules = append(rules, AggregationRule{Name: line[1 : len(line)-1], Method: "average"})
+			rule = &rules[len(rules)-1]
+			continue
+		case rule == nil:
+			return nil, fmt.Errorf("%s:%d: option outside of a section", rulesFile, lineNum)
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected `key = value`", rulesFile, lineNum)
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch key {
+		case "pattern":
+			if rule.Pattern, err = regexp.Compile(value); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", rulesFile, lineNum, err)
+			}
+		case "aggregationMethod":
+			switch value {
+			case "average", "avg", "sum", "min", "max", "last":
+				rule.Method = value
+			default:
+				return nil, fmt.Errorf("%s:%d: unknown aggregation method '%s'", rulesFile, lineNum, value)
+			}
+		case "xFilesFactor":
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown option '%s'", rulesFile, lineNum, key)
+		}
+	}
+	if err := scn.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, r := range rules {
+		if r.Pattern == nil {
+			return nil, fmt.Errorf("%s: section [%s] has no pattern", rulesFile, r.Name)
+		}
+	}
+	return rules, nil
+}
+
+// method returns aggregation method of the first matching rule
+func (a *Aggregator) method(name string) string {
+	for _, rule := range a.Rules {
+		if rule.Pattern.MatchString(name) {
+			return rule.Method
+		}
+	}
+	return "average"
+}
+
+// Add accumulates the metric into its series' bucket
+func (a *Aggregator) Add(m *Metric) {
+	start := m.Timestamp.Truncate(a.Interval)
+	key := aggregationKey{m.SeriesID(), start.UnixNano()}
+
+	a.Lock()
+	defer a.Unlock()
+	b, ok := a.buckets[key]
+	if !ok {
+		b = &aggregationBucket{
+			metric: &Metric{Name: m.Name, Timestamp: start, Fields: m.Fields, OK: m.OK},
+			method: a.method(m.Name),
+			min:    math.Inf(1),
+			max:    math.Inf(-1),
+		}
+		a.buckets[key] = b
+	}
+	if agg := m.Aggregate; agg != nil {
+		b.aggregated = true
+		b.count += agg.Count
+		b.sum += agg.Sum
+		b.min = math.Min(b.min, agg.Min)
+		b.max = math.Max(b.max, agg.Max)
+	} else {
+		b.count++
+		b.sum += m.Value
+		b.min = math.Min(b.min, m.Value)
+		b.max = math.Max(b.max, m.Value)
+	}
+	if !m.Timestamp.Before(b.last) {
+		b.last = m.Timestamp
+		b.metric.Value = m.Value
+	}
+}
+
+// Flush emits buckets of finished intervals, or all of them when forced
+// (on shutdown). Late points for an already flushed interval start a new bucket.
+func (a *Aggregator) Flush(emit func(*Metric), force bool) int {
+	current := time.Now().Truncate(a.Interval).UnixNano()
+	var ready []*aggregationBucket
+
+	a.Lock()
+	for key, b := range a.buckets {
+		if force || key.start < current {
+			ready = append(ready, b)
+			delete(a.buckets, key)
+		}
+	}
+	a.Unlock()
+
+	for _, b := range ready {
+		switch b.method {
+		case "sum":
+			b.metric.Value = b.sum
+		case "min":
+			b.metric.Value = b.min
+		case "max":
+			b.metric.Value = b.max
+		case "last":
+			// already set
+		default:
+			b.metric.Value = b.sum / b.count
+		}
+		if b.aggregated || a.Tuples {
+			b.metric.Aggregate = &Aggregate{Sum: b.sum, Count: b.count, Min: b.min, Max: b.max}
+		}
+		emit(b.metric)
+	}
+	return len(ready)
+}
+
+// AggregationSnapshot is the bucket of an unfinished interval kept across
+// restart, see WriterSnapshot
+type AggregationSnapshot struct {
+	Metric     *Metric
+	Count      float64
+	Sum        float64
+	Min        float64
+	Max        float64
+	Last       time.Time
+	Aggregated bool
+}
+
+// Snapshot takes the buckets out (finished intervals should be flushed
+// first), so they're kept rather than flushed partial
+func (a *Aggregator) Snapshot() []AggregationSnapshot {
+	a.Lock()
+	defer a.Unlock()
+	out := make([]AggregationSnapshot, 0, len(a.buckets))
+	for key, b := range a.buckets {
+		out = append(out, AggregationSnapshot{
+			Metric:     b.metric,
+			Count:      b.count,
+			Sum:        b.sum,
+			Min:        b.min,
+			Max:        b.max,
+			Last:       b.last,
+			Aggregated: b.aggregated,
+		})
+		delete(a.buckets, key)
+	}
+	return out
+}
+
+// Restore merges the snapshot buckets in, intervals finished meanwhile get
+// flushed with the next ones
+func (a *Aggregator) Restore(buckets []AggregationSnapshot) {
+	a.Lock()
+	defer a.Unlock()
+	for _, s := range buckets {
+		start := s.Metric.Timestamp.Truncate(a.Interval)
+		key := aggregationKey{s.Metric.SeriesID(), start.UnixNano()}
+		b, ok := a.buckets[key]
+		if !ok {
+			s.Metric.Timestamp = start
+			a.buckets[key] = &aggregationBucket{
+				metric:     s.Metric,
+				method:     a.method(s.Metric.Name),
+				count:      s.Count,
+				sum:        s.Sum,
+				min:        s.Min,
+				max:        s.Max,
+				last:       s.Last,
+				aggregated: s.Aggregated,
+			}
+			continue
+		}
+		b.count += s.Count
+		b.sum += s.Sum
+		b.min = math.Min(b.min, s.Min)
+		b.max = math.Max(b.max, s.Max)
+		b.aggregated = b.aggregated || s.Aggregated
+		if s.Last.After(b.last) {
+			b.last = s.Last
+			b.metric.Value = s.Metric.Value
+		}
+	}
+}
+
+// Run flushes finished intervals until stop is closed
+func (a *Aggregator) Run(emit func(*Metric), stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(a.Interval):
+			if n := a.Flush(emit, false); n > 0 {
+				a.Logger.Debug("[aggregator] Flushed %d aggregated metrics", n)
+			}
+		}
+	}
+}
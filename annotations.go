@@ -0,0 +1,87 @@
+package metcap
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Annotations lets teams post one-off events (deploy markers, incidents)
+// through the admin API, stored in the writer's events index next to the
+// threshold events so the same Grafana annotation query shows both.
+type Annotations struct {
+	Writer *Writer
+	Logger *Logger
+}
+
+type annotationRequest struct {
+	Time   string            `json:"time"` // RFC3339, defaults to now
+	Title  string            `json:"title"`
+	Text   string            `json:"text"`
+	Tags   []string          `json:"tags"`
+	Fields map[string]string `json:"fields"`
+}
+
+func NewAnnotations(w *Writer, logger *Logger) *Annotations {
+	return &Annotations{Writer: w, Logger: logger}
+}
+
+// Register adds the annotation endpoint to the admin API, requiring its
+// token
+func (a *Annotations) Register(admin *Admin) {
+	admin.HandleAuth("/annotations", a.handlePost)
+}
+
+// handlePost: POST /annotations {"title": "deploy", "text": "v1.2.3", "tags": ["deploy"]}
+func (a *Annotations) handlePost(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var ar annotationRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 1<<20)).Decode(&ar); err != nil {
+		http.Error(w, "invalid annotation: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if ar.Title == "" && ar.Text == "" {
+		http.Error(w, "annotation needs title or text", http.StatusBadRequest)
+		return
+	}
+	ev := &Event{
+		Timestamp: time.Now(),
+		Type:      "annotation",
+		Name:      ar.Title,
+		Fields:    ar.Fields,
+		Tags:      ar.Tags,
+		Text:      ar.Text,
+	}
+	if ar.Time != "" {
+		t, err := time.Parse(time.RFC3339, ar.Time)
+		if err != nil {
+			http.Error(w, "invalid time: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		ev.Timestamp = t
+	}
+
+	es, _ := a.Writer.Client()
+	if es == nil {
+		http.Error(w, "not connected to ElasticSearch yet", http.StatusServiceUnavailable)
+		return
+	}
+	index := ev.Index(a.Writer.Config.Events.Index)
+	// stored right away rather than through the bulk processor, so the
+	// sender learns whether it made it
+	res, err := es.PerformRequest("POST", "/"+index+"/"+a.Writer.Config.Events.DocType, nil, ev)
+	if err != nil {
+		a.Logger.Error("[writer] Failed to store annotation: %v", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	var doc struct {
+		ID string `json:"_id"`
+	}
+	json.Unmarshal(res.Body, &doc)
+	a.Logger.Info("[writer] Stored annotation '%s' from %s into %s", ev.Name, req.RemoteAddr, index)
+	writeJSON(w, http.StatusCreated, map[string]string{"index": index, "id": doc.ID})
+}
@@ -0,0 +1,140 @@
+package metcap
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// Anonymizer replaces values of personal fields (user IDs, client IPs)
+// right before indexing. "hash" keeps [length] hex digits (default 16) of
+// the value's HMAC-SHA256 under the [key], so equal values stay equal and
+// series keep their cardinality while the values can't be looked up
+// without the key; "truncate" keeps the first [length] characters; "ip"
+// masks IPv4 addresses to their [prefix] network (default /24) and IPv6
+// ones to [prefix6] (default /48), values which aren't addresses get
+// hashed.
+type Anonymizer struct {
+	key        []byte
+	rules      map[string]anonymizeRule // by field key
+	Anonymized *StatsCounter
+}
+
+type anonymizeRule struct {
+	method  string
+	length  int
+	prefix  int
+	prefix6 int
+}
+
+func NewAnonymizer(c *AnonymizeConfig) (*Anonymizer, error) {
+	if len(c.Rules) == 0 {
+		return nil, nil
+	}
+	key := c.Key
+	if c.KeyFile != "" {
+		data, err := ioutil.ReadFile(c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key = strings.TrimSpace(string(data))
+	}
+	a := &Anonymizer{
+		key:        []byte(key),
+		rules:      make(map[string]anonymizeRule),
+		Anonymized: NewStatsCounter(time.Now()),
+	}
+	for _, rc := range c.Rules {
+		rule := anonymizeRule{rc.Method, rc.Length, rc.Prefix, rc.Prefix6}
+		if rule.prefix <= 0 {
+			rule.prefix = 24
+		}
+		if rule.prefix6 <= 0 {
+			rule.prefix6 = 48
+		}
+		if rule.prefix > 32 || rule.prefix6 > 128 {
+			return nil, errors.New("anonymize prefix out of range")
+		}
+		switch rule.method {
+		case "hash", "ip":
+			if key == "" {
+				return nil, fmt.Errorf("anonymize method '%s' needs key or key_file", rule.method)
+			}
+			if rule.length <= 0 || rule.length > 2*sha256.Size {
+				rule.length = 16
+			}
+		case "truncate":
+			if rule.length <= 0 {
+				return nil, errors.New("anonymize method 'truncate' needs length")
+			}
+		default:
+			return nil, fmt.Errorf("unknown anonymize method '%s'", rule.method)
+		}
+		if len(rc.Fields) == 0 {
+			return nil, errors.New("anonymize rule needs fields")
+		}
+		for _, field := range rc.Fields {
+			a.rules[field] = rule
+		}
+	}
+	return a, nil
+}
+
+func (a *Anonymizer) hash(value string, length int) string {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))[:length]
+}
+
+func (a *Anonymizer) anonymize(value string, rule anonymizeRule) string {
+	switch rule.method {
+	case "truncate":
+		if r := []rune(value); len(r) > rule.length {
+			return string(r[:rule.length])
+		}
+		return value
+	case "ip":
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return a.hash(value, rule.length)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(rule.prefix, 32)).String()
+		}
+		return ip.Mask(net.CIDRMask(rule.prefix6, 128)).String()
+	}
+	return a.hash(value, rule.length)
+}
+
+// BeforeIndex makes the anonymizer a WriterHook, the metric is copied if
+// any of its fields gets replaced, without the raw line holding the values
+func (a *Anonymizer) BeforeIndex(m *Metric) (*Metric, bool) {
+	var out *Metric
+	for k, v := range m.Fields {
+		rule, ok := a.rules[k]
+		if !ok {
+			continue
+		}
+		if out == nil {
+			c := *m
+			c.Fields = make(map[string]string, len(m.Fields))
+			for fk, fv := range m.Fields {
+				c.Fields[fk] = fv
+			}
+			c.Raw = ""
+			out = &c
+		}
+		out.Fields[k] = a.anonymize(v, rule)
+	}
+	if out == nil {
+		return m, true
+	}
+	a.Anonymized.Increment(1)
+	return out, true
+}
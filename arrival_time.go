@@ -0,0 +1,88 @@
+package metcap
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"time"
+)
+
+// ArrivalTime replaces timestamps sent by sources with broken clocks by the
+// time metrics arrive. A rule applies to metrics with names matching its
+// [match] pattern, coming from any of its [sources] CIDRs, or both when both
+// are set. Overrides moving the timestamp by more than [arrival_time_skew]
+// are counted separately, telling how far off the clocks really are.
+type ArrivalTime struct {
+	rules      []arrivalTimeRule
+	skew       time.Duration
+	Overridden *StatsCounter
+	Skewed     *StatsCounter
+}
+
+type arrivalTimeRule struct {
+	match   *regexp.Regexp
+	sources []*net.IPNet
+}
+
+func NewArrivalTime(c ListenerConfig) (*ArrivalTime, error) {
+	if len(c.ArrivalTime) == 0 {
+		return nil, nil
+	}
+	a := &ArrivalTime{
+		skew:       c.ArrivalTimeSkew.Duration,
+		Overridden: NewStatsCounter(time.Now()),
+		Skewed:     NewStatsCounter(time.Now()),
+	}
+	if a.skew <= 0 {
+		a.skew = 10 * time.Second
+	}
+	for _, rc := range c.ArrivalTime {
+		if rc.Match == "" && len(rc.Sources) == 0 {
+			return nil, fmt.Errorf("arrival_time rule needs match or sources")
+		}
+		var rule arrivalTimeRule
+		if rc.Match != "" {
+			re, err := regexp.Compile(rc.Match)
+			if err != nil {
+				return nil, err
+			}
+			rule.match = re
+		}
+		sources, err := parseCIDRs(rc.Sources)
+		if err != nil {
+			return nil, err
+		}
+		rule.sources = sources
+		a.rules = append(a.rules, rule)
+	}
+	return a, nil
+}
+
+func (r arrivalTimeRule) matches(m *Metric, source net.IP) bool {
+	if r.match != nil && !r.match.MatchString(m.Name) {
+		return false
+	}
+	if len(r.sources) == 0 {
+		return true
+	}
+	return ipInNets(source, r.sources)
+}
+
+// Apply sets the metric's timestamp to now if any rule matches
+func (a *ArrivalTime) Apply(m *Metric, source net.IP, now time.Time) {
+	for _, rule := range a.rules {
+		if !rule.matches(m, source) {
+			continue
+		}
+		diff := m.Timestamp.Sub(now)
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff > a.skew {
+			a.Skewed.Increment(1)
+		}
+		a.Overridden.Increment(1)
+		m.Timestamp = now
+		return
+	}
+}
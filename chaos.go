@@ -0,0 +1,160 @@
+package metcap
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Chaos injects faults into the pipeline so its recovery paths (bulk
+// retries and failures, transport backlog, codec and policy errors) can be
+// exercised in staging rather than waited for in real outages: bulk
+// requests answered 503 without reaching ElasticSearch, writer pops from
+// the transport delayed, decoded metrics corrupted (NaN value, empty name
+// or a timestamp a year off), each for the configured percentage of them.
+// It's never enabled unless [enabled] is set, whatever the percentages.
+type Chaos struct {
+	BulkFailPercent float64
+	PopDelayPercent float64
+	PopDelay        time.Duration
+	CorruptPercent  float64
+	BulksFailed     *StatsCounter
+	PopsDelayed     *StatsCounter
+	Corrupted       *StatsCounter
+	Logger          *Logger
+
+	rnd *rand.Rand
+	mux *sync.Mutex
+}
+
+func NewChaos(c *ChaosConfig, logger *Logger) (*Chaos, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+	for _, p := range []float64{c.BulkFailPercent, c.PopDelayPercent, c.CorruptPercent} {
+		if p < 0 || p > 100 {
+			return nil, fmt.Errorf("invalid chaos percentage %v", p)
+		}
+	}
+	ch := &Chaos{
+		BulkFailPercent: c.BulkFailPercent,
+		PopDelayPercent: c.PopDelayPercent,
+		PopDelay:        c.PopDelay.Duration,
+		CorruptPercent:  c.CorruptPercent,
+		BulksFailed:     NewStatsCounter(time.Now()),
+		PopsDelayed:     NewStatsCounter(time.Now()),
+		Corrupted:       NewStatsCounter(time.Now()),
+		Logger:          logger,
+		rnd:             rand.New(rand.NewSource(time.Now().UnixNano())),
+		mux:             &sync.Mutex{},
+	}
+	if ch.PopDelay <= 0 {
+		ch.PopDelay = time.Second
+	}
+	logger.Alert("[chaos] Fault injection enabled: %.1f%% bulks failed, %.1f%% pops delayed by %v, %.1f%% metrics corrupted",
+		ch.BulkFailPercent, ch.PopDelayPercent, ch.PopDelay, ch.CorruptPercent)
+	return ch, nil
+}
+
+// hit tells whether the fault of the percentage happens this time
+func (ch *Chaos) hit(percent float64) bool {
+	if percent <= 0 {
+		return false
+	}
+	ch.mux.Lock()
+	defer ch.mux.Unlock()
+	return ch.rnd.Float64()*100 < percent
+}
+
+func (ch *Chaos) intn(n int) int {
+	ch.mux.Lock()
+	defer ch.mux.Unlock()
+	return ch.rnd.Intn(n)
+}
+
+// RoundTripper fails bulk requests without sending them, passes the rest
+// on to the transport (default one if nil); writers have transports of
+// their own
+func (ch *Chaos) RoundTripper(transport http.RoundTripper) http.RoundTripper {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return chaosTransport{ch, transport}
+}
+
+type chaosTransport struct {
+	chaos     *Chaos
+	transport http.RoundTripper
+}
+
+func (t chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ch := t.chaos
+	if !strings.HasSuffix(req.URL.Path, "/_bulk") || !ch.hit(ch.BulkFailPercent) {
+		return t.transport.RoundTrip(req)
+	}
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	ch.BulksFailed.Increment(1)
+	body := `{"error":{"type":"chaos","reason":"bulk failed by fault injection"},"status":503}`
+	return &http.Response{
+		Status:        "503 Service Unavailable",
+		StatusCode:    http.StatusServiceUnavailable,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// DelayPop sleeps before the writer takes from the transport
+func (ch *Chaos) DelayPop() {
+	if !ch.hit(ch.PopDelayPercent) {
+		return
+	}
+	ch.PopsDelayed.Increment(1)
+	time.Sleep(ch.PopDelay)
+}
+
+// Corrupt mangles the decoded metric one of the ways codecs and senders
+// get it wrong
+func (ch *Chaos) Corrupt(m *Metric) {
+	if !ch.hit(ch.CorruptPercent) {
+		return
+	}
+	ch.Corrupted.Increment(1)
+	switch ch.intn(3) {
+	case 0:
+		m.Value = math.NaN()
+	case 1:
+		m.Name = ""
+	default:
+		m.Timestamp = m.Timestamp.AddDate(1, 0, 0)
+	}
+}
+
+func (ch *Chaos) LogReport() {
+	ch.Logger.Info("[chaos] faults: %d/%d/%d (bulks_failed/pops_delayed/metrics_corrupted)",
+		ch.BulksFailed.Total(),
+		ch.PopsDelayed.Total(),
+		ch.Corrupted.Total(),
+	)
+}
+
+// SelfSource reports the faults injected, so they can be told apart from
+// real ones on the dashboards
+func (ch *Chaos) SelfSource() SelfSource {
+	return func(emit func(string, float64, map[string]string)) {
+		emit("chaos.bulks_failed", float64(ch.BulksFailed.Total()), nil)
+		emit("chaos.pops_delayed", float64(ch.PopsDelayed.Total()), nil)
+		emit("chaos.metrics_corrupted", float64(ch.Corrupted.Total()), nil)
+	}
+}
@@ -0,0 +1,346 @@
+// Package client pushes metrics to a metcap listener from Go programs, with
+// batching, retries and a bounded buffer, so services don't need to write
+// their own socket code.
+//
+//	c, err := client.New(client.Config{Protocol: "influx", Address: "metcap:8086"})
+//	...
+//	c.Push(client.Metric{Name: "requests", Value: 1, Fields: map[string]string{"host": "web1"}})
+//	...
+//	c.Close() // sends what's buffered
+//
+// Protocols:
+//   - "graphite": plain lines over TCP to a graphite listener, fields are
+//     not sent (graphite listeners derive them from the path), timestamps
+//     are sent in seconds
+//   - "influx": line protocol over TCP to an influx listener, fields being
+//     the tags and timestamps sent in milliseconds (as the listener guesses
+//     13 digits, keep its [precision] unset or "ms")
+//   - "http": JSON lines POSTed to an http listener with the json codec,
+//     Address being the URL
+//
+// The line protocols have no escaping, so Push rejects metrics the
+// listener couldn't read: names (and influx field names and values) take
+// letters, digits, "_", "-" and "." only. NaN and infinite values are
+// rejected with any protocol.
+//
+// There's no gRPC listener to push to, so no gRPC protocol either.
+//
+// Listeners decode the data of a TCP connection once it's closed, so every
+// batch goes over a connection of its own.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metric is a point to push, Timestamp defaults to the time of Push
+type Metric struct {
+	Name      string
+	Value     float64
+	Timestamp time.Time
+	Fields    map[string]string
+}
+
+type Config struct {
+	Protocol      string        // "graphite", "influx" or "http"
+	Address       string        // host:port, URL for "http"
+	BatchSize     int           // metrics sent at once (default 500)
+	FlushInterval time.Duration // longest a metric waits for the batch (default 1s)
+	BufferSize    int           // metrics waiting to be sent (default 10000)
+	Block         bool          // Push waits while the buffer is full instead of dropping
+	Retries       int           // attempts after the first failed one (default 3)
+	RetryWait     time.Duration // wait before the first retry, doubled for the next (default 100ms)
+	Timeout       time.Duration // of connecting and sending a batch (default 5s)
+}
+
+// ErrBufferFull is returned by Push dropping the metric
+var ErrBufferFull = errors.New("metcap client buffer full")
+
+// ErrClosed is returned by Push after Close
+var ErrClosed = errors.New("metcap client closed")
+
+// InvalidMetricError is returned by Push rejecting the metric the protocol
+// can't carry
+type InvalidMetricError struct {
+	Name   string
+	Reason string
+}
+
+func (e *InvalidMetricError) Error() string {
+	return fmt.Sprintf("invalid metric '%s': %s", e.Name, e.Reason)
+}
+
+// what the line protocol listeners take, names and influx fields alike
+var lineTokenRe = regexp.MustCompile(`^[a-zA-Z0-9_\-\.]+$`)
+
+type Stats struct {
+	Sent    uint64 // metrics sent, over TCP not telling whether the listener took them
+	Dropped uint64 // metrics dropped by Push with full buffer
+	Invalid uint64 // metrics rejected by Push
+	Failed  uint64 // metrics of batches failing all the retries
+}
+
+type Client struct {
+	config   Config
+	format   func(*bytes.Buffer, Metric)
+	validate func(Metric) error
+	send     func([]byte) error
+	http     *http.Client
+	buffer   chan Metric
+	done     chan struct{}
+	closed   bool
+	mux      sync.RWMutex
+	stats    Stats
+}
+
+func New(c Config) (*Client, error) {
+	if c.Address == "" {
+		return nil, errors.New("missing address")
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = 500
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = time.Second
+	}
+	if c.BufferSize <= 0 {
+		c.BufferSize = 10000
+	}
+	if c.Retries < 0 {
+		c.Retries = 0
+	} else if c.Retries == 0 {
+		c.Retries = 3
+	}
+	if c.RetryWait <= 0 {
+		c.RetryWait = 100 * time.Millisecond
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 5 * time.Second
+	}
+	cl := &Client{
+		config: c,
+		buffer: make(chan Metric, c.BufferSize),
+		done:   make(chan struct{}),
+	}
+	switch c.Protocol {
+	case "graphite":
+		cl.format, cl.validate, cl.send = formatGraphite, validateGraphite, cl.sendTCP
+	case "influx":
+		cl.format, cl.validate, cl.send = formatInflux, validateInflux, cl.sendTCP
+	case "http":
+		cl.format, cl.validate, cl.send = formatJSON, validateJSON, cl.sendHTTP
+		cl.http = &http.Client{Timeout: c.Timeout}
+	default:
+		return nil, fmt.Errorf("unknown protocol '%s'", c.Protocol)
+	}
+	go cl.run()
+	return cl, nil
+}
+
+// Push queues the metric; with the buffer full it's dropped and
+// ErrBufferFull returned, unless Config.Block is set. Metrics the protocol
+// can't carry get *InvalidMetricError.
+func (c *Client) Push(m Metric) error {
+	if err := c.validate(m); err != nil {
+		atomic.AddUint64(&c.stats.Invalid, 1)
+		return err
+	}
+	if m.Timestamp.IsZero() {
+		m.Timestamp = time.Now()
+	}
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	if c.closed {
+		return ErrClosed
+	}
+	if c.config.Block {
+		c.buffer <- m
+		return nil
+	}
+	select {
+	case c.buffer <- m:
+		return nil
+	default:
+		atomic.AddUint64(&c.stats.Dropped, 1)
+		return ErrBufferFull
+	}
+}
+
+// Close sends the buffered metrics and stops the client
+func (c *Client) Close() error {
+	c.mux.Lock()
+	if c.closed {
+		c.mux.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.buffer)
+	c.mux.Unlock()
+	<-c.done
+	return nil
+}
+
+func (c *Client) Stats() Stats {
+	return Stats{
+		Sent:    atomic.LoadUint64(&c.stats.Sent),
+		Dropped: atomic.LoadUint64(&c.stats.Dropped),
+		Invalid: atomic.LoadUint64(&c.stats.Invalid),
+		Failed:  atomic.LoadUint64(&c.stats.Failed),
+	}
+}
+
+func (c *Client) run() {
+	defer close(c.done)
+	batch := make([]Metric, 0, c.config.BatchSize)
+	ticker := time.NewTicker(c.config.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case m, ok := <-c.buffer:
+			if !ok {
+				c.flush(batch)
+				return
+			}
+			if batch = append(batch, m); len(batch) >= c.config.BatchSize {
+				c.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			c.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// flush sends the batch, retrying with doubling waits
+func (c *Client) flush(batch []Metric) {
+	if len(batch) == 0 {
+		return
+	}
+	var buf bytes.Buffer
+	for _, m := range batch {
+		c.format(&buf, m)
+	}
+	wait := c.config.RetryWait
+	for attempt := 0; ; attempt++ {
+		err := c.send(buf.Bytes())
+		if err == nil {
+			atomic.AddUint64(&c.stats.Sent, uint64(len(batch)))
+			return
+		}
+		if _, permanent := err.(permanentError); permanent || attempt >= c.config.Retries {
+			atomic.AddUint64(&c.stats.Failed, uint64(len(batch)))
+			return
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// permanentError isn't worth retrying, ie. the listener rejected the data
+type permanentError struct{ error }
+
+func (c *Client) sendTCP(data []byte) error {
+	conn, err := net.DialTimeout("tcp", c.config.Address, c.config.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(c.config.Timeout))
+	_, err = conn.Write(data)
+	return err
+}
+
+func (c *Client) sendHTTP(data []byte) error {
+	res, err := c.http.Post(c.config.Address, "application/x-ndjson", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+	switch {
+	case res.StatusCode < 300:
+		return nil
+	case res.StatusCode >= 500:
+		return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	return permanentError{fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))}
+}
+
+func validateJSON(m Metric) error {
+	if m.Name == "" {
+		return &InvalidMetricError{m.Name, "empty name"}
+	}
+	if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+		return &InvalidMetricError{m.Name, fmt.Sprintf("value %v", m.Value)}
+	}
+	return nil
+}
+
+func validateGraphite(m Metric) error {
+	if !lineTokenRe.MatchString(m.Name) {
+		return &InvalidMetricError{m.Name, "name has characters other than letters, digits, '_', '-' and '.'"}
+	}
+	return validateJSON(m)
+}
+
+func validateInflux(m Metric) error {
+	for k, v := range m.Fields {
+		if !lineTokenRe.MatchString(k) || !lineTokenRe.MatchString(v) {
+			return &InvalidMetricError{m.Name, fmt.Sprintf("field %s=%s has characters other than letters, digits, '_', '-' and '.'", k, v)}
+		}
+	}
+	return validateGraphite(m)
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func formatGraphite(buf *bytes.Buffer, m Metric) {
+	fmt.Fprintf(buf, "%s %s %d\n", m.Name, formatValue(m.Value), m.Timestamp.Unix())
+}
+
+// formatInflux writes the line with millisecond timestamp, fields being
+// the tags
+func formatInflux(buf *bytes.Buffer, m Metric) {
+	buf.WriteString(m.Name)
+	first := true
+	for k, v := range m.Fields {
+		if first {
+			buf.WriteByte(' ')
+			first = false
+		} else {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(k + "=" + v)
+	}
+	fmt.Fprintf(buf, " value=%s %d\n", formatValue(m.Value), m.Timestamp.UnixNano()/int64(time.Millisecond))
+}
+
+type jsonMetric struct {
+	Name      string            `json:"name"`
+	Value     float64           `json:"value"`
+	Timestamp string            `json:"timestamp"`
+	Fields    map[string]string `json:"fields,omitempty"`
+}
+
+func formatJSON(buf *bytes.Buffer, m Metric) {
+	out, _ := json.Marshal(jsonMetric{m.Name, m.Value, m.Timestamp.Format(time.RFC3339Nano), m.Fields})
+	buf.Write(out)
+	buf.WriteByte('\n')
+}
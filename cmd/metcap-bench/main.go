@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/blufor/metcap"
+)
+
+// metcap-bench decodes the golden corpus with every codec, checks the counts
+// of decoded and failed lines against the .golden files next to the corpus
+// files and benchmarks the decoding throughput, the decoded metrics themselves
+// are checked by `go test` against the .metrics files.
+// Corpus files are named after the codec, ie. graphite.txt or influx-tags.txt.
+
+func main() {
+	corpus := flag.String("corpus", "testdata/corpus", "Directory of the corpus files")
+	mutator := flag.String("mutator", "etc/graphite_mutator.conf", "Graphite mutator rules")
+	workers := flag.Int("workers", runtime.NumCPU(), "Codec workers")
+	update := flag.Bool("update", false, "Rewrite the golden files with current results")
+	bench := flag.Bool("bench", true, "Run the benchmarks")
+	flag.Parse()
+
+	files, err := filepath.Glob(filepath.Join(*corpus, "*.txt"))
+	if err != nil || len(files) == 0 {
+		fmt.Printf("ERROR: No corpus files in '%s'\n", *corpus)
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+			os.Exit(1)
+		}
+		name := strings.TrimSuffix(filepath.Base(file), ".txt")
+		codec, err := newCodec(strings.SplitN(name, "-", 2)[0], *mutator, *workers)
+		if err != nil {
+			fmt.Printf("ERROR: %s: %v\n", file, err)
+			os.Exit(1)
+		}
+
+		decoded, errs := decode(codec, data)
+		result := fmt.Sprintf("decoded=%d failed=%d\n", decoded, errs)
+		golden := strings.TrimSuffix(file, ".txt") + ".golden"
+		if *update {
+			if err := ioutil.WriteFile(golden, []byte(result), 0644); err != nil {
+				fmt.Printf("ERROR: %v\n", err)
+				os.Exit(1)
+			}
+		} else if expected, err := ioutil.ReadFile(golden); err != nil {
+			fmt.Printf("%s: no golden file (%v)\n", name, err)
+		} else if string(expected) != result {
+			fmt.Printf("FAIL %s: got %s     expected %s", name, result, expected)
+			failed = true
+		}
+
+		if *bench {
+			res := testing.Benchmark(func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(len(data)))
+				for i := 0; i < b.N; i++ {
+					decode(codec, data)
+				}
+			})
+			lines := bytes.Count(data, []byte("\n"))
+			fmt.Printf("%-20s %s %s %.0f lines/s\n", name, res, res.MemString(),
+				float64(lines)*float64(res.N)/res.T.Seconds())
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func newCodec(name, mutator string, workers int) (metcap.Codec, error) {
+	o := metcap.CodecOptions{Workers: workers}
+	switch name {
+	case "graphite":
+		return metcap.NewGraphiteCodec(mutator, false, o)
+	case "influx":
+		return metcap.NewInfluxCodec(o)
+	}
+	return nil, fmt.Errorf("unknown codec '%s'", name)
+}
+
+func decode(codec metcap.Codec, data []byte) (decoded, failed int) {
+	metrics, errs := codec.Decode(bytes.NewReader(data))
+	for metrics != nil || errs != nil {
+		select {
+		case _, ok := <-metrics:
+			if !ok {
+				metrics = nil
+				continue
+			}
+			decoded++
+		case _, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			failed++
+		}
+	}
+	return decoded, failed
+}
@@ -4,34 +4,34 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"runtime"
 	// "runtime/pprof"
 
 	"github.com/blufor/metcap"
 	"github.com/pkg/profile"
 )
 
-var (
-	// Version is used to specify version number on build
-	Version string
-	// Build is used to specify commit sub-hash on build
-	Build string
-)
-
 func main() {
 	var p interface {
 		Stop()
 	}
 	cfg := flag.String("config", "/etc/metcap/main.conf", "Path to config file")
-	cores := flag.Int("cores", runtime.NumCPU(), "Number of cores to use")
+	cores := flag.Int("cores", 0, "Number of cores to use (default: [cpu] gomaxprocs, cgroup quota or all)")
 	prof := flag.String("prof", "", "Run with profiling enabled, can be either one of: cpu,mem,blk,trace")
 	version := flag.Bool("version", false, "Show version")
+	check := flag.Bool("check", false, "Check the config file, print warnings and exit")
 	flag.Parse()
-	if *version {
-		fmt.Printf("MetCap version %s (build %s)\n", Version, Build)
+	if *version || flag.Arg(0) == "version" {
+		fmt.Println(metcap.GetBuildInfo())
 		return
 	}
 	config := metcap.ReadConfig(cfg)
+	if *check {
+		for _, warning := range config.Warnings() {
+			fmt.Println("WARNING:", warning)
+		}
+		fmt.Println("Config OK")
+		return
+	}
 	switch *prof {
 	case "":
 	case "cpu":
@@ -46,7 +46,9 @@ func main() {
 		fmt.Printf("ERROR: Unknown profiling type '%s'. Use one of: cpu,mem,blk,trace\n", *prof)
 		os.Exit(1)
 	}
-	runtime.GOMAXPROCS(*cores)
+	if *cores > 0 {
+		config.CPU.GoMaxProcs = *cores
+	}
 	mc, exitCode := metcap.NewEngine(config)
 	mc.Run()
 	codeNum := <-exitCode
@@ -1,20 +1,578 @@
 package metcap
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// valuePattern matches values ParseFloat reads, including nan and (-)inf,
+// so they get to the listener's value policy rather than failing the line
+const valuePattern = `[-+]?([0-9\.]+([eE][-+]?[0-9]+)?|[nN][aA][nN]|[iI][nN][fF]([iI][nN][iI][tT][yY])?)`
+
 type Codec interface {
 	Decode(io.Reader) (<-chan *Metric, <-chan error)
 }
 
+// DecodeBatch decodes the whole input at once, for programs embedding the
+// codecs as a library without dealing with the channels of Decode. Metrics
+// come in the order they got decoded, which is the input's one only with a
+// single codec worker. Errors are sampled like Decode's, the Count of a
+// *CodecError tells how many failures it stands for.
+func DecodeBatch(c Codec, input []byte) ([]*Metric, []error) {
+	var (
+		decoded []*Metric
+		failed  []error
+	)
+	metrics, errs := c.Decode(bytes.NewReader(input))
+	for metrics != nil || errs != nil {
+		select {
+		case m, ok := <-metrics:
+			if !ok {
+				metrics = nil
+				continue
+			}
+			decoded = append(decoded, m)
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			failed = append(failed, err)
+		}
+	}
+	return decoded, failed
+}
+
+// CodecError tells why input failed to decode. Codecs set the category and
+// the decoder the raw line; the listener fills in its name and codec. Count
+// is the number of identical errors the error stands for, the rest of them
+// having been sampled out.
 type CodecError struct {
 	msg string
 	err error
 	src interface{}
+
+	Category CodecErrorCategory
+	Line     string
+	Codec    string
+	Listener string
+	Count    int
+}
+
+func newCodecError(category CodecErrorCategory, msg string, err error, src interface{}) *CodecError {
+	return &CodecError{msg: msg, err: err, src: src, Category: category, Count: 1}
 }
 
 func (e *CodecError) Error() string {
 	return fmt.Sprintf("%s - %v [%v]", e.msg, e.err, e.src)
 }
+
+type CodecErrorCategory int
+
+const (
+	CodecErrUnknown CodecErrorCategory = iota
+	CodecErrInput                      // reading failed or the input is corrupt
+	CodecErrSyntax                     // line doesn't match the format
+	CodecErrName                       // malformed name or fields
+	CodecErrValue                      // unreadable value
+	CodecErrSchema                     // decoded metric rejected by strict checks
+	CodecErrCommand                    // exec codec command failed
+	numCodecErrCategories
+)
+
+var codecErrCategoryNames = [numCodecErrCategories]string{"unknown", "input", "syntax", "name", "value", "schema", "command"}
+
+func (c CodecErrorCategory) String() string {
+	if c < 0 || c >= numCodecErrCategories {
+		return "unknown"
+	}
+	return codecErrCategoryNames[c]
+}
+
+func (c CodecErrorCategory) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// codecErrorSampler passes at most [limit] errors of a kind (category and
+// message) per second. The suppressed ones are counted into the next passed
+// error of their kind, or returned by leftover, so failure counts stay
+// exact while a flood of identical errors doesn't clog the channel or logs.
+type codecErrorSampler struct {
+	limit int
+	mux   *sync.Mutex
+	kinds map[string]*sampledErrors
+}
+
+type sampledErrors struct {
+	second     int64
+	passed     int
+	suppressed int
+	last       *CodecError
+}
+
+func newCodecErrorSampler(limit int) *codecErrorSampler {
+	return &codecErrorSampler{limit: limit, mux: &sync.Mutex{}, kinds: make(map[string]*sampledErrors)}
+}
+
+// sample tells whether the error passes, along with the number of errors
+// of its kind suppressed since the last one passed
+func (s *codecErrorSampler) sample(e *CodecError) (bool, int) {
+	if s == nil || s.limit <= 0 {
+		return true, 0
+	}
+	key := e.Category.String() + "|" + e.msg
+	now := time.Now().Unix()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	k, ok := s.kinds[key]
+	if !ok {
+		k = &sampledErrors{}
+		s.kinds[key] = k
+	}
+	if k.second != now {
+		k.second, k.passed = now, 0
+	}
+	if k.passed >= s.limit {
+		k.suppressed += e.Count
+		k.last = e
+		return false, 0
+	}
+	k.passed++
+	suppressed := k.suppressed
+	k.suppressed, k.last = 0, nil
+	return true, suppressed
+}
+
+// leftover returns the last suppressed error of every kind still holding
+// suppressed ones, counting all of them
+func (s *codecErrorSampler) leftover() []*CodecError {
+	if s == nil {
+		return nil
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var out []*CodecError
+	for _, k := range s.kinds {
+		if k.suppressed > 0 {
+			k.last.Count = k.suppressed
+			out = append(out, k.last)
+			k.suppressed, k.last = 0, nil
+		}
+	}
+	return out
+}
+
+// parseTimestamp reads Unix timestamp in seconds, either with decimal second
+// fractions (ie. 1620000000.123) or digits past the 10th being the fractions
+// (ie. 13 digits for milliseconds). Zero and negative
+// timestamps are returned as they are for the listener's timestamp policy.
+// Missing timestamp is returned as zero time for the decoder to assign,
+// unreadable or overflowing one is an error.
+func parseTimestamp(ts string) (time.Time, error) {
+	if ts == "" {
+		return time.Time{}, nil
+	}
+	if dot := strings.IndexByte(ts, '.'); dot >= 0 {
+		sec, err := strconv.ParseInt(ts[:dot], 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		nsec := parseSecondFraction(ts[dot+1:])
+		if strings.HasPrefix(ts, "-") { // -1.5 is 1.5s before the epoch
+			nsec = -nsec
+		}
+		return time.Unix(sec, nsec), nil
+	}
+	if len(ts) <= 10 || strings.HasPrefix(ts, "-") {
+		sec, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(sec, 0), nil
+	}
+	sec, err := strconv.ParseInt(ts[:10], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(sec, parseSecondFraction(ts[10:])), nil
+}
+
+// PrecisionCodec reads integer timestamps in the unit given, instead of
+// guessing it by the number of digits
+type PrecisionCodec interface {
+	WithPrecision(time.Duration) Codec
+}
+
+// parsePrecision reads InfluxDB's precision names: "ns" (or "n"), "us"
+// ("u"), "ms", "s", "m" and "h"; empty means guessing
+func parsePrecision(p string) (time.Duration, error) {
+	switch p {
+	case "":
+		return 0, nil
+	case "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	}
+	return 0, fmt.Errorf("invalid precision '%s'", p)
+}
+
+var errTimestampRange = errors.New("timestamp out of range")
+
+// parseTimestampIn reads integer timestamp in units of precision
+func parseTimestampIn(ts string, precision time.Duration) (time.Time, error) {
+	n, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if precision >= time.Second {
+		perUnit := int64(precision / time.Second)
+		if n > math.MaxInt64/perUnit || n < math.MinInt64/perUnit {
+			return time.Time{}, errTimestampRange
+		}
+		return time.Unix(n*perUnit, 0), nil
+	}
+	perSec := int64(time.Second / precision)
+	return time.Unix(n/perSec, n%perSec*int64(precision)), nil
+}
+
+// parseTimestampUnit reads the timestamp in units of precision, decimal
+// fractions of them included, or guesses the unit by the digits if zero
+func parseTimestampUnit(ts string, precision time.Duration) (time.Time, error) {
+	if precision == 0 || ts == "" {
+		return parseTimestamp(ts)
+	}
+	if strings.IndexByte(ts, '.') < 0 {
+		return parseTimestampIn(ts, precision)
+	}
+	if precision == time.Second {
+		return parseTimestamp(ts)
+	}
+	f, err := strconv.ParseFloat(ts, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	nsec := f * float64(precision)
+	if math.IsNaN(nsec) || nsec >= math.MaxInt64 || nsec < math.MinInt64 {
+		return time.Time{}, errTimestampRange
+	}
+	return time.Unix(0, int64(nsec)), nil
+}
+
+// parseSecondFraction reads decimal digits of a second into nanoseconds
+func parseSecondFraction(frac string) int64 {
+	if len(frac) > 9 {
+		frac = frac[:9]
+	}
+	nsec, err := strconv.ParseInt(frac+strings.Repeat("0", 9-len(frac)), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return nsec
+}
+
+// CodecOptions tune concurrency and validation of the line-based codecs
+type CodecOptions struct {
+	Workers       int           // goroutines parsing lines
+	MetricsBuffer int           // capacity of the metrics channel
+	ErrorsBuffer  int           // capacity of the errors channel
+	MaxInflight   int           // lines scanned ahead of the workers
+	Schema        *Schema       // strict mode checks, if set
+	SnapNow       time.Duration // boundary to round assigned timestamps to
+	Conformance   string        // "strict", "lenient" or "recover"
+	ErrorRate     int           // errors of a kind passed per second
+	Precision     string        // unit of integer timestamps, if not guessed
+	Overflow      string        // "block" or "drop" errors on full channel
+	Overflowed    *StatsCounter // failed metrics of the dropped errors
+	ReadRetries   int           // temporary read errors retried in a row
+	Resumed       *StatsCounter // reads retried
+	RawLines      float64       // share of metrics carrying their input line
+
+	precision time.Duration // Precision parsed by withDefaults
+}
+
+// now is the timestamp of metrics which came without one, rounded to the
+// nearest [timestamp_snap] boundary so metrics of one interval from all
+// the nodes line up
+func (o CodecOptions) now() time.Time {
+	if o.SnapNow > 0 {
+		return time.Now().Round(o.SnapNow)
+	}
+	return time.Now()
+}
+
+// timestamp reads the timestamp in the [precision] unit, so timestamps of
+// any number of digits (pre-2001 or post-2286 seconds, 12 digit millis)
+// are read right; without it the unit is guessed by the digits
+func (o CodecOptions) timestamp(ts string) (time.Time, error) {
+	return parseTimestampUnit(ts, o.precision)
+}
+
+// fixes tells whether best-effort fixes of non-conforming input apply
+func (o CodecOptions) fixes() bool {
+	return o.Conformance == "lenient" || o.Conformance == "recover"
+}
+
+// fixLine applies the lenient fixes to line of a codec starting lines with
+// the metric name: runs of blanks are collapsed into one space, runs of dots
+// in the name into one dot and dots around the name are dropped
+func (o CodecOptions) fixLine(line string) string {
+	if !o.fixes() {
+		return line
+	}
+	tokens := strings.Fields(line)
+	if len(tokens) == 0 {
+		return ""
+	}
+	name := tokens[0]
+	for strings.Contains(name, "..") {
+		name = strings.Replace(name, "..", ".", -1)
+	}
+	if name = strings.Trim(name, "."); name != "" {
+		tokens[0] = name
+	}
+	return strings.Join(tokens, " ")
+}
+
+func (o CodecOptions) withDefaults() CodecOptions {
+	if o.Workers <= 0 {
+		o.Workers = defaultWorkers()
+	}
+	if o.MetricsBuffer < 0 {
+		o.MetricsBuffer = 0
+	}
+	if o.ErrorsBuffer < 0 {
+		o.ErrorsBuffer = 0
+	}
+	if o.MaxInflight <= 0 {
+		o.MaxInflight = 1000
+	}
+	if o.ErrorRate == 0 {
+		o.ErrorRate = 10
+	}
+	if o.ReadRetries == 0 {
+		o.ReadRetries = defaultReadRetries
+	}
+	if o.Overflow == "drop" && o.ErrorsBuffer == 0 {
+		o.ErrorsBuffer = 1000 // unbuffered, nearly all would be dropped
+	}
+	o.precision, _ = parsePrecision(o.Precision) // checked by newCodec
+	return o
+}
+
+// sendError passes the error on; with [codec_errors_overflow] "drop" it's
+// dropped and counted if the channel is full, so a slow consumer of the
+// errors doesn't stall the decoding
+func (o CodecOptions) sendError(errs chan<- error, err error) {
+	if o.Overflow != "drop" {
+		errs <- err
+		return
+	}
+	select {
+	case errs <- err:
+	default:
+		if o.Overflowed != nil {
+			count := 1
+			if ce, ok := err.(*CodecError); ok {
+				count = ce.Count
+			}
+			o.Overflowed.Increment(count)
+		}
+	}
+}
+
+// decodeLines scans the input and parses the lines with a pool of workers.
+// parse returns nil metric and nil error for lines to be skipped silently.
+// after, if set, is called once the input is read and its error is reported.
+func decodeLines(input io.Reader, o CodecOptions, parse func(string) (*Metric, error), after func() error) (<-chan *Metric, <-chan error) {
+	return decodeSplitLines(input, o, nil, parse, after)
+}
+
+// decodeSplitLines is decodeLines with split, if set, breaking every scanned
+// line into the ones to be parsed
+func decodeSplitLines(input io.Reader, o CodecOptions, split func(string) []string, parse func(string) (*Metric, error), after func() error) (<-chan *Metric, <-chan error) {
+	return decodeMultiLines(input, o, split, func(line string, emit func(*Metric)) error {
+		m, err := parse(line)
+		if err == nil && m != nil {
+			emit(m)
+		}
+		return err
+	}, after)
+}
+
+// decodeMultiLines is decodeSplitLines for codecs getting any number of
+// metrics out of a line, parse passes each of them to emit
+func decodeMultiLines(input io.Reader, o CodecOptions, split func(string) []string, parse func(string, func(*Metric)) error, after func() error) (<-chan *Metric, <-chan error) {
+	o = o.withDefaults()
+	input = newResumingReader(input, o.ReadRetries, true, o.Resumed)
+	metrics := make(chan *Metric, o.MetricsBuffer)
+	errs := make(chan error, o.ErrorsBuffer)
+	lines := make(chan string, o.MaxInflight)
+	wg := &sync.WaitGroup{}
+
+	// report sends the error along with the line it came from, unless it's
+	// sampled out
+	sampler := newCodecErrorSampler(o.ErrorRate)
+	report := func(err error, line string) {
+		if ce, ok := err.(*CodecError); ok {
+			if ce.Line == "" {
+				ce.Line = line
+			}
+			pass, suppressed := sampler.sample(ce)
+			if !pass {
+				return
+			}
+			ce.Count += suppressed
+		}
+		o.sendError(errs, err)
+	}
+
+	for n := 0; n < o.Workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var line string
+			emit := func(m *Metric) {
+				if m.Timestamp.IsZero() {
+					m.Timestamp = o.now()
+				}
+				if o.RawLines >= 1 || o.RawLines > 0 && rand.Float64() < o.RawLines {
+					m.Raw = line
+				}
+				if o.Schema != nil {
+					if err := o.Schema.Validate(m); err != nil {
+						report(newCodecError(CodecErrSchema, "Invalid metric", err, line), line)
+						return
+					}
+				}
+				metrics <- m
+			}
+			for line = range lines {
+				if o.fixes() {
+					line = strings.TrimSpace(line)
+				}
+				err := parse(line, emit)
+				if err != nil && o.Conformance == "recover" {
+					err = resyncLine(line, parse, emit, err)
+				}
+				if err != nil {
+					report(err, line)
+				}
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		push := func(text string) {
+			if split == nil {
+				lines <- text
+				return
+			}
+			for _, line := range split(text) {
+				lines <- line
+			}
+		}
+		var err error
+		if o.Conformance == "recover" {
+			err = readLinesResync(input, push, func(err error) { report(err, "") })
+		} else {
+			scn := bufio.NewScanner(input)
+			for scn.Scan() {
+				push(scn.Text())
+			}
+			err = scn.Err()
+		}
+		close(lines)
+		if err != nil {
+			report(newCodecError(CodecErrInput, "Failed to read input", err, nil), "")
+		}
+		if after != nil {
+			if err := after(); err != nil {
+				report(err, "")
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		for _, err := range sampler.leftover() {
+			o.sendError(errs, err)
+		}
+		close(metrics)
+		close(errs)
+	}()
+
+	return metrics, errs
+}
+
+// readLinesResync reads lines like bufio.Scanner, but overlong lines (ie.
+// binary garbage without newlines) are skipped up to the next newline
+// instead of ending the stream
+func readLinesResync(input io.Reader, push func(string), report func(error)) error {
+	rd := bufio.NewReaderSize(input, bufio.MaxScanTokenSize)
+	for {
+		line, err := rd.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			skipped := len(line)
+			for err == bufio.ErrBufferFull {
+				line, err = rd.ReadSlice('\n')
+				skipped += len(line)
+			}
+			report(newCodecError(CodecErrInput, "Skipped overlong line", fmt.Errorf("%d bytes", skipped), nil))
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if len(line) > 0 {
+			push(strings.TrimRight(string(line), "\r\n"))
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// resyncLine recovers a record preceded by corrupt bytes, retrying the parse
+// of the failed line from after each control or non-ASCII byte. The skipped
+// prefix is still reported.
+func resyncLine(line string, parse func(string, func(*Metric)) error, emit func(*Metric), failed error) error {
+	for i := 0; i < len(line); i++ {
+		if c := line[i]; c >= ' ' && c < 0x7f {
+			continue
+		}
+		rest := strings.TrimSpace(line[i+1:])
+		if rest == "" {
+			break
+		}
+		if parse(rest, emit) == nil {
+			return newCodecError(CodecErrInput, "Skipped corrupt input", nil, strconv.Quote(line[:i+1]))
+		}
+	}
+	return failed
+}
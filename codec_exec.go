@@ -0,0 +1,135 @@
+package metcap
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExecCodec pipes the raw input to an external command, which is expected to
+// print metrics back to its stdout, one per line:
+//
+//	<name> <value> [<timestamp>] [<field>=<value> ...]
+//
+// so proprietary formats can be handled without touching metcap itself.
+// Every connection runs the command in a session with the connection's
+// details in METCAP_* environment variables (see ConnContext.Env).
+type ExecCodec struct {
+	options CodecOptions
+	command []string
+	timeout time.Duration
+}
+
+func NewExecCodec(command []string, timeout time.Duration, o CodecOptions) (ExecCodec, error) {
+	if len(command) == 0 {
+		return ExecCodec{}, errors.New("exec codec requires exec_command")
+	}
+	if _, err := exec.LookPath(command[0]); err != nil {
+		return ExecCodec{}, err
+	}
+	return ExecCodec{
+		options: o.withDefaults(),
+		command: command,
+		timeout: timeout,
+	}, nil
+}
+
+func (c ExecCodec) Decode(input io.Reader) (<-chan *Metric, <-chan error) {
+	return c.decode(input, nil)
+}
+
+// DecodeBatch decodes the input at once, see DecodeBatch
+func (c ExecCodec) DecodeBatch(input []byte) ([]*Metric, []error) {
+	return DecodeBatch(c, input)
+}
+
+func (c ExecCodec) NewSession(ctx *ConnContext) CodecSession {
+	return execSession{c, ctx}
+}
+
+type execSession struct {
+	codec ExecCodec
+	ctx   *ConnContext
+}
+
+func (s execSession) Decode(input io.Reader) (<-chan *Metric, <-chan error) {
+	return s.codec.decode(input, s.ctx.Env())
+}
+
+func (s execSession) Close() error {
+	return nil
+}
+
+func (c ExecCodec) decode(input io.Reader, env []string) (<-chan *Metric, <-chan error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(c.command[0], c.command[1:]...)
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.Stdin = input
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		return decodeLines(bytes.NewReader(nil), c.options, c.readLine, func() error {
+			return newCodecError(CodecErrCommand, "Failed to run exec codec command", err, c.command)
+		})
+	}
+
+	var timer *time.Timer
+	if c.timeout > 0 {
+		timer = time.AfterFunc(c.timeout, func() { cmd.Process.Kill() })
+	}
+
+	return decodeLines(stdout, c.options, c.readLine, func() error {
+		if timer != nil {
+			timer.Stop()
+		}
+		if err := cmd.Wait(); err != nil {
+			return newCodecError(CodecErrCommand, "Exec codec command failed", err, strings.TrimSpace(stderr.String()))
+		}
+		return nil
+	})
+}
+
+// helper function to parse single line of the command output
+func (c ExecCodec) readLine(line string) (*Metric, error) {
+	line = c.options.fixLine(line)
+	if line == "" {
+		return nil, nil
+	}
+	tokens := strings.Fields(line)
+	if len(tokens) < 2 {
+		return nil, newCodecError(CodecErrSyntax, "Failed to read exec codec output", errors.New("expected at least name and value"), line)
+	}
+	value, err := strconv.ParseFloat(tokens[1], 64)
+	if err != nil {
+		return nil, newCodecError(CodecErrValue, "Failed to read exec codec output", err, line)
+	}
+	m := &Metric{
+		Name:   tokens[0],
+		Value:  value,
+		Fields: make(map[string]string),
+	}
+	for i, token := range tokens[2:] {
+		if i == 0 && !strings.Contains(token, "=") {
+			if m.Timestamp, err = c.options.timestamp(token); err != nil {
+				return nil, newCodecError(CodecErrValue, "Failed to read exec codec output", err, line)
+			}
+			continue
+		}
+		kv := strings.SplitN(token, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, newCodecError(CodecErrName, "Failed to read exec codec output", errors.New("malformed field '"+token+"'"), line)
+		}
+		internField(m.Fields, kv[0], kv[1])
+	}
+	return m, nil
+}
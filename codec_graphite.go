@@ -2,138 +2,329 @@ package metcap
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
 type GraphiteCodec struct {
+	options      CodecOptions
+	splitLines   bool
 	mutatorRules []GraphiteMutatorRule
+	unmatched    *StatsCounter
 	lineRegex    *regexp.Regexp
 	fields       [][2]string
 }
 
 type GraphiteMutatorRule struct {
-	match *regexp.Regexp
-	rule  string
+	match  *regexp.Regexp
+	rule   string
+	source string // file:line
+	hits   *StatsCounter
 }
 
-func NewGraphiteCodec(mutFile string) (GraphiteCodec, error) {
-	var mut []GraphiteMutatorRule
-	re := regexp.MustCompile(`^(?P<path>[a-zA-Z0-9_\-\.]+) (?P<value>-?[0-9\.]+)(\ (?P<timestamp>[0-9]{10,13}))?$`)
+// GraphiteMutatorStats tells how many paths matched each of the mutator
+// rules (in order of the files) and how many matched none
+type GraphiteMutatorStats struct {
+	Rules     []GraphiteMutatorRuleStats `json:"rules"`
+	Unmatched uint64                     `json:"unmatched"`
+}
+
+type GraphiteMutatorRuleStats struct {
+	Match  string `json:"match"`
+	Rule   string `json:"rule"`
+	Source string `json:"source"`
+	Hits   uint64 `json:"hits"`
+}
 
+func NewGraphiteCodec(mutFile string, splitLines bool, o CodecOptions) (GraphiteCodec, error) {
 	mutRules, err := os.Open(mutFile)
 	if err != nil {
 		return GraphiteCodec{}, err
 	}
+	defer mutRules.Close()
+	return newGraphiteCodec(mutRules, mutFile, splitLines, o)
+}
 
-	scn := bufio.NewScanner(mutRules)
-	for scn.Scan() {
-		rule := strings.Split(scn.Text(), "|||")[0:2]
-		ruleRe, err := regexp.Compile(rule[0])
+// NewGraphiteCodecFiles reads the mutator rules of the files in order, so
+// rules of earlier files take priority
+func NewGraphiteCodecFiles(mutFiles []string, splitLines bool, o CodecOptions) (GraphiteCodec, error) {
+	var mut []GraphiteMutatorRule
+	for _, file := range mutFiles {
+		f, err := os.Open(file)
+		if err != nil {
+			return GraphiteCodec{}, err
+		}
+		rules, err := readMutatorRules(f, file, 0)
+		f.Close()
 		if err != nil {
 			return GraphiteCodec{}, err
 		}
-		mut = append(mut, GraphiteMutatorRule{ruleRe, rule[1]})
+		mut = append(mut, rules...)
 	}
+	return graphiteCodecOf(mut, splitLines, o), nil
+}
 
+// newGraphiteCodec reads the mutator rules from r, named file in errors
+func newGraphiteCodec(mutRules io.Reader, file string, splitLines bool, o CodecOptions) (GraphiteCodec, error) {
+	mut, err := readMutatorRules(mutRules, file, 0)
+	if err != nil {
+		return GraphiteCodec{}, err
+	}
+	return graphiteCodecOf(mut, splitLines, o), nil
+}
+
+func graphiteCodecOf(mut []GraphiteMutatorRule, splitLines bool, o CodecOptions) GraphiteCodec {
+	o = o.withDefaults()
+	// guessed units end with millis, us/ns timestamps need [precision]
+	digits := "13"
+	if o.precision > 0 {
+		digits = "19"
+	}
+	re := regexp.MustCompile(`^(?P<path>[a-zA-Z0-9_\-\.]+) (?P<value>` + valuePattern + `)(\ (?P<timestamp>-?[0-9]{1,` + digits + `}(\.[0-9]+)?))?$`)
 	return GraphiteCodec{
+		options:      o,
+		splitLines:   splitLines,
 		mutatorRules: mut,
+		unmatched:    NewStatsCounter(time.Now()),
 		lineRegex:    re,
-	}, nil
+	}
 }
 
-func (c GraphiteCodec) Decode(input io.Reader) (<-chan *Metric, <-chan error) {
-	scn := bufio.NewScanner(input)
-	wg := &sync.WaitGroup{}
-	metrics := make(chan *Metric)
-	errs := make(chan error)
+// mutatorRuleFiles lists [mutator_file], the files matching [mutator_files]
+// globs (each sorted) and the *.conf files of [mutator_dir] (sorted), in
+// the order of priority
+func mutatorRuleFiles(c ListenerConfig) ([]string, error) {
+	var files []string
+	if c.MutatorFile != "" {
+		files = append(files, c.MutatorFile)
+	}
+	for _, pattern := range c.MutatorFiles {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return nil, fmt.Errorf("mutator file '%s': no such file", pattern)
+		}
+		files = append(files, matches...) // Glob sorts them
+	}
+	if c.MutatorDir != "" {
+		if _, err := os.Stat(c.MutatorDir); err != nil {
+			return nil, err
+		}
+		matches, _ := filepath.Glob(filepath.Join(c.MutatorDir, "*.conf"))
+		files = append(files, matches...)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("graphite codec needs mutator_file, mutator_files or mutator_dir")
+	}
+	return files, nil
+}
+
+// Conflicts reports rules with the same regex as an earlier one, which
+// never match as the earlier one takes the paths first
+func (c GraphiteCodec) Conflicts() []string {
+	var conflicts []string
+	first := make(map[string]GraphiteMutatorRule)
+	for _, mut := range c.mutatorRules {
+		pattern := mut.match.String()
+		prev, ok := first[pattern]
+		if !ok {
+			first[pattern] = mut
+			continue
+		}
+		if prev.rule == mut.rule {
+			conflicts = append(conflicts, fmt.Sprintf("rule '%s' at %s duplicates %s", pattern, mut.source, prev.source))
+		} else {
+			conflicts = append(conflicts, fmt.Sprintf("rule '%s|||%s' at %s is shadowed by '%s' at %s", pattern, mut.rule, mut.source, prev.rule, prev.source))
+		}
+	}
+	return conflicts
+}
 
+// maxMutatorIncludes limits nesting of includes, breaking include cycles
+const maxMutatorIncludes = 8
+
+// readMutatorRules parses `regex|||rule` lines. Blank lines and lines
+// starting with # are skipped, `include <path>` reads rules of another file
+// (or all files matching a glob, in lexical order) in place; relative paths
+// are relative to the including file. Errors point at file:line.
+func readMutatorRules(r io.Reader, file string, depth int) ([]GraphiteMutatorRule, error) {
+	var mut []GraphiteMutatorRule
+	lineNum := 0
+	scn := bufio.NewScanner(r)
 	for scn.Scan() {
-		wg.Add(1)
-		go func(line string) {
-			defer wg.Done()
-			// skip empty line
-			if line == "" {
-				return
-			}
-			if !c.lineRegex.Match([]byte(line)) {
-				return
-			}
-			// read path, value and optional timestamp into hash map `dissected`
-			match := c.lineRegex.FindStringSubmatch(line)
-			dissected := map[string]string{}
-			for i, n := range c.lineRegex.SubexpNames() {
-				dissected[n] = match[i]
-			}
-			mTimestamp := c.readTimestamp(dissected)
-			mValue, err := c.readValue(dissected)
-			if err != nil {
-				errs <- &CodecError{"Failed to read value", err, dissected["value"]}
-				return
-			}
-			mName, mFields, err := c.readFields(dissected)
+		lineNum++
+		line := strings.TrimSpace(scn.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "include") && !strings.Contains(line, "|||"):
+			included, err := includeMutatorRules(strings.TrimSpace(strings.TrimPrefix(line, "include")), file, lineNum, depth)
 			if err != nil {
-				errs <- &CodecError{"Failed to read name/fields", err, dissected["path"]}
-				return
+				return nil, err
 			}
-			metrics <- &Metric{Name: mName, Timestamp: mTimestamp, Value: mValue, Fields: mFields}
-		}(scn.Text())
+			mut = append(mut, included...)
+			continue
+		}
+		rule := strings.Split(line, "|||")
+		if len(rule) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected `regex|||rule`", file, lineNum)
+		}
+		ruleRe, err := regexp.Compile(rule[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, lineNum, err)
+		}
+		mut = append(mut, GraphiteMutatorRule{ruleRe, rule[1], fmt.Sprintf("%s:%d", file, lineNum), NewStatsCounter(time.Now())})
+	}
+	if err := scn.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return mut, nil
+}
+
+// includeMutatorRules reads the rules included at line of file from
+func includeMutatorRules(pattern, from string, line, depth int) ([]GraphiteMutatorRule, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("%s:%d: include without path", from, line)
+	}
+	if depth >= maxMutatorIncludes {
+		return nil, fmt.Errorf("%s:%d: includes nested deeper than %d, cycle?", from, line, maxMutatorIncludes)
 	}
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(from), pattern)
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%d: %v", from, line, err)
+	}
+	if len(files) == 0 && !strings.ContainsAny(pattern, "*?[") {
+		return nil, fmt.Errorf("%s:%d: can't include '%s': no such file", from, line, pattern)
+	}
+	var mut []GraphiteMutatorRule
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", from, line, err)
+		}
+		rules, err := readMutatorRules(f, file, depth+1)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		mut = append(mut, rules...)
+	}
+	return mut, nil
+}
 
-	go func() {
-		wg.Wait()
-		close(metrics)
-		close(errs)
-	}()
+func (c GraphiteCodec) MutatorStats() GraphiteMutatorStats {
+	stats := GraphiteMutatorStats{Unmatched: c.unmatched.Total()}
+	for _, mut := range c.mutatorRules {
+		stats.Rules = append(stats.Rules, GraphiteMutatorRuleStats{mut.match.String(), mut.rule, mut.source, mut.hits.Total()})
+	}
+	return stats
+}
 
-	return metrics, errs
+func (c GraphiteCodec) Decode(input io.Reader) (<-chan *Metric, <-chan error) {
+	if c.splitLines {
+		return decodeSplitLines(input, c.options, c.splitLine, c.decodeLine, nil)
+	}
+	return decodeLines(input, c.options, c.decodeLine, nil)
 }
 
-// helper function to parse timestamp into time.Time
-func (c GraphiteCodec) readTimestamp(d map[string]string) time.Time {
-	var (
-		tNow      time.Time
-		tByte     []byte
-		tLen      int
-		tUnixSec  int64
-		tUnixNsec int64
-		err       error
-	)
+// DecodeBatch decodes the input at once, see DecodeBatch
+func (c GraphiteCodec) DecodeBatch(input []byte) ([]*Metric, []error) {
+	return DecodeBatch(c, input)
+}
 
-	tNow = time.Now()
-	tByte = []byte(d["timestamp"])
-	tLen = len(tByte)
-
-	switch {
-	// time not specified
-	case tLen == 0:
-		return tNow
-	// time is in Unix timestamp
-	case tLen <= 10:
-		tInt, err := strconv.ParseInt(string(tByte), 10, 64)
-		if err != nil {
-			return tNow
+// splitLine recovers metrics some relays concatenate on one line, separated
+// by \r or just spaces. Lines matching as they are stay untouched, leftover
+// tokens are passed on to fail as unmatched.
+func (c GraphiteCodec) splitLine(line string) []string {
+	if c.lineRegex.MatchString(line) {
+		return []string{line}
+	}
+	var lines []string
+	for _, part := range strings.Split(line, "\r") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
 		}
-		return time.Unix(tInt, 0)
-	// time is in Unix timestamp with second fractions
-	case tLen > 10:
-		tUnixSec, err = strconv.ParseInt(string(tByte[:10]), 10, 64)
-		if err != nil {
-			return tNow
+		if c.lineRegex.MatchString(part) {
+			lines = append(lines, part)
+			continue
 		}
-		tUnixNsec, err = strconv.ParseInt(string(tByte[10:tLen])+strings.Repeat("0", len(tByte[10:tLen])), 10, 64)
-		if err != nil {
-			return tNow
+		tokens := strings.Fields(part)
+		for len(tokens) > 0 {
+			if len(tokens) < 2 || !isGraphiteValue(tokens[1]) {
+				lines = append(lines, strings.Join(tokens, " "))
+				break
+			}
+			n := 2
+			// integer after the value is a timestamp, unless a value follows it
+			// making it the path of the next metric
+			if len(tokens) > 2 && isGraphiteTimestamp(tokens[2]) && (len(tokens) == 3 || !isGraphiteValue(tokens[3])) {
+				n = 3
+			}
+			lines = append(lines, strings.Join(tokens[:n], " "))
+			tokens = tokens[n:]
 		}
-		return time.Unix(tUnixSec, tUnixNsec*int64(time.Millisecond))
-	default:
-		return tNow
 	}
+	return lines
+}
+
+func isGraphiteValue(token string) bool {
+	_, err := strconv.ParseFloat(token, 64)
+	return err == nil
+}
+
+func isGraphiteTimestamp(token string) bool {
+	_, err := strconv.ParseInt(token, 10, 64)
+	return err == nil
+}
+
+func (c GraphiteCodec) decodeLine(line string) (*Metric, error) {
+	line = c.options.fixLine(line)
+	// skip empty line
+	if line == "" {
+		return nil, nil
+	}
+	if !c.lineRegex.Match([]byte(line)) {
+		return nil, newCodecError(CodecErrSyntax, "Line doesn't match", nil, line)
+	}
+	// read path, value and optional timestamp into hash map `dissected`
+	match := c.lineRegex.FindStringSubmatch(line)
+	dissected := map[string]string{}
+	for i, n := range c.lineRegex.SubexpNames() {
+		dissected[n] = match[i]
+	}
+	mTimestamp, err := c.readTimestamp(dissected)
+	if err != nil {
+		return nil, newCodecError(CodecErrValue, "Failed to read timestamp", err, dissected["timestamp"])
+	}
+	mValue, err := c.readValue(dissected)
+	if err != nil {
+		return nil, newCodecError(CodecErrValue, "Failed to read value", err, dissected["value"])
+	}
+	mName, mFields, err := c.readFields(dissected)
+	if err != nil {
+		return nil, newCodecError(CodecErrName, "Failed to read name/fields", err, dissected["path"])
+	}
+	return &Metric{Name: mName, Timestamp: mTimestamp, Value: mValue, Fields: mFields}, nil
+}
+
+// helper function to parse timestamp into time.Time
+func (c GraphiteCodec) readTimestamp(d map[string]string) (time.Time, error) {
+	if d["timestamp"] == "-1" { // carbon's "now", assigned by the decoder
+		return time.Time{}, nil
+	}
+	return c.options.timestamp(d["timestamp"])
 }
 
 // helper function to parse value as float64
@@ -143,7 +334,7 @@ func (c GraphiteCodec) readValue(d map[string]string) (float64, error) {
 		err   error
 	)
 	if value, err = strconv.ParseFloat(d["value"], 64); err != nil {
-		return float64(0), &CodecError{"Failed to parse value", err, d["value"]}
+		return float64(0), newCodecError(CodecErrValue, "Failed to parse value", err, d["value"])
 	}
 	return value, nil
 }
@@ -164,12 +355,17 @@ func (c GraphiteCodec) readFields(d map[string]string) (string, map[string]strin
 			// try to match metric path with a mutator rule
 			if mut.match.Match([]byte(d["path"])) {
 				_mutRuleMatch = true
+				mut.hits.Increment(1)
 				fieldValues := strings.Split(d["path"], ".")
 				fieldNames := strings.Split(mut.rule, ".")
 
 				// iterate thru fields
 			FIELD_PARSER:
 				for i, field := range fieldValues {
+					if i >= len(fieldNames) {
+						// path is longer than the rule, the rest is ignored
+						break FIELD_PARSER
+					}
 					switch {
 					case fieldNames[i] == "+":
 						// catch-all flag -> fill name
@@ -187,11 +383,11 @@ func (c GraphiteCodec) readFields(d map[string]string) (string, map[string]strin
 					case strings.ContainsAny(fieldNames[i], stringMatcher+numMatcher) && strings.HasSuffix(fieldNames[i], "+"):
 						// string rule with catch-all flag -> catch-all field
 						f := strings.TrimRight(fieldNames[i], "+")
-						fields[f] = strings.Join(fieldValues[i:], "_")
+						internField(fields, f, strings.Join(fieldValues[i:], "_"))
 						break FIELD_PARSER
 					case strings.ContainsAny(fieldNames[i], stringMatcher+numMatcher):
 						// string rule -> field
-						fields[fieldNames[i]] = field
+						internField(fields, fieldNames[i], field)
 					}
 				}
 				break
@@ -199,6 +395,7 @@ func (c GraphiteCodec) readFields(d map[string]string) (string, map[string]strin
 		}
 
 		if !_mutRuleMatch {
+			c.unmatched.Increment(1)
 			name = append(name, strings.Join(strings.Split(d["path"], "."), "_"))
 		}
 		// not Graphite? then it must be only Influx (for now :))
@@ -206,14 +403,15 @@ func (c GraphiteCodec) readFields(d map[string]string) (string, map[string]strin
 		name = append(name, d["name"])
 		// iterate thru fields
 		for _, field := range strings.Split(d["fields"], ",") {
-			kv := strings.Split(field, "=")
-			if kv[0] != "" {
-				fields[kv[0]] = kv[1]
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) == 2 && kv[0] != "" {
+				internField(fields, kv[0], kv[1])
 			}
 		}
 	}
-	if len(name) == 0 {
-		return "", make(map[string]string), &CodecError{"Failed to parse metric name", nil, name}
+	// a rule may leave the name empty, ie. for a path ending with a dot
+	if len(name) == 0 || strings.Join(name, "") == "" {
+		return "", make(map[string]string), newCodecError(CodecErrName, "Failed to parse metric name", nil, name)
 	}
 	return strings.Join(name, ":"), fields, nil
 }
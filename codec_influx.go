@@ -1,130 +1,125 @@
 package metcap
 
 import (
-	"bufio"
 	"io"
 	"regexp"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
 type InfluxCodec struct {
+	options   CodecOptions
 	lineRegex *regexp.Regexp
 	fields    [][2]string
+	precision time.Duration // zero guesses the unit by the digits
 }
 
-func NewInfluxCodec() (InfluxCodec, error) {
-	re := regexp.MustCompile(`^(?P<name>[a-zA-Z0-9_\-\.]+) ((?P<fields>[a-zA-Z0-9,_\-\.\=]+)\ )?value=(?P<value>-?[0-9\.]+)(\ (?P<timestamp>\d{10,13}))?$`)
+// Besides value, lines may carry pre-aggregated tuple of sum, count, min and
+// max (all four), ie. `name host=a sum=12,count=4,min=1,max=5`, indexed as
+// the metric's agg with mean as the value unless value is given too.
+func NewInfluxCodec(o CodecOptions) (InfluxCodec, error) {
+	value := `(value|sum|count|min|max)=` + valuePattern
+	re := regexp.MustCompile(`^(?P<name>[a-zA-Z0-9_\-\.]+) ((?P<fields>[a-zA-Z0-9,_\-\.\=]+)\ )?(?P<values>` + value + `(,` + value + `)*)(\ (?P<timestamp>-?[0-9]{1,19}))?$`)
 
+	precision, err := parsePrecision(o.Precision)
+	if err != nil {
+		return InfluxCodec{}, err
+	}
 	return InfluxCodec{
+		options:   o,
 		lineRegex: re,
+		precision: precision,
 	}, nil
 }
 
-func (c InfluxCodec) Decode(input io.Reader) (<-chan *Metric, <-chan error) {
-	scn := bufio.NewScanner(input)
-	wg := &sync.WaitGroup{}
-	metrics := make(chan *Metric)
-	errs := make(chan error)
-
-	for scn.Scan() {
-		go func(line string) {
-			defer wg.Done()
-			wg.Add(1)
-			if regexp.MustCompile(`^$`).Match([]byte(line)) {
-				return
-			}
-			if !c.lineRegex.Match([]byte(line)) {
-				return
-			}
-			// read name, fields, value and optional timestamp into hash map `dissected`
-			match := c.lineRegex.FindStringSubmatch(line)
-			dissected := map[string]string{}
-			for i, n := range c.lineRegex.SubexpNames() {
-				dissected[n] = match[i]
-			}
-			mTimestamp := c.readTimestamp(dissected)
-			mValue, err := c.readValue(dissected)
-			if err != nil {
-				errs <- &CodecError{"Failed to read value", err, dissected}
-				return
-			}
-			mName, err := c.readName(dissected)
-			if err != nil {
-				errs <- &CodecError{"Failed to read name", err, dissected}
-				return
-			}
-			mFields, err := c.readFields(dissected)
-			if err != nil {
-				errs <- &CodecError{"Failed to read fields", err, dissected}
-				return
-			}
-			metrics <- &Metric{Name: mName, Timestamp: mTimestamp, Value: mValue, Fields: mFields}
-		}(scn.Text())
-	}
+// WithPrecision makes the codec a PrecisionCodec
+func (c InfluxCodec) WithPrecision(precision time.Duration) Codec {
+	c.precision = precision
+	return c
+}
 
-	go func() {
-		wg.Wait()
-		close(metrics)
-		close(errs)
-	}()
+func (c InfluxCodec) Decode(input io.Reader) (<-chan *Metric, <-chan error) {
+	return decodeLines(input, c.options, c.decodeLine, nil)
+}
 
-	return metrics, errs
+// DecodeBatch decodes the input at once, see DecodeBatch
+func (c InfluxCodec) DecodeBatch(input []byte) ([]*Metric, []error) {
+	return DecodeBatch(c, input)
 }
 
-func (c InfluxCodec) readTimestamp(d map[string]string) time.Time {
-	var (
-		tNow      time.Time
-		tByte     []byte
-		tLen      int
-		tUnixSec  int64
-		tUnixNsec int64
-		err       error
-	)
+func (c InfluxCodec) decodeLine(line string) (*Metric, error) {
+	line = c.options.fixLine(line)
+	if line == "" {
+		return nil, nil
+	}
+	if !c.lineRegex.Match([]byte(line)) {
+		return nil, newCodecError(CodecErrSyntax, "Line doesn't match", nil, line)
+	}
+	// read name, fields, value and optional timestamp into hash map `dissected`
+	match := c.lineRegex.FindStringSubmatch(line)
+	dissected := map[string]string{}
+	for i, n := range c.lineRegex.SubexpNames() {
+		dissected[n] = match[i]
+	}
+	if c.precision == 0 && len(strings.TrimPrefix(dissected["timestamp"], "-")) > 13 {
+		// nanoseconds and such can't be told apart by digits
+		return nil, newCodecError(CodecErrSyntax, "Timestamp too long without precision", nil, line)
+	}
+	mTimestamp, err := c.readTimestamp(dissected)
+	if err != nil {
+		return nil, newCodecError(CodecErrValue, "Failed to read timestamp", err, dissected)
+	}
+	mValue, mAggregate, err := c.readValues(dissected)
+	if err != nil {
+		return nil, newCodecError(CodecErrValue, "Failed to read value", err, dissected)
+	}
+	mName, err := c.readName(dissected)
+	if err != nil {
+		return nil, newCodecError(CodecErrName, "Failed to read name", err, dissected)
+	}
+	mFields, err := c.readFields(dissected)
+	if err != nil {
+		return nil, newCodecError(CodecErrName, "Failed to read fields", err, dissected)
+	}
+	return &Metric{Name: mName, Timestamp: mTimestamp, Value: mValue, Fields: mFields, Aggregate: mAggregate}, nil
+}
 
-	tNow = time.Now()
-	tByte = []byte(d["timestamp"])
-	tLen = len(tByte)
+func (c InfluxCodec) readTimestamp(d map[string]string) (time.Time, error) {
+	return parseTimestampUnit(d["timestamp"], c.precision)
+}
 
-	switch {
-	// time not specified
-	case tLen == 0:
-		return tNow
-	// time is in Unix timestamp
-	case tLen <= 10:
-		tInt, err := strconv.ParseInt(string(tByte), 10, 64)
-		if err != nil {
-			return tNow
+// helper function to parse value and aggregate tuple as float64
+func (c InfluxCodec) readValues(d map[string]string) (float64, *Aggregate, error) {
+	values := make(map[string]float64)
+	for _, kv := range strings.Split(d["values"], ",") {
+		kv := strings.SplitN(kv, "=", 2)
+		if _, ok := values[kv[0]]; ok {
+			return float64(0), nil, newCodecError(CodecErrValue, "Duplicate value", nil, kv[0])
 		}
-		return time.Unix(tInt, 0)
-	// time is in Unix timestamp with second fractions
-	case tLen > 10:
-		tUnixSec, err = strconv.ParseInt(string(tByte[:10]), 10, 64)
+		value, err := strconv.ParseFloat(kv[1], 64)
 		if err != nil {
-			return tNow
+			return float64(0), nil, newCodecError(CodecErrValue, "Failed to parse value", err, d)
 		}
-		tUnixNsec, err = strconv.ParseInt(string(tByte[10:tLen])+strings.Repeat("0", len(tByte[10:tLen])), 10, 64)
-		if err != nil {
-			return tNow
+		values[kv[0]] = value
+	}
+	value, hasValue := values["value"]
+	if len(values) == 1 && hasValue {
+		return value, nil, nil
+	}
+	for _, k := range []string{"sum", "count", "min", "max"} {
+		if _, ok := values[k]; !ok {
+			return float64(0), nil, newCodecError(CodecErrValue, "Incomplete aggregate, missing "+k, nil, d)
 		}
-		return time.Unix(tUnixSec, tUnixNsec*int64(time.Millisecond))
-	default:
-		return tNow
 	}
-}
-
-// helper function to parse value as float64
-func (c InfluxCodec) readValue(d map[string]string) (float64, error) {
-	var (
-		value float64
-		err   error
-	)
-	if value, err = strconv.ParseFloat(d["value"], 64); err != nil {
-		return float64(0), &CodecError{"Failed to parse value", err, d}
-	}
-	return value, nil
+	agg := &Aggregate{Sum: values["sum"], Count: values["count"], Min: values["min"], Max: values["max"]}
+	if err := agg.Valid(); err != nil {
+		return float64(0), nil, newCodecError(CodecErrValue, "Invalid aggregate", err, d)
+	}
+	if !hasValue {
+		value = agg.Sum / agg.Count
+	}
+	return value, agg, nil
 }
 
 // helper function to parse metric name
@@ -132,7 +127,7 @@ func (c InfluxCodec) readName(d map[string]string) (string, error) {
 	if name, ok := d["name"]; ok {
 		return name, nil
 	} else {
-		return "", &CodecError{"Failed to parse name", nil, d}
+		return "", newCodecError(CodecErrName, "Failed to parse name", nil, d)
 	}
 }
 
@@ -141,14 +136,20 @@ func (c InfluxCodec) readFields(d map[string]string) (map[string]string, error)
 	fields := make(map[string]string)
 	if _, ok := d["fields"]; ok {
 		for _, field := range strings.Split(d["fields"], ",") {
-			kv := strings.Split(field, "=")
+			if field == "" {
+				continue
+			}
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				return make(map[string]string), newCodecError(CodecErrName, "Field without value", nil, field)
+			}
 			if kv[0] != "" {
-				fields[kv[0]] = kv[1]
+				internField(fields, kv[0], kv[1])
 			}
 		}
 	}
 	if len(fields) == 0 {
-		return make(map[string]string), &CodecError{"Failed to parse fields", nil, d}
+		return make(map[string]string), newCodecError(CodecErrName, "Failed to parse fields", nil, d)
 	}
 	return fields, nil
 }
@@ -0,0 +1,141 @@
+package metcap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JSONCodec reads newline delimited JSON, every line being a metric object
+// or an array of them, ie. {"name": "temperature", "value": 21.5,
+// "timestamp": 1500000000, "fields": {"sensor": "a1"}}. Timestamp is Unix
+// time (seconds, or milliseconds like the other codecs) or an RFC3339
+// string, now if missing. Field values may be strings, numbers or booleans.
+type JSONCodec struct {
+	options CodecOptions
+}
+
+type jsonMetric struct {
+	Name      string                     `json:"name"`
+	Value     *json.Number               `json:"value"`
+	Timestamp json.RawMessage            `json:"timestamp"`
+	Fields    map[string]json.RawMessage `json:"fields"`
+}
+
+func NewJSONCodec(o CodecOptions) (JSONCodec, error) {
+	return JSONCodec{options: o.withDefaults()}, nil
+}
+
+func (c JSONCodec) Decode(input io.Reader) (<-chan *Metric, <-chan error) {
+	return decodeMultiLines(input, c.options, nil, c.decodeLine, nil)
+}
+
+// DecodeBatch decodes the input at once, see DecodeBatch
+func (c JSONCodec) DecodeBatch(input []byte) ([]*Metric, []error) {
+	return DecodeBatch(c, input)
+}
+
+// decodeLine emits the metrics of the line, the first failing one of an
+// array is reported
+func (c JSONCodec) decodeLine(line string, emit func(*Metric)) error {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil
+	}
+	var objects []jsonMetric
+	dec := json.NewDecoder(strings.NewReader(line))
+	dec.UseNumber()
+	var err error
+	if line[0] == '[' {
+		err = dec.Decode(&objects)
+	} else {
+		objects = make([]jsonMetric, 1)
+		err = dec.Decode(&objects[0])
+	}
+	if err != nil {
+		return newCodecError(CodecErrSyntax, "Invalid JSON", err, line)
+	}
+	var failed error
+	for _, obj := range objects {
+		m, err := c.metric(obj)
+		if err != nil {
+			if failed == nil {
+				failed = err
+			}
+			continue
+		}
+		emit(m)
+	}
+	return failed
+}
+
+func (c JSONCodec) metric(obj jsonMetric) (*Metric, error) {
+	if obj.Name == "" {
+		return nil, newCodecError(CodecErrName, "Missing name", nil, obj)
+	}
+	if obj.Value == nil {
+		return nil, newCodecError(CodecErrValue, "Missing value", nil, obj.Name)
+	}
+	value, err := strconv.ParseFloat(obj.Value.String(), 64)
+	if err != nil {
+		return nil, newCodecError(CodecErrValue, "Failed to read value", err, obj.Name)
+	}
+	ts, err := c.readTimestamp(obj.Timestamp)
+	if err != nil {
+		return nil, newCodecError(CodecErrValue, "Failed to read timestamp", err, obj.Name)
+	}
+	keys := make([]string, 0, len(obj.Fields))
+	for k := range obj.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys) // the same failing field is reported every time
+	fields := make(map[string]string, len(obj.Fields))
+	for _, k := range keys {
+		v, err := jsonFieldValue(obj.Fields[k])
+		if err != nil {
+			return nil, newCodecError(CodecErrName, "Failed to read field", err, k)
+		}
+		internField(fields, k, v)
+	}
+	return &Metric{Name: obj.Name, Timestamp: ts, Value: value, Fields: fields}, nil
+}
+
+func (c JSONCodec) readTimestamp(raw json.RawMessage) (time.Time, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return time.Time{}, nil
+	}
+	if raw[0] == '"' {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return time.Time{}, err
+		}
+		return time.Parse(time.RFC3339Nano, s)
+	}
+	return c.options.timestamp(string(raw))
+}
+
+// jsonFieldValue turns string, number or boolean into the field's value
+func jsonFieldValue(raw json.RawMessage) (string, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 {
+		return "", errors.New("empty value")
+	}
+	switch raw[0] {
+	case '"':
+		var s string
+		err := json.Unmarshal(raw, &s)
+		return s, err
+	case '{', '[':
+		return "", fmt.Errorf("nested value %s", raw)
+	}
+	if string(raw) == "null" {
+		return "", errors.New("null value")
+	}
+	return string(raw), nil // number or boolean as it came
+}
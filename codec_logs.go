@@ -0,0 +1,265 @@
+package metcap
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LogExtractRule turns a log message matching the regex into a metric.
+// Rules are read from a file of `source|||regex|||name` lines, where source
+// is the part of the message the regex applies to: "message", "program" or
+// "host" of syslog messages, JSON path (ie. "short_message", "_took_ms" or
+// "_http.status") of GELF ones. Group named "value" holds the value (1 without
+// it, counting the messages), other named groups become fields and name can
+// reference groups as $1 or ${name}.
+type LogExtractRule struct {
+	source string
+	match  *regexp.Regexp
+	name   string
+}
+
+func NewLogExtractRules(file string) ([]LogExtractRule, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []LogExtractRule
+	scn := bufio.NewScanner(f)
+	for scn.Scan() {
+		line := strings.TrimSpace(scn.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := strings.Split(line, "|||")
+		if len(rule) != 3 {
+			return nil, fmt.Errorf("malformed extract rule '%s'", line)
+		}
+		re, err := regexp.Compile(rule[1])
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, LogExtractRule{rule[0], re, rule[2]})
+	}
+	if err := scn.Err(); err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return nil, errors.New("no extract rules")
+	}
+	return rules, nil
+}
+
+// extractMetrics applies all the rules to the message, source looks up the
+// rule's source text. Values that don't parse are reported as errors.
+func extractMetrics(rules []LogExtractRule, source func(string) (string, bool), fields map[string]string, ts time.Time, emit func(*Metric)) error {
+	for _, rule := range rules {
+		src, ok := source(rule.source)
+		if !ok {
+			continue
+		}
+		idx := rule.match.FindStringSubmatchIndex(src)
+		if idx == nil {
+			continue
+		}
+		m := &Metric{
+			Name:      string(rule.match.ExpandString(nil, rule.name, src, idx)),
+			Timestamp: ts,
+			Value:     1,
+			Fields:    make(map[string]string, len(fields)),
+		}
+		for k, v := range fields {
+			m.Fields[k] = v
+		}
+		for i, group := range rule.match.SubexpNames() {
+			if group == "" || idx[2*i] < 0 {
+				continue
+			}
+			value := src[idx[2*i]:idx[2*i+1]]
+			if group != "value" {
+				internField(m.Fields, group, value)
+				continue
+			}
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return newCodecError(CodecErrValue, "Failed to read extracted value", err, src)
+			}
+			m.Value = v
+		}
+		emit(m)
+	}
+	return nil
+}
+
+// SyslogCodec extracts metrics from RFC 3164 and RFC 5424 syslog messages,
+// one per line. Metrics get the sending host and program in fields.
+type SyslogCodec struct {
+	options CodecOptions
+	rules   []LogExtractRule
+}
+
+func NewSyslogCodec(extractFile string, o CodecOptions) (SyslogCodec, error) {
+	rules, err := NewLogExtractRules(extractFile)
+	if err != nil {
+		return SyslogCodec{}, err
+	}
+	return SyslogCodec{options: o, rules: rules}, nil
+}
+
+func (c SyslogCodec) Decode(input io.Reader) (<-chan *Metric, <-chan error) {
+	return decodeMultiLines(input, c.options, nil, c.decodeLine, nil)
+}
+
+// DecodeBatch decodes the input at once, see DecodeBatch
+func (c SyslogCodec) DecodeBatch(input []byte) ([]*Metric, []error) {
+	return DecodeBatch(c, input)
+}
+
+var (
+	// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD] MSG
+	syslog5424Regex = regexp.MustCompile(`^<[0-9]{1,3}>1 (\S+) (\S+) (\S+) \S+ \S+ (-|\[.*?\])(?: (.*))?$`)
+	// <PRI>Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG
+	syslog3164Regex = regexp.MustCompile(`^<[0-9]{1,3}>([A-Z][a-z]{2} [ 0-9][0-9] [0-9]{2}:[0-9]{2}:[0-9]{2}) (\S+) ([^:\[ ]+)(?:\[[0-9]+\])?: ?(.*)$`)
+)
+
+func (c SyslogCodec) decodeLine(line string, emit func(*Metric)) error {
+	line = strings.TrimRight(line, "\r\x00")
+	if line == "" {
+		return nil
+	}
+	var (
+		ts                     time.Time
+		host, program, message string
+	)
+	if match := syslog5424Regex.FindStringSubmatch(line); match != nil {
+		ts, _ = time.Parse(time.RFC3339Nano, match[1])
+		host, program, message = match[2], match[3], match[5]
+	} else if match := syslog3164Regex.FindStringSubmatch(line); match != nil {
+		// no year nor zone in there, take it as local time of this year
+		if t, err := time.ParseInLocation(time.Stamp, match[1], time.Local); err == nil {
+			ts = t.AddDate(time.Now().Year(), 0, 0)
+		}
+		host, program, message = match[2], match[3], match[4]
+	} else {
+		return newCodecError(CodecErrSyntax, "Line isn't a syslog message", nil, line)
+	}
+	source := func(s string) (string, bool) {
+		switch s {
+		case "message":
+			return message, true
+		case "program":
+			return program, true
+		case "host":
+			return host, true
+		}
+		return "", false
+	}
+	return extractMetrics(c.rules, source, map[string]string{"host": host, "program": program}, ts, emit)
+}
+
+// GELFCodec extracts metrics from GELF messages, JSON objects delimited by
+// newline or null byte (GELF TCP); gzip or zlib compressed payloads (GELF
+// UDP) are decompressed, chunked ones aren't supported. Metrics get the
+// host in fields.
+type GELFCodec struct {
+	options CodecOptions
+	rules   []LogExtractRule
+}
+
+func NewGELFCodec(extractFile string, o CodecOptions) (GELFCodec, error) {
+	rules, err := NewLogExtractRules(extractFile)
+	if err != nil {
+		return GELFCodec{}, err
+	}
+	return GELFCodec{options: o, rules: rules}, nil
+}
+
+func (c GELFCodec) Decode(input io.Reader) (<-chan *Metric, <-chan error) {
+	buf := bufio.NewReader(input)
+	magic, _ := buf.Peek(2)
+	var (
+		r   io.Reader = buf
+		err error
+	)
+	switch {
+	case len(magic) == 2 && magic[0] == 0x1e && magic[1] == 0x0f:
+		err = errors.New("chunked GELF isn't supported")
+	case len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		r, err = gzip.NewReader(buf)
+	case len(magic) == 2 && magic[0] == 0x78:
+		r, err = zlib.NewReader(buf)
+	}
+	if err != nil {
+		r = bytes.NewReader(nil)
+		return decodeMultiLines(r, c.options, nil, c.decodeLine, func() error {
+			return newCodecError(CodecErrInput, "Failed to read GELF payload", err, nil)
+		})
+	}
+	return decodeMultiLines(r, c.options, splitNull, c.decodeLine, nil)
+}
+
+// DecodeBatch decodes the input at once, see DecodeBatch
+func (c GELFCodec) DecodeBatch(input []byte) ([]*Metric, []error) {
+	return DecodeBatch(c, input)
+}
+
+func splitNull(line string) []string {
+	return strings.Split(line, "\x00")
+}
+
+func (c GELFCodec) decodeLine(line string, emit func(*Metric)) error {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil
+	}
+	var msg map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &msg); err != nil {
+		return newCodecError(CodecErrSyntax, "Failed to parse GELF message", err, line)
+	}
+	var ts time.Time
+	if t, ok := msg["timestamp"].(float64); ok {
+		sec, frac := math.Modf(t)
+		ts = time.Unix(int64(sec), int64(frac*1e9))
+	}
+	host, _ := msg["host"].(string)
+	source := func(path string) (string, bool) {
+		return jsonPathString(msg, path)
+	}
+	return extractMetrics(c.rules, source, map[string]string{"host": host}, ts, emit)
+}
+
+// jsonPathString walks dot separated path of nested objects and returns the
+// value found as string
+func jsonPathString(v interface{}, path string) (string, bool) {
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if v, ok = obj[key]; !ok {
+			return "", false
+		}
+	}
+	switch value := v.(type) {
+	case string:
+		return value, true
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(value), true
+	}
+	return "", false
+}
@@ -0,0 +1,344 @@
+package metcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ProtobufBatchCodec reads batches of metrics in protocol buffers, for
+// high-frequency agents the per-point overhead of text lines costs too
+// much: field keys are sent once per batch in a dictionary, points refer to
+// them by index and carry their timestamps relative to the batch's one.
+// The input is a stream of batches, each preceded by its length as varint
+// (like protobuf's writeDelimitedTo), over TCP or as the HTTP body.
+//
+//	message Batch {
+//	  repeated string keys = 1;   // field keys, referred to by index
+//	  repeated Point points = 2;
+//	  int64 timestamp = 3;        // Unix nanoseconds
+//	}
+//
+//	message Point {
+//	  string name = 1;
+//	  sint64 timestamp = 2;            // nanoseconds from the batch's one
+//	  double value = 3;                // mean of agg if left out
+//	  repeated uint32 field_keys = 4;  // packed, indices into keys
+//	  repeated string field_values = 5; // in the order of field_keys
+//	  Aggregate agg = 6;               // see ProtobufMetricCodec
+//	}
+//
+// Points with neither timestamp get the current time.
+type ProtobufBatchCodec struct {
+	options  CodecOptions
+	maxBatch int
+}
+
+// protobufMaxBatch caps the size of a batch, so a corrupt length doesn't
+// allocate gigabytes
+const protobufMaxBatch = 64 << 20
+
+func NewProtobufBatchCodec(o CodecOptions) (ProtobufBatchCodec, error) {
+	return ProtobufBatchCodec{options: o, maxBatch: protobufMaxBatch}, nil
+}
+
+func (c ProtobufBatchCodec) Decode(input io.Reader) (<-chan *Metric, <-chan error) {
+	o := c.options.withDefaults()
+	input = newResumingReader(input, o.ReadRetries, true, o.Resumed)
+	metrics := make(chan *Metric, o.MetricsBuffer)
+	errs := make(chan error, o.ErrorsBuffer)
+	batches := make(chan []byte, o.Workers)
+	wg := &sync.WaitGroup{}
+
+	sampler := newCodecErrorSampler(o.ErrorRate)
+	report := func(ce *CodecError) {
+		pass, suppressed := sampler.sample(ce)
+		if !pass {
+			return
+		}
+		ce.Count += suppressed
+		o.sendError(errs, ce)
+	}
+
+	for n := 0; n < o.Workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				err := c.decodeBatch(batch, func(m *Metric) {
+					if m.Timestamp.IsZero() {
+						m.Timestamp = o.now()
+					}
+					if o.Schema != nil {
+						if err := o.Schema.Validate(m); err != nil {
+							report(newCodecError(CodecErrSchema, "Invalid metric", err, m.Name))
+							return
+						}
+					}
+					metrics <- m
+				})
+				if err != nil {
+					report(err)
+				}
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(batches)
+		rd := bufio.NewReader(input)
+		for {
+			size, err := binary.ReadUvarint(rd)
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				report(newCodecError(CodecErrInput, "Failed to read batch length", err, nil))
+				return
+			}
+			if size > uint64(c.maxBatch) {
+				// the stream can't be resynced past it
+				report(newCodecError(CodecErrInput, "Batch too large", fmt.Errorf("%d bytes over %d", size, c.maxBatch), nil))
+				return
+			}
+			batch := make([]byte, size)
+			if _, err := io.ReadFull(rd, batch); err != nil {
+				report(newCodecError(CodecErrInput, "Failed to read batch", err, nil))
+				return
+			}
+			batches <- batch
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		for _, err := range sampler.leftover() {
+			o.sendError(errs, err)
+		}
+		close(metrics)
+		close(errs)
+	}()
+
+	return metrics, errs
+}
+
+// DecodeBatch decodes the input at once, see DecodeBatch
+func (c ProtobufBatchCodec) DecodeBatch(input []byte) ([]*Metric, []error) {
+	return DecodeBatch(c, input)
+}
+
+// decodeBatch emits the points of the batch once it's read whole, as the
+// keys and timestamp may come after the points; a point failing to decode
+// fails the rest of the batch
+func (c ProtobufBatchCodec) decodeBatch(data []byte, emit func(*Metric)) *CodecError {
+	var (
+		keys   []string
+		points [][]byte
+		base   int64
+	)
+	r := &protoReader{buf: data}
+	for !r.done() {
+		field, wireType, err := r.next()
+		if err != nil {
+			return newCodecError(CodecErrSyntax, "Corrupt batch", err, nil)
+		}
+		switch {
+		case field == 1 && wireType == protoBytes:
+			key, err := r.bytes()
+			if err != nil {
+				return newCodecError(CodecErrSyntax, "Corrupt batch", err, nil)
+			}
+			keys = append(keys, string(key))
+		case field == 2 && wireType == protoBytes:
+			point, err := r.bytes()
+			if err != nil {
+				return newCodecError(CodecErrSyntax, "Corrupt batch", err, nil)
+			}
+			points = append(points, point)
+		case field == 3 && wireType == protoVarint:
+			ts, err := r.varint()
+			if err != nil {
+				return newCodecError(CodecErrSyntax, "Corrupt batch", err, nil)
+			}
+			base = int64(ts)
+		default:
+			if err := r.skip(wireType); err != nil {
+				return newCodecError(CodecErrSyntax, "Corrupt batch", err, nil)
+			}
+		}
+	}
+	for i, point := range points {
+		m, err := c.decodePoint(point, keys, base)
+		if err != nil {
+			if err.src == nil {
+				err.src = fmt.Sprintf("point %d of %d", i, len(points))
+			}
+			err.Count = len(points) - i
+			return err
+		}
+		emit(m)
+	}
+	return nil
+}
+
+func (c ProtobufBatchCodec) decodePoint(data []byte, keys []string, base int64) (*Metric, *CodecError) {
+	var (
+		m         = &Metric{}
+		fieldKeys []uint64
+		values    []string
+		offset    int64
+		hasOffset bool
+		hasValue  bool
+	)
+	r := &protoReader{buf: data}
+	for !r.done() {
+		field, wireType, err := r.next()
+		if err != nil {
+			return nil, newCodecError(CodecErrSyntax, "Corrupt point", err, nil)
+		}
+		switch {
+		case field == 1 && wireType == protoBytes:
+			name, err := r.bytes()
+			if err != nil {
+				return nil, newCodecError(CodecErrSyntax, "Corrupt point", err, nil)
+			}
+			m.Name = string(name)
+		case field == 2 && wireType == protoVarint:
+			zz, err := r.varint()
+			if err != nil {
+				return nil, newCodecError(CodecErrSyntax, "Corrupt point", err, nil)
+			}
+			offset, hasOffset = int64(zz>>1)^-int64(zz&1), true // zigzag
+		case field == 3 && wireType == protoFixed64:
+			if m.Value, err = r.double(); err != nil {
+				return nil, newCodecError(CodecErrValue, "Corrupt point", err, nil)
+			}
+			hasValue = true
+		case field == 4 && wireType == protoBytes: // packed
+			packed, err := r.bytes()
+			if err != nil {
+				return nil, newCodecError(CodecErrSyntax, "Corrupt point", err, nil)
+			}
+			pr := &protoReader{buf: packed}
+			for !pr.done() {
+				k, err := pr.varint()
+				if err != nil {
+					return nil, newCodecError(CodecErrSyntax, "Corrupt point", err, nil)
+				}
+				fieldKeys = append(fieldKeys, k)
+			}
+		case field == 4 && wireType == protoVarint: // unpacked
+			k, err := r.varint()
+			if err != nil {
+				return nil, newCodecError(CodecErrSyntax, "Corrupt point", err, nil)
+			}
+			fieldKeys = append(fieldKeys, k)
+		case field == 5 && wireType == protoBytes:
+			v, err := r.bytes()
+			if err != nil {
+				return nil, newCodecError(CodecErrSyntax, "Corrupt point", err, nil)
+			}
+			values = append(values, string(v))
+		case field == 6 && wireType == protoBytes:
+			agg, err := r.bytes()
+			if err != nil {
+				return nil, newCodecError(CodecErrSyntax, "Corrupt point", err, nil)
+			}
+			if m.Aggregate, err = protoAggregate(agg); err != nil {
+				return nil, newCodecError(CodecErrValue, "Corrupt aggregate", err, nil)
+			}
+			if err := m.Aggregate.Valid(); err != nil {
+				return nil, newCodecError(CodecErrValue, "Invalid aggregate", err, nil)
+			}
+		default:
+			if err := r.skip(wireType); err != nil {
+				return nil, newCodecError(CodecErrSyntax, "Corrupt point", err, nil)
+			}
+		}
+	}
+	if m.Name == "" {
+		return nil, newCodecError(CodecErrName, "Point without name", nil, nil)
+	}
+	if len(fieldKeys) != len(values) {
+		return nil, newCodecError(CodecErrName, "Field keys and values don't pair", fmt.Errorf("%d keys, %d values", len(fieldKeys), len(values)), m.Name)
+	}
+	if len(fieldKeys) > 0 {
+		m.Fields = make(map[string]string, len(fieldKeys))
+		for i, k := range fieldKeys {
+			if k >= uint64(len(keys)) {
+				return nil, newCodecError(CodecErrName, "Field key out of the dictionary", fmt.Errorf("index %d of %d keys", k, len(keys)), m.Name)
+			}
+			internField(m.Fields, keys[k], values[i])
+		}
+	}
+	if base != 0 || hasOffset {
+		m.Timestamp = time.Unix(0, base+offset)
+	}
+	if m.Aggregate != nil && !hasValue {
+		m.Value = m.Aggregate.Sum / m.Aggregate.Count
+	}
+	return m, nil
+}
+
+// AppendProtobufBatch encodes the metrics as a length-delimited batch, for
+// agents written in Go and tests
+func AppendProtobufBatch(b []byte, metrics []*Metric) []byte {
+	var (
+		batch []byte
+		index = make(map[string]uint64)
+		base  int64
+	)
+	for _, m := range metrics {
+		for _, k := range sortedKeys(m.Fields) {
+			if _, ok := index[k]; !ok {
+				index[k] = uint64(len(index))
+				batch = protoAppendString(batch, 1, k)
+			}
+		}
+		if !m.Timestamp.IsZero() && (base == 0 || m.Timestamp.UnixNano() < base) {
+			base = m.Timestamp.UnixNano()
+		}
+	}
+	for _, m := range metrics {
+		var point, packed []byte
+		point = protoAppendString(point, 1, m.Name)
+		if !m.Timestamp.IsZero() {
+			offset := m.Timestamp.UnixNano() - base
+			point = protoAppendTag(point, 2, protoVarint)
+			point = protoAppendVarint(point, uint64(offset<<1)^uint64(offset>>63)) // zigzag
+		}
+		if m.Aggregate == nil || m.Value != 0 {
+			point = protoAppendDouble(point, 3, m.Value)
+		}
+		keys := sortedKeys(m.Fields)
+		for _, k := range keys {
+			packed = protoAppendVarint(packed, index[k])
+		}
+		if len(packed) > 0 {
+			point = protoAppendBytes(point, 4, packed)
+		}
+		for _, k := range keys {
+			point = protoAppendString(point, 5, m.Fields[k])
+		}
+		if a := m.Aggregate; a != nil {
+			var agg []byte
+			agg = protoAppendDouble(agg, 1, a.Sum)
+			agg = protoAppendDouble(agg, 2, a.Count)
+			agg = protoAppendDouble(agg, 3, a.Min)
+			agg = protoAppendDouble(agg, 4, a.Max)
+			point = protoAppendBytes(point, 6, agg)
+		}
+		batch = protoAppendBytes(batch, 2, point)
+	}
+	if base != 0 {
+		batch = protoAppendTag(batch, 3, protoVarint)
+		batch = protoAppendVarint(batch, uint64(base))
+	}
+	b = protoAppendVarint(b, uint64(len(batch)))
+	return append(b, batch...)
+}
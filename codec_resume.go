@@ -0,0 +1,73 @@
+package metcap
+
+import (
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// resumingReader retries reads failing temporarily (EAGAIN, EINTR, read
+// timeouts of a connection with a deadline) up to retries times in a row,
+// backing off from 10ms to 1s, so a hiccup of a long-lived connection
+// doesn't end the whole decode; the data read so far stays in the scanner
+// and reading continues on the same connection. Other errors and too many
+// failures in a row are returned.
+type resumingReader struct {
+	r        io.Reader
+	retries  int
+	timeouts bool // retry read timeouts too
+	resumed  *StatsCounter
+}
+
+const (
+	defaultReadRetries = 3
+	resumeBackoff      = 10 * time.Millisecond
+	resumeBackoffMax   = time.Second
+)
+
+func newResumingReader(r io.Reader, retries int, timeouts bool, resumed *StatsCounter) io.Reader {
+	if retries <= 0 {
+		return r
+	}
+	return &resumingReader{r: r, retries: retries, timeouts: timeouts, resumed: resumed}
+}
+
+func (r *resumingReader) Read(p []byte) (int, error) {
+	backoff := resumeBackoff
+	for failed := 0; ; failed++ {
+		n, err := r.r.Read(p)
+		if err == nil || n > 0 || failed >= r.retries || !r.temporary(err) {
+			return n, err
+		}
+		if r.resumed != nil {
+			r.resumed.Increment(1)
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > resumeBackoffMax {
+			backoff = resumeBackoffMax
+		}
+	}
+}
+
+func (r *resumingReader) temporary(err error) bool {
+	if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
+		return r.timeouts
+	}
+	// unwrap *net.OpError and *os.SyscallError down to the errno
+	for {
+		switch e := err.(type) {
+		case *net.OpError:
+			err = e.Err
+			continue
+		case *os.SyscallError:
+			err = e.Err
+			continue
+		case syscall.Errno:
+			return e == syscall.EAGAIN || e == syscall.EWOULDBLOCK || e == syscall.EINTR
+		}
+		nErr, ok := err.(net.Error)
+		return ok && nErr.Temporary()
+	}
+}
@@ -0,0 +1,62 @@
+package metcap
+
+import (
+	"io"
+	"net"
+)
+
+// ConnContext describes the connection the data being decoded came from.
+// Sessions may put whatever they negotiate with the sender (ie. options of
+// a stream header) into Options.
+type ConnContext struct {
+	Listener   string
+	Protocol   string
+	Remote     net.Addr
+	ServerName string // TLS SNI
+	Options    map[string]string
+}
+
+// Env exposes the context to external commands as METCAP_* variables
+func (ctx *ConnContext) Env() []string {
+	if ctx == nil {
+		return nil
+	}
+	env := []string{
+		"METCAP_LISTENER=" + ctx.Listener,
+		"METCAP_PROTOCOL=" + ctx.Protocol,
+	}
+	if ctx.Remote != nil {
+		env = append(env, "METCAP_REMOTE_ADDR="+ctx.Remote.String())
+	}
+	if ctx.ServerName != "" {
+		env = append(env, "METCAP_SERVER_NAME="+ctx.ServerName)
+	}
+	return env
+}
+
+// SessionCodec is a codec keeping state for the whole connection, ie. for
+// streams opening with a header or batches referring to earlier ones. The
+// listener starts a session for every TCP connection (every datagram for
+// UDP) and closes it once all its metrics and errors are read.
+type SessionCodec interface {
+	Codec
+	NewSession(ctx *ConnContext) CodecSession
+}
+
+type CodecSession interface {
+	Decode(io.Reader) (<-chan *Metric, <-chan error)
+	Close() error
+}
+
+// DecodeConn decodes the connection's data in a session of its own if the
+// codec supports it, the returned func ends the session
+func DecodeConn(c Codec, ctx *ConnContext, input io.Reader) (<-chan *Metric, <-chan error, func() error) {
+	sc, ok := c.(SessionCodec)
+	if !ok {
+		metrics, errs := c.Decode(input)
+		return metrics, errs, func() error { return nil }
+	}
+	s := sc.NewSession(ctx)
+	metrics, errs := s.Decode(input)
+	return metrics, errs, s.Close
+}
@@ -0,0 +1,330 @@
+package metcap
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The golden corpus in testdata/corpus is decoded by the codec the file is
+// named after and every decoded metric is compared against the .metrics
+// file next to it, `go test -run Corpus -update` rewrites them. Counts of
+// decoded and failed lines are checked by cmd/metcap-bench as well.
+
+var updateGolden = flag.Bool("update", false, "Rewrite the golden files with current results")
+
+const corpusMutator = "etc/graphite_mutator.conf"
+
+var fuzzMutatorRules = strings.Join([]string{
+	`^stats\..*$|||-.type.1.2`,
+	`^STRESS\.host|||-.-.host.-.-.1.2+`,
+	`^servers\.|||-.host.1+`,
+	`^apps\.|||-.app.+`,
+}, "\n")
+
+func corpusCodec(tb testing.TB, name string) Codec {
+	var (
+		codec Codec
+		err   error
+	)
+	o := CodecOptions{Workers: 1}
+	switch name {
+	case "graphite":
+		codec, err = NewGraphiteCodec(corpusMutator, false, o)
+	case "influx":
+		codec, err = NewInfluxCodec(o)
+	default:
+		err = fmt.Errorf("unknown codec '%s'", name)
+	}
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return codec
+}
+
+func corpusData(tb testing.TB, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "corpus", name+".txt"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return data
+}
+
+// renderMetric prints what a codec decoded, the timestamp of lines without
+// one is the time of decoding, printed as `now`
+func renderMetric(m *Metric) string {
+	keys := make([]string, 0, len(m.Fields))
+	for k := range m.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fields := make([]string, len(keys))
+	for i, k := range keys {
+		fields[i] = k + "=" + m.Fields[k]
+	}
+	ts := fmt.Sprintf("%d", m.Timestamp.UnixNano())
+	if time.Since(m.Timestamp) < time.Hour && time.Until(m.Timestamp) < time.Hour {
+		ts = "now"
+	}
+	return fmt.Sprintf("%s {%s} %v %s", m.Name, strings.Join(fields, ","), m.Value, ts)
+}
+
+func TestCorpus(t *testing.T) {
+	for _, name := range []string{"graphite", "influx"} {
+		t.Run(name, func(t *testing.T) {
+			metrics, errs := DecodeBatch(corpusCodec(t, name), corpusData(t, name))
+			lines := make([]string, len(metrics))
+			for i, m := range metrics {
+				lines[i] = renderMetric(m)
+			}
+			sort.Strings(lines)
+			result := fmt.Sprintf("%sfailed=%d\n", strings.Join(lines, "\n")+"\n", len(errs))
+
+			golden := filepath.Join("testdata", "corpus", name+".metrics")
+			if *updateGolden {
+				if err := ioutil.WriteFile(golden, []byte(result), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			expected, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(expected) != result {
+				t.Errorf("decoded metrics differ from %s:\n%s", golden, result)
+			}
+		})
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	for ts, expected := range map[string]time.Time{
+		"":                     {},
+		"1620000000":           time.Unix(1620000000, 0),
+		"1620000000.123":       time.Unix(1620000000, 123000000),
+		"1620000000123":        time.Unix(1620000000, 123000000),
+		"1620000000123456789":  time.Unix(1620000000, 123456789),
+		"0":                    time.Unix(0, 0),
+		"-1":                   time.Unix(-1, 0),
+		"-1.5":                 time.Unix(-2, 500000000),
+		"-0.25":                time.Unix(0, -250000000),
+		"1620000000.123456789": time.Unix(1620000000, 123456789),
+	} {
+		if got, err := parseTimestamp(ts); err != nil || !got.Equal(expected) {
+			t.Errorf("%q parsed as %v (%v), not %v", ts, got, err, expected)
+		}
+	}
+}
+
+func TestTimestampOverflow(t *testing.T) {
+	for _, tc := range []struct {
+		precision, ts string
+		ok            bool
+	}{
+		{"ns", "99999999999999999999", false},
+		{"s", "99999999999999999999", false},
+		{"h", "9223372036854775807", false},
+		{"h", "-9223372036854775807", false},
+		{"ms", "1620000000000", true},
+		{"ms", "99999999999999999.5", false},
+	} {
+		codec, err := NewInfluxCodec(CodecOptions{Workers: 1, Precision: tc.precision})
+		if err != nil {
+			t.Fatal(err)
+		}
+		metrics, errs := DecodeBatch(codec, []byte("cpu host=a value=1 "+tc.ts+"\n"))
+		if ok := len(metrics) == 1 && len(errs) == 0; ok != tc.ok {
+			t.Errorf("%s in %s decoded to %d metrics, errors: %v", tc.ts, tc.precision, len(metrics), errs)
+		}
+	}
+	// graphite takes up to 19 digits with precision set
+	codec, err := newGraphiteCodec(strings.NewReader(fuzzMutatorRules), "overflow", false, CodecOptions{Workers: 1, Precision: "us"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ts, expected := range map[string]bool{"1620000000123456": true, "9999999999999999999": false} {
+		metrics, errs := DecodeBatch(codec, []byte("apps.a.b 1 "+ts+"\n"))
+		if ok := len(metrics) == 1 && len(errs) == 0; ok != expected {
+			t.Errorf("%s in us decoded to %d metrics, errors: %v", ts, len(metrics), errs)
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// hiccupReader times out between the chunks it reads, like a long-lived
+// connection with a read deadline
+type hiccupReader struct {
+	chunks []string
+	failed bool
+}
+
+func (r *hiccupReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	if !r.failed {
+		r.failed = true
+		return 0, timeoutError{}
+	}
+	r.failed = false
+	n := copy(p, r.chunks[0])
+	r.chunks = r.chunks[1:]
+	return n, nil
+}
+
+func TestGraphiteResume(t *testing.T) {
+	resumed := NewStatsCounter(time.Now())
+	codec, err := newGraphiteCodec(strings.NewReader(fuzzMutatorRules), "resume", false, CodecOptions{Workers: 1, Resumed: resumed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, errs := codec.Decode(&hiccupReader{chunks: []string{"apps.a.b 1 100\napps.a", ".c 2 100\n"}})
+	n := 0
+	for metrics != nil || errs != nil {
+		select {
+		case _, ok := <-metrics:
+			if !ok {
+				metrics = nil
+				continue
+			}
+			n++
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			t.Error(err)
+		}
+	}
+	if n != 2 {
+		t.Errorf("decoded %d metrics, not 2", n)
+	}
+	if r := resumed.Total(); r != 2 {
+		t.Errorf("resumed %d reads, not 2", r)
+	}
+}
+
+func benchmarkDecode(b *testing.B, name string) {
+	codec, data := corpusCodec(b, name), corpusData(b, name)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		DecodeBatch(codec, data)
+	}
+}
+
+func BenchmarkGraphiteDecode(b *testing.B) { benchmarkDecode(b, "graphite") }
+func BenchmarkInfluxDecode(b *testing.B)   { benchmarkDecode(b, "influx") }
+
+// BenchmarkMetricCodec compares the serialization formats of the transport
+// buffer, encoded size included, on the finite metrics of the influx corpus
+// (JSON can't carry the rest)
+func BenchmarkMetricCodec(b *testing.B) {
+	decoded, _ := DecodeBatch(corpusCodec(b, "influx"), corpusData(b, "influx"))
+	var metrics []*Metric
+	for _, m := range decoded {
+		if !math.IsNaN(m.Value) && !math.IsInf(m.Value, 0) {
+			metrics = append(metrics, m)
+		}
+	}
+	for _, format := range []string{"msgpack", "json", "gob", "protobuf"} {
+		codec, err := NewMetricCodec(format)
+		if err != nil {
+			b.Fatal(err)
+		}
+		encoded := make([][]byte, len(metrics))
+		size := 0
+		for i, m := range metrics {
+			if encoded[i], err = codec.Marshal(m); err != nil {
+				b.Fatal(err)
+			}
+			size += len(encoded[i])
+		}
+		b.Run(format+"/marshal", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				for _, m := range metrics {
+					codec.Marshal(m)
+				}
+			}
+			b.ReportMetric(float64(size)/float64(len(metrics)), "bytes/metric")
+		})
+		b.Run(format+"/decode", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				for _, data := range encoded {
+					if _, err := DecodeMetric(data); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// fuzzCorpus seeds a fuzz target with the corpus lines one by one
+func fuzzCorpus(f *testing.F, name string) {
+	for _, line := range bytes.Split(corpusData(f, name), []byte("\n")) {
+		f.Add(line)
+	}
+}
+
+func fuzzDecode(t *testing.T, codec Codec, data []byte) {
+	metrics, _ := DecodeBatch(codec, data)
+	for _, m := range metrics {
+		if m.Name == "" {
+			t.Fatalf("%q decoded to a metric without a name", data)
+		}
+		// whatever decodes has to be storable
+		if _, err := DecodeMetric(m.Serialize()); err != nil {
+			t.Fatalf("%q decoded to %s failing the round trip: %v", data, renderMetric(m), err)
+		}
+	}
+}
+
+func FuzzGraphite(f *testing.F) {
+	fuzzCorpus(f, "graphite")
+	codec, err := newGraphiteCodec(strings.NewReader(fuzzMutatorRules), "fuzz", true, CodecOptions{Workers: 1})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) { fuzzDecode(t, codec, data) })
+}
+
+func FuzzInflux(f *testing.F) {
+	fuzzCorpus(f, "influx")
+	codec := corpusCodec(f, "influx")
+	f.Fuzz(func(t *testing.T, data []byte) { fuzzDecode(t, codec, data) })
+}
+
+func FuzzMetricCodec(f *testing.F) {
+	metrics, _ := DecodeBatch(corpusCodec(f, "influx"), corpusData(f, "influx"))
+	for _, m := range metrics {
+		f.Add(m.Serialize())
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := DecodeMetric(data)
+		if err != nil {
+			return
+		}
+		// whatever decodes has to survive the round trip
+		if _, err := DecodeMetric(m.Serialize()); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -1,57 +1,457 @@
 package metcap
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
 )
 
 type Config struct {
+	Include     []string
 	Syslog      bool
 	Debug       bool
 	ReportEvery configDuration `toml:"report_every"`
+	CPU         CPUConfig
 	Transport   TransportConfig
 	Listener    map[string]ListenerConfig
 	Writer      WriterConfig
 	Aggregator  AggregatorConfig
+	Hold        HoldConfig
+	Sketch      SketchConfig
+	Last        LastConfig
+	Upgrade     UpgradeConfig
+	Admin       AdminConfig
+	Export      ExportConfig
+	Quota       QuotaConfig
+	Sampling    SamplingConfig
+	State       StateConfig
+	Render      RenderConfig
+	Self        SelfConfig
+	Chaos       ChaosConfig
+	Diagnostics DiagnosticsConfig
+	Pipeline    map[string]PipelineConfig
+	Processor   map[string]ProcessorConfig
+	Output      map[string]WriterConfig
 }
 
 type TransportConfig struct {
-	Type             string
-	BufferSize       int    `toml:"buffer_size"`
-	RedisURL         string `toml:"redis_url"`
-	RedisTimeout     int    `toml:"redis_timeout"`
-	RedisWait        int    `toml:"redis_wait"`
-	RedisRetries     int    `toml:"redis_retries"`
-	RedisConnections int    `toml:"redis_connections"`
-	RedisQueue       string `toml:"redis_queue"`
-	AMQPURL          string `toml:"amqp_url"`
-	AMQPTag          string `toml:"amqp_tag"`
-	AMQPTimeout      int    `toml:"amqp_timeout"`
-	AMQPWorkers      int    `toml:"amqp_workers"`
+	Type              string
+	BufferSize        int            `toml:"buffer_size"`
+	Serialization     string         `toml:"serialization"`
+	EncryptionKey     string         `toml:"encryption_key"`
+	EncryptionKeyFile string         `toml:"encryption_key_file"`
+	RedisURL          string         `toml:"redis_url"`
+	RedisTimeout      int            `toml:"redis_timeout"`
+	RedisWait         int            `toml:"redis_wait"`
+	RedisRetries      int            `toml:"redis_retries"`
+	RedisConnections  int            `toml:"redis_connections"`
+	RedisQueue        string         `toml:"redis_queue"`
+	RedisBatch        int            `toml:"redis_batch"`
+	RedisBatchWait    configDuration `toml:"redis_batch_wait"`
+	RedisGroup        string         `toml:"redis_group"`
+	RedisConsumer     string         `toml:"redis_consumer"`
+	RedisStreamMaxLen int            `toml:"redis_stream_maxlen"`
+	RedisClaimIdle    configDuration `toml:"redis_claim_idle"`
+	RedisReplayFrom   string         `toml:"redis_replay_from"`
+	CompactBacklog    int            `toml:"compact_backlog"`
+	CompactAge        configDuration `toml:"compact_age"`
+	CompactResolution configDuration `toml:"compact_resolution"`
+	CompactInterval   configDuration `toml:"compact_interval"`
+	CompactChunk      int            `toml:"compact_chunk"`
+	CompactRulesFile  string         `toml:"compact_rules_file"`
+	AMQPURL           string         `toml:"amqp_url"`
+	AMQPTag           string         `toml:"amqp_tag"`
+	AMQPTimeout       int            `toml:"amqp_timeout"`
+	AMQPWorkers       int            `toml:"amqp_workers"`
 }
 
 type ListenerConfig struct {
-	Port        int
-	Protocol    string
-	Codec       string
-	Decoders    int
-	MutatorFile string `toml:"mutator_file"`
+	Port     int
+	Protocol string
+	Codec    string
+	Decoders int
+
+	CodecWorkers       int `toml:"codec_workers"`
+	CodecMetricsBuffer int `toml:"codec_metrics_buffer"`
+	CodecErrorsBuffer  int `toml:"codec_errors_buffer"`
+	CodecMaxInflight   int `toml:"codec_max_inflight"`
+	CodecErrorRate     int `toml:"codec_error_rate"`
+
+	CodecErrorsOverflow string `toml:"codec_errors_overflow"`
+	CodecReadRetries    int    `toml:"codec_read_retries"`
+
+	RawLines float64 `toml:"raw_lines"`
+
+	Strict      bool   `toml:"strict"`
+	MaxFields   int    `toml:"max_fields"`
+	Conformance string `toml:"conformance"`
+
+	MutatorFile  string         `toml:"mutator_file"`
+	MutatorFiles []string       `toml:"mutator_files"`
+	MutatorDir   string         `toml:"mutator_dir"`
+	SplitLines   bool           `toml:"split_lines"`
+	HostField    string         `toml:"host_field"`
+	HostLookup   string         `toml:"host_lookup"`
+	HostCache    configDuration `toml:"host_cache"`
+	RewriteFile  string         `toml:"rewrite_file"`
+	ScriptFile   string         `toml:"script_file"`
+	ExecCommand  []string       `toml:"exec_command"`
+	ExecTimeout  configDuration `toml:"exec_timeout"`
+	ExtractFile  string         `toml:"extract_file"`
+
+	TLSCert     string      `toml:"tls_cert"`
+	TLSKey      string      `toml:"tls_key"`
+	SNI         []SNIConfig `toml:"sni"`
+	TenantField string      `toml:"tenant_field"`
+
+	NaNPolicy       string `toml:"nan_policy"`
+	InfPolicy       string `toml:"inf_policy"`
+	TimestampPolicy string `toml:"timestamp_policy"`
+	LengthPolicy    string `toml:"length_policy"`
+	MaxNameLength   int    `toml:"max_name_length"`
+	MaxFieldLength  int    `toml:"max_field_length"`
+
+	TimestampSnap configDuration `toml:"timestamp_snap"`
+	Precision     string         `toml:"precision"`
+
+	ArrivalTime     []ArrivalTimeConfig `toml:"arrival_time"`
+	ArrivalTimeSkew configDuration      `toml:"arrival_time_skew"`
+
+	HMACKeysFile string         `toml:"hmac_keys_file"`
+	HMACOptional bool           `toml:"hmac_optional"`
+	HMACWindow   configDuration `toml:"hmac_window"`
+
+	Encoding string `toml:"encoding"`
+	Sanitize string `toml:"sanitize"`
+
+	ReusePort    bool           `toml:"reuseport"`
+	AcceptLoops  int            `toml:"accept_loops"`
+	KeepAlive    configDuration `toml:"keepalive"`
+	IdleTimeout  configDuration `toml:"idle_timeout"`
+	MinRate      int            `toml:"min_rate"`
+	MinRateGrace configDuration `toml:"min_rate_grace"`
+	Ack          bool           `toml:"ack"`
+	PayloadSize  int            `toml:"udp_payload_size"`
+	ReadBuffer   int            `toml:"udp_read_buffer"`
+
+	MQTTBroker   string   `toml:"mqtt_broker"`
+	MQTTTopics   []string `toml:"mqtt_topics"`
+	MQTTQoS      int      `toml:"mqtt_qos"`
+	MQTTClientID string   `toml:"mqtt_client_id"`
+	MQTTUsername string   `toml:"mqtt_username"`
+	MQTTPassword string   `toml:"mqtt_password"`
+
+	ProxyProtocol  bool     `toml:"proxy_protocol"`
+	TrustedProxies []string `toml:"trusted_proxies"`
+	HTTPMaxBody    int64    `toml:"http_max_body"`
+
+	MaxConnections   int    `toml:"max_connections"`
+	ConnectionPolicy string `toml:"connection_policy"`
+	ConnectionQueue  int    `toml:"connection_queue"`
+	ChurnLimit       int    `toml:"churn_limit"`
+	ChurnPolicy      string `toml:"churn_policy"`
+
+	ErrorBudget   float64        `toml:"error_budget"`
+	ErrorWindow   configDuration `toml:"error_window"`
+	ErrorMinLines int            `toml:"error_min_lines"`
+	ErrorBan      configDuration `toml:"error_ban"`
+
+	Quota QuotaConfig `toml:"quota"`
+}
+
+// CodecOptions returns the codec tuning part of listener config
+func (c ListenerConfig) CodecOptions() CodecOptions {
+	return CodecOptions{
+		Workers:       c.CodecWorkers,
+		MetricsBuffer: c.CodecMetricsBuffer,
+		ErrorsBuffer:  c.CodecErrorsBuffer,
+		MaxInflight:   c.CodecMaxInflight,
+		Schema:        NewSchema(c),
+		SnapNow:       c.TimestampSnap.Duration,
+		Conformance:   c.Conformance,
+		ErrorRate:     c.CodecErrorRate,
+		Precision:     c.Precision,
+		Overflow:      c.CodecErrorsOverflow,
+		ReadRetries:   c.CodecReadRetries,
+		RawLines:      c.RawLines,
+	}
 }
 
 type WriterConfig struct {
+	URLs             []string          `toml:"urls"`
+	Timeout          int               `toml:"timeout"`
+	Concurrency      int               `toml:"concurrency"`
+	IndexProcessors  bool              `toml:"index_processors"`
+	Ordered          bool              `toml:"ordered"`
+	IndexConcurrency int               `toml:"index_concurrency"`
+	IndexQueue       int               `toml:"index_queue"`
+	IndexIdle        configDuration    `toml:"index_idle"`
+	BulkMax          int               `toml:"bulk_max"`
+	BulkWait         configDuration    `toml:"bulk_wait"`
+	BulkWaitJitter   configDuration    `toml:"bulk_wait_jitter"`
+	BulkQueueMax     int               `toml:"bulk_queue_max"`
+	BulkGzip         bool              `toml:"bulk_gzip"`
+	BulkGzipLevel    int               `toml:"bulk_gzip_level"`
+	RetryStatuses    []int             `toml:"retry_statuses"`
+	RetryMax         int               `toml:"retry_max"`
+	RetryBackoff     configDuration    `toml:"retry_backoff"`
+	RetryBackoffMax  configDuration    `toml:"retry_backoff_max"`
+	Startup          string            `toml:"startup"`
+	StartupRetry     configDuration    `toml:"startup_retry"`
+	Index            string            `toml:"index"`
+	DocType          string            `toml:"doc_type"`
+	Shards           *int              `toml:"index_shards"`
+	Replicas         *int              `toml:"index_replicas"`
+	RefreshInterval  string            `toml:"index_refresh_interval"`
+	IndexCodec       string            `toml:"index_codec"`
+	IndexSettings    map[string]string `toml:"index_settings"`
+	FieldsMapping    string            `toml:"fields_mapping"`
+	SnapshotFile     string            `toml:"snapshot_file"`
+	DrainTimeout     configDuration    `toml:"drain_timeout"`
+	NameMapping      string            `toml:"name_mapping"`
+	NameDelimiter    string            `toml:"name_delimiter"`
+	Events           EventsConfig      `toml:"events"`
+	TTL              []TTLConfig       `toml:"ttl"`
+	IndexRules       []IndexRuleConfig `toml:"index_rule"`
+	HealthCheck      configDuration    `toml:"health_check"`
+	MaxRelocating    int               `toml:"health_max_relocating"`
+	Shadow           ShadowConfig      `toml:"shadow"`
+	Maintenance      MaintenanceConfig `toml:"maintenance"`
+	Normalize        string            `toml:"normalize"`
+	ScriptFile       string            `toml:"script_file"`
+	Compat           string            `toml:"compat"`
+	Username         string            `toml:"username"`
+	Password         string            `toml:"password"`
+	Sniff            *bool             `toml:"sniff"`
+	VerifyInterval   configDuration    `toml:"verify_interval"`
+	Aliases          []string          `toml:"aliases"`
+	WriteAlias       string            `toml:"write_alias"`
+	ReadAlias        string            `toml:"read_alias"`
+	ILMPolicy        string            `toml:"ilm_policy"`
+	DataStreams      []string          `toml:"data_streams"`
+	Dedup            DedupConfig       `toml:"dedup"`
+	Anonymize        AnonymizeConfig   `toml:"anonymize"`
+}
+
+type AnonymizeConfig struct {
+	Key     string                `toml:"key"`
+	KeyFile string                `toml:"key_file"`
+	Rules   []AnonymizeRuleConfig `toml:"rule"`
+}
+
+type AnonymizeRuleConfig struct {
+	Fields  []string `toml:"fields"`
+	Method  string   `toml:"method"`
+	Length  int      `toml:"length"`
+	Prefix  int      `toml:"prefix"`
+	Prefix6 int      `toml:"prefix6"`
+}
+
+type DedupConfig struct {
+	Mode     string         `toml:"mode"`
+	Window   configDuration `toml:"window"`
+	RedisURL string         `toml:"redis_url"`
+	Key      string         `toml:"key"`
+}
+
+type MaintenanceConfig struct {
+	Age         configDuration `toml:"age"`
+	Interval    configDuration `toml:"interval"`
+	MaxSegments int            `toml:"max_segments"`
+}
+
+type ShadowConfig struct {
 	URLs        []string       `toml:"urls"`
-	Timeout     int            `toml:"timeout"`
+	Percent     float64        `toml:"percent"`
+	Index       string         `toml:"index"`
 	Concurrency int            `toml:"concurrency"`
 	BulkMax     int            `toml:"bulk_max"`
 	BulkWait    configDuration `toml:"bulk_wait"`
-	Index       string         `toml:"index"`
-	DocType     string         `toml:"doc_type"`
+	Buffer      int            `toml:"buffer"`
+	Normalize   string         `toml:"normalize"`
+	Compat      string         `toml:"compat"`
+	Username    string         `toml:"username"`
+	Password    string         `toml:"password"`
+	Sniff       *bool          `toml:"sniff"`
+}
+
+type IndexRuleConfig struct {
+	Match       string `toml:"match"`
+	Granularity string `toml:"granularity"`
+}
+
+type TTLConfig struct {
+	Match string         `toml:"match"`
+	TTL   configDuration `toml:"ttl"`
+}
+
+type EventsConfig struct {
+	Index       string            `toml:"index"`
+	DocType     string            `toml:"doc_type"`
+	Thresholds  []ThresholdConfig `toml:"threshold"`
+	Annotations bool              `toml:"annotations"`
+}
+
+type ThresholdConfig struct {
+	Name  string  `toml:"name"`
+	Match string  `toml:"match"`
+	Value float64 `toml:"value"`
+}
+
+type SNIConfig struct {
+	ServerName  string `toml:"server_name"`
+	Codec       string `toml:"codec"`
+	MutatorFile string `toml:"mutator_file"`
+	ExtractFile string `toml:"extract_file"`
+	Tenant      string `toml:"tenant"`
+}
+
+type ArrivalTimeConfig struct {
+	Match   string   `toml:"match"`
+	Sources []string `toml:"sources"`
+}
+
+type QuotaConfig struct {
+	Rate    float64             `toml:"rate"`
+	Burst   float64             `toml:"burst"`
+	Policy  string              `toml:"policy"`
+	Tenants []TenantQuotaConfig `toml:"tenant"`
+}
+
+type TenantQuotaConfig struct {
+	Tenant    string  `toml:"tenant"`
+	Rate      float64 `toml:"rate"`
+	Burst     float64 `toml:"burst"`
+	MaxSeries int     `toml:"max_series"`
+	MaxBytes  uint64  `toml:"max_bytes"`
+	Action    string  `toml:"action"`
+	Keep      int     `toml:"keep"`
+}
+
+type SamplingConfig struct {
+	TenantField string               `toml:"tenant_field"`
+	OnDemand    bool                 `toml:"on_demand"`
+	Rules       []SamplingRuleConfig `toml:"rule"`
+}
+
+type DiagnosticsConfig struct {
+	Gops          bool   `toml:"gops"`
+	GopsAddr      string `toml:"gops_addr"`
+	GopsConfigDir string `toml:"gops_config_dir"`
+}
+
+type StateConfig struct {
+	RedisURL string `toml:"redis_url"`
+	Key      string `toml:"key"`
+}
+
+type SamplingRuleConfig struct {
+	Match  string `toml:"match"`
+	Tenant string `toml:"tenant"`
+	Keep   int    `toml:"keep"`
+}
+
+type AdminConfig struct {
+	Listen       string `toml:"listen"`
+	Token        string `toml:"token"`
+	ListenersDir string `toml:"listeners_dir"`
+}
+
+type ExportConfig struct {
+	Enabled    bool           `toml:"enabled"`
+	MaxBatch   int            `toml:"max_batch"`
+	Wait       configDuration `toml:"wait"`
+	AckTimeout configDuration `toml:"ack_timeout"`
+}
+
+type RenderConfig struct {
+	Enabled   bool `toml:"enabled"`
+	MaxSeries int  `toml:"max_series"`
+	MaxPoints int  `toml:"max_points"`
+}
+
+type SelfConfig struct {
+	Interval  configDuration `toml:"interval"`
+	Prefix    string         `toml:"prefix"`
+	HostField string         `toml:"host_field"`
+	Pipeline  string         `toml:"pipeline"`
+}
+
+type PipelineConfig struct {
+	Inputs     []string `toml:"inputs"`
+	Processors []string `toml:"processors"`
+	Outputs    []string `toml:"outputs"`
+}
+
+type ProcessorConfig struct {
+	Type   string `toml:"type"`
+	Match  string `toml:"match"`
+	Action string `toml:"action"`
+	File   string `toml:"file"`
+	Keep   int    `toml:"keep"`
+	Preset string `toml:"preset"`
+
+	Expression string         `toml:"expression"`
+	Join       []string       `toml:"join"`
+	Window     configDuration `toml:"window"`
+}
+
+type AggregatorConfig struct {
+	Interval  configDuration `toml:"interval"`
+	RulesFile string         `toml:"rules_file"`
+}
+
+type UpgradeConfig struct {
+	Timeout configDuration `toml:"timeout"`
+	PidFile string         `toml:"pid_file"`
+}
+
+type HoldConfig struct {
+	Match    []string       `toml:"match"`
+	Interval configDuration `toml:"interval"`
+	MaxAge   configDuration `toml:"max_age"`
+}
+
+type CPUConfig struct {
+	GoMaxProcs       int `toml:"gomaxprocs"`
+	MaxCodecWorkers  int `toml:"max_codec_workers"`
+	MaxAcceptLoops   int `toml:"max_accept_loops"`
+	MaxDecoders      int `toml:"max_decoders"`
+	MaxWriterWorkers int `toml:"max_writer_workers"`
 }
 
-type AggregatorConfig struct{}
+type ChaosConfig struct {
+	Enabled         bool           `toml:"enabled"`
+	BulkFailPercent float64        `toml:"bulk_fail_percent"`
+	PopDelayPercent float64        `toml:"pop_delay_percent"`
+	PopDelay        configDuration `toml:"pop_delay"`
+	CorruptPercent  float64        `toml:"corrupt_percent"`
+}
+
+type SketchConfig struct {
+	Match       []string       `toml:"match"`
+	Interval    configDuration `toml:"interval"`
+	Accuracy    float64        `toml:"accuracy"`
+	Percentiles []float64      `toml:"percentiles"`
+	DropRaw     bool           `toml:"drop_raw"`
+	MaxSeries   int            `toml:"max_series"`
+}
+
+type LastConfig struct {
+	MaxSeries int         `toml:"max_series"`
+	Series    []TTLConfig `toml:"series"`
+}
 
 type configDuration struct {
 	time.Duration
@@ -63,6 +463,19 @@ func (d *configDuration) UnmarshalText(text []byte) error {
 	return err
 }
 
+// Warnings tell about settings trading durability or safety for
+// simplicity, logged at startup and printed by -check
+func (c *Config) Warnings() []string {
+	var warnings []string
+	switch c.Transport.Type {
+	case "direct":
+		warnings = append(warnings, "transport 'direct' buffers nothing: metrics not yet committed to ElasticSearch (up to the writer's bulk queue) are lost on crash or kill, and while ElasticSearch is slow or down the listeners block, pushing back on TCP senders and dropping UDP")
+	case "channel":
+		warnings = append(warnings, fmt.Sprintf("transport 'channel' buffers up to %d metrics in memory, lost on crash or kill", c.Transport.BufferSize))
+	}
+	return warnings
+}
+
 // ReadConfig
 //
 func ReadConfig(configfile *string) Config {
@@ -72,10 +485,151 @@ func ReadConfig(configfile *string) Config {
 	}
 
 	var config Config
-	if _, err := toml.DecodeFile(*configfile, &config); err != nil {
+	if err := readConfigFile(*configfile, &config, 0); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
 	return config
 }
+
+const maxConfigIncludeDepth = 8
+
+var configEnvRe = regexp.MustCompile(`\$\{([a-zA-Z_][a-zA-Z0-9_]*)(:-([^}]*))?\}`)
+
+// readConfigFile decodes TOML, YAML or JSON file (by extension) on top of
+// the already read config, then the files it includes. Include patterns
+// are globs relative to the including file and get loaded in sorted order.
+func readConfigFile(path string, config *Config, depth int) error {
+	if depth > maxConfigIncludeDepth {
+		return fmt.Errorf("%s: includes nested too deep", path)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	data = interpolateEnv(data)
+
+	// YAML & JSON go through TOML, so the struct needs just the toml tags
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		var tree map[interface{}]interface{}
+		if err := yaml.Unmarshal(data, &tree); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		data, err = configTreeToTOML(tree)
+	case ".json":
+		var tree map[string]interface{}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&tree); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		data, err = configTreeToTOML(tree)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	config.Include = nil
+	if _, err := toml.Decode(string(data), config); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	includes := config.Include
+	config.Include = nil
+	for _, pattern := range includes {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		sort.Strings(files)
+		for _, f := range files {
+			if err := readConfigFile(f, config, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// interpolateEnv replaces ${VAR} and ${VAR:-default} with environment
+// variables; bare $VAR is left alone as regexes in the config need `$`
+func interpolateEnv(data []byte) []byte {
+	return configEnvRe.ReplaceAllFunc(data, func(m []byte) []byte {
+		sub := configEnvRe.FindSubmatch(m)
+		if val, ok := os.LookupEnv(string(sub[1])); ok {
+			return []byte(val)
+		}
+		return sub[3]
+	})
+}
+
+// configTreeToTOML re-encodes decoded YAML/JSON document as TOML
+func configTreeToTOML(tree interface{}) ([]byte, error) {
+	normalized, err := normalizeConfigTree(tree)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(normalized); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// normalizeConfigTree converts YAML maps to string-keyed ones and JSON
+// numbers to int64/float64
+func normalizeConfigTree(v interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("non-string key %v", k)
+			}
+			n, err := normalizeConfigTree(item)
+			if err != nil {
+				return nil, err
+			}
+			out[key] = n
+		}
+		return out, nil
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for key, item := range val {
+			n, err := normalizeConfigTree(item)
+			if err != nil {
+				return nil, err
+			}
+			out[key] = n
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			n, err := normalizeConfigTree(item)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = n
+		}
+		return out, nil
+	case json.Number:
+		if i, err := val.Int64(); err == nil {
+			return i, nil
+		}
+		return val.Float64()
+	case int:
+		return int64(val), nil
+	case nil:
+		return nil, errors.New("null values aren't supported")
+	default:
+		return val, nil
+	}
+}
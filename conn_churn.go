@@ -0,0 +1,75 @@
+package metcap
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ConnChurn counts connections per sending host and minute to find agents
+// opening a connection per metric instead of keeping one open. Hosts over
+// the limit are logged once a minute and, with the "reject" policy, their
+// connections over the limit are closed right away.
+type ConnChurn struct {
+	*sync.Mutex
+	limit  int
+	reject bool
+	window time.Time
+	counts map[string]int
+	last   map[string]int
+}
+
+func NewConnChurn(c ListenerConfig) (*ConnChurn, error) {
+	if c.ChurnLimit <= 0 {
+		return nil, nil
+	}
+	if c.ChurnPolicy != "" && c.ChurnPolicy != "log" && c.ChurnPolicy != "reject" {
+		return nil, fmt.Errorf("unknown churn policy '%s'", c.ChurnPolicy)
+	}
+	return &ConnChurn{
+		Mutex:  &sync.Mutex{},
+		limit:  c.ChurnLimit,
+		reject: c.ChurnPolicy == "reject",
+		window: time.Now(),
+		counts: make(map[string]int),
+		last:   make(map[string]int),
+	}, nil
+}
+
+// Record counts a new connection of the host, returns its connections in
+// the current minute and whether the host is over the limit
+func (c *ConnChurn) Record(host string) (int, bool) {
+	c.Lock()
+	defer c.Unlock()
+	c.roll(time.Now())
+	c.counts[host]++
+	return c.counts[host], c.counts[host] > c.limit
+}
+
+// Churners returns connections per minute of the hosts over the limit in
+// the last complete minute
+func (c *ConnChurn) Churners() map[string]int {
+	c.Lock()
+	defer c.Unlock()
+	c.roll(time.Now())
+	churners := make(map[string]int)
+	for host, n := range c.last {
+		if n > c.limit {
+			churners[host] = n
+		}
+	}
+	return churners
+}
+
+// roll starts a new minute once the current one is over, the last one is
+// empty if no connection came in it; call with the lock held
+func (c *ConnChurn) roll(now time.Time) {
+	elapsed := now.Sub(c.window)
+	if elapsed < time.Minute {
+		return
+	}
+	if elapsed >= 2*time.Minute {
+		c.counts = make(map[string]int)
+	}
+	c.last, c.counts, c.window = c.counts, make(map[string]int), now
+}
@@ -0,0 +1,110 @@
+package metcap
+
+import (
+	"io/ioutil"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// CPU limits of containers (cgroup quotas) aren't visible to the runtime,
+// which sizes GOMAXPROCS and the worker defaults by the CPUs of the whole
+// host; a pod limited to 2 CPUs on a 64 core node then runs 64 threads
+// fighting for its quota and gets throttled. [cpu] sets GOMAXPROCS by the
+// quota (or [gomaxprocs]) and caps the worker counts of the modules.
+// Cpusets (ie. numactl --cpunodebind) are already honored by the runtime.
+
+var (
+	cgroupV2CPUMax  = "/sys/fs/cgroup/cpu.max"
+	cgroupV1CPUDirs = []string{"/sys/fs/cgroup/cpu", "/sys/fs/cgroup/cpu,cpuacct"}
+)
+
+// cgroupCPUQuota returns the CPUs the cgroup's quota allows, 0 when unlimited
+func cgroupCPUQuota() float64 {
+	if data, err := ioutil.ReadFile(cgroupV2CPUMax); err == nil {
+		// "max 100000" or "{quota} {period}"
+		fields := strings.Fields(string(data))
+		if len(fields) == 2 && fields[0] != "max" {
+			return cpuQuotaRatio(fields[0], fields[1])
+		}
+		return 0
+	}
+	for _, dir := range cgroupV1CPUDirs {
+		quota, err := ioutil.ReadFile(dir + "/cpu.cfs_quota_us")
+		if err != nil {
+			continue
+		}
+		period, err := ioutil.ReadFile(dir + "/cpu.cfs_period_us")
+		if err != nil {
+			continue
+		}
+		return cpuQuotaRatio(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+	}
+	return 0
+}
+
+func cpuQuotaRatio(quota, period string) float64 {
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil || q <= 0 { // -1 in cgroup v1 is unlimited
+		return 0
+	}
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0
+	}
+	return q / p
+}
+
+// SetMaxProcs sets GOMAXPROCS by [gomaxprocs], or the cgroup quota rounded
+// up, returns the value and where it comes from
+func (c CPUConfig) SetMaxProcs() (int, string) {
+	procs, source := runtime.NumCPU(), "CPUs available"
+	if c.GoMaxProcs > 0 {
+		procs, source = c.GoMaxProcs, "config"
+	} else if quota := cgroupCPUQuota(); quota > 0 {
+		if n := int(math.Ceil(quota)); n < procs {
+			procs, source = n, "cgroup quota "+strconv.FormatFloat(quota, 'f', -1, 64)
+		}
+	}
+	runtime.GOMAXPROCS(procs)
+	return procs, source
+}
+
+// defaultWorkers is the worker count of modules sized by CPUs, following
+// GOMAXPROCS rather than the host's CPUs
+func defaultWorkers() int {
+	return runtime.GOMAXPROCS(0)
+}
+
+func capWorkers(n, max int) int {
+	if max > 0 && n > max {
+		return max
+	}
+	return n
+}
+
+// limitListener caps the listener's workers, defaults included
+func (c CPUConfig) limitListener(l ListenerConfig) ListenerConfig {
+	if c.MaxCodecWorkers > 0 {
+		if l.CodecWorkers <= 0 {
+			l.CodecWorkers = defaultWorkers()
+		}
+		l.CodecWorkers = capWorkers(l.CodecWorkers, c.MaxCodecWorkers)
+	}
+	if c.MaxAcceptLoops > 0 {
+		if l.AcceptLoops <= 0 {
+			l.AcceptLoops = defaultWorkers()
+		}
+		l.AcceptLoops = capWorkers(l.AcceptLoops, c.MaxAcceptLoops)
+	}
+	l.Decoders = capWorkers(l.Decoders, c.MaxDecoders)
+	return l
+}
+
+// limitWriter caps the writer's bulk processors and their workers
+func (c CPUConfig) limitWriter(w WriterConfig) WriterConfig {
+	w.Concurrency = capWorkers(w.Concurrency, c.MaxWriterWorkers)
+	w.IndexConcurrency = capWorkers(w.IndexConcurrency, c.MaxWriterWorkers)
+	return w
+}
@@ -0,0 +1,53 @@
+package metcap
+
+import (
+	"errors"
+	"net"
+
+	"github.com/google/gops/agent"
+)
+
+// Diagnostics runs the gops agent, so operators can take goroutine dumps,
+// heap profiles, GC traces and such from running daemons with the gops
+// tool (`gops stack {pid}`, `gops memstats {pid}`, `gops trace {pid}`)
+// without exposing a pprof port. The agent listens on [gops_addr] (default
+// "127.0.0.1:0", any local port, found by gops through the pid file in
+// [gops_config_dir]). It has no authentication, so addresses other than
+// loopback ones are refused.
+type Diagnostics struct {
+	Addr string
+}
+
+var errGopsExposed = errors.New("gops agent can't listen on a non-loopback address, anyone reaching it could dump the process")
+
+func NewDiagnostics(c *DiagnosticsConfig, logger *Logger) (*Diagnostics, error) {
+	if !c.Gops {
+		return nil, nil
+	}
+	d := &Diagnostics{Addr: c.GopsAddr}
+	if d.Addr == "" {
+		d.Addr = "127.0.0.1:0"
+	}
+	host, _, err := net.SplitHostPort(d.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, errGopsExposed
+	}
+	err = agent.Listen(agent.Options{
+		Addr:            d.Addr,
+		ConfigDir:       c.GopsConfigDir,
+		ShutdownCleanup: false, // the engine handles signals, see Close
+	})
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("[diagnostics] gops agent listening on %s", d.Addr)
+	return d, nil
+}
+
+// Close stops the agent and removes its pid file
+func (d *Diagnostics) Close() {
+	agent.Close()
+}
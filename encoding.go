@@ -0,0 +1,164 @@
+package metcap
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+// Transcoder turns the input of legacy senders into valid UTF-8 before it's
+// decoded. Lines which aren't valid UTF-8 are read as [encoding] ("latin1"
+// or "windows-1252") if set; [sanitize] then either replaces what's still
+// invalid with U+FFFD ("replace") or makes the lines plain ASCII ("ascii"),
+// transliterating accented letters (é → e, ß → ss) and replacing anything
+// else with "_", so they pass the ASCII-only path patterns of the codecs.
+type Transcoder struct {
+	charmap    *[128]rune // runes of bytes 0x80-0xff, nil for UTF-8
+	sanitize   string
+	Transcoded *StatsCounter
+	Sanitized  *StatsCounter
+}
+
+func NewTranscoder(c ListenerConfig) (*Transcoder, error) {
+	t := &Transcoder{
+		sanitize:   c.Sanitize,
+		Transcoded: NewStatsCounter(time.Now()),
+		Sanitized:  NewStatsCounter(time.Now()),
+	}
+	switch c.Encoding {
+	case "", "utf-8", "utf8":
+	case "latin1", "iso-8859-1":
+		t.charmap = &latin1Runes
+	case "windows-1252", "cp1252":
+		t.charmap = &windows1252Runes
+	default:
+		return nil, fmt.Errorf("unknown encoding '%s'", c.Encoding)
+	}
+	switch c.Sanitize {
+	case "", "replace", "ascii":
+	default:
+		return nil, fmt.Errorf("unknown sanitize mode '%s'", c.Sanitize)
+	}
+	if t.charmap == nil && t.sanitize == "" {
+		return nil, nil
+	}
+	return t, nil
+}
+
+// Transcode returns the input with every line transcoded and sanitized,
+// input needing neither is returned as it is
+func (t *Transcoder) Transcode(in []byte) []byte {
+	if t.clean(in) {
+		return in
+	}
+	out := make([]byte, 0, len(in)+len(in)/8)
+	for len(in) > 0 {
+		end := bytes.IndexByte(in, '\n')
+		if end < 0 {
+			end = len(in)
+		} else {
+			end++
+		}
+		out = t.line(out, in[:end])
+		in = in[end:]
+	}
+	return out
+}
+
+func (t *Transcoder) clean(b []byte) bool {
+	if t.sanitize == "ascii" {
+		for _, c := range b {
+			if c >= utf8.RuneSelf {
+				return false
+			}
+		}
+		return true
+	}
+	return utf8.Valid(b)
+}
+
+// line appends the transcoded line to out
+func (t *Transcoder) line(out, line []byte) []byte {
+	if t.clean(line) {
+		return append(out, line...)
+	}
+	if t.charmap != nil && !utf8.Valid(line) {
+		t.Transcoded.Increment(1)
+		var buf [utf8.UTFMax]byte
+		transcoded := make([]byte, 0, len(line)*2)
+		for _, c := range line {
+			if c < utf8.RuneSelf {
+				transcoded = append(transcoded, c)
+				continue
+			}
+			n := utf8.EncodeRune(buf[:], t.charmap[c-0x80])
+			transcoded = append(transcoded, buf[:n]...)
+		}
+		line = transcoded
+	}
+	switch t.sanitize {
+	case "ascii":
+		t.Sanitized.Increment(1)
+		for len(line) > 0 {
+			r, n := utf8.DecodeRune(line)
+			line = line[n:]
+			switch {
+			case r < utf8.RuneSelf:
+				out = append(out, byte(r))
+			case asciiTransliterations[r] != "":
+				out = append(out, asciiTransliterations[r]...)
+			default:
+				out = append(out, '_')
+			}
+		}
+		return out
+	case "replace":
+		if utf8.Valid(line) {
+			return append(out, line...)
+		}
+		t.Sanitized.Increment(1)
+		for len(line) > 0 {
+			r, n := utf8.DecodeRune(line)
+			line = line[n:]
+			out = append(out, string(r)...) // RuneError for invalid bytes
+		}
+		return out
+	}
+	return append(out, line...)
+}
+
+var latin1Runes = func() (m [128]rune) {
+	for i := range m {
+		m[i] = rune(0x80 + i)
+	}
+	return
+}()
+
+// windows-1252 is latin1 with printable characters in place of the C1
+// controls, undefined bytes are kept as the controls
+var windows1252Runes = func() (m [128]rune) {
+	m = latin1Runes
+	for i, r := range []rune{
+		'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8d, 'Ž', 0x8f,
+		0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9d, 'ž', 'Ÿ',
+	} {
+		m[i] = r
+	}
+	return
+}()
+
+var asciiTransliterations = map[rune]string{
+	'À': "A", 'Á': "A", 'Â': "A", 'Ã': "A", 'Ä': "A", 'Å': "A", 'Æ': "AE", 'Ç': "C",
+	'È': "E", 'É': "E", 'Ê': "E", 'Ë': "E", 'Ì': "I", 'Í': "I", 'Î': "I", 'Ï': "I",
+	'Ð': "D", 'Ñ': "N", 'Ò': "O", 'Ó': "O", 'Ô': "O", 'Õ': "O", 'Ö': "O", 'Ø': "O",
+	'Ù': "U", 'Ú': "U", 'Û': "U", 'Ü': "U", 'Ý': "Y", 'Þ': "TH", 'ß': "ss",
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'æ': "ae", 'ç': "c",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ì': "i", 'í': "i", 'î': "i", 'ï': "i",
+	'ð': "d", 'ñ': "n", 'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ý': "y", 'þ': "th", 'ÿ': "y",
+	'Š': "S", 'š': "s", 'Ž': "Z", 'ž': "z", 'Œ': "OE", 'œ': "oe", 'Ÿ': "Y",
+	'Č': "C", 'č': "c", 'Ř': "R", 'ř': "r", 'Ě': "E", 'ě': "e", 'Ů': "U", 'ů': "u",
+	'Ť': "T", 'ť': "t", 'Ď': "D", 'ď': "d", 'Ň': "N", 'ň': "n", 'Ľ': "L", 'ľ': "l",
+	'Ł': "L", 'ł': "l", 'Ő': "O", 'ő': "o", 'Ű': "U", 'ű': "u",
+}
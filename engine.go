@@ -1,8 +1,10 @@
 package metcap
 
 import (
+	"io/ioutil"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
@@ -33,92 +35,339 @@ func (e *Engine) Run() {
 		syscall.SIGTERM,
 		syscall.SIGUSR1,
 		syscall.SIGUSR2,
+		syscall.SIGHUP,
 	}
-	signal.Notify(e.SignalChan, signals...)
-
 	logger := NewLogger(&e.Config.Syslog, debugFlag)
 	go logger.Run()
 
-	logger.Info("[engine] Starting...")
+	logger.Info("[engine] Starting %s...", GetBuildInfo())
+	for _, warning := range e.Config.Warnings() {
+		logger.Info("[engine] Warning: %s", warning)
+	}
+	procs, procsSource := e.Config.CPU.SetMaxProcs()
+	logger.Info("[engine] Using %d CPUs (%s)", procs, procsSource)
+	chaos, err := NewChaos(&e.Config.Chaos, logger)
+	if err != nil {
+		logger.Alert("[engine] Failed to initialize fault injection: %v", err)
+		e.ExitCode <- 1
+		return
+	}
+	// not worth refusing to start over, ie. fixed port still taken by the
+	// process being upgraded, unless it'd be exposed
+	diagnostics, err := NewDiagnostics(&e.Config.Diagnostics, logger)
+	if err == errGopsExposed {
+		logger.Alert("[engine] Failed to start diagnostics agent on %s: %v", e.Config.Diagnostics.GopsAddr, err)
+		e.ExitCode <- 1
+		return
+	}
+	if err != nil {
+		logger.Error("[engine] Failed to start diagnostics agent: %v", err)
+	}
 
 	var listenerEnabled, writerEnabled bool = false, false
 	var transport Transport
-	var listeners []*Listener
 	var writers []*Writer
 
-	if e.Config.Writer.URLs != nil {
-		writerEnabled = true
+	if e.Config.Writer.URLs != nil || e.Config.Export.Enabled {
+		writerEnabled = true // transport has got consumers
 	}
 	if len(e.Config.Listener) > 0 {
 		listenerEnabled = true
 	}
 
 	// initialize transport
-	logger.Info("[engine] Using '%s' transport", e.Config.Transport.Type)
-	var err error
-	switch e.Config.Transport.Type {
-	case "channel":
-		if listenerEnabled == false || writerEnabled == false {
-			logger.Alert("[engine] Channel transport requires you to have both listener and writer enabled!")
+	if len(e.Config.Pipeline) == 0 {
+		logger.Info("[engine] Using '%s' transport", e.Config.Transport.Type)
+		transport, err = NewTransport(&e.Config.Transport, listenerEnabled, writerEnabled, exitFlag, logger)
+		if err != nil {
+			logger.Alert("[engine] Failed to set-up transport: %v", err)
 			e.ExitCode <- 1
 			return
 		}
-		transport = NewChannelTransport(&e.Config.Transport, logger)
-	case "redis":
-		transport, err = NewRedisTransport(&e.Config.Transport, listenerEnabled, writerEnabled, exitFlag, logger)
-	case "amqp":
-		transport, err = NewAMQPTransport(&e.Config.Transport, listenerEnabled, writerEnabled, exitFlag, logger)
-	default:
-		logger.Alert("[engine] Transport '%s' not implemented", e.Config.Transport.Type)
-		e.ExitCode <- 1
-		return
 	}
+
+	var admin *Admin
+	if e.Config.Admin.Listen != "" {
+		admin = NewAdmin(&e.Config.Admin, logger)
+	}
+
+	state, err := NewOpState(&e.Config.State, logger)
 	if err != nil {
-		logger.Alert("[engine] Failed to set-up transport: %v", err)
+		logger.Alert("[engine] Failed to restore state: %v", err)
 		e.ExitCode <- 1
 		return
 	}
+	if admin != nil {
+		state.Register(admin)
+		admin.HandleJSON("/version", func() interface{} {
+			return GetBuildInfo()
+		})
+	}
+
+	// explicit pipelines replace the implicit listeners -> transport -> writer
+	var pipelines []*Pipeline
+	inputs := make(map[string]*Pipeline)
+	for pName, pc := range e.Config.Pipeline {
+		pc := pc
+		pipeline, err := NewPipeline(pName, &pc, e.Config.Transport, e.Config.Processor, e.Config.Listener, e.Config.Output, exitFlag, logger)
+		if err != nil {
+			logger.Alert("[engine] Failed to set-up pipeline: %v", err)
+			e.ExitCode <- 1
+			return
+		}
+		for _, input := range pc.Inputs {
+			if other, ok := inputs[input]; ok {
+				logger.Alert("[engine] Listener '%s' is input of both '%s' and '%s' pipelines", input, other.Name, pName)
+				e.ExitCode <- 1
+				return
+			}
+			inputs[input] = pipeline
+		}
+		for i, oName := range pipeline.OutputNames {
+			oc := e.Config.CPU.limitWriter(e.Config.Output[oName])
+			writer, err := NewWriter(&oc, pipeline.Outputs[i], chaos, e.Workers, logger, exitFlag)
+			if err != nil {
+				logger.Alert("[engine] Failed to initialize output '%s' of pipeline '%s'. Exiting", oName, pName)
+				e.ExitCode <- 1
+				return
+			}
+			writer.State = state
+			writers = append(writers, &writer)
+			go writer.Start()
+		}
+		pipelines = append(pipelines, pipeline)
+	}
 
 	// initialize & start writer
-	if writerEnabled {
-		writer, err := NewWriter(&e.Config.Writer, transport, e.Workers, logger, exitFlag)
+	if transport != nil && e.Config.Writer.URLs != nil {
+		e.Config.Writer = e.Config.CPU.limitWriter(e.Config.Writer)
+		writer, err := NewWriter(&e.Config.Writer, transport, chaos, e.Workers, logger, exitFlag)
 		if err != nil {
 			logger.Alert("[engine] Failed to initialize writer. Exiting")
 			e.ExitCode <- 1
 			return
 		}
+		writer.State = state
+		if e.Config.Aggregator.Interval.Duration > 0 {
+			writer.Aggregator, err = NewAggregator(&e.Config.Aggregator, logger)
+			if err != nil {
+				logger.Alert("[engine] Failed to initialize aggregator: %v", err)
+				e.ExitCode <- 1
+				return
+			}
+			logger.Info("[engine] Aggregating metrics every %v", e.Config.Aggregator.Interval.Duration)
+		}
+		writer.Hold, err = NewSampleHold(&e.Config.Hold, logger)
+		if err != nil {
+			logger.Alert("[engine] Failed to initialize sample-and-hold: %v", err)
+			e.ExitCode <- 1
+			return
+		}
+		writer.Sketch, err = NewSketcher(&e.Config.Sketch, logger)
+		if err != nil {
+			logger.Alert("[engine] Failed to initialize sketches: %v", err)
+			e.ExitCode <- 1
+			return
+		}
+		writer.Last, err = NewLastValues(&e.Config.Last)
+		if err != nil {
+			logger.Alert("[engine] Failed to initialize last values: %v", err)
+			e.ExitCode <- 1
+			return
+		}
+		if writer.Last != nil {
+			if admin == nil {
+				logger.Alert("[engine] Last values require the admin API to be enabled!")
+				e.ExitCode <- 1
+				return
+			}
+			writer.Last.Register(admin)
+		}
+		if e.Config.Render.Enabled {
+			if admin == nil {
+				logger.Alert("[engine] Render API requires the admin API to be enabled!")
+				e.ExitCode <- 1
+				return
+			}
+			NewRender(&e.Config.Render, &writer, logger).Register(admin)
+		}
+		if e.Config.Writer.Events.Annotations {
+			if admin == nil || e.Config.Admin.Token == "" {
+				logger.Alert("[engine] Annotations require the admin API enabled with a token!")
+				e.ExitCode <- 1
+				return
+			}
+			NewAnnotations(&writer, logger).Register(admin)
+		}
 		writers = append(writers, &writer)
 		go writer.Start()
 	}
 
+	// after the writer, so the process can be killed while it's blocked
+	// waiting for ElasticSearch
+	signal.Notify(e.SignalChan, signals...)
+
 	// initialize & start listeners
+	quota, err := NewQuota(e.Config.Quota)
+	if err != nil {
+		logger.Alert("[engine] Invalid quota: %v", err)
+		e.ExitCode <- 1
+		return
+	}
+	tenantQuotas, err := NewTenantQuotas(e.Config.Quota, logger)
+	if err != nil {
+		logger.Alert("[engine] Invalid tenant quota: %v", err)
+		e.ExitCode <- 1
+		return
+	}
+	sampler, err := NewSampler(e.Config.Sampling)
+	if err != nil {
+		logger.Alert("[engine] Invalid sampling: %v", err)
+		e.ExitCode <- 1
+		return
+	}
+	if sampler != nil {
+		sampler.State = state
+	}
+	listeners := NewListenerRegistry(&e.Config.Admin, transport, e.Workers, logger, exitFlag, func(listener *Listener) {
+		listener.Global = quota
+		listener.Tenants = tenantQuotas
+		listener.Sampler = sampler
+		listener.State = state
+		listener.Chaos = chaos
+	})
+	listeners.CPU = e.Config.CPU
+	if admin != nil {
+		listeners.Register(admin)
+		if tenantQuotas != nil {
+			tenantQuotas.Register(admin)
+		}
+	}
 	if listenerEnabled {
 		for lName, cfg := range e.Config.Listener {
-			listener, err := NewListener(lName, cfg, transport, e.Workers, logger, exitFlag)
+			lTransport, pipeline := transport, inputs[lName]
+			if transport == nil {
+				if pipeline == nil {
+					logger.Error("[engine] Listener '%s' isn't input of any pipeline, skipping", lName)
+					continue
+				}
+				lTransport = pipeline.Transport
+			}
+			listener, err := NewListener(lName, e.Config.CPU.limitListener(cfg), lTransport, e.Workers, logger, exitFlag)
 			if err != nil {
 				logger.Alert("[engine] Failed to initialize listener '%s'", lName)
 				continue
 			}
-			listeners = append(listeners, &listener)
+			listener.Pipeline = pipeline
+			listeners.setup(&listener)
+			listeners.Add(&listener)
 			go listener.Start()
 		}
 	}
 
+	var exporter *Exporter
+	if e.Config.Export.Enabled {
+		if transport == nil {
+			logger.Alert("[engine] Export isn't supported with pipelines!")
+			e.ExitCode <- 1
+			return
+		}
+		if admin == nil {
+			logger.Alert("[engine] Export requires the admin API to be enabled!")
+			e.ExitCode <- 1
+			return
+		}
+		exporter = NewExporter(&e.Config.Export, transport, logger)
+		exporter.Register(admin)
+		e.Workers.Add(1)
+		go func() {
+			defer e.Workers.Done()
+			exporter.Run(exitFlag)
+		}()
+	}
+
+	if admin != nil {
+		if err := admin.Start(); err != nil {
+			e.ExitCode <- 1
+			return
+		}
+	}
+
 	// start transport
-	transport.Start()
+	selfTransport := transport
+	if transport != nil {
+		transport.Start()
+	}
+	for _, pipeline := range pipelines {
+		pipeline.Start()
+		if pipeline.Name == e.Config.Self.Pipeline {
+			selfTransport = pipeline.Transport
+		}
+	}
+
+	var self *SelfReporter
+	if e.Config.Self.Interval.Duration > 0 {
+		if selfTransport == nil {
+			logger.Error("[engine] Own metrics need [self] pipeline set to one of the pipelines!")
+		} else if listenerEnabled {
+			self = NewSelfReporter(&e.Config.Self, selfTransport, logger)
+			self.Add(buildInfoSelfSource())
+			self.Add(runtimeSelfSource())
+			if transport != nil {
+				self.Add(transportSelfSource(transport))
+			}
+			for _, pipeline := range pipelines {
+				self.Add(pipeline.SelfSource())
+			}
+			self.Add(listeners.SelfSource())
+			for _, writer := range writers {
+				self.Add(writer.SelfSource())
+			}
+			if tenantQuotas != nil {
+				self.Add(tenantQuotas.SelfSource())
+			}
+			if chaos != nil {
+				self.Add(chaos.SelfSource())
+			}
+			e.Workers.Add(1)
+			go func() {
+				defer e.Workers.Done()
+				self.Run(exitFlag)
+			}()
+		} else {
+			logger.Error("[engine] Own metrics are published through the transport, which requires a listener enabled!")
+		}
+	}
 
 	stopReporter := make(chan struct{}, 1)
 	// stats report goroutine
 	go func() {
 		// report func
 		report := func() {
-			for _, listener := range listeners {
+			for _, listener := range listeners.List() {
 				listener.LogReport()
 			}
-			transport.LogReport()
+			if transport != nil {
+				transport.LogReport()
+			}
+			for _, pipeline := range pipelines {
+				pipeline.LogReport()
+			}
 			for _, writer := range writers {
 				writer.LogReport()
 			}
+			if exporter != nil {
+				exporter.LogReport()
+			}
+			if tenantQuotas != nil {
+				tenantQuotas.LogReport()
+			}
+			if chaos != nil {
+				chaos.LogReport()
+			}
+			if self != nil {
+				self.LogReport()
+			}
 		}
 		// sleepTime between reports
 		var sleepTime time.Duration
@@ -150,6 +399,45 @@ func (e *Engine) Run() {
 		}
 	}()
 
+	if e.Config.Upgrade.Timeout.Duration <= 0 {
+		e.Config.Upgrade.Timeout.Duration = 30 * time.Second
+	}
+	notifyReady(logger)
+	if e.Config.Upgrade.PidFile != "" {
+		if err := ioutil.WriteFile(e.Config.Upgrade.PidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+			logger.Error("[engine] Failed to write pid file: %v", err)
+		}
+	}
+
+	shutdown := func() {
+		exitFlag.Raise()
+
+		e.Workers.Wait()
+		if admin != nil {
+			admin.Stop()
+		}
+
+		logger.Debug("[engine] Waiting for transport to terminate")
+		if transport != nil {
+			transport.Stop()
+		}
+		for _, pipeline := range pipelines {
+			pipeline.Transport.Stop()
+		}
+
+		stopReporter <- struct{}{}
+		time.Sleep(100 * time.Millisecond)
+		<-stopReporter
+
+		if diagnostics != nil {
+			diagnostics.Close()
+		}
+
+		logger.Info("[engine] Exiting...")
+		time.Sleep(100 * time.Millisecond)
+		e.ExitCode <- 0
+	}
+
 	// signal handler
 	for {
 		sig := <-e.SignalChan
@@ -160,22 +448,40 @@ func (e *Engine) Run() {
 			} else {
 				logger.Info("[engine] Received SIGTERM - shutting down")
 			}
-			exitFlag.Raise()
-
-			e.Workers.Wait()
-
-			logger.Debug("[engine] Waiting for transport to terminate")
-			transport.Stop()
-
-			stopReporter <- struct{}{}
-			time.Sleep(100 * time.Millisecond)
-			<-stopReporter
-
-			logger.Info("[engine] Exiting...")
-			time.Sleep(100 * time.Millisecond)
-			e.ExitCode <- 0
+			shutdown()
 			return
 
+		case sig == syscall.SIGHUP:
+			logger.Info("[engine] Received SIGHUP - handing sockets over to a new process")
+			var sockets []HandoffSocket
+			var err error
+			for _, listener := range listeners.List() {
+				var s []HandoffSocket
+				if s, err = listener.HandoffSockets(); err != nil {
+					break
+				}
+				sockets = append(sockets, s...)
+			}
+			if err == nil && admin != nil {
+				var s []HandoffSocket
+				if s, err = admin.HandoffSockets(); err == nil {
+					sockets = append(sockets, s...)
+				}
+			}
+			if err == nil {
+				var pid int
+				if pid, err = Upgrade(sockets, e.Config.Upgrade.Timeout.Duration, logger); err == nil {
+					logger.Info("[engine] Process %d took over, shutting down", pid)
+					shutdown()
+					return
+				}
+			} else {
+				for _, s := range sockets {
+					s.File.Close()
+				}
+			}
+			logger.Error("[engine] Upgrade failed, keeping on: %v", err)
+
 		case sig == syscall.SIGUSR1:
 			if debugFlag.Get() {
 				logger.Info("[engine] Received SIGUSR1 - disabling DEBUG mode")
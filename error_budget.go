@@ -0,0 +1,110 @@
+package metcap
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrorBudget tracks ratio of malformed lines per sending host and bans
+// the hosts exceeding it for a while, protecting the decoders from garbage
+type ErrorBudget struct {
+	*sync.Mutex
+	ratio    float64
+	window   time.Duration
+	minLines int
+	ban      time.Duration
+	sources  map[string]*errorBudgetSource
+}
+
+type errorBudgetSource struct {
+	since       time.Time
+	lines       int
+	errors      int
+	bannedUntil time.Time
+}
+
+func NewErrorBudget(c ListenerConfig) *ErrorBudget {
+	window := c.ErrorWindow.Duration
+	if window == 0 {
+		window = 5 * time.Minute
+	}
+	ban := c.ErrorBan.Duration
+	if ban == 0 {
+		ban = 10 * time.Minute
+	}
+	return &ErrorBudget{
+		Mutex:    &sync.Mutex{},
+		ratio:    c.ErrorBudget,
+		window:   window,
+		minLines: c.ErrorMinLines,
+		ban:      ban,
+		sources:  make(map[string]*errorBudgetSource),
+	}
+}
+
+// Record adds decoding results of a source host, returns true if the host
+// has just exceeded its error budget and got banned
+func (b *ErrorBudget) Record(host string, lines, errors int) bool {
+	b.Lock()
+	defer b.Unlock()
+	now := time.Now()
+	src, ok := b.sources[host]
+	if !ok || now.Sub(src.since) > b.window {
+		src = &errorBudgetSource{since: now, bannedUntil: b.bannedUntil(host)}
+		b.sources[host] = src
+	}
+	src.lines += lines
+	src.errors += errors
+	if src.lines < b.minLines || src.lines == 0 || now.Before(src.bannedUntil) {
+		return false
+	}
+	if float64(src.errors)/float64(src.lines) > b.ratio {
+		src.bannedUntil = now.Add(b.ban)
+		src.since, src.lines, src.errors = now, 0, 0
+		return true
+	}
+	return false
+}
+
+// Banned reports whether the host is banned at the moment
+func (b *ErrorBudget) Banned(host string) bool {
+	b.Lock()
+	defer b.Unlock()
+	return time.Now().Before(b.bannedUntil(host))
+}
+
+// BannedCount returns number of currently banned hosts
+func (b *ErrorBudget) BannedCount() int {
+	b.Lock()
+	defer b.Unlock()
+	now, n := time.Now(), 0
+	for host, src := range b.sources {
+		switch {
+		case now.Before(src.bannedUntil):
+			n++
+		case now.Sub(src.since) > b.window:
+			delete(b.sources, host)
+		}
+	}
+	return n
+}
+
+func (b *ErrorBudget) bannedUntil(host string) time.Time {
+	if src, ok := b.sources[host]; ok {
+		return src.bannedUntil
+	}
+	return time.Time{}
+}
+
+// sourceHost strips port from the remote address
+func sourceHost(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
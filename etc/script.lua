@@ -0,0 +1,17 @@
+-- Runs for every metric with globals:
+--   name      metric name
+--   value     metric value
+--   timestamp Unix seconds (with fractions)
+--   fields    table of field values
+-- Changes made to them are kept, drop() drops the metric.
+-- Only base, string, math and table libraries are available.
+
+if fields.env == "dev" and value == 0 then
+  drop()
+end
+
+-- ie. convert bytes to megabytes
+if string.find(name, "_bytes$") then
+  name = string.gsub(name, "_bytes$", "_mb")
+  value = value / 1048576
+end
@@ -0,0 +1,111 @@
+package metcap
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Event is a document marking a series crossing a threshold, or posted as
+// an annotation, meant for Grafana annotations
+type Event struct {
+	Timestamp time.Time         `json:"@timestamp"`
+	Type      string            `json:"type"`
+	Rule      string            `json:"rule"`
+	Name      string            `json:"name"`
+	Value     float64           `json:"value"`
+	Threshold float64           `json:"threshold"`
+	Fields    map[string]string `json:"fields"`
+	Tags      []string          `json:"tags,omitempty"`
+	Text      string            `json:"text"`
+}
+
+func (e *Event) JSON() []byte {
+	out, err := json.Marshal(e)
+	if err != nil {
+		panic(err) // REFACTOR: throw error and do checking
+	}
+	return out
+}
+
+func (e *Event) Index(name string) string {
+	t := e.Timestamp.UTC()
+	return fmt.Sprintf("%s-%d.%02d.%02d", name, t.Year(), int(t.Month()), t.Day())
+}
+
+// EventEvaluator watches series matching the threshold rules and emits an
+// event whenever a series crosses the threshold in either direction
+type EventEvaluator struct {
+	*sync.Mutex
+	rules []eventRule
+	above map[string]bool
+}
+
+type eventRule struct {
+	name      string
+	match     *regexp.Regexp
+	threshold float64
+}
+
+func NewEventEvaluator(c *EventsConfig) (*EventEvaluator, error) {
+	var rules []eventRule
+	for i, t := range c.Thresholds {
+		re, err := regexp.Compile(t.Match)
+		if err != nil {
+			return nil, err
+		}
+		name := t.Name
+		if name == "" {
+			name = fmt.Sprintf("threshold_%d", i)
+		}
+		rules = append(rules, eventRule{name, re, t.Value})
+	}
+	return &EventEvaluator{
+		Mutex: &sync.Mutex{},
+		rules: rules,
+		above: make(map[string]bool),
+	}, nil
+}
+
+// Evaluate returns events for thresholds the metric's series just crossed.
+// The first point of a series only sets its state.
+func (e *EventEvaluator) Evaluate(m *Metric) []*Event {
+	var events []*Event
+	series := ""
+	for _, rule := range e.rules {
+		if !rule.match.MatchString(m.Name) {
+			continue
+		}
+		if series == "" {
+			series = m.SeriesID()
+		}
+		key := rule.name + "|" + series
+		above := m.Value > rule.threshold
+
+		e.Lock()
+		was, known := e.above[key]
+		e.above[key] = above
+		e.Unlock()
+
+		if !known || was == above {
+			continue
+		}
+		ev := &Event{
+			Timestamp: m.Timestamp,
+			Type:      "crossed_below",
+			Rule:      rule.name,
+			Name:      m.Name,
+			Value:     m.Value,
+			Threshold: rule.threshold,
+			Fields:    m.Fields,
+		}
+		if above {
+			ev.Type = "crossed_above"
+		}
+		ev.Text = fmt.Sprintf("%s %s %g (%s)", m.Name, ev.Type, rule.threshold, rule.name)
+		events = append(events, ev)
+	}
+	return events
+}
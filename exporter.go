@@ -0,0 +1,238 @@
+package metcap
+
+import (
+	"bufio"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Exporter lets pull-based consumers take batches of metrics off the
+// transport over the admin API. A batch stays pending until it's acked,
+// unacked batches go back to the transport after [ack_timeout]: nacked to
+// redis_stream, pushed back to the head of the redis queue, otherwise held
+// for the next exports. The transport's input side isn't used, it doesn't
+// run on export-only nodes.
+type Exporter struct {
+	Config    *ExportConfig
+	Transport Transport
+	Logger    *Logger
+	Stats     *ExporterStats
+
+	lastID  uint64
+	pending map[string]*exportBatch
+	held    []*Metric
+	mux     *sync.Mutex
+}
+
+// requeuer puts metrics back to the buffer itself
+type requeuer interface {
+	Requeue(metrics []*Metric) error
+}
+
+type exportBatch struct {
+	metrics []*Metric
+	expires time.Time
+}
+
+func NewExporter(c *ExportConfig, t Transport, logger *Logger) *Exporter {
+	if c.MaxBatch <= 0 {
+		c.MaxBatch = 10000
+	}
+	if c.AckTimeout.Duration <= 0 {
+		c.AckTimeout.Duration = 30 * time.Second
+	}
+	if c.Wait.Duration <= 0 {
+		c.Wait.Duration = time.Second
+	}
+	return &Exporter{
+		Config:    c,
+		Transport: t,
+		Logger:    logger,
+		Stats:     NewExporterStats(),
+		pending:   make(map[string]*exportBatch),
+		mux:       &sync.Mutex{},
+	}
+}
+
+// Register adds the export endpoints to the admin API
+func (e *Exporter) Register(a *Admin) {
+	a.Handle("/export", e.handleExport)
+	a.Handle("/export/ack", e.handleAck)
+}
+
+// Run requeues expired batches until exitFlag is raised, then all of them
+func (e *Exporter) Run(exitFlag *Flag) {
+	for !exitFlag.Get() {
+		time.Sleep(time.Second)
+		e.requeue(time.Now(), false)
+	}
+	e.requeue(time.Now().Add(e.Config.AckTimeout.Duration), true)
+}
+
+// handleExport: POST /export?max=N returns up to N metrics as NDJSON with
+// the batch id in X-Export-Batch header, or 204 if nothing arrived in [wait]
+func (e *Exporter) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	max := e.Config.MaxBatch
+	if v := r.URL.Query().Get("max"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid max", http.StatusBadRequest)
+			return
+		}
+		if n < max {
+			max = n
+		}
+	}
+
+	batch := &exportBatch{}
+	e.mux.Lock()
+	n := len(e.held)
+	if n > max {
+		n = max
+	}
+	batch.metrics = append(batch.metrics, e.held[:n]...)
+	e.held = e.held[n:]
+	e.mux.Unlock()
+	timeout := time.After(e.Config.Wait.Duration)
+COLLECT:
+	for len(batch.metrics) < max {
+		select {
+		case m, ok := <-e.Transport.OutputChan():
+			if !ok {
+				break COLLECT
+			}
+			batch.metrics = append(batch.metrics, m)
+		case <-timeout:
+			break COLLECT
+		}
+	}
+	if len(batch.metrics) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	id := strconv.FormatUint(atomic.AddUint64(&e.lastID, 1), 10)
+	batch.expires = time.Now().Add(e.Config.AckTimeout.Duration)
+	e.mux.Lock()
+	e.pending[id] = batch
+	e.mux.Unlock()
+	e.Stats.Exported.Increment(len(batch.metrics))
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Export-Batch", id)
+	w.WriteHeader(http.StatusOK)
+	out := bufio.NewWriter(w)
+	for _, m := range batch.metrics {
+		out.Write(m.JSON())
+		out.WriteByte('\n')
+	}
+	out.Flush()
+}
+
+// handleAck: POST /export/ack?batch=ID commits the batch
+func (e *Exporter) handleAck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Query().Get("batch")
+	e.mux.Lock()
+	batch, ok := e.pending[id]
+	delete(e.pending, id)
+	e.mux.Unlock()
+	if !ok {
+		http.Error(w, "unknown or expired batch", http.StatusNotFound)
+		return
+	}
+	e.Stats.Acked.Increment(len(batch.metrics))
+	if at, ok := e.Transport.(AckedTransport); ok {
+		at.Ack(batch.metrics)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// requeue returns the batches expired by now to the transport, held ones
+// are left for the next exports unless exiting
+func (e *Exporter) requeue(now time.Time, exiting bool) {
+	var expired []*exportBatch
+	e.mux.Lock()
+	for id, batch := range e.pending {
+		if !batch.expires.After(now) {
+			expired = append(expired, batch)
+			delete(e.pending, id)
+		}
+	}
+	e.mux.Unlock()
+	for _, batch := range expired {
+		e.Logger.Error("[export] Batch of %d metrics wasn't acked in time, requeueing", len(batch.metrics))
+		e.Stats.Requeued.Increment(len(batch.metrics))
+		switch t := e.Transport.(type) {
+		case AckedTransport:
+			t.Nack(batch.metrics)
+			continue
+		case requeuer:
+			err := t.Requeue(batch.metrics)
+			if err == nil {
+				continue
+			}
+			e.Logger.Error("[export] Failed to requeue %d metrics, holding them: %v", len(batch.metrics), err)
+		}
+		e.mux.Lock()
+		e.held = append(e.held, batch.metrics...)
+		e.mux.Unlock()
+	}
+	if !exiting {
+		return
+	}
+	e.mux.Lock()
+	held := e.held
+	e.held = nil
+	e.mux.Unlock()
+	lost := 0
+	for _, m := range held {
+		select {
+		case e.Transport.InputChan() <- m:
+		default:
+			lost++
+		}
+	}
+	if lost > 0 {
+		e.Logger.Alert("[export] Lost %d unacked metrics on exit, the transport can't take them back", lost)
+	}
+}
+
+func (e *Exporter) LogReport() {
+	e.mux.Lock()
+	pending, held := len(e.pending), len(e.held)
+	e.mux.Unlock()
+	e.Logger.Info("[export] metrics: %d/%d/%d/%d/%.3f (exported/acked/requeued/held/rate_per_sec), batches: %d (pending)",
+		e.Stats.Exported.Total(),
+		e.Stats.Acked.Total(),
+		e.Stats.Requeued.Total(),
+		held,
+		e.Stats.Exported.Rate(time.Second),
+		pending,
+	)
+}
+
+type ExporterStats struct {
+	Exported *StatsCounter
+	Acked    *StatsCounter
+	Requeued *StatsCounter
+}
+
+func NewExporterStats() *ExporterStats {
+	now := time.Now()
+	return &ExporterStats{
+		Exported: NewStatsCounter(now),
+		Acked:    NewStatsCounter(now),
+		Requeued: NewStatsCounter(now),
+	}
+}
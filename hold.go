@@ -0,0 +1,128 @@
+package metcap
+
+import (
+	"regexp"
+	"sync"
+	"time"
+)
+
+// SampleHold re-emits the last value of gauge series matching [match] every
+// [interval] they don't get a new sample, so last() on dashboards doesn't
+// show gaps while they're quiet. Series silent for [max_age] are taken as
+// gone and no longer held.
+type SampleHold struct {
+	*sync.Mutex
+	Match    []*regexp.Regexp
+	Interval time.Duration
+	MaxAge   time.Duration
+	Logger   *Logger
+	Series   *StatsGauge
+	Emitted  *StatsCounter
+	series   map[string]*heldSeries
+}
+
+type heldSeries struct {
+	metric  *Metric
+	seen    time.Time // last real sample
+	emitted time.Time // last sample or re-emit
+}
+
+func NewSampleHold(c *HoldConfig, logger *Logger) (*SampleHold, error) {
+	if c.Interval.Duration <= 0 || len(c.Match) == 0 {
+		return nil, nil
+	}
+	h := &SampleHold{
+		Mutex:    &sync.Mutex{},
+		Interval: c.Interval.Duration,
+		MaxAge:   c.MaxAge.Duration,
+		Logger:   logger,
+		Series:   NewStatsGauge(),
+		Emitted:  NewStatsCounter(time.Now()),
+		series:   make(map[string]*heldSeries),
+	}
+	if h.MaxAge <= 0 {
+		h.MaxAge = 10 * h.Interval
+	}
+	for _, pattern := range c.Match {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		h.Match = append(h.Match, re)
+	}
+	return h, nil
+}
+
+func (h *SampleHold) matches(name string) bool {
+	for _, re := range h.Match {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Observe keeps the latest sample of every matching series
+func (h *SampleHold) Observe(batch []*Metric) {
+	now := time.Now()
+	h.Lock()
+	defer h.Unlock()
+	for _, m := range batch {
+		if !h.matches(m.Name) {
+			continue
+		}
+		id := m.SeriesID()
+		s, ok := h.series[id]
+		if !ok {
+			s = &heldSeries{}
+			h.series[id] = s
+		}
+		if s.metric == nil || !m.Timestamp.Before(s.metric.Timestamp) {
+			s.metric = m.Copy()
+		}
+		s.seen, s.emitted = now, now
+	}
+	h.Series.Set(int64(len(h.series)))
+}
+
+// Hold re-emits the series quiet for an [interval] and forgets the ones
+// quiet for [max_age], returns the number re-emitted
+func (h *SampleHold) Hold(emit func([]*Metric)) int {
+	now := time.Now()
+	var batch []*Metric
+
+	h.Lock()
+	for id, s := range h.series {
+		switch {
+		case now.Sub(s.seen) >= h.MaxAge:
+			delete(h.series, id)
+		case now.Sub(s.emitted) >= h.Interval:
+			m := s.metric.Copy()
+			m.Timestamp = now
+			batch = append(batch, m)
+			s.emitted = now
+		}
+	}
+	h.Series.Set(int64(len(h.series)))
+	h.Unlock()
+
+	if len(batch) > 0 {
+		h.Emitted.Increment(len(batch))
+		emit(batch)
+	}
+	return len(batch)
+}
+
+// Run holds the series every second until stop is closed
+func (h *SampleHold) Run(emit func([]*Metric), stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Second):
+			if n := h.Hold(emit); n > 0 {
+				h.Logger.Debug("[hold] Re-emitted %d held series", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package metcap
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HostResolver names the sending hosts for [host_field] injection, either by
+// peer IP or its reverse DNS record. DNS answers (failures included) are
+// cached for [host_cache], so a lookup happens once per sender and period.
+type HostResolver struct {
+	lookup bool
+	ttl    time.Duration
+	cache  map[string]hostEntry
+	mux    *sync.Mutex
+}
+
+type hostEntry struct {
+	name    string
+	expires time.Time
+}
+
+func NewHostResolver(c ListenerConfig) *HostResolver {
+	ttl := c.HostCache.Duration
+	if ttl <= 0 {
+		ttl = 10 * time.Minute
+	}
+	return &HostResolver{
+		lookup: c.HostLookup == "dns",
+		ttl:    ttl,
+		cache:  make(map[string]hostEntry),
+		mux:    &sync.Mutex{},
+	}
+}
+
+// Resolve returns the host name of addr, its IP if there's no PTR record
+func (r *HostResolver) Resolve(addr net.Addr) string {
+	ip := sourceHost(addr)
+	if !r.lookup || ip == "" {
+		return ip
+	}
+	now := time.Now()
+	r.mux.Lock()
+	entry, ok := r.cache[ip]
+	r.mux.Unlock()
+	if ok && entry.expires.After(now) {
+		return entry.name
+	}
+
+	name := ip
+	if names, err := net.LookupAddr(ip); err == nil && len(names) > 0 {
+		name = strings.TrimSuffix(names[0], ".")
+	}
+	r.mux.Lock()
+	r.cache[ip] = hostEntry{name, now.Add(r.ttl)}
+	for k, e := range r.cache {
+		if !e.expires.After(now) {
+			delete(r.cache, k)
+		}
+	}
+	r.mux.Unlock()
+	return name
+}
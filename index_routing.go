@@ -0,0 +1,49 @@
+package metcap
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// IndexRule puts metrics with names matching the pattern into indices of
+// the granularity, so low-volume metrics don't each cost a set of shards
+// every day
+type IndexRule struct {
+	match       *regexp.Regexp
+	granularity string
+}
+
+func NewIndexRules(c []IndexRuleConfig) ([]IndexRule, error) {
+	var rules []IndexRule
+	for _, r := range c {
+		switch r.Granularity {
+		case "daily", "monthly", "yearly":
+		default:
+			return nil, fmt.Errorf("unknown index granularity '%s'", r.Granularity)
+		}
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, IndexRule{re, r.Granularity})
+	}
+	return rules, nil
+}
+
+// routeIndex names the metric's index by the first matching rule, daily
+// if none matches
+func routeIndex(rules []IndexRule, m *Metric, name string) string {
+	for _, rule := range rules {
+		if rule.match.MatchString(m.Name) {
+			t := m.Timestamp.UTC()
+			switch rule.granularity {
+			case "monthly":
+				return fmt.Sprintf("%s-%d.%02d", name, t.Year(), int(t.Month()))
+			case "yearly":
+				return fmt.Sprintf("%s-%d", name, t.Year())
+			}
+			return m.Index(name)
+		}
+	}
+	return m.Index(name)
+}
@@ -0,0 +1,77 @@
+package metcap
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Interner shares one copy of repeated strings, ie. field names like host
+// or dc and their common values, instead of every decoded metric holding
+// its own. The strings codecs cut out of the input would otherwise also
+// keep the whole read buffer alive for as long as the metric lives. Only
+// strings up to maxLen bytes are interned; once there are max of them the
+// table starts over, so a burst of unique values can't grow it for good.
+type Interner struct {
+	hits    uint64 // first, 64-bit aligned for atomic
+	misses  uint64
+	strings map[string]string
+	max     int
+	maxLen  int
+	mux     *sync.RWMutex
+}
+
+const (
+	internMax    = 100000
+	internMaxLen = 64
+)
+
+// fieldInterner is shared by codecs and enrichment
+var fieldInterner = NewInterner(internMax, internMaxLen)
+
+func NewInterner(max, maxLen int) *Interner {
+	return &Interner{
+		strings: make(map[string]string),
+		max:     max,
+		maxLen:  maxLen,
+		mux:     &sync.RWMutex{},
+	}
+}
+
+// Intern returns the shared copy of s
+func (in *Interner) Intern(s string) string {
+	if s == "" || len(s) > in.maxLen {
+		return s
+	}
+	in.mux.RLock()
+	shared, ok := in.strings[s]
+	in.mux.RUnlock()
+	if ok {
+		atomic.AddUint64(&in.hits, 1)
+		return shared
+	}
+	atomic.AddUint64(&in.misses, 1)
+	shared = string([]byte(s)) // detach from the input buffer
+	in.mux.Lock()
+	if len(in.strings) >= in.max {
+		in.strings = make(map[string]string)
+	}
+	in.strings[shared] = shared
+	in.mux.Unlock()
+	return shared
+}
+
+// Len is the number of interned strings
+func (in *Interner) Len() int {
+	in.mux.RLock()
+	defer in.mux.RUnlock()
+	return len(in.strings)
+}
+
+// Hits and Misses count the lookups finding and adding the string
+func (in *Interner) Hits() uint64   { return atomic.LoadUint64(&in.hits) }
+func (in *Interner) Misses() uint64 { return atomic.LoadUint64(&in.misses) }
+
+// internField sets the field with interned name and value
+func internField(fields map[string]string, k, v string) {
+	fields[fieldInterner.Intern(k)] = fieldInterner.Intern(v)
+}
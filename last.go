@@ -0,0 +1,208 @@
+package metcap
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LastValues keeps the last value of every series with name matching
+// [match] of a [[last.series]] rule (first one wins) for the rule's [ttl],
+// so health checks can tell a series is fresh through the admin API
+// without querying ElasticSearch. Values are kept as indexed, after writer
+// hooks (script, normalize, anonymize) and aggregation. At most
+// [max_series] (default 100000) series are kept, new ones beyond are
+// skipped until others expire.
+type LastValues struct {
+	*sync.Mutex
+	rules     []TTLRule
+	maxSeries int
+	series    map[string]*lastValue
+	byName    map[string]map[string]*lastValue
+	pruned    time.Time
+	Series    *StatsGauge
+	Skipped   *StatsCounter
+}
+
+type lastValue struct {
+	metric  *Metric
+	expires time.Time
+}
+
+type lastValueJSON struct {
+	Name      string            `json:"name"`
+	Fields    map[string]string `json:"fields,omitempty"`
+	Value     float64           `json:"value"`
+	Timestamp time.Time         `json:"timestamp"`
+	Age       float64           `json:"age"`
+}
+
+func NewLastValues(c *LastConfig) (*LastValues, error) {
+	if len(c.Series) == 0 {
+		return nil, nil
+	}
+	rules, err := NewTTLRules(c.Series)
+	if err != nil {
+		return nil, err
+	}
+	lv := &LastValues{
+		Mutex:     &sync.Mutex{},
+		rules:     rules,
+		maxSeries: c.MaxSeries,
+		series:    make(map[string]*lastValue),
+		byName:    make(map[string]map[string]*lastValue),
+		pruned:    time.Now(),
+		Series:    NewStatsGauge(),
+		Skipped:   NewStatsCounter(time.Now()),
+	}
+	if lv.maxSeries <= 0 {
+		lv.maxSeries = 100000
+	}
+	return lv, nil
+}
+
+func (lv *LastValues) ttl(name string) time.Duration {
+	for _, rule := range lv.rules {
+		if rule.match.MatchString(name) {
+			return rule.ttl
+		}
+	}
+	return 0
+}
+
+// Observe keeps the newest sample of every matching series
+func (lv *LastValues) Observe(batch []*Metric) {
+	now := time.Now()
+	lv.Lock()
+	defer lv.Unlock()
+	if now.Sub(lv.pruned) >= time.Second {
+		lv.prune(now)
+	}
+	skipped := 0
+	for _, m := range batch {
+		ttl := lv.ttl(m.Name)
+		if ttl <= 0 {
+			continue
+		}
+		id := m.SeriesID()
+		v, ok := lv.series[id]
+		if !ok {
+			if len(lv.series) >= lv.maxSeries {
+				skipped++
+				continue
+			}
+			v = &lastValue{}
+			lv.series[id] = v
+			if lv.byName[m.Name] == nil {
+				lv.byName[m.Name] = make(map[string]*lastValue)
+			}
+			lv.byName[m.Name][id] = v
+		}
+		if v.metric == nil || !m.Timestamp.Before(v.metric.Timestamp) {
+			v.metric = m.Copy()
+		}
+		v.expires = now.Add(ttl)
+	}
+	if skipped > 0 {
+		lv.Skipped.Increment(skipped)
+	}
+	lv.Series.Set(int64(len(lv.series)))
+}
+
+// prune forgets the expired series, with the lock held
+func (lv *LastValues) prune(now time.Time) {
+	lv.pruned = now
+	for id, v := range lv.series {
+		if now.After(v.expires) {
+			delete(lv.series, id)
+			if byName := lv.byName[v.metric.Name]; byName != nil {
+				delete(byName, id)
+				if len(byName) == 0 {
+					delete(lv.byName, v.metric.Name)
+				}
+			}
+		}
+	}
+	lv.Series.Set(int64(len(lv.series)))
+}
+
+// Get returns the unexpired series of the name having all the fields,
+// sorted by series
+func (lv *LastValues) Get(name string, fields map[string]string) []*Metric {
+	now := time.Now()
+	lv.Lock()
+	defer lv.Unlock()
+	ids := make([]string, 0, len(lv.byName[name]))
+	for id := range lv.byName[name] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var out []*Metric
+	for _, id := range ids {
+		v := lv.byName[name][id]
+		if now.After(v.expires) || !hasFields(v.metric, fields) {
+			continue
+		}
+		out = append(out, v.metric.Copy())
+	}
+	return out
+}
+
+func hasFields(m *Metric, fields map[string]string) bool {
+	for k, want := range fields {
+		if m.Fields[k] != want {
+			return false
+		}
+	}
+	return true
+}
+
+// Register serves GET /last?name=...; other query parameters filter by
+// fields, ie. /last?name=cpu.load&host=web1. With max_age set (ie. 5m) it
+// answers 503 when the newest matching sample is older, for health checks
+// to just look at the status. Requires the admin [token], values may be
+// personal.
+func (lv *LastValues) Register(a *Admin) {
+	a.HandleAuth("/last", func(w http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		name := q.Get("name")
+		if name == "" {
+			http.Error(w, "missing name", http.StatusBadRequest)
+			return
+		}
+		var maxAge time.Duration
+		if s := q.Get("max_age"); s != "" {
+			var err error
+			if maxAge, err = time.ParseDuration(s); err != nil {
+				http.Error(w, "invalid max_age: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		fields := make(map[string]string)
+		for k := range q {
+			if k != "name" && k != "max_age" {
+				fields[k] = q.Get(k)
+			}
+		}
+		metrics := lv.Get(name, fields)
+		if len(metrics) == 0 {
+			http.Error(w, "no recent samples of '"+name+"'", http.StatusNotFound)
+			return
+		}
+		now := time.Now()
+		out := make([]lastValueJSON, len(metrics))
+		var newest time.Time
+		for i, m := range metrics {
+			out[i] = lastValueJSON{m.Name, m.Fields, m.Value, m.Timestamp, now.Sub(m.Timestamp).Seconds()}
+			if m.Timestamp.After(newest) {
+				newest = m.Timestamp
+			}
+		}
+		status := http.StatusOK
+		if maxAge > 0 && now.Sub(newest) > maxAge {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, out)
+	})
+}
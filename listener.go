@@ -3,25 +3,57 @@ package metcap
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 type Listener struct {
 	Name      string
-	Socket    net.Listener
+	Sockets   []net.Listener
+	Packet    net.PacketConn
+	MQTT      *MQTTSubscriber
 	Config    ListenerConfig
 	ConnWg    sync.WaitGroup
 	DataWg    sync.WaitGroup
 	ModuleWg  *sync.WaitGroup
 	Transport Transport
 	Codec     Codec
+	TLS       *tls.Config
+	Routes    []SNIRoute
+	Rewrites  []RewriteRule
+	Policy    ValuePolicy
+	Quota     *Quota
+	Global    *Quota
+	Tenants   *TenantQuotas
+	Sampler   *Sampler
+	Pipeline  *Pipeline
+	Hosts     *HostResolver
+	Script    *Script
+	Budget    *ErrorBudget
+	Churn     *ConnChurn
+	Arrival   *ArrivalTime
+	HMAC      *HMACVerifier
+	Transcode *Transcoder
+	Chaos     *Chaos
+	Trusted   []*net.IPNet
+	HTTP      []*http.Server
+	State     *OpState
+	ErrLog    *codecErrorSampler
+	ConnSlots chan struct{}
 	Logger    *Logger
 	Stats     *ListenerStats
 	ExitFlag  *Flag
+
+	stopFlag *Flag         // this listener only, see Stop
+	done     chan struct{} // closed once stopped
 }
 
 func NewListener(
@@ -32,68 +64,279 @@ func NewListener(
 	logger *Logger,
 	exitFlag *Flag,
 ) (Listener, error) {
-	logger.Info("[listener:%s] Starting [%s://0.0.0.0:%d/%s]", name, c.Protocol, c.Port, c.Codec)
+	if c.Protocol == "udp" && c.Codec == "influx" && c.Port == 0 {
+		c.Port = 8089 // InfluxDB UDP service default
+	}
+	if c.TenantField == "" {
+		c.TenantField = "tenant"
+	}
 
-	sock, err := net.Listen("tcp", ":"+strconv.Itoa(c.Port))
+	if c.Protocol == "mqtt" {
+		logger.Info("[listener:%s] Starting [%s/%s]", name, c.MQTTBroker, c.Codec)
+	} else {
+		logger.Info("[listener:%s] Starting [%s://0.0.0.0:%d/%s]", name, c.Protocol, c.Port, c.Codec)
+	}
+
+	var (
+		socks  []net.Listener
+		packet net.PacketConn
+		err    error
+	)
+	switch c.Protocol {
+	case "mqtt":
+		// subscribed once everything else is set up
+	case "udp":
+		packet, err = inheritedPacketConn("listener:" + name)
+		if packet != nil {
+			logger.Info("[listener:%s] Took over socket of the previous process", name)
+		} else if err == nil {
+			packet, err = net.ListenPacket("udp", ":"+strconv.Itoa(c.Port))
+		}
+		if err == nil && c.ReadBuffer > 0 {
+			granted, bufErr := setReadBuffer(packet, c.ReadBuffer)
+			if bufErr != nil {
+				logger.Error("[listener:%s] Couldn't set receive buffer size: %v", name, bufErr)
+			} else {
+				logger.Info("[listener:%s] Receive buffer size set to %d bytes (%d requested)", name, granted, c.ReadBuffer)
+			}
+		}
+	default:
+		socks, err = inheritedListeners("listener:" + name)
+		if len(socks) > 0 {
+			logger.Info("[listener:%s] Took over %d sockets of the previous process", name, len(socks))
+		} else if err == nil {
+			socks, err = listenTCP(c)
+		}
+	}
 	if err != nil {
 		logger.Alert("[listener:%s] Couldn't start listener: %v", name, err)
 		return Listener{}, err
 	}
 
-	var codec Codec
+	stats := NewListenerStats()
+	codec, err := newCodec(name, c, stats, logger)
+	if err != nil {
+		logger.Alert("[listener:%s] Failed to initialize codec: %v", name, err)
+		return Listener{}, err
+	}
 
-	switch c.Codec {
-	case "graphite":
-		logger.Debug("[listener:%s] Detected graphite codec, loading mutator config", name)
-		codec, err = NewGraphiteCodec(c.MutatorFile)
-	case "influx":
-		logger.Debug("[listener:%s] Detected influx codec", name)
-		codec, err = NewInfluxCodec()
+	tlsConfig, err := newTLSConfig(c)
+	if err != nil {
+		logger.Alert("[listener:%s] Failed to load TLS certificate: %v", name, err)
+		return Listener{}, err
 	}
+	routes, err := newSNIRoutes(name, c, stats, logger)
 	if err != nil {
-		logger.Alert("[listener:%s] Failed to initialize codec: %v", name, err)
+		logger.Alert("[listener:%s] Invalid SNI route: %v", name, err)
+		return Listener{}, err
+	}
+
+	rewrites, err := NewRewriteRules(c.RewriteFile)
+	if err != nil {
+		logger.Alert("[listener:%s] Failed to load rewrite rules: %v", name, err)
+		return Listener{}, err
+	}
+
+	policy, err := NewValuePolicy(c)
+	if err != nil {
+		logger.Alert("[listener:%s] Invalid value policy: %v", name, err)
+		return Listener{}, err
+	}
+
+	quota, err := NewQuota(c.Quota)
+	if err != nil {
+		logger.Alert("[listener:%s] Invalid quota: %v", name, err)
+		return Listener{}, err
+	}
+
+	var script *Script
+	if c.ScriptFile != "" {
+		script, err = NewScript(c.ScriptFile)
+		if err != nil {
+			logger.Alert("[listener:%s] Failed to load script: %v", name, err)
+			return Listener{}, err
+		}
+	}
+
+	var hosts *HostResolver
+	if c.HostField != "" {
+		hosts = NewHostResolver(c)
+	}
+
+	churn, err := NewConnChurn(c)
+	if err != nil {
+		logger.Alert("[listener:%s] Invalid connection churn limit: %v", name, err)
+		return Listener{}, err
+	}
+
+	arrival, err := NewArrivalTime(c)
+	if err != nil {
+		logger.Alert("[listener:%s] Invalid arrival time rules: %v", name, err)
+		return Listener{}, err
+	}
+
+	verifier, err := NewHMACVerifier(c)
+	if err != nil {
+		logger.Alert("[listener:%s] Invalid HMAC keys: %v", name, err)
+		return Listener{}, err
+	}
+
+	transcoder, err := NewTranscoder(c)
+	if err != nil {
+		logger.Alert("[listener:%s] Invalid input encoding: %v", name, err)
 		return Listener{}, err
 	}
 
+	trusted, err := parseCIDRs(c.TrustedProxies)
+	if err != nil {
+		logger.Alert("[listener:%s] Invalid trusted proxies: %v", name, err)
+		return Listener{}, err
+	}
+
+	var budget *ErrorBudget
+	if c.ErrorBudget > 0 {
+		budget = NewErrorBudget(c)
+	}
+
+	var slots chan struct{}
+	if c.MaxConnections > 0 {
+		slots = make(chan struct{}, c.MaxConnections)
+	}
+
+	var subscriber *MQTTSubscriber
+	if c.Protocol == "mqtt" {
+		subscriber, err = NewMQTTSubscriber(name, c, logger)
+		if err != nil {
+			logger.Alert("[listener:%s] Couldn't connect to MQTT broker: %v", name, err)
+			return Listener{}, err
+		}
+	}
+
 	return Listener{
 		Name:      name,
-		Socket:    sock,
+		Sockets:   socks,
+		Packet:    packet,
+		MQTT:      subscriber,
 		Config:    c,
 		ConnWg:    sync.WaitGroup{},
 		DataWg:    sync.WaitGroup{},
 		ModuleWg:  moduleWg,
 		Transport: t,
 		Codec:     codec,
+		TLS:       tlsConfig,
+		Routes:    routes,
+		Rewrites:  rewrites,
+		Policy:    policy,
+		Quota:     quota,
+		Hosts:     hosts,
+		Script:    script,
+		Budget:    budget,
+		Churn:     churn,
+		Arrival:   arrival,
+		HMAC:      verifier,
+		Transcode: transcoder,
+		Trusted:   trusted,
+		ErrLog:    newCodecErrorSampler(c.CodecErrorRate),
+		ConnSlots: slots,
 		Logger:    logger,
 		ExitFlag:  exitFlag,
-		Stats:     NewListenerStats(),
+		Stats:     stats,
+		stopFlag:  &Flag{new(sync.Mutex), false},
+		done:      make(chan struct{}),
 	}, nil
 }
 
+// newCodec initializes the codec of the listener's [codec]
+func newCodec(name string, c ListenerConfig, stats *ListenerStats, logger *Logger) (Codec, error) {
+	switch c.Conformance {
+	case "", "strict", "lenient", "recover":
+	default:
+		return nil, fmt.Errorf("unknown conformance '%s'", c.Conformance)
+	}
+	switch c.CodecErrorsOverflow {
+	case "", "block", "drop":
+	default:
+		return nil, fmt.Errorf("unknown codec_errors_overflow '%s'", c.CodecErrorsOverflow)
+	}
+	if _, err := parsePrecision(c.Precision); err != nil {
+		return nil, err
+	}
+	o := c.CodecOptions()
+	o.Overflowed = stats.CodecErrorsOverflowed
+	o.Resumed = stats.ReadsResumed
+	switch c.Codec {
+	case "graphite":
+		logger.Debug("[listener:%s] Detected graphite codec, loading mutator config", name)
+		files, err := mutatorRuleFiles(c)
+		if err != nil {
+			return nil, err
+		}
+		codec, err := NewGraphiteCodecFiles(files, c.SplitLines, o)
+		if err != nil {
+			return nil, err
+		}
+		for _, conflict := range codec.Conflicts() {
+			logger.Error("[listener:%s] Mutator %s", name, conflict)
+		}
+		return codec, nil
+	case "influx":
+		logger.Debug("[listener:%s] Detected influx codec", name)
+		return NewInfluxCodec(o)
+	case "exec":
+		logger.Debug("[listener:%s] Detected exec codec, running %v", name, c.ExecCommand)
+		return NewExecCodec(c.ExecCommand, c.ExecTimeout.Duration, o)
+	case "syslog":
+		logger.Debug("[listener:%s] Detected syslog codec, loading extract rules", name)
+		return NewSyslogCodec(c.ExtractFile, o)
+	case "gelf":
+		logger.Debug("[listener:%s] Detected GELF codec, loading extract rules", name)
+		return NewGELFCodec(c.ExtractFile, o)
+	case "json":
+		logger.Debug("[listener:%s] Detected JSON codec", name)
+		return NewJSONCodec(o)
+	case "protobuf":
+		logger.Debug("[listener:%s] Detected protobuf batch codec", name)
+		return NewProtobufBatchCodec(o)
+	}
+	return nil, fmt.Errorf("unknown codec '%s'", c.Codec)
+}
+
 func (l *Listener) Start() {
 	l.ModuleWg.Add(1)
 	defer l.ModuleWg.Done()
+	defer close(l.done)
 
 	l.Logger.Info("[listener:%s] Starting to accept connections", l.Name)
 
 	connPipe := make(chan *net.Conn, 1000)
-	dataPipe := make(chan *bytes.Buffer, 100000)
+	dataPipe := make(chan *connData, 100000)
 	exitMux := make(chan struct{}, 1)
 	exitDecoders := make(chan struct{})
 	exitFinished := make(chan struct{}, 1)
 	decoderWg := sync.WaitGroup{}
 
+	if l.Config.Protocol == "http" {
+		for range l.Sockets {
+			l.HTTP = append(l.HTTP, l.newHTTPServer(&dataPipe))
+		}
+	}
+
 	// connection acceptor
 	go func() {
-		for {
-			conn, err := l.Socket.Accept()
-			if err != nil {
-				l.Logger.Error("[listener:%s] Can't accept connection: %v", l.Name, err)
-				return
+		if l.Packet != nil {
+			l.readPackets(&dataPipe)
+			return
+		}
+		if l.MQTT != nil {
+			l.MQTT.Start(l.receiveMQTT(&dataPipe))
+			return
+		}
+		for i, sock := range l.Sockets {
+			if l.Config.Protocol == "http" {
+				go l.serveHTTP(l.HTTP[i], sock)
+				continue
 			}
-			l.ConnWg.Add(1)
-			l.Stats.ConnOpen.Increment(1)
-			connPipe <- &conn
+			go l.accept(sock, connPipe)
 		}
 	}()
 
@@ -105,7 +348,19 @@ func (l *Listener) Start() {
 				go l.read(*conn, &dataPipe, time.Now())
 			case <-exitMux:
 				l.Logger.Debug("[listener:%s] Closing LISTEN socket", l.Name)
-				l.Socket.Close()
+				if l.Packet != nil {
+					l.Packet.Close()
+				}
+				if l.MQTT != nil {
+					l.MQTT.Stop()
+				}
+				for _, srv := range l.HTTP {
+					// finishes the requests in progress
+					srv.Shutdown(context.Background())
+				}
+				for _, sock := range l.Sockets {
+					sock.Close()
+				}
 				l.Logger.Info("[listener:%s] LISTEN socket closed", l.Name)
 				go func() { // drain connPipe channel
 					for conn := range connPipe {
@@ -159,15 +414,21 @@ func (l *Listener) Start() {
 
 	// update dataPipe statistic
 	go func() {
-		for {
+		for !l.stopFlag.Get() {
 			l.Stats.CodecToProcess.Set(int64(len(dataPipe)))
+			if l.Budget != nil {
+				l.Stats.SourcesBanned.Set(int64(l.Budget.BannedCount()))
+			}
+			if l.Churn != nil {
+				l.Stats.SourcesChurning.Set(int64(len(l.Churn.Churners())))
+			}
 			time.Sleep(1 * time.Second)
 		}
 	}()
 
 	// shutdown handler
 	for {
-		if l.ExitFlag.Get() {
+		if l.ExitFlag.Get() || l.stopFlag.Get() {
 			l.Logger.Info("[listener:%s] Stopping...", l.Name)
 			exitMux <- struct{}{}
 			<-exitFinished
@@ -179,16 +440,174 @@ func (l *Listener) Start() {
 
 }
 
+// Stop stops the listener alone, like on exit, and waits until it's done
+func (l *Listener) Stop() {
+	l.stopFlag.Raise()
+	<-l.done
+}
+
+// Close closes the sockets of a listener which wasn't started
+func (l *Listener) Close() {
+	for _, sock := range l.Sockets {
+		sock.Close()
+	}
+	if l.Packet != nil {
+		l.Packet.Close()
+	}
+	if l.MQTT != nil {
+		l.MQTT.Stop()
+	}
+}
+
+// queueConn waits for a free connection slot, or rejects the connection
+// if the policy says so or the queue is full
+func (l *Listener) queueConn(conn net.Conn, connPipe chan *net.Conn) {
+	if l.Config.ConnectionPolicy != "queue" || l.Stats.ConnQueued.Get() >= int64(l.Config.ConnectionQueue) {
+		l.Stats.ConnRejected.Increment(1)
+		l.Logger.Debug("[listener:%s] Rejecting connection from %s, %d connections open", l.Name, conn.RemoteAddr().String(), l.Config.MaxConnections)
+		conn.Close()
+		l.ConnWg.Done()
+		return
+	}
+	l.Stats.ConnQueued.Increment(1)
+	go func() {
+		l.ConnSlots <- struct{}{}
+		l.Stats.ConnQueued.Decrement(1)
+		l.Stats.ConnOpen.Increment(1)
+		connPipe <- &conn
+	}()
+}
+
 func (l *Listener) LogReport() {
-	l.Logger.Info("[listener:%s] connections: %d/%d/%d/%.3f (open/total/total_failed/rate_per_sec), connection_time: %s/%s (avg/max)",
+	l.Logger.Info("[listener:%s] connections: %d/%d/%d/%d/%d/%.3f (open/total/total_failed/total_timed_out/total_slow/rate_per_sec), connection_time: %s/%s (avg/max), cut: %d (total_bytes)",
 		l.Name,
 		l.Stats.ConnOpen.Get(),
 		l.Stats.ConnProcessed.Total(),
 		l.Stats.ConnFailed.Total(),
+		l.Stats.ConnTimedOut.Total(),
+		l.Stats.ConnSlow.Total(),
 		l.Stats.ConnProcessed.Rate(time.Second),
 		l.Stats.ConnTime.Avg(),
 		l.Stats.ConnTime.Max(),
+		l.Stats.BytesCut.Total(),
 	)
+	if l.Stats.BadValues.Total()+l.Stats.BadTimestamps.Total()+l.Stats.TooLong.Total() > 0 {
+		l.Logger.Info("[listener:%s] policy: %d/%d/%d/%d (bad_values/bad_timestamps/too_long/dropped)",
+			l.Name,
+			l.Stats.BadValues.Total(),
+			l.Stats.BadTimestamps.Total(),
+			l.Stats.TooLong.Total(),
+			l.Stats.PolicyDropped.Total(),
+		)
+	}
+	if l.Stats.CodecFailedMetrics.Total() > 0 {
+		var counts []string
+		for i, c := range l.Stats.CodecErrors {
+			if n := c.Total(); n > 0 {
+				counts = append(counts, fmt.Sprintf("%s=%d", CodecErrorCategory(i), n))
+			}
+		}
+		l.Logger.Info("[listener:%s] codec errors: %s", l.Name, strings.Join(counts, " "))
+	}
+	if n := l.Stats.CodecErrorsOverflowed.Total(); n > 0 {
+		l.Logger.Info("[listener:%s] codec errors overflowed: %d", l.Name, n)
+	}
+	if n := l.Stats.ReadsResumed.Total(); n > 0 {
+		l.Logger.Info("[listener:%s] reads resumed after temporary errors: %d", l.Name, n)
+	}
+	if l.Config.Ack {
+		l.Logger.Info("[listener:%s] acks sent: %d", l.Name, l.Stats.AcksSent.Total())
+	}
+	if l.Script != nil {
+		l.Logger.Info("[listener:%s] script: %d/%d (dropped/failed)",
+			l.Name,
+			l.Script.Dropped.Total(),
+			l.Script.Failed.Total(),
+		)
+	}
+	if l.Arrival != nil {
+		l.Logger.Info("[listener:%s] arrival time: %d/%d (overridden/skewed)",
+			l.Name,
+			l.Arrival.Overridden.Total(),
+			l.Arrival.Skewed.Total(),
+		)
+	}
+	if l.HMAC != nil {
+		l.Logger.Info("[listener:%s] hmac: %d/%d (verified/unsigned_accepted), failed: %s",
+			l.Name,
+			l.HMAC.Verified.Total(),
+			l.HMAC.Unsigned.Total(),
+			l.HMAC.failedString(),
+		)
+	}
+	if l.Transcode != nil {
+		l.Logger.Info("[listener:%s] encoding: %d/%d (transcoded_lines/sanitized_lines)",
+			l.Name,
+			l.Transcode.Transcoded.Total(),
+			l.Transcode.Sanitized.Total(),
+		)
+	}
+	if l.Sampler != nil {
+		l.Logger.Info("[listener:%s] sampled out: %d", l.Name, l.Stats.SampledOut.Total())
+	}
+	if l.Pipeline != nil {
+		l.Logger.Info("[listener:%s] pipeline '%s' dropped: %d", l.Name, l.Pipeline.Name, l.Stats.PipelineDropped.Total())
+	}
+	if l.Quota != nil || l.Global != nil {
+		l.Logger.Info("[listener:%s] quota: %d/%d (dropped/deferred)",
+			l.Name,
+			l.Stats.QuotaDropped.Total(),
+			l.Stats.QuotaDeferred.Total(),
+		)
+	}
+	if l.Packet != nil {
+		if rxQueue, drops, err := udpSocketStats(l.Config.Port); err == nil {
+			l.Stats.UDPRxQueue.Set(rxQueue)
+			l.Stats.UDPKernelDrops.Set(drops)
+		}
+		l.Logger.Info("[listener:%s] udp: %d/%d/%d/%d (datagrams/bytes/read_failed/oversized), kernel: %d/%d (rx_queue/drops), points: %d/%d (received/parse_failed)",
+			l.Name,
+			l.Stats.UDPDatagrams.Total(),
+			l.Stats.UDPBytes.Total(),
+			l.Stats.UDPReadFailed.Total(),
+			l.Stats.UDPOversized.Total(),
+			l.Stats.UDPRxQueue.Get(),
+			l.Stats.UDPKernelDrops.Get(),
+			l.Stats.CodecDecodedMetrics.Total(),
+			l.Stats.CodecFailedMetrics.Total(),
+		)
+	}
+	if l.MQTT != nil {
+		l.Logger.Info("[listener:%s] mqtt: %d/%d (messages/bytes), points: %d/%d (received/parse_failed)",
+			l.Name,
+			l.Stats.MQTTMessages.Total(),
+			l.Stats.MQTTBytes.Total(),
+			l.Stats.CodecDecodedMetrics.Total(),
+			l.Stats.CodecFailedMetrics.Total(),
+		)
+	}
+	if l.ConnSlots != nil {
+		l.Logger.Info("[listener:%s] connection limit: %d/%d/%d (max/queued/total_rejected)",
+			l.Name,
+			l.Config.MaxConnections,
+			l.Stats.ConnQueued.Get(),
+			l.Stats.ConnRejected.Total(),
+		)
+	}
+	if l.Budget != nil {
+		l.Logger.Info("[listener:%s] error budget: %d/%d (banned_sources/rejected_connections)",
+			l.Name,
+			l.Stats.SourcesBanned.Get(),
+			l.Stats.ConnBanned.Total(),
+		)
+	}
+	if l.Churn != nil {
+		l.Logger.Info("[listener:%s] connection churn: %d/%d (churning_sources/rejected_connections)",
+			l.Name,
+			l.Stats.SourcesChurning.Get(),
+			l.Stats.ConnChurned.Total(),
+		)
+	}
 	l.Logger.Info("[listener:%s] decoders: %d/%d/%d (processing/to_process/total_processed), metrics: %d/%.3f (total_decoded/rate_per_sec), decoding_time: %s/%s (avg/max)",
 		l.Name,
 		l.Stats.CodecProcessing.Get(),
@@ -202,76 +621,462 @@ func (l *Listener) LogReport() {
 
 }
 
-func (l *Listener) read(conn net.Conn, pipe *chan *bytes.Buffer, tStart time.Time) {
+// connData holds everything read from a single connection
+type connData struct {
+	buf        *bytes.Buffer
+	remote     net.Addr
+	serverName string        // TLS SNI
+	precision  time.Duration // of the timestamps, given by the request
+	verified   bool          // HMAC signature checked and stripped already
+}
+
+// accept loop of one of the listening sockets
+func (l *Listener) accept(sock net.Listener, connPipe chan *net.Conn) {
+	for {
+		conn, err := sock.Accept()
+		if err != nil {
+			l.Logger.Error("[listener:%s] Can't accept connection: %v", l.Name, err)
+			return
+		}
+		if tcpConn, ok := conn.(*net.TCPConn); ok && l.Config.KeepAlive.Duration > 0 {
+			tcpConn.SetKeepAlive(true)
+			tcpConn.SetKeepAlivePeriod(l.Config.KeepAlive.Duration)
+		}
+		if l.State.Get("draining") {
+			l.Stats.ConnRejected.Increment(1)
+			conn.Close()
+			continue
+		}
+		if pc, ok := l.proxied(conn).(*proxyConn); ok {
+			// the header is read off the accept loop so a slow client
+			// doesn't hold up the others
+			l.ConnWg.Add(1)
+			go func() {
+				defer l.ConnWg.Done()
+				if err := pc.init(); err != nil {
+					l.Stats.ConnFailed.Increment(1)
+					l.Logger.Error("[listener:%s] Invalid PROXY protocol header from %s: %v", l.Name, conn.RemoteAddr().String(), err)
+					conn.Close()
+					return
+				}
+				l.admit(pc, connPipe)
+			}()
+			continue
+		}
+		l.admit(conn, connPipe)
+	}
+}
+
+// admit passes the connection on to be read unless its source is banned or
+// churning, or the connection limit is reached
+func (l *Listener) admit(conn net.Conn, connPipe chan *net.Conn) {
+	if l.TLS != nil {
+		conn = tls.Server(conn, l.TLS)
+	}
+	if l.Budget != nil && l.Budget.Banned(sourceHost(conn.RemoteAddr())) {
+		l.Stats.ConnBanned.Increment(1)
+		conn.Close()
+		return
+	}
+	if l.Churn != nil && !l.checkChurn(conn) {
+		return
+	}
+	l.ConnWg.Add(1)
+	if l.ConnSlots == nil {
+		l.Stats.ConnOpen.Increment(1)
+		connPipe <- &conn
+		return
+	}
+	select {
+	case l.ConnSlots <- struct{}{}:
+		l.Stats.ConnOpen.Increment(1)
+		connPipe <- &conn
+	default:
+		l.queueConn(conn, connPipe)
+	}
+}
+
+// checkChurn records the connection of its source, it returns false if the
+// connection got closed for the source opening too many
+func (l *Listener) checkChurn(conn net.Conn) bool {
+	host := sourceHost(conn.RemoteAddr())
+	n, over := l.Churn.Record(host)
+	if !over {
+		return true
+	}
+	if n == l.Config.ChurnLimit+1 {
+		l.Logger.Error("[listener:%s] Source %s opened over %d connections this minute, it should keep its connection open", l.Name, host, l.Config.ChurnLimit)
+	}
+	if !l.Churn.reject {
+		return true
+	}
+	l.Stats.ConnChurned.Increment(1)
+	conn.Close()
+	return false
+}
+
+func (l *Listener) read(conn net.Conn, pipe *chan *connData, tStart time.Time) {
 	defer l.Stats.ConnProcessed.Increment(1)
 	defer l.ConnWg.Done()
+	if l.ConnSlots != nil {
+		defer func() { <-l.ConnSlots }()
+	}
 	l.Logger.Debug("[listener:%s] Accepted connection from %s", l.Name, conn.RemoteAddr().String())
-	iBuf := bufio.NewReader(conn)
-	var oBuf bytes.Buffer
-	_, err := io.Copy(&oBuf, iBuf)
-	conn.Close()
+	var input io.Reader = conn
+	if l.Config.IdleTimeout.Duration > 0 || l.Config.MinRate > 0 {
+		input = newConnReader(conn, l.Config)
+	}
+	retries := l.Config.CodecReadRetries
+	if retries == 0 {
+		retries = defaultReadRetries
+	}
+	// timeouts are the idle timeout's, those end the connection
+	iBuf := bufio.NewReader(newResumingReader(input, retries, false, l.Stats.ReadsResumed))
+	var src io.Reader = iBuf
+	var acks *ackReader
+	if l.Config.Ack {
+		acks = newAckReader(iBuf, conn, l.Stats.AcksSent)
+		acks.deferred = l.HMAC != nil
+		src = acks
+	}
+	var (
+		oBuf     bytes.Buffer
+		verified bool
+	)
+	_, err := io.Copy(&oBuf, src)
+	if acks != nil && acks.deferred {
+		defer conn.Close() // acked once verified
+	} else {
+		conn.Close()
+	}
 	dur := time.Since(tStart)
 	l.Stats.ConnOpen.Decrement(1)
+	if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
+		// sender went silent (crashed, half-open connection), keep the lines
+		// we've got whole
+		l.Stats.ConnTimedOut.Increment(1)
+		l.Logger.Info("[listener:%s] Closing idle connection from %s after %v", l.Name, conn.RemoteAddr().String(), l.Config.IdleTimeout.Duration)
+		l.Stats.BytesCut.Increment(cutPartialLine(&oBuf))
+		err = nil
+	}
+	if err == errSlowSender {
+		// slowloris-style sender, don't let it pin the connection forever
+		l.Stats.ConnSlow.Increment(1)
+		l.Logger.Info("[listener:%s] Closing connection from %s sending below %d B/s", l.Name, conn.RemoteAddr().String(), l.Config.MinRate)
+		l.Stats.BytesCut.Increment(cutPartialLine(&oBuf))
+		err = nil
+	}
 	if err != nil {
 		l.Stats.ConnFailed.Increment(1)
 		l.Logger.Error("[listener:%s] Error reading connection data from %s: %v", l.Name, conn.RemoteAddr().String(), err)
-		return
+		if acks == nil || !acks.enabled || acks.deferred {
+			return
+		}
+		// the sender's been told about the lines read, they have to make it
+	}
+	if acks != nil && acks.enabled && acks.deferred {
+		// acked only once verified, the signature covers the whole batch
+		payload, keyID, err := l.HMAC.Verify(oBuf.Bytes())
+		if err != nil {
+			l.Logger.Debug("[listener:%s] Rejected batch from %s (key '%s'): %v", l.Name, conn.RemoteAddr().String(), keyID, err)
+			return
+		}
+		oBuf.Next(oBuf.Len() - len(payload)) // the signature line
+		verified = true
+		acks.release(countLines(payload))
 	}
 	l.Logger.Debug("[listener:%s] Handled connection from %s, %d bytes, took %v", l.Name, conn.RemoteAddr().String(), oBuf.Len(), dur)
 	l.Stats.ConnTime.Add(dur)
+	data := &connData{buf: &oBuf, remote: conn.RemoteAddr(), verified: verified}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		data.serverName = tlsConn.ConnectionState().ServerName
+	}
 	l.DataWg.Add(1)
-	*pipe <- &oBuf
+	*pipe <- data
 
 }
 
-func (l *Listener) decode(data *bytes.Buffer) {
+// countLines counts the lines of data, the last one may lack its newline
+func countLines(data []byte) int {
+	n := bytes.Count(data, []byte("\n"))
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		n++
+	}
+	return n
+}
+
+// cutPartialLine drops what follows the last newline, a line the connection
+// got closed in the middle of, returns the count of bytes dropped
+func cutPartialLine(buf *bytes.Buffer) int {
+	data := buf.Bytes()
+	cut := len(data) - (bytes.LastIndexByte(data, '\n') + 1)
+	buf.Truncate(len(data) - cut)
+	return cut
+}
+
+func (l *Listener) decode(data *connData) {
 	t0 := time.Now()
 	defer l.Stats.CodecProcessed.Increment(1)
 	defer l.Stats.CodecProcessing.Decrement(1)
 	defer l.DataWg.Done()
 	l.Stats.CodecProcessing.Increment(1)
-	metrics, errs := l.Codec.Decode(bytes.NewReader(data.Bytes()))
-	for metric := range metrics {
-		l.Transport.InputChan() <- metric
-		l.Stats.CodecDecodedMetrics.Increment(1)
+	ctx := &ConnContext{Listener: l.Name, Protocol: l.Config.Protocol, Remote: data.remote, ServerName: data.serverName}
+	route := l.route(data.serverName)
+	tenant := route.Tenant
+	input := data.buf.Bytes()
+	if l.HMAC != nil && !data.verified {
+		var (
+			keyID string
+			err   error
+		)
+		if input, keyID, err = l.HMAC.Verify(input); err != nil {
+			l.Logger.Debug("[listener:%s] Rejected batch from %s (key '%s'): %v", l.Name, data.remote, keyID, err)
+			return
+		}
+	}
+	if l.Transcode != nil {
+		input = l.Transcode.Transcode(input)
+	}
+	codec := route.Codec
+	if pc, ok := codec.(PrecisionCodec); ok && data.precision > 0 {
+		codec = pc.WithPrecision(data.precision)
+	}
+	metrics, errs, closeSession := DecodeConn(codec, ctx, bytes.NewReader(input))
+	decoded, failed := 0, 0
+	hostName, hostResolved := "", false
+	var sourceIP net.IP
+	if l.Arrival != nil {
+		sourceIP = net.ParseIP(sourceHost(data.remote))
+	}
+	arrived := l.Config.CodecOptions().now()
+	for metrics != nil || errs != nil {
+		select {
+		case metric, ok := <-metrics:
+			if !ok {
+				metrics = nil
+				continue
+			}
+			if l.Chaos != nil {
+				l.Chaos.Corrupt(metric)
+			}
+			if l.Arrival != nil {
+				l.Arrival.Apply(metric, sourceIP, arrived)
+			}
+			if tenant != "" {
+				if metric.Fields == nil {
+					metric.Fields = make(map[string]string)
+				}
+				metric.Fields[l.Config.TenantField] = tenant
+			}
+			if !l.Policy.apply(metric, l.Stats) {
+				l.Stats.PolicyDropped.Increment(1)
+				continue
+			}
+			if !l.takeQuota() {
+				continue
+			}
+			if l.Tenants != nil {
+				ok, wait := l.Tenants.Allow(metric, tenant)
+				if !ok {
+					l.Stats.QuotaDropped.Increment(1)
+					continue
+				}
+				if wait > 0 {
+					l.Stats.QuotaDeferred.Increment(1)
+				}
+			}
+			metric.Name = rewriteName(l.Rewrites, metric.Name)
+			if l.Script != nil && !l.Script.Apply(metric) {
+				continue
+			}
+			if l.Pipeline != nil && !l.Pipeline.process(metric) {
+				l.Stats.PipelineDropped.Increment(1)
+				continue
+			}
+			if l.Hosts != nil && metric.Fields[l.Config.HostField] == "" {
+				if !hostResolved {
+					hostName, hostResolved = l.Hosts.Resolve(data.remote), true
+				}
+				if metric.Fields == nil {
+					metric.Fields = make(map[string]string)
+				}
+				internField(metric.Fields, l.Config.HostField, hostName)
+			}
+			if l.Sampler != nil && !l.Sampler.Keep(metric) {
+				l.Stats.SampledOut.Increment(1)
+				continue
+			}
+			l.Transport.InputChan() <- metric
+			l.Stats.CodecDecodedMetrics.Increment(1)
+			decoded++
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			ce, ok := err.(*CodecError)
+			if !ok {
+				ce = newCodecError(CodecErrUnknown, "Codec failed", err, nil)
+			}
+			ce.Codec, ce.Listener = route.CodecName, l.Name
+			failed += ce.Count
+			l.Stats.CodecFailedMetrics.Increment(ce.Count)
+			l.Stats.CodecErrors[ce.Category].Increment(ce.Count)
+			if pass, suppressed := l.ErrLog.sample(ce); pass {
+				l.Logger.Error("[listener:%s] %s error from %s: %v (%d similar not logged)", l.Name, ce.Category, data.remote, ce, suppressed)
+			}
+		}
 	}
-	if len(errs) > 0 {
-		l.Logger.Error("[listener:%s] Failed to decode %d metrics!", l.Name, len(errs))
+	if err := closeSession(); err != nil {
+		l.Logger.Error("[listener:%s] Failed to close codec session of %s: %v", l.Name, data.remote, err)
+	}
+	if failed > 0 {
+		l.Logger.Error("[listener:%s] Failed to decode %d metrics!", l.Name, failed)
 		// log the metric raw data?
 	}
+	if l.Budget != nil {
+		host := sourceHost(data.remote)
+		if l.Budget.Record(host, decoded+failed, failed) {
+			l.Logger.Error("[listener:%s] Source %s exceeded error budget of %.0f%% malformed lines, banning for %v", l.Name, host, l.Budget.ratio*100, l.Budget.ban)
+		}
+	}
 	l.Stats.CodecTime.Add(time.Since(t0))
 }
 
+// takeQuota checks the metric against the listener's and the global quota
+func (l *Listener) takeQuota() bool {
+	for _, q := range []*Quota{l.Quota, l.Global} {
+		if q == nil {
+			continue
+		}
+		ok, wait := q.Take()
+		if !ok {
+			l.Stats.QuotaDropped.Increment(1)
+			return false
+		}
+		if wait > 0 {
+			l.Stats.QuotaDeferred.Increment(1)
+		}
+	}
+	return true
+}
+
 type ListenerStats struct {
-	ConnProcessed       *StatsCounter
-	ConnFailed          *StatsCounter
-	ConnOpen            *StatsGauge
-	ConnTime            *StatsTimer
-	CodecProcessed      *StatsCounter
-	CodecProcessing     *StatsGauge
-	CodecToProcess      *StatsGauge
-	CodecDecodedMetrics *StatsCounter
-	CodecTime           *StatsTimer
+	ConnProcessed         *StatsCounter
+	ConnFailed            *StatsCounter
+	ConnTimedOut          *StatsCounter
+	ConnSlow              *StatsCounter
+	BytesCut              *StatsCounter
+	ConnBanned            *StatsCounter
+	ConnChurned           *StatsCounter
+	ConnRejected          *StatsCounter
+	ConnQueued            *StatsGauge
+	SourcesBanned         *StatsGauge
+	SourcesChurning       *StatsGauge
+	ConnOpen              *StatsGauge
+	ConnTime              *StatsTimer
+	CodecProcessed        *StatsCounter
+	CodecProcessing       *StatsGauge
+	CodecToProcess        *StatsGauge
+	CodecDecodedMetrics   *StatsCounter
+	CodecFailedMetrics    *StatsCounter
+	CodecErrors           [numCodecErrCategories]*StatsCounter
+	CodecErrorsOverflowed *StatsCounter
+	ReadsResumed          *StatsCounter
+	AcksSent              *StatsCounter
+	CodecTime             *StatsTimer
+	BadValues             *StatsCounter
+	BadTimestamps         *StatsCounter
+	TooLong               *StatsCounter
+	PolicyDropped         *StatsCounter
+	QuotaDropped          *StatsCounter
+	SampledOut            *StatsCounter
+	PipelineDropped       *StatsCounter
+	QuotaDeferred         *StatsCounter
+	UDPDatagrams          *StatsCounter
+	UDPBytes              *StatsCounter
+	UDPReadFailed         *StatsCounter
+	UDPOversized          *StatsCounter
+	UDPRxQueue            *StatsGauge
+	UDPKernelDrops        *StatsGauge
+	MQTTMessages          *StatsCounter
+	MQTTBytes             *StatsCounter
 }
 
 func NewListenerStats() *ListenerStats {
 	now := time.Now()
+	var codecErrors [numCodecErrCategories]*StatsCounter
+	for i := range codecErrors {
+		codecErrors[i] = NewStatsCounter(now)
+	}
 	return &ListenerStats{
-		ConnProcessed:       NewStatsCounter(now),
-		ConnFailed:          NewStatsCounter(now),
-		ConnOpen:            NewStatsGauge(),
-		ConnTime:            NewStatsTimer(1000),
-		CodecProcessed:      NewStatsCounter(now),
-		CodecProcessing:     NewStatsGauge(),
-		CodecToProcess:      NewStatsGauge(),
-		CodecDecodedMetrics: NewStatsCounter(now),
-		CodecTime:           NewStatsTimer(1000),
+		ConnProcessed:         NewStatsCounter(now),
+		ConnFailed:            NewStatsCounter(now),
+		ConnTimedOut:          NewStatsCounter(now),
+		ConnSlow:              NewStatsCounter(now),
+		BytesCut:              NewStatsCounter(now),
+		ConnBanned:            NewStatsCounter(now),
+		ConnChurned:           NewStatsCounter(now),
+		ConnRejected:          NewStatsCounter(now),
+		ConnQueued:            NewStatsGauge(),
+		SourcesBanned:         NewStatsGauge(),
+		SourcesChurning:       NewStatsGauge(),
+		ConnOpen:              NewStatsGauge(),
+		ConnTime:              NewStatsTimer(1000),
+		CodecProcessed:        NewStatsCounter(now),
+		CodecProcessing:       NewStatsGauge(),
+		CodecToProcess:        NewStatsGauge(),
+		CodecDecodedMetrics:   NewStatsCounter(now),
+		CodecFailedMetrics:    NewStatsCounter(now),
+		CodecErrors:           codecErrors,
+		CodecErrorsOverflowed: NewStatsCounter(now),
+		ReadsResumed:          NewStatsCounter(now),
+		AcksSent:              NewStatsCounter(now),
+		CodecTime:             NewStatsTimer(1000),
+		BadValues:             NewStatsCounter(now),
+		BadTimestamps:         NewStatsCounter(now),
+		TooLong:               NewStatsCounter(now),
+		PolicyDropped:         NewStatsCounter(now),
+		QuotaDropped:          NewStatsCounter(now),
+		SampledOut:            NewStatsCounter(now),
+		PipelineDropped:       NewStatsCounter(now),
+		QuotaDeferred:         NewStatsCounter(now),
+		UDPDatagrams:          NewStatsCounter(now),
+		UDPBytes:              NewStatsCounter(now),
+		UDPReadFailed:         NewStatsCounter(now),
+		UDPOversized:          NewStatsCounter(now),
+		UDPRxQueue:            NewStatsGauge(),
+		UDPKernelDrops:        NewStatsGauge(),
+		MQTTMessages:          NewStatsCounter(now),
+		MQTTBytes:             NewStatsCounter(now),
 	}
 }
 
 func (s *ListenerStats) Reset() {
 	s.ConnProcessed.Reset()
 	s.ConnFailed.Reset()
+	s.ConnTimedOut.Reset()
+	s.ConnSlow.Reset()
+	s.BytesCut.Reset()
+	s.ConnBanned.Reset()
+	s.ConnChurned.Reset()
+	s.ConnRejected.Reset()
 	s.CodecProcessed.Reset()
 	s.CodecDecodedMetrics.Reset()
+	s.CodecFailedMetrics.Reset()
+	for _, c := range s.CodecErrors {
+		c.Reset()
+	}
+	s.BadValues.Reset()
+	s.BadTimestamps.Reset()
+	s.TooLong.Reset()
+	s.PolicyDropped.Reset()
+	s.QuotaDropped.Reset()
+	s.SampledOut.Reset()
+	s.PipelineDropped.Reset()
+	s.QuotaDeferred.Reset()
+	s.UDPDatagrams.Reset()
+	s.UDPBytes.Reset()
+	s.UDPReadFailed.Reset()
+	s.UDPOversized.Reset()
 }
@@ -0,0 +1,132 @@
+package metcap
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// With [ack] set, a tcp listener lets senders opt into acknowledgements by
+// opening the connection with an `metcap-ack {n}` line. The listener then
+// replies `ack {lines}` with the count of lines received so far every n
+// lines, for every `metcap-batch` line (batch frame) and, if the sender
+// half-closes the connection, once all is read. Neither line gets decoded.
+// Vanilla Graphite clients don't send the opening line, so they're never
+// written to. Lines acked are decoded even if the connection fails later
+// (ie. reset by the sender), a line cut by the failure isn't. Listeners
+// verifying HMAC signatures defer the acks until the connection's ended and
+// its batch verified, then ack it whole.
+const (
+	ackHandshake  = "metcap-ack"
+	ackBatchFrame = "metcap-batch"
+	ackTimeout    = 5 * time.Second
+)
+
+type ackReader struct {
+	r        *bufio.Reader
+	conn     net.Conn
+	every    int
+	enabled  bool
+	deferred bool // acked by release only
+	started  bool
+	failed   bool
+	lines    int
+	acked    int
+	pending  []byte
+	err      error
+	sent     *StatsCounter
+}
+
+func newAckReader(r *bufio.Reader, conn net.Conn, sent *StatsCounter) *ackReader {
+	return &ackReader{r: r, conn: conn, sent: sent}
+}
+
+func (a *ackReader) Read(p []byte) (int, error) {
+	for len(a.pending) == 0 {
+		if a.err != nil {
+			return 0, a.err
+		}
+		line, err := a.r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			// cut by the failure, the sender resends it
+			line = nil
+		}
+		if len(line) > 0 {
+			a.pending = a.line(line)
+		}
+		if err != nil {
+			a.err = err
+			if err == io.EOF && a.lines != a.acked && !a.deferred {
+				a.ack()
+			}
+		}
+	}
+	n := copy(p, a.pending)
+	a.pending = a.pending[n:]
+	return n, nil
+}
+
+// line counts the line and acks when it's time, returns what's left to
+// decode
+func (a *ackReader) line(line []byte) []byte {
+	text := bytes.TrimRight(line, "\r\n")
+	if !a.started {
+		a.started = true
+		if every, ok := parseAckHandshake(text); ok {
+			a.enabled, a.every = true, every
+			return nil
+		}
+	}
+	if !a.enabled {
+		return line
+	}
+	if string(text) == ackBatchFrame {
+		if !a.deferred {
+			a.ack()
+		}
+		return nil
+	}
+	a.lines++
+	if a.every > 0 && a.lines-a.acked >= a.every && !a.deferred {
+		a.ack()
+	}
+	return line
+}
+
+// parseAckHandshake reads `metcap-ack {n}`, n = 0 acks only batch frames
+func parseAckHandshake(text []byte) (int, bool) {
+	fields := bytes.Fields(text)
+	if len(fields) != 2 || string(fields[0]) != ackHandshake {
+		return 0, false
+	}
+	every, err := strconv.Atoi(string(fields[1]))
+	if err != nil || every < 0 {
+		return 0, false
+	}
+	return every, true
+}
+
+// ack writes the count of lines; a sender not reading them gets no more
+// once a write fails
+func (a *ackReader) ack() {
+	if !a.enabled || a.failed {
+		return
+	}
+	a.conn.SetWriteDeadline(time.Now().Add(ackTimeout))
+	if _, err := fmt.Fprintf(a.conn, "ack %d\n", a.lines); err != nil {
+		a.failed = true
+		return
+	}
+	a.acked = a.lines
+	a.sent.Increment(1)
+}
+
+// release acks the lines of a deferred reader once they're verified
+func (a *ackReader) release(lines int) {
+	a.lines = lines
+	a.ack()
+}
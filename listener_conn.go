@@ -0,0 +1,71 @@
+package metcap
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+var errSlowSender = errors.New("sender below minimum throughput")
+
+// connReader guards reads from a connection against senders going silent
+// (idle timeout) and senders trickling data too slowly (minimum rate)
+type connReader struct {
+	conn        net.Conn
+	idleTimeout time.Duration
+	minRate     float64
+	grace       time.Duration
+	start       time.Time
+	lastRead    time.Time
+	bytes       int64
+}
+
+func newConnReader(conn net.Conn, c ListenerConfig) *connReader {
+	now := time.Now()
+	grace := c.MinRateGrace.Duration
+	if grace == 0 {
+		grace = 10 * time.Second
+	}
+	return &connReader{
+		conn:        conn,
+		idleTimeout: c.IdleTimeout.Duration,
+		minRate:     float64(c.MinRate),
+		grace:       grace,
+		start:       now,
+		lastRead:    now,
+	}
+}
+
+func (r *connReader) Read(p []byte) (int, error) {
+	for {
+		var deadline time.Time
+		if r.idleTimeout > 0 {
+			deadline = r.lastRead.Add(r.idleTimeout)
+		}
+		if r.minRate > 0 {
+			// wake up every second to check the rate even if nothing comes
+			check := time.Now().Add(time.Second)
+			if deadline.IsZero() || check.Before(deadline) {
+				deadline = check
+			}
+		}
+		r.conn.SetReadDeadline(deadline)
+
+		n, err := r.conn.Read(p)
+		now := time.Now()
+		if n > 0 {
+			r.bytes += int64(n)
+			r.lastRead = now
+		}
+		if elapsed := now.Sub(r.start); r.minRate > 0 && elapsed > r.grace && float64(r.bytes)/elapsed.Seconds() < r.minRate {
+			return n, errSlowSender
+		}
+		if nErr, ok := err.(net.Error); ok && nErr.Timeout() && n == 0 {
+			if r.idleTimeout > 0 && now.Sub(r.lastRead) >= r.idleTimeout {
+				return 0, err
+			}
+			continue // just the rate check wake-up
+		}
+		return n, err
+	}
+}
@@ -0,0 +1,169 @@
+package metcap
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HMACVerifier rejects batches (the data of a TCP connection, a datagram,
+// an HTTP request body or an MQTT message) not signed by a key of
+// [hmac_keys_file], so metrics can't be injected into an exposed port by
+// whoever reaches it. Signed batches open with the line
+//
+//	hmac-sha256 {key_id} {unix_time} {signature}
+//
+// which isn't decoded, the signature being hex HMAC-SHA256 of the time, a
+// newline and the rest of the batch. Batches signed more than [hmac_window]
+// off the current time are rejected, so captured ones can't be replayed.
+// The file holds a `{key_id} {secret}` line per sender, # comments
+// allowed. Unsigned batches are rejected unless [hmac_optional] is set, for
+// migrating senders one by one. Failures are counted per key ID
+// ("unsigned", "unknown" for keys not in the file).
+type HMACVerifier struct {
+	keys     map[string][]byte
+	optional bool
+	window   time.Duration
+	Verified *StatsCounter
+	Unsigned *StatsCounter
+	failed   map[string]*StatsCounter
+	mux      *sync.Mutex
+}
+
+const hmacHeader = "hmac-sha256"
+
+var (
+	errHMACUnsigned = errors.New("batch not signed")
+	errHMACMismatch = errors.New("signature mismatch")
+	errHMACExpired  = errors.New("signed outside the time window")
+)
+
+func NewHMACVerifier(c ListenerConfig) (*HMACVerifier, error) {
+	if c.HMACKeysFile == "" {
+		return nil, nil
+	}
+	f, err := os.Open(c.HMACKeysFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	v := &HMACVerifier{
+		keys:     make(map[string][]byte),
+		optional: c.HMACOptional,
+		window:   c.HMACWindow.Duration,
+		Verified: NewStatsCounter(time.Now()),
+		Unsigned: NewStatsCounter(time.Now()),
+		failed:   make(map[string]*StatsCounter),
+		mux:      &sync.Mutex{},
+	}
+	if v.window <= 0 {
+		v.window = 5 * time.Minute
+	}
+	lineNum := 0
+	scn := bufio.NewScanner(f)
+	for scn.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scn.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected `key_id secret`", c.HMACKeysFile, lineNum)
+		}
+		v.keys[fields[0]] = []byte(fields[1])
+	}
+	if err := scn.Err(); err != nil {
+		return nil, err
+	}
+	if len(v.keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys", c.HMACKeysFile)
+	}
+	return v, nil
+}
+
+// Verify checks the signature of the batch, returns it without the
+// signature line and the key ID it was signed with
+func (v *HMACVerifier) Verify(input []byte) ([]byte, string, error) {
+	header, payload := input, []byte(nil)
+	if i := bytes.IndexByte(input, '\n'); i >= 0 {
+		header, payload = input[:i], input[i+1:]
+	}
+	fields := strings.Fields(string(header))
+	if len(fields) != 4 || fields[0] != hmacHeader {
+		if v.optional {
+			v.Unsigned.Increment(1)
+			return input, "", nil
+		}
+		v.fail("unsigned")
+		return nil, "", errHMACUnsigned
+	}
+	keyID := fields[1]
+	key, ok := v.keys[keyID]
+	if !ok {
+		v.fail("unknown")
+		return nil, keyID, fmt.Errorf("unknown key '%s'", keyID)
+	}
+	sig, err := hex.DecodeString(fields[3])
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(fields[2] + "\n"))
+	mac.Write(payload)
+	if err != nil || !hmac.Equal(sig, mac.Sum(nil)) {
+		v.fail(keyID)
+		return nil, keyID, errHMACMismatch
+	}
+	signed, err := strconv.ParseInt(fields[2], 10, 64)
+	if off := time.Since(time.Unix(signed, 0)); err != nil || off > v.window || off < -v.window {
+		v.fail(keyID)
+		return nil, keyID, errHMACExpired
+	}
+	v.Verified.Increment(1)
+	return payload, keyID, nil
+}
+
+func (v *HMACVerifier) fail(keyID string) {
+	v.mux.Lock()
+	c, ok := v.failed[keyID]
+	if !ok {
+		c = NewStatsCounter(time.Now())
+		v.failed[keyID] = c
+	}
+	v.mux.Unlock()
+	c.Increment(1)
+}
+
+// Failed returns the failures per key ID
+func (v *HMACVerifier) Failed() map[string]uint64 {
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	out := make(map[string]uint64, len(v.failed))
+	for keyID, c := range v.failed {
+		out[keyID] = c.Total()
+	}
+	return out
+}
+
+// failedString formats the failures as `key_id=n ...` sorted by key ID
+func (v *HMACVerifier) failedString() string {
+	failed := v.Failed()
+	keyIDs := make([]string, 0, len(failed))
+	for keyID := range failed {
+		keyIDs = append(keyIDs, keyID)
+	}
+	sort.Strings(keyIDs)
+	parts := make([]string, len(keyIDs))
+	for i, keyID := range keyIDs {
+		parts[i] = fmt.Sprintf("%s=%d", keyID, failed[keyID])
+	}
+	return strings.Join(parts, " ")
+}
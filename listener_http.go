@@ -0,0 +1,135 @@
+package metcap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// With [protocol] "http" the listener takes the body of every POST (or PUT)
+// request as the data of a connection, for senders speaking only HTTP and
+// for HTTP load balancers in front of metcap. The sender's address is
+// taken from X-Forwarded-For when the request comes from [trusted_proxies].
+// InfluxDB clients' `precision` query parameter (ie. /write?precision=ms)
+// sets the unit of the request's timestamps for the influx codec.
+
+const defaultHTTPMaxBody = 32 << 20
+
+// newHTTPServer serves the listener's socket, the data goes to the pipe
+func (l *Listener) newHTTPServer(pipe *chan *connData) *http.Server {
+	return &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			l.handleHTTP(w, req, pipe)
+		}),
+		ReadTimeout: l.Config.IdleTimeout.Duration,
+		IdleTimeout: l.Config.IdleTimeout.Duration,
+	}
+}
+
+// serveHTTP runs the server on the socket until it's closed
+func (l *Listener) serveHTTP(srv *http.Server, sock net.Listener) {
+	if l.Config.ProxyProtocol {
+		sock = &proxyListener{sock, l}
+	}
+	if l.TLS != nil {
+		sock = tls.NewListener(sock, l.TLS)
+	}
+	if err := srv.Serve(sock); err != nil && err != http.ErrServerClosed {
+		l.Logger.Error("[listener:%s] HTTP server failed: %v", l.Name, err)
+	}
+}
+
+func (l *Listener) handleHTTP(w http.ResponseWriter, req *http.Request, pipe *chan *connData) {
+	if req.Method != "POST" && req.Method != "PUT" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if l.ExitFlag.Get() || l.State.Get("draining") {
+		l.Stats.ConnRejected.Increment(1)
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	precision, err := parsePrecision(req.URL.Query().Get("precision"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	remote := l.forwardedFor(req)
+	if l.Budget != nil && l.Budget.Banned(sourceHost(remote)) {
+		l.Stats.ConnBanned.Increment(1)
+		http.Error(w, "banned for malformed input", http.StatusForbidden)
+		return
+	}
+
+	tStart := time.Now()
+	l.ConnWg.Add(1)
+	defer l.ConnWg.Done()
+	defer l.Stats.ConnProcessed.Increment(1)
+	l.Stats.ConnOpen.Increment(1)
+	defer l.Stats.ConnOpen.Decrement(1)
+
+	maxBody := l.Config.HTTPMaxBody
+	if maxBody <= 0 {
+		maxBody = defaultHTTPMaxBody
+	}
+	var body io.Reader = http.MaxBytesReader(w, req.Body, maxBody)
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			l.Stats.ConnFailed.Increment(1)
+			http.Error(w, "invalid gzip body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = io.LimitReader(gz, maxBody)
+	}
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, body); err != nil {
+		l.Stats.ConnFailed.Increment(1)
+		l.Logger.Error("[listener:%s] Error reading request body from %s: %v", l.Name, remote, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dur := time.Since(tStart)
+	l.Logger.Debug("[listener:%s] Handled request from %s, %d bytes, took %v", l.Name, remote, buf.Len(), dur)
+	l.Stats.ConnTime.Add(dur)
+	data := &connData{buf: &buf, remote: remote, precision: precision}
+	if req.TLS != nil {
+		data.serverName = req.TLS.ServerName
+	}
+	l.DataWg.Add(1)
+	*pipe <- data
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// forwardedFor returns the sender's address; X-Forwarded-For is walked
+// from the right (the nearest proxy's entry) skipping trusted proxies, the
+// first address outside of them is the client. Headers of untrusted peers
+// are ignored, as anyone can make them up.
+func (l *Listener) forwardedFor(req *http.Request) net.Addr {
+	peer, err := net.ResolveTCPAddr("tcp", req.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	if !ipInNets(peer.IP, l.Trusted) {
+		return peer
+	}
+	hops := strings.Split(strings.Join(req.Header["X-Forwarded-For"], ","), ",")
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		client = &net.TCPAddr{IP: ip}
+		if !ipInNets(ip, l.Trusted) {
+			break
+		}
+	}
+	return client
+}
@@ -0,0 +1,132 @@
+package metcap
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// With [protocol] "mqtt" the listener subscribes to [mqtt_topics] at
+// [mqtt_broker] instead of listening on a port, every message's payload is
+// decoded like the data of a connection. Messages are acknowledged (QoS
+// 1 and 2) once handed to the decoders; with QoS above 0 the session is
+// persistent, so the broker keeps the messages while metcap is away.
+type MQTTSubscriber struct {
+	Client mqtt.Client
+	Broker string
+	Topics map[string]byte
+	Logger *Logger
+
+	name    string
+	ready   chan struct{}
+	deliver func(topic string, payload []byte)
+}
+
+const mqttTimeout = 10 * time.Second
+
+// mqttAddr stands for the sender of a message, the topic it came from, so
+// per-source accounting and [host_field] apply per topic
+type mqttAddr string
+
+func (a mqttAddr) Network() string { return "mqtt" }
+func (a mqttAddr) String() string  { return string(a) }
+
+func NewMQTTSubscriber(name string, c ListenerConfig, logger *Logger) (*MQTTSubscriber, error) {
+	if c.MQTTBroker == "" {
+		return nil, errors.New("mqtt listener needs mqtt_broker")
+	}
+	if len(c.MQTTTopics) == 0 {
+		return nil, errors.New("mqtt listener needs mqtt_topics")
+	}
+	if c.MQTTQoS < 0 || c.MQTTQoS > 2 {
+		return nil, fmt.Errorf("invalid mqtt_qos %d", c.MQTTQoS)
+	}
+	clientID := c.MQTTClientID
+	if clientID == "" {
+		host, _ := os.Hostname()
+		clientID = "metcap-" + host + "-" + name
+	}
+	s := &MQTTSubscriber{
+		Broker: c.MQTTBroker,
+		Topics: make(map[string]byte),
+		Logger: logger,
+		name:   name,
+		ready:  make(chan struct{}),
+	}
+	for _, topic := range c.MQTTTopics {
+		s.Topics[topic] = byte(c.MQTTQoS)
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(c.MQTTBroker).
+		SetClientID(clientID).
+		SetUsername(c.MQTTUsername).
+		SetPassword(c.MQTTPassword).
+		SetCleanSession(c.MQTTQoS == 0).
+		SetAutoReconnect(true).
+		// messages of the persistent session may arrive before subscribing
+		SetDefaultPublishHandler(s.handle).
+		SetOnConnectHandler(s.subscribe).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			logger.Error("[listener:%s] Lost connection to MQTT broker %s: %v", name, s.Broker, err)
+		})
+	s.Client = mqtt.NewClient(opts)
+	token := s.Client.Connect()
+	if !token.WaitTimeout(mqttTimeout) {
+		return nil, fmt.Errorf("connecting to %s timed out", s.Broker)
+	}
+	if err := token.Error(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// subscribe (re)subscribes the topics on every connect
+func (s *MQTTSubscriber) subscribe(client mqtt.Client) {
+	token := client.SubscribeMultiple(s.Topics, s.handle)
+	if !token.WaitTimeout(mqttTimeout) {
+		s.Logger.Error("[listener:%s] Subscribing to %s timed out", s.name, s.Broker)
+		return
+	}
+	if err := token.Error(); err != nil {
+		s.Logger.Error("[listener:%s] Failed to subscribe at %s: %v", s.name, s.Broker, err)
+		return
+	}
+	s.Logger.Info("[listener:%s] Subscribed to %d topics at %s", s.name, len(s.Topics), s.Broker)
+}
+
+// handle holds the messages back until the listener starts
+func (s *MQTTSubscriber) handle(_ mqtt.Client, msg mqtt.Message) {
+	<-s.ready
+	s.deliver(msg.Topic(), msg.Payload())
+}
+
+// Start passes the messages on to deliver
+func (s *MQTTSubscriber) Start(deliver func(topic string, payload []byte)) {
+	s.deliver = deliver
+	close(s.ready)
+}
+
+// Stop disconnects, letting the messages in progress finish
+func (s *MQTTSubscriber) Stop() {
+	s.Client.Disconnect(uint(mqttTimeout / time.Millisecond))
+}
+
+// receiveMQTT hands the message payloads to the decoders
+func (l *Listener) receiveMQTT(pipe *chan *connData) func(string, []byte) {
+	return func(topic string, payload []byte) {
+		l.ConnWg.Add(1)
+		defer l.ConnWg.Done()
+		l.Stats.MQTTMessages.Increment(1)
+		l.Stats.MQTTBytes.Increment(len(payload))
+		if l.Budget != nil && l.Budget.Banned(topic) {
+			l.Stats.ConnBanned.Increment(1)
+			return
+		}
+		l.DataWg.Add(1)
+		*pipe <- &connData{buf: bytes.NewBuffer(payload), remote: mqttAddr(topic)}
+	}
+}
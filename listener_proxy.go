@@ -0,0 +1,214 @@
+package metcap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Behind a load balancer every connection comes from the balancer's
+// address, so per-source accounting (error budget, churn, host field,
+// arrival time rules) would lump all senders together. With
+// [proxy_protocol] the balancer (HAProxy, ELB, nginx stream) prepends the
+// original client address in a PROXY protocol header, v1 (text) or v2
+// (binary), which is read before anything else on the connection.
+
+const proxyHeaderTimeout = 5 * time.Second
+
+var (
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	errNoProxyHeader = errors.New("missing PROXY protocol header")
+)
+
+// proxyConn reads the PROXY header on first use and reports the client
+// address it carries as RemoteAddr
+type proxyConn struct {
+	net.Conn
+	once   sync.Once
+	r      *bufio.Reader
+	remote net.Addr
+	err    error
+}
+
+func newProxyConn(conn net.Conn) *proxyConn {
+	return &proxyConn{Conn: conn}
+}
+
+// init reads the header, the error is kept for every later read
+func (c *proxyConn) init() error {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.r = bufio.NewReader(c.Conn)
+		c.remote, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+	})
+	return c.err
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if err := c.init(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr is the client's address, the peer's one if the header
+// carries none (health checks, "UNKNOWN" or LOCAL connections)
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.init() == nil && c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader returns the source address of the v1 or v2 header, nil
+// if the header doesn't carry any
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	// the shortest v1 header, "PROXY UNKNOWN\r\n", is longer than this
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, errNoProxyHeader
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyV1(r)
+	}
+	return nil, errNoProxyHeader
+}
+
+// readProxyV1: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 2003\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) <= 107 { // maximum header length by the spec
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY v1 header too long")
+	}
+	parts := strings.Split(string(line[:len(line)-2]), " ")
+	if len(parts) >= 2 && parts[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(parts) != 6 || (parts[1] != "TCP4" && parts[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY v1 header '%s'", line[:len(line)-2])
+	}
+	ip := net.ParseIP(parts[2])
+	port, err := strconv.Atoi(parts[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid PROXY v1 source '%s %s'", parts[2], parts[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2 reads the binary header, TLVs following the addresses are
+// skipped
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	switch hdr[12] & 0x0f {
+	case 0x0: // LOCAL, ie. the balancer's own health check
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v2 command %d", hdr[12]&0x0f)
+	}
+	switch hdr[13] >> 4 {
+	case 0x1: // AF_INET
+		if len(body) < 12 {
+			return nil, errors.New("short PROXY v2 IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 0x2: // AF_INET6
+		if len(body) < 36 {
+			return nil, errors.New("short PROXY v2 IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	return nil, nil // AF_UNSPEC, AF_UNIX
+}
+
+// proxied wraps the connection to read its PROXY header, unless it comes
+// from outside of [trusted_proxies] (when set), those are taken as direct
+func (l *Listener) proxied(conn net.Conn) net.Conn {
+	if !l.Config.ProxyProtocol {
+		return conn
+	}
+	if len(l.Trusted) > 0 && !ipInNets(net.ParseIP(sourceHost(conn.RemoteAddr())), l.Trusted) {
+		return conn
+	}
+	return newProxyConn(conn)
+}
+
+// proxyListener hands out the accepted connections proxied, for the HTTP
+// server
+type proxyListener struct {
+	net.Listener
+	l *Listener
+}
+
+func (pl *proxyListener) Accept() (net.Conn, error) {
+	conn, err := pl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return pl.l.proxied(conn), nil
+}
+
+// parseCIDRs parses the networks, plain addresses are taken as single
+// host ones
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
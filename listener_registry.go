@@ -0,0 +1,278 @@
+package metcap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+)
+
+// ListenerRegistry keeps the running listeners. Through the admin API
+// listeners can be added (PUT /listeners/{name} with the listener's
+// options as JSON) and removed (DELETE /listeners/{name}) at runtime, so a
+// new endpoint doesn't take a restart draining the buffers. Added listeners
+// are saved into [listeners_dir] as {name}.json, include them in the config
+// to have them back after restart; removing a listener deletes its file.
+// Listeners running commands or scripts (exec codec, [script_file]) can't
+// be added through the API, only by the config.
+type ListenerRegistry struct {
+	Dir       string
+	Transport Transport
+	Workers   *sync.WaitGroup
+	Logger    *Logger
+	ExitFlag  *Flag
+	CPU       CPUConfig
+
+	setup     func(*Listener)
+	listeners map[string]*Listener
+	creating  map[string]bool // names of listeners being set up
+	mux       *sync.Mutex
+}
+
+var listenerNameRe = regexp.MustCompile(`^[a-zA-Z0-9_\-]+$`)
+
+var errListenerNotAllowed = errors.New("listeners running commands or scripts can't be added through the API")
+
+// NewListenerRegistry registers listeners set up by setup (global quota,
+// sampler, state) and feeding t; with pipelines t is nil and listeners
+// can't be added at runtime
+func NewListenerRegistry(c *AdminConfig, t Transport, workers *sync.WaitGroup, logger *Logger, exitFlag *Flag, setup func(*Listener)) *ListenerRegistry {
+	return &ListenerRegistry{
+		Dir:       c.ListenersDir,
+		Transport: t,
+		Workers:   workers,
+		Logger:    logger,
+		ExitFlag:  exitFlag,
+		setup:     setup,
+		listeners: make(map[string]*Listener),
+		creating:  make(map[string]bool),
+		mux:       &sync.Mutex{},
+	}
+}
+
+// Add registers a listener of the config
+func (r *ListenerRegistry) Add(l *Listener) {
+	r.mux.Lock()
+	r.listeners[l.Name] = l
+	r.mux.Unlock()
+}
+
+// List returns the listeners sorted by name
+func (r *ListenerRegistry) List() []*Listener {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	out := make([]*Listener, 0, len(r.listeners))
+	for _, l := range r.listeners {
+		out = append(out, l)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func (r *ListenerRegistry) get(name string) *Listener {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.listeners[name]
+}
+
+// Create starts a listener of the options tree (as in the [listener.*]
+// sections) and saves them. The listener's set up outside of the lock, as
+// it may take a while (ie. connecting to a MQTT broker).
+func (r *ListenerRegistry) Create(name string, options map[string]interface{}) error {
+	if r.Transport == nil {
+		return errors.New("listeners can't be added with pipelines configured")
+	}
+	if r.ExitFlag.Get() {
+		return errors.New("shutting down")
+	}
+	tree := map[string]interface{}{"listener": map[string]interface{}{name: options}}
+	data, err := configTreeToTOML(tree)
+	if err != nil {
+		return err
+	}
+	var config Config
+	if _, err := toml.Decode(string(data), &config); err != nil {
+		return err
+	}
+	lc := config.Listener[name]
+	if lc.Codec == "exec" || len(lc.ExecCommand) > 0 || lc.ScriptFile != "" {
+		return errListenerNotAllowed
+	}
+
+	r.mux.Lock()
+	_, exists := r.listeners[name]
+	if exists || r.creating[name] {
+		r.mux.Unlock()
+		return fmt.Errorf("listener '%s' exists", name)
+	}
+	r.creating[name] = true
+	r.mux.Unlock()
+	defer func() {
+		r.mux.Lock()
+		delete(r.creating, name)
+		r.mux.Unlock()
+	}()
+
+	listener, err := NewListener(name, r.CPU.limitListener(lc), r.Transport, r.Workers, r.Logger, r.ExitFlag)
+	if err != nil {
+		return err
+	}
+	r.setup(&listener)
+	if r.Dir != "" {
+		if err := r.save(name, tree); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+	r.mux.Lock()
+	r.listeners[name] = &listener
+	r.mux.Unlock()
+	go listener.Start()
+	r.Logger.Info("[admin] Added listener '%s'", name)
+	return nil
+}
+
+func (r *ListenerRegistry) save(name string, tree map[string]interface{}) error {
+	data, err := json.MarshalIndent(tree, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(r.Dir, name+".json")
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Remove stops the listener, letting its connections finish, and deletes
+// its saved options
+func (r *ListenerRegistry) Remove(name string) error {
+	r.mux.Lock()
+	listener, ok := r.listeners[name]
+	delete(r.listeners, name)
+	r.mux.Unlock()
+	if !ok {
+		return os.ErrNotExist
+	}
+	listener.Stop()
+	if r.Dir != "" {
+		err := os.Remove(filepath.Join(r.Dir, name+".json"))
+		if os.IsNotExist(err) {
+			r.Logger.Info("[admin] Removed listener '%s', it's back after restart unless removed from the config", name)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	r.Logger.Info("[admin] Removed listener '%s'", name)
+	return nil
+}
+
+// SelfSource reports the stats of all the listeners
+func (r *ListenerRegistry) SelfSource() SelfSource {
+	return func(emit func(string, float64, map[string]string)) {
+		for _, l := range r.List() {
+			l.SelfSource()(emit)
+		}
+	}
+}
+
+type listenerSummary struct {
+	Protocol string `json:"protocol"`
+	Port     int    `json:"port,omitempty"`
+	Codec    string `json:"codec"`
+}
+
+// Register serves GET /listeners, GET /listeners/{name}/churn and
+// /listeners/{name}/mutator, and PUT and DELETE /listeners/{name}
+// requiring the token
+func (r *ListenerRegistry) Register(a *Admin) {
+	a.HandleJSON("/listeners", func() interface{} {
+		out := make(map[string]listenerSummary)
+		for _, l := range r.List() {
+			out[l.Name] = listenerSummary{l.Config.Protocol, l.Config.Port, l.Config.Codec}
+		}
+		return out
+	})
+	a.Handle("/listeners/", func(w http.ResponseWriter, req *http.Request) {
+		path := strings.Split(strings.TrimPrefix(req.URL.Path, "/listeners/"), "/")
+		name := path[0]
+		if req.Method == "GET" && len(path) == 2 {
+			r.handleStats(w, name, path[1])
+			return
+		}
+		if len(path) != 1 || !listenerNameRe.MatchString(name) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		switch req.Method {
+		case "PUT", "POST", "DELETE":
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !a.authorized(w, req) {
+			return
+		}
+		if req.Method == "DELETE" {
+			if err := r.Remove(name); os.IsNotExist(err) {
+				http.Error(w, "unknown listener '"+name+"'", http.StatusNotFound)
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			} else {
+				w.WriteHeader(http.StatusNoContent)
+			}
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, 1<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var options map[string]interface{}
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		if err := dec.Decode(&options); err != nil {
+			http.Error(w, "invalid listener options: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := r.Create(name, options); err != nil {
+			r.Logger.Error("[admin] Failed to add listener '%s': %v", name, err)
+			status := http.StatusConflict
+			if err == errListenerNotAllowed {
+				status = http.StatusForbidden
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+}
+
+func (r *ListenerRegistry) handleStats(w http.ResponseWriter, name, stats string) {
+	l := r.get(name)
+	if l == nil {
+		http.Error(w, "unknown listener '"+name+"'", http.StatusNotFound)
+		return
+	}
+	switch codec, ok := l.Codec.(GraphiteCodec); {
+	case stats == "churn" && l.Churn != nil:
+		writeJSON(w, http.StatusOK, l.Churn.Churners())
+	case stats == "mutator" && ok:
+		writeJSON(w, http.StatusOK, codec.MutatorStats())
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
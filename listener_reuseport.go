@@ -0,0 +1,54 @@
+package metcap
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// SO_REUSEPORT on Linux, syscall package doesn't define it
+const soReusePort = 0xf
+
+// listenTCP opens the listening socket, or [accept_loops] of them bound to
+// the same port with SO_REUSEPORT when [reuseport] is set, so the kernel
+// spreads new connections over several accept loops
+func listenTCP(c ListenerConfig) ([]net.Listener, error) {
+	addr := ":" + strconv.Itoa(c.Port)
+	if !c.ReusePort {
+		sock, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{sock}, nil
+	}
+
+	loops := c.AcceptLoops
+	if loops <= 0 {
+		loops = defaultWorkers()
+	}
+	lc := net.ListenConfig{
+		Control: func(network, address string, conn syscall.RawConn) error {
+			var sockErr error
+			err := conn.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	var socks []net.Listener
+	for n := 0; n < loops; n++ {
+		sock, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			for _, s := range socks {
+				s.Close()
+			}
+			return nil, err
+		}
+		socks = append(socks, sock)
+	}
+	return socks, nil
+}
@@ -0,0 +1,144 @@
+package metcap
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// readCut feeds data to a listener's connection reader and returns what it
+// hands on for decoding once the connection's closed
+func readCut(t *testing.T, c ListenerConfig, data string) string {
+	l := &Listener{Name: "test", Config: c, Logger: testLogger(), Stats: NewListenerStats()}
+	client, server := net.Pipe()
+	defer client.Close()
+	go client.Write([]byte(data))
+
+	pipe := make(chan *connData, 1)
+	l.ConnWg.Add(1)
+	l.Stats.ConnOpen.Increment(1)
+	l.read(server, &pipe, time.Now())
+	select {
+	case d := <-pipe:
+		return d.buf.String()
+	default:
+		t.Fatal("nothing handed on for decoding")
+	}
+	return ""
+}
+
+func TestListenerIdleCut(t *testing.T) {
+	c := ListenerConfig{IdleTimeout: configDuration{100 * time.Millisecond}}
+	if out := readCut(t, c, "a.b 1 100\na.b 2"); out != "a.b 1 100\n" {
+		t.Errorf("idle connection decoded %q", out)
+	}
+	if out := readCut(t, c, "a.b 2"); out != "" {
+		t.Errorf("idle connection decoded %q", out)
+	}
+}
+
+func TestListenerSlowCut(t *testing.T) {
+	c := ListenerConfig{MinRate: 1 << 20, MinRateGrace: configDuration{100 * time.Millisecond}}
+	if out := readCut(t, c, "a.b 1 100\na.b 2"); out != "a.b 1 100\n" {
+		t.Errorf("slow connection decoded %q", out)
+	}
+}
+
+func hmacListener(t *testing.T) *Listener {
+	keys := filepath.Join(t.TempDir(), "keys")
+	if err := ioutil.WriteFile(keys, []byte("sender s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c := ListenerConfig{HMACKeysFile: keys, Ack: true}
+	verifier, err := NewHMACVerifier(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Listener{Name: "test", Config: c, HMAC: verifier, Logger: testLogger(), Stats: NewListenerStats()}
+}
+
+func hmacSign(signed time.Time, payload string) string {
+	ts := strconv.FormatInt(signed.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(ts + "\n" + payload))
+	return fmt.Sprintf("%s sender %s %s\n%s", hmacHeader, ts, hex.EncodeToString(mac.Sum(nil)), payload)
+}
+
+func TestHMACVerify(t *testing.T) {
+	l := hmacListener(t)
+	payload := "a.b 1 100\n"
+	for _, tc := range []struct {
+		input string
+		err   error
+	}{
+		{hmacSign(time.Now(), payload), nil},
+		{hmacSign(time.Now().Add(-time.Hour), payload), errHMACExpired},
+		{hmacSign(time.Now().Add(time.Hour), payload), errHMACExpired},
+		{hmacSign(time.Now(), payload) + "a.b 2 100\n", errHMACMismatch},
+		{payload, errHMACUnsigned},
+	} {
+		out, _, err := l.HMAC.Verify([]byte(tc.input))
+		if err != tc.err {
+			t.Errorf("%q: error %v, not %v", tc.input, err, tc.err)
+		}
+		if err == nil && string(out) != payload {
+			t.Errorf("%q: verified %q", tc.input, out)
+		}
+	}
+}
+
+// TestHMACAck checks acks are sent only for batches verified
+func TestHMACAck(t *testing.T) {
+	for _, tc := range []struct {
+		batch string
+		ack   string
+	}{
+		{hmacSign(time.Now(), "a.b 1 100\na.b 2 100\n"), "ack 2\n"},
+		{hmacSign(time.Now(), "a.b 1 100\n") + "a.b 2 100\n", ""},
+		{"a.b 1 100\na.b 2 100\n", ""},
+	} {
+		l := hmacListener(t)
+		sock, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := net.Dial("tcp", sock.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := sock.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sock.Close()
+		client.Write([]byte("metcap-ack 1\n" + tc.batch))
+		client.(*net.TCPConn).CloseWrite()
+
+		pipe := make(chan *connData, 1)
+		l.ConnWg.Add(1)
+		l.Stats.ConnOpen.Increment(1)
+		l.read(server, &pipe, time.Now())
+		acks, _ := ioutil.ReadAll(client)
+		client.Close()
+		if string(acks) != tc.ack {
+			t.Errorf("%q got acks %q, not %q", tc.batch, acks, tc.ack)
+		}
+		select {
+		case d := <-pipe:
+			if tc.ack == "" || !d.verified {
+				t.Errorf("%q handed on unverified", tc.batch)
+			}
+		default:
+			if tc.ack != "" {
+				t.Errorf("%q not handed on", tc.batch)
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package metcap
+
+import (
+	"crypto/tls"
+	"errors"
+	"strings"
+)
+
+// SNIRoute decodes TLS connections for the server name with a codec of its
+// own and puts the metrics under the tenant, so one port can take several
+// protocols and tenants
+type SNIRoute struct {
+	ServerName string
+	Codec      Codec
+	CodecName  string
+	Tenant     string
+}
+
+// newTLSConfig loads the listener's [tls_cert] and [tls_key], TLS is off
+// without them
+func newTLSConfig(c ListenerConfig) (*tls.Config, error) {
+	if c.TLSCert == "" && c.TLSKey == "" {
+		return nil, nil
+	}
+	if c.Protocol == "udp" {
+		return nil, errors.New("TLS requires tcp protocol")
+	}
+	cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// newSNIRoutes sets up the codecs of the [[sni]] routes, taking the
+// listener's codec options unless the route overrides them
+func newSNIRoutes(name string, c ListenerConfig, stats *ListenerStats, logger *Logger) ([]SNIRoute, error) {
+	if len(c.SNI) == 0 {
+		return nil, nil
+	}
+	if c.TLSCert == "" {
+		return nil, errors.New("SNI routes require tls_cert and tls_key")
+	}
+	var routes []SNIRoute
+	for _, rc := range c.SNI {
+		if rc.ServerName == "" {
+			return nil, errors.New("missing server_name")
+		}
+		rcc := c
+		if rc.Codec != "" {
+			rcc.Codec = rc.Codec
+		}
+		if rc.MutatorFile != "" {
+			rcc.MutatorFile, rcc.MutatorFiles, rcc.MutatorDir = rc.MutatorFile, nil, ""
+		}
+		if rc.ExtractFile != "" {
+			rcc.ExtractFile = rc.ExtractFile
+		}
+		codec, err := newCodec(name, rcc, stats, logger)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("[listener:%s] Routing TLS connections for '%s' to %s codec", name, rc.ServerName, rcc.Codec)
+		routes = append(routes, SNIRoute{strings.ToLower(rc.ServerName), codec, rcc.Codec, rc.Tenant})
+	}
+	return routes, nil
+}
+
+// matches the server name exactly or by "*." wildcard of one label
+func (r SNIRoute) matches(serverName string) bool {
+	if strings.HasPrefix(r.ServerName, "*.") {
+		dot := strings.IndexByte(serverName, '.')
+		return dot > 0 && serverName[dot:] == r.ServerName[1:]
+	}
+	return serverName == r.ServerName
+}
+
+// route picks the first route matching the server name, the listener's
+// codec with no tenant if there's none
+func (l *Listener) route(serverName string) SNIRoute {
+	if serverName != "" {
+		serverName = strings.ToLower(serverName)
+		for _, r := range l.Routes {
+			if r.matches(serverName) {
+				return r
+			}
+		}
+	}
+	return SNIRoute{Codec: l.Codec, CodecName: l.Config.Codec}
+}
@@ -0,0 +1,112 @@
+package metcap
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// readPackets treats every datagram as a batch of lines, like the InfluxDB UDP
+// service Telegraf's UDP output expects. Nothing is ever sent back.
+func (l *Listener) readPackets(pipe *chan *connData) {
+	size := l.Config.PayloadSize
+	if size <= 0 {
+		size = 65536
+	}
+	// one byte extra to tell apart datagrams truncated by the kernel
+	buf := make([]byte, size+1)
+
+	for {
+		n, addr, err := l.Packet.ReadFrom(buf)
+		if err != nil {
+			if nErr, ok := err.(net.Error); ok && nErr.Temporary() {
+				l.Stats.UDPReadFailed.Increment(1)
+				continue
+			}
+			l.Logger.Error("[listener:%s] Can't read datagram: %v", l.Name, err)
+			return
+		}
+		l.Stats.UDPDatagrams.Increment(1)
+		l.Stats.UDPBytes.Increment(n)
+		if n > size {
+			// the tail is lost, don't index a partial batch with a cut-off line
+			l.Stats.UDPOversized.Increment(1)
+			l.Logger.Error("[listener:%s] Dropping datagram from %s exceeding %d bytes", l.Name, addr.String(), size)
+			continue
+		}
+		if l.Budget != nil && l.Budget.Banned(sourceHost(addr)) {
+			l.Stats.ConnBanned.Increment(1)
+			continue
+		}
+		data := bytes.NewBuffer(make([]byte, 0, n))
+		data.Write(buf[:n])
+		l.DataWg.Add(1)
+		*pipe <- &connData{buf: data, remote: addr}
+	}
+}
+
+// setReadBuffer asks the kernel for SO_RCVBUF of the given size, it's capped
+// by net.core.rmem_max (and doubled by Linux for bookkeeping), so the size
+// actually granted is read back and returned
+func setReadBuffer(packet net.PacketConn, size int) (int, error) {
+	conn, ok := packet.(*net.UDPConn)
+	if !ok {
+		return 0, fmt.Errorf("not an UDP socket")
+	}
+	if err := conn.SetReadBuffer(size); err != nil {
+		return 0, err
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var granted int
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		granted, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return granted, sockErr
+}
+
+// udpSocketStats reads receive queue length and drop counter of the socket
+// bound to port from /proc/net/udp{,6}, those are the datagrams lost in the
+// kernel before metcap got to read them
+func udpSocketStats(port int) (rxQueue int64, drops int64, err error) {
+	hexPort := fmt.Sprintf(":%04X", port)
+	found := false
+	for _, file := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		f, err := os.Open(file)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // header
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 13 || !strings.HasSuffix(fields[1], hexPort) {
+				continue
+			}
+			queues := strings.SplitN(fields[4], ":", 2)
+			if len(queues) == 2 {
+				q, _ := strconv.ParseInt(queues[1], 16, 64)
+				rxQueue += q
+			}
+			d, _ := strconv.ParseInt(fields[12], 10, 64)
+			drops += d
+			found = true
+		}
+		f.Close()
+	}
+	if !found {
+		return 0, 0, fmt.Errorf("socket on port %d not found in /proc/net/udp", port)
+	}
+	return rxQueue, drops, nil
+}
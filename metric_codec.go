@@ -0,0 +1,297 @@
+package metcap
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// MetricCodec serializes metrics for the transport buffer
+//
+// Every format but msgpack prepends a format tag byte, so readers can decode
+// whatever format the writing node was configured with. Msgpack stays
+// untagged, as that's what nodes predating the tags read and write.
+type MetricCodec interface {
+	Marshal(*Metric) ([]byte, error)
+	Unmarshal([]byte, *Metric) error
+	ContentType() string
+}
+
+const (
+	metricTagJSON     byte = 0x01
+	metricTagGob      byte = 0x02
+	metricTagProtobuf byte = 0x03
+)
+
+// NewMetricCodec returns serialization codec by name, defaults to msgpack
+func NewMetricCodec(format string) (MetricCodec, error) {
+	switch format {
+	case "", "msgpack":
+		return MsgpackMetricCodec{}, nil
+	case "json":
+		return JSONMetricCodec{}, nil
+	case "gob":
+		return GobMetricCodec{}, nil
+	case "protobuf":
+		return ProtobufMetricCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unknown serialization format '%s'", format)
+	}
+}
+
+// DecodeMetric detects the format tag and deserializes the metric
+func DecodeMetric(data []byte) (Metric, error) {
+	var (
+		m     Metric
+		codec MetricCodec
+	)
+	if len(data) == 0 {
+		return Metric{}, errors.New("empty serialized metric")
+	}
+	switch data[0] {
+	case metricTagJSON:
+		codec = JSONMetricCodec{}
+	case metricTagGob:
+		codec = GobMetricCodec{}
+	case metricTagProtobuf:
+		codec = ProtobufMetricCodec{}
+	case metricTagEncrypted:
+		return Metric{}, errors.New("encrypted metric, encryption key isn't configured")
+	default:
+		codec = MsgpackMetricCodec{}
+	}
+	if err := codec.Unmarshal(data, &m); err != nil {
+		return Metric{}, err
+	}
+	return m, nil
+}
+
+// ----- msgpack -----
+type MsgpackMetricCodec struct{}
+
+func (MsgpackMetricCodec) Marshal(m *Metric) ([]byte, error) {
+	return msgpack.Marshal(m)
+}
+
+func (MsgpackMetricCodec) Unmarshal(data []byte, m *Metric) error {
+	return msgpack.Unmarshal(data, m)
+}
+
+func (MsgpackMetricCodec) ContentType() string { return "application/msgpack" }
+
+// ----- JSON -----
+type JSONMetricCodec struct{}
+
+func (JSONMetricCodec) Marshal(m *Metric) ([]byte, error) {
+	out, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{metricTagJSON}, out...), nil
+}
+
+func (JSONMetricCodec) Unmarshal(data []byte, m *Metric) error {
+	return json.Unmarshal(data[1:], m)
+}
+
+func (JSONMetricCodec) ContentType() string { return "application/json" }
+
+// ----- gob -----
+type GobMetricCodec struct{}
+
+func (GobMetricCodec) Marshal(m *Metric) ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{metricTagGob})
+	if err := gob.NewEncoder(buf).Encode(m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobMetricCodec) Unmarshal(data []byte, m *Metric) error {
+	return gob.NewDecoder(bytes.NewReader(data[1:])).Decode(m)
+}
+
+func (GobMetricCodec) ContentType() string { return "application/x-gob" }
+
+// ----- protobuf -----
+//
+//	message Metric {
+//	  string name = 1;
+//	  int64 timestamp = 2; // Unix nanoseconds
+//	  double value = 3;
+//	  map<string, string> fields = 4;
+//	  bool ok = 5;
+//	  Aggregate agg = 6;
+//	  string raw = 7;
+//	}
+//
+//	message Aggregate {
+//	  double sum = 1;
+//	  double count = 2;
+//	  double min = 3;
+//	  double max = 4;
+//	}
+type ProtobufMetricCodec struct{}
+
+func (ProtobufMetricCodec) Marshal(m *Metric) ([]byte, error) {
+	b := []byte{metricTagProtobuf}
+	b = protoAppendString(b, 1, m.Name)
+	b = protoAppendTag(b, 2, protoVarint)
+	b = protoAppendVarint(b, uint64(m.Timestamp.UnixNano()))
+	b = protoAppendDouble(b, 3, m.Value)
+	for _, k := range sortedKeys(m.Fields) { // same metric, same bytes
+		var entry []byte
+		entry = protoAppendString(entry, 1, k)
+		entry = protoAppendString(entry, 2, m.Fields[k])
+		b = protoAppendBytes(b, 4, entry)
+	}
+	if m.OK {
+		b = protoAppendTag(b, 5, protoVarint)
+		b = protoAppendVarint(b, 1)
+	}
+	if a := m.Aggregate; a != nil {
+		var agg []byte
+		agg = protoAppendDouble(agg, 1, a.Sum)
+		agg = protoAppendDouble(agg, 2, a.Count)
+		agg = protoAppendDouble(agg, 3, a.Min)
+		agg = protoAppendDouble(agg, 4, a.Max)
+		b = protoAppendBytes(b, 6, agg)
+	}
+	if m.Raw != "" {
+		b = protoAppendString(b, 7, m.Raw)
+	}
+	return b, nil
+}
+
+func (ProtobufMetricCodec) Unmarshal(data []byte, m *Metric) error {
+	r := &protoReader{buf: data[1:]}
+	m.Fields = make(map[string]string)
+	for !r.done() {
+		field, wireType, err := r.next()
+		if err != nil {
+			return err
+		}
+		switch {
+		case field == 1 && wireType == protoBytes:
+			name, err := r.bytes()
+			if err != nil {
+				return err
+			}
+			m.Name = string(name)
+		case field == 2 && wireType == protoVarint:
+			ts, err := r.varint()
+			if err != nil {
+				return err
+			}
+			m.Timestamp = time.Unix(0, int64(ts))
+		case field == 3 && wireType == protoFixed64:
+			if m.Value, err = r.double(); err != nil {
+				return err
+			}
+		case field == 4 && wireType == protoBytes:
+			entry, err := r.bytes()
+			if err != nil {
+				return err
+			}
+			k, v, err := protoMapEntry(entry)
+			if err != nil {
+				return err
+			}
+			m.Fields[k] = v
+		case field == 5 && wireType == protoVarint:
+			ok, err := r.varint()
+			if err != nil {
+				return err
+			}
+			m.OK = ok != 0
+		case field == 6 && wireType == protoBytes:
+			entry, err := r.bytes()
+			if err != nil {
+				return err
+			}
+			if m.Aggregate, err = protoAggregate(entry); err != nil {
+				return err
+			}
+		case field == 7 && wireType == protoBytes:
+			raw, err := r.bytes()
+			if err != nil {
+				return err
+			}
+			m.Raw = string(raw)
+		default:
+			if err := r.skip(wireType); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (ProtobufMetricCodec) ContentType() string { return "application/x-protobuf" }
+
+// protoAggregate reads the Aggregate message
+func protoAggregate(data []byte) (*Aggregate, error) {
+	a := &Aggregate{}
+	r := &protoReader{buf: data}
+	for !r.done() {
+		field, wireType, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		if wireType != protoFixed64 {
+			if err := r.skip(wireType); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		v, err := r.double()
+		if err != nil {
+			return nil, err
+		}
+		switch field {
+		case 1:
+			a.Sum = v
+		case 2:
+			a.Count = v
+		case 3:
+			a.Min = v
+		case 4:
+			a.Max = v
+		}
+	}
+	return a, nil
+}
+
+// protoMapEntry reads key (1) and value (2) of a map<string, string> entry
+func protoMapEntry(data []byte) (string, string, error) {
+	var k, v string
+	r := &protoReader{buf: data}
+	for !r.done() {
+		field, wireType, err := r.next()
+		if err != nil {
+			return "", "", err
+		}
+		if wireType != protoBytes {
+			if err := r.skip(wireType); err != nil {
+				return "", "", err
+			}
+			continue
+		}
+		val, err := r.bytes()
+		if err != nil {
+			return "", "", err
+		}
+		switch field {
+		case 1:
+			k = string(val)
+		case 2:
+			v = string(val)
+		}
+	}
+	return k, v, nil
+}
@@ -0,0 +1,333 @@
+package metcap
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricMath derives a series from an expression over others, ie.
+// `mem_used_pct = mem_used / mem_total * 100`. Metrics named in the
+// expression are joined on the [join] fields (ie. host); once all of them
+// came for a join key within [window] (default 1m) of each other, the
+// result is emitted as a metric named by the left side, with the join
+// fields and the newest timestamp, and the key starts over. The metrics
+// themselves pass on unchanged. Expressions take + - * /, parentheses and
+// numbers; division by zero emits nothing. Names with other characters than
+// letters, digits, "_", "." and ":" (ie. "-", which would subtract) are
+// quoted in single quotes, ie. `'db-01.load' * 100`.
+type MetricMath struct {
+	Name    string
+	Expr    mathExpr
+	Vars    []string
+	Join    []string
+	Window  time.Duration
+	Derived *StatsCounter
+	Failed  *StatsCounter
+
+	emit    func(*Metric)
+	pending map[string]*mathPoints
+	pruned  time.Time
+	mux     *sync.Mutex
+}
+
+type mathPoints struct {
+	values map[string]float64
+	ts     map[string]time.Time
+}
+
+func NewMetricMath(c ProcessorConfig) (*MetricMath, error) {
+	eq := strings.IndexByte(c.Expression, '=')
+	if eq < 0 {
+		return nil, errors.New("expression needs the form 'name = expression'")
+	}
+	name := strings.Trim(strings.TrimSpace(c.Expression[:eq]), "'")
+	if name == "" {
+		return nil, errors.New("missing name of the derived metric")
+	}
+	p := &mathParser{input: c.Expression[eq+1:]}
+	expr, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	mm := &MetricMath{
+		Name:    name,
+		Expr:    expr,
+		Vars:    p.vars,
+		Join:    c.Join,
+		Window:  c.Window.Duration,
+		Derived: NewStatsCounter(time.Now()),
+		Failed:  NewStatsCounter(time.Now()),
+		pending: make(map[string]*mathPoints),
+		pruned:  time.Now(),
+		mux:     &sync.Mutex{},
+	}
+	if mm.Window <= 0 {
+		mm.Window = time.Minute
+	}
+	if len(mm.Vars) == 0 {
+		return nil, errors.New("expression uses no metrics")
+	}
+	return mm, nil
+}
+
+// SetEmit makes the processor an Emitter
+func (mm *MetricMath) SetEmit(emit func(*Metric)) {
+	mm.emit = emit
+}
+
+func (mm *MetricMath) isVar(name string) bool {
+	for _, v := range mm.Vars {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (mm *MetricMath) Process(m *Metric) bool {
+	if !mm.isVar(m.Name) {
+		return true
+	}
+	keyParts := make([]string, len(mm.Join))
+	for i, f := range mm.Join {
+		keyParts[i] = m.Fields[f]
+	}
+	key := strings.Join(keyParts, "\x00")
+
+	mm.mux.Lock()
+	mm.prune(time.Now())
+	p, ok := mm.pending[key]
+	if !ok {
+		p = &mathPoints{values: make(map[string]float64), ts: make(map[string]time.Time)}
+		mm.pending[key] = p
+	}
+	p.values[m.Name], p.ts[m.Name] = m.Value, m.Timestamp
+	var newest time.Time
+	for name, ts := range p.ts {
+		if m.Timestamp.Sub(ts) > mm.Window || ts.Sub(m.Timestamp) > mm.Window {
+			delete(p.values, name) // too far apart to be joined
+			delete(p.ts, name)
+			continue
+		}
+		if ts.After(newest) {
+			newest = ts
+		}
+	}
+	if len(p.values) < len(mm.Vars) {
+		mm.mux.Unlock()
+		return true
+	}
+	values := p.values
+	delete(mm.pending, key)
+	mm.mux.Unlock()
+
+	value := mm.Expr.eval(values)
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		mm.Failed.Increment(1)
+		return true
+	}
+	fields := make(map[string]string, len(mm.Join))
+	for i, f := range mm.Join {
+		if keyParts[i] != "" {
+			fields[f] = keyParts[i]
+		}
+	}
+	mm.Derived.Increment(1)
+	if mm.emit != nil {
+		mm.emit(&Metric{Name: mm.Name, Timestamp: newest, Value: value, Fields: fields, OK: true})
+	}
+	return true
+}
+
+// prune drops join keys incomplete for longer than the window
+func (mm *MetricMath) prune(now time.Time) {
+	if now.Sub(mm.pruned) < mm.Window {
+		return
+	}
+	mm.pruned = now
+	for key, p := range mm.pending {
+		stale := true
+		for _, ts := range p.ts {
+			if now.Sub(ts) <= mm.Window {
+				stale = false
+				break
+			}
+		}
+		if stale {
+			delete(mm.pending, key)
+		}
+	}
+}
+
+// ----- expressions -----
+
+type mathExpr interface {
+	eval(vars map[string]float64) float64
+}
+
+type mathNum float64
+type mathVar string
+type mathOp struct {
+	op          byte
+	left, right mathExpr
+}
+
+func (n mathNum) eval(map[string]float64) float64 { return float64(n) }
+func (v mathVar) eval(vars map[string]float64) float64 {
+	return vars[string(v)]
+}
+
+func (o mathOp) eval(vars map[string]float64) float64 {
+	l, r := o.left.eval(vars), o.right.eval(vars)
+	switch o.op {
+	case '+':
+		return l + r
+	case '-':
+		return l - r
+	case '*':
+		return l * r
+	}
+	if r == 0 {
+		return math.NaN()
+	}
+	return l / r
+}
+
+// mathParser reads expressions by the grammar:
+//
+//	expr   = term { ("+" | "-") term }
+//	term   = factor { ("*" | "/") factor }
+//	factor = number | name | "(" expr ")" | "-" factor
+type mathParser struct {
+	input string
+	pos   int
+	vars  []string
+}
+
+func (p *mathParser) parse() (mathExpr, error) {
+	e, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.input) {
+		return nil, fmt.Errorf("unexpected '%s' at %d", p.input[p.pos:], p.pos)
+	}
+	return e, nil
+}
+
+func (p *mathParser) skipSpace() {
+	for p.pos < len(p.input) && (p.input[p.pos] == ' ' || p.input[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *mathParser) peek() byte {
+	if p.skipSpace(); p.pos < len(p.input) {
+		return p.input[p.pos]
+	}
+	return 0
+}
+
+func (p *mathParser) expr() (mathExpr, error) {
+	left, err := p.term()
+	for err == nil && (p.peek() == '+' || p.peek() == '-') {
+		op := p.input[p.pos]
+		p.pos++
+		var right mathExpr
+		if right, err = p.term(); err == nil {
+			left = mathOp{op, left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *mathParser) term() (mathExpr, error) {
+	left, err := p.factor()
+	for err == nil && (p.peek() == '*' || p.peek() == '/') {
+		op := p.input[p.pos]
+		p.pos++
+		var right mathExpr
+		if right, err = p.factor(); err == nil {
+			left = mathOp{op, left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *mathParser) factor() (mathExpr, error) {
+	c := p.peek()
+	switch {
+	case c == '(':
+		p.pos++
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ')' at %d", p.pos)
+		}
+		p.pos++
+		return e, nil
+	case c == '-':
+		p.pos++
+		e, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		return mathOp{'-', mathNum(0), e}, nil
+	case c >= '0' && c <= '9' || c == '.':
+		start := p.pos
+		for p.pos < len(p.input) && (p.input[p.pos] >= '0' && p.input[p.pos] <= '9' || p.input[p.pos] == '.') {
+			p.pos++
+		}
+		n, err := strconv.ParseFloat(p.input[start:p.pos], 64)
+		if err != nil {
+			return nil, err
+		}
+		return mathNum(n), nil
+	case c == '\'':
+		end := strings.IndexByte(p.input[p.pos+1:], '\'')
+		if end < 0 {
+			return nil, fmt.Errorf("missing closing quote of name at %d", p.pos)
+		}
+		name := p.input[p.pos+1 : p.pos+1+end]
+		if name == "" {
+			return nil, fmt.Errorf("empty name at %d", p.pos)
+		}
+		p.pos += end + 2
+		return p.variable(name), nil
+	case isMathNameChar(c, true):
+		start := p.pos
+		for p.pos < len(p.input) && isMathNameChar(p.input[p.pos], false) {
+			p.pos++
+		}
+		return p.variable(p.input[start:p.pos]), nil
+	case c == 0:
+		return nil, errors.New("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected '%c' at %d", c, p.pos)
+}
+
+// variable registers the metric name the expression reads
+func (p *mathParser) variable(name string) mathExpr {
+	known := false
+	for _, v := range p.vars {
+		known = known || v == name
+	}
+	if !known {
+		p.vars = append(p.vars, name)
+	}
+	return mathVar(name)
+}
+
+// unquoted metric names take letters, digits, "_", "." and ":" (of mutated
+// graphite names), not starting with digit, dot or colon
+func isMathNameChar(c byte, first bool) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' ||
+		!first && (c >= '0' && c <= '9' || c == '.' || c == ':')
+}
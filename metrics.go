@@ -3,6 +3,9 @@ package metcap
 import (
 	"encoding/json"
 	"fmt"
+	"math"
+	"sort"
+	"strings"
 	"time"
 
 	"gopkg.in/vmihailenco/msgpack.v2"
@@ -16,10 +19,38 @@ type Metric struct {
 	Value     float64           `json:"value"`
 	Fields    map[string]string `json:"fields"`
 	OK        bool              `json:"ok"`
+	ExpireAt  *time.Time        `json:"expire_at,omitempty"`
+	Aggregate *Aggregate        `json:"agg,omitempty"`
+	Raw       string            `json:"raw,omitempty" msgpack:",omitempty"` // input line, see [raw_lines]
+}
+
+// Aggregate is the tuple of a metric aggregated by the sender (ie. statsd
+// repeater), the metric's value is then the mean
+type Aggregate struct {
+	Sum   float64 `json:"sum"`
+	Count float64 `json:"count"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+}
+
+// Valid tells whether the members are finite and of some samples, as
+// documents with NaN or infinite ones fail to render
+func (a *Aggregate) Valid() error {
+	for _, v := range []float64{a.Sum, a.Count, a.Min, a.Max} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("non-finite aggregate member %v", v)
+		}
+	}
+	if a.Count <= 0 {
+		return fmt.Errorf("aggregate of %v samples", a.Count)
+	}
+	return nil
 }
 
 type Metrics []Metric
 
+// JSON renders the metric with the fields sorted by key (encoding/json
+// sorts map keys), so equal metrics give equal documents
 func (m *Metric) JSON() []byte {
 	out, err := json.Marshal(m)
 	if err != nil {
@@ -36,18 +67,50 @@ func (m *Metric) Serialize() []byte {
 	return out
 }
 
+// Copy returns a copy of the metric not sharing the fields
+func (m *Metric) Copy() *Metric {
+	out := *m
+	out.Fields = make(map[string]string, len(m.Fields))
+	for k, v := range m.Fields {
+		out.Fields[k] = v
+	}
+	if m.Aggregate != nil {
+		agg := *m.Aggregate
+		out.Aggregate = &agg
+	}
+	return &out
+}
+
+// SeriesID identifies the series by name and sorted fields
+func (m *Metric) SeriesID() string {
+	keys := sortedKeys(m.Fields)
+	id := make([]string, 0, len(keys)+1)
+	id = append(id, m.Name)
+	for _, k := range keys {
+		id = append(id, k+"="+m.Fields[k])
+	}
+	return strings.Join(id, ",")
+}
+
+// sortedKeys returns the keys of fields in order, for whatever depends on
+// the order of fields not to depend on Go's random map iteration
+func sortedKeys(fields map[string]string) []string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func (m *Metric) Index(name string) string {
 	t := m.Timestamp.UTC()
 	return fmt.Sprintf("%s-%d.%02d.%02d", name, t.Year(), int(t.Month()), t.Day())
 }
 
+// DeserializeMetric decodes metric serialized with any of the MetricCodecs
 func DeserializeMetric(data string) (Metric, error) {
-	var m Metric
-	err := msgpack.Unmarshal([]byte(data), &m)
-	if err != nil {
-		return Metric{}, err
-	}
-	return m, nil
+	return DecodeMetric([]byte(data))
 }
 
 /// generate Metric from JSON
@@ -0,0 +1,97 @@
+package metcap
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NormalizePreset rewrites metric names and field keys into the form a
+// target system accepts
+type NormalizePreset struct {
+	Name  string
+	name  func(string) string
+	field func(string) string
+}
+
+var normalizePresets = map[string]NormalizePreset{
+	// [a-zA-Z_:][a-zA-Z0-9_:]* names, [a-zA-Z_][a-zA-Z0-9_]* labels, "__" is reserved
+	"prometheus_safe": {
+		Name: "prometheus_safe",
+		name: func(s string) string {
+			return leadingDigit(replaceInvalid(s, isWordChar(":")))
+		},
+		field: func(s string) string {
+			return strings.TrimLeft(leadingDigit(replaceInvalid(s, isWordChar(""))), "_")
+		},
+	},
+	// dots in field keys make object mappings, leading "_" is for meta fields
+	"es_safe": {
+		Name: "es_safe",
+		name: func(s string) string { return s },
+		field: func(s string) string {
+			return strings.TrimLeft(strings.Replace(s, ".", "_", -1), "_")
+		},
+	},
+	// dotted hierarchy, so the ":" joining mutator name parts becomes "."
+	"graphite_safe": {
+		Name: "graphite_safe",
+		name: func(s string) string {
+			return replaceInvalid(strings.Replace(s, ":", ".", -1), isWordChar("-."))
+		},
+		field: func(s string) string {
+			return replaceInvalid(s, isWordChar("-"))
+		},
+	},
+}
+
+func NewNormalizePreset(name string) (*NormalizePreset, error) {
+	if name == "" {
+		return nil, nil
+	}
+	p, ok := normalizePresets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown normalization preset '%s'", name)
+	}
+	return &p, nil
+}
+
+// Normalize returns normalized copy of the metric
+func (p *NormalizePreset) Normalize(m *Metric) *Metric {
+	out := *m
+	out.Name = p.name(m.Name)
+	out.Fields = make(map[string]string, len(m.Fields))
+	// in order, so of keys normalized to the same one the last sorted wins
+	for _, k := range sortedKeys(m.Fields) {
+		if nk := p.field(k); nk != "" {
+			out.Fields[nk] = m.Fields[k]
+		}
+	}
+	return &out
+}
+
+// BeforeIndex makes the preset a WriterHook
+func (p *NormalizePreset) BeforeIndex(m *Metric) (*Metric, bool) {
+	return p.Normalize(m), true
+}
+
+func isWordChar(extra string) func(rune) bool {
+	return func(r rune) bool {
+		return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || strings.ContainsRune(extra, r)
+	}
+}
+
+func replaceInvalid(s string, valid func(rune) bool) string {
+	return strings.Map(func(r rune) rune {
+		if valid(r) {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+func leadingDigit(s string) string {
+	if s != "" && s[0] >= '0' && s[0] <= '9' {
+		return "_" + s
+	}
+	return s
+}
@@ -0,0 +1,165 @@
+package metcap
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/redis.v4"
+)
+
+// OpState holds the intentional degradations operators switch on through
+// the admin API: "paused" stops the writer consuming the transport (metrics
+// pile up there, ie. for ElasticSearch maintenance), "draining" makes the
+// listeners refuse new connections (so load balancers move senders away)
+// and "sampling" applies the on-demand sampling rules. With [redis_url] set
+// the state is kept in Redis, so it survives restarts until cleared.
+type OpState struct {
+	Redis  *redis.Client
+	Key    string
+	Logger *Logger
+
+	mux     *sync.Mutex
+	flags   map[string]bool
+	changed chan struct{}
+}
+
+var opStateFlags = []string{"paused", "draining", "sampling"}
+
+func NewOpState(c *StateConfig, logger *Logger) (*OpState, error) {
+	s := &OpState{
+		Key:     c.Key,
+		Logger:  logger,
+		mux:     &sync.Mutex{},
+		flags:   make(map[string]bool),
+		changed: make(chan struct{}),
+	}
+	if s.Key == "" {
+		s.Key = "metcap:state"
+	}
+	if c.RedisURL == "" {
+		return s, nil
+	}
+	conn, err := newRedisClient(&TransportConfig{RedisURL: c.RedisURL})
+	if err != nil {
+		return nil, err
+	}
+	s.Redis = conn
+	stored, err := conn.HGetAll(s.Key).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, flag := range opStateFlags {
+		if stored[flag] != "" {
+			s.flags[flag] = true
+			logger.Info("[engine] Restored '%s' state set at %s", flag, stored[flag])
+		}
+	}
+	return s, nil
+}
+
+// Get tells whether the flag is on, always off without state
+func (s *OpState) Get(flag string) bool {
+	if s == nil {
+		return false
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.flags[flag]
+}
+
+// Watch returns the flag along with channel closed on the next change
+func (s *OpState) Watch(flag string) (bool, <-chan struct{}) {
+	if s == nil {
+		return false, nil
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.flags[flag], s.changed
+}
+
+// Set switches the flag, it's persisted first so the change is refused if
+// it couldn't be; both under the lock, so concurrent switches can't leave
+// Redis and the flags apart
+func (s *OpState) Set(flag string, on bool) error {
+	if !isOpStateFlag(flag) {
+		return fmt.Errorf("unknown state '%s'", flag)
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.Redis != nil {
+		var err error
+		if on {
+			err = s.Redis.HSet(s.Key, flag, time.Now().UTC().Format(time.RFC3339)).Err()
+		} else {
+			err = s.Redis.HDel(s.Key, flag).Err()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if s.flags[flag] == on {
+		return nil
+	}
+	s.flags[flag] = on
+	close(s.changed)
+	s.changed = make(chan struct{})
+	if on {
+		s.Logger.Info("[engine] State '%s' switched on", flag)
+	} else {
+		s.Logger.Info("[engine] State '%s' switched off", flag)
+	}
+	return nil
+}
+
+func isOpStateFlag(flag string) bool {
+	for _, f := range opStateFlags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *OpState) snapshot() map[string]bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	out := make(map[string]bool, len(opStateFlags))
+	for _, flag := range opStateFlags {
+		out[flag] = s.flags[flag]
+	}
+	return out
+}
+
+// Register adds the state endpoints to the admin API, changes require its
+// token
+func (s *OpState) Register(a *Admin) {
+	a.HandleJSON("/state", func() interface{} { return s.snapshot() })
+	a.HandleAuth("/state/", s.handleSet)
+}
+
+// handleSet: PUT /state/{flag} switches it on, DELETE /state/{flag} off
+func (s *OpState) handleSet(w http.ResponseWriter, req *http.Request) {
+	var on bool
+	switch req.Method {
+	case "PUT", "POST":
+		on = true
+	case "DELETE":
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flag := strings.TrimPrefix(req.URL.Path, "/state/")
+	if !isOpStateFlag(flag) {
+		http.Error(w, "unknown state '"+flag+"'", http.StatusNotFound)
+		return
+	}
+	if err := s.Set(flag, on); err != nil {
+		s.Logger.Error("[engine] Failed to persist state '%s': %v", flag, err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.snapshot())
+}
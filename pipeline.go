@@ -0,0 +1,266 @@
+package metcap
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+// Pipeline is an explicitly declared route of metrics: the listeners it
+// takes as inputs decode into its own transport (a separate Redis queue,
+// AMQP tag or channel) through its processors, and every output writer gets
+// all the metrics of the transport. Without any [pipeline] configured, all
+// the listeners, the one transport and the writer make an implicit pipeline.
+type Pipeline struct {
+	Name        string
+	Config      *PipelineConfig
+	Transport   Transport
+	Processors  []Processor
+	OutputNames []string
+	Outputs     []Transport // of the outputs configured on this node
+	Logger      *Logger
+}
+
+// Processor is a pipeline stage, it changes the metric in place and returns
+// false if it's to be dropped
+type Processor interface {
+	Process(m *Metric) bool
+}
+
+// Emitter is a processor producing metrics of its own, they're passed to
+// emit to go through the rest of the pipeline
+type Emitter interface {
+	SetEmit(emit func(*Metric))
+}
+
+func NewPipeline(name string, c *PipelineConfig, tc TransportConfig, procs map[string]ProcessorConfig, listeners map[string]ListenerConfig, outputs map[string]WriterConfig, exitFlag *Flag, logger *Logger) (*Pipeline, error) {
+	p := &Pipeline{Name: name, Config: c, Logger: logger}
+	for _, pName := range c.Processors {
+		pc, ok := procs[pName]
+		if !ok {
+			return nil, fmt.Errorf("pipeline '%s': unknown processor '%s'", name, pName)
+		}
+		proc, err := NewProcessor(pc)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline '%s': processor '%s': %v", name, pName, err)
+		}
+		p.Processors = append(p.Processors, proc)
+	}
+
+	// inputs and outputs not configured on this node are run elsewhere
+	var listenerEnabled, writerEnabled bool
+	for _, input := range c.Inputs {
+		if _, ok := listeners[input]; ok {
+			listenerEnabled = true
+		}
+	}
+	for _, output := range c.Outputs {
+		if _, ok := outputs[output]; ok {
+			p.OutputNames = append(p.OutputNames, output)
+			writerEnabled = true
+		}
+	}
+
+	// every pipeline gets a buffer of its own
+	tc.RedisQueue = pipelineQueue(tc.RedisQueue, name)
+	tc.AMQPTag = pipelineQueue(tc.AMQPTag, name)
+	t, err := NewTransport(&tc, listenerEnabled, writerEnabled, exitFlag, logger)
+	if err != nil {
+		return nil, fmt.Errorf("pipeline '%s': %v", name, err)
+	}
+	p.Transport = t
+	for i, proc := range p.Processors {
+		if e, ok := proc.(Emitter); ok {
+			e.SetEmit(p.emitAfter(i))
+		}
+	}
+
+	if len(p.OutputNames) == 1 {
+		p.Outputs = []Transport{t}
+	} else {
+		fanout := &sync.Once{}
+		for range p.OutputNames {
+			p.Outputs = append(p.Outputs, &teeTransport{
+				Transport: t,
+				Output:    make(chan *Metric, tc.BufferSize),
+				closeSrc:  fanout,
+			})
+		}
+	}
+	return p, nil
+}
+
+func pipelineQueue(queue, pipeline string) string {
+	if queue == "" {
+		queue = "default"
+	}
+	return queue + ":" + pipeline
+}
+
+// Start starts the transport and, for more outputs, hands a copy of every
+// metric to each of them
+func (p *Pipeline) Start() {
+	p.Logger.Info("[pipeline:%s] %v -> %v -> %v", p.Name, p.Config.Inputs, p.Config.Processors, p.Config.Outputs)
+	p.Transport.Start()
+	if len(p.Outputs) < 2 {
+		return
+	}
+	go func() {
+		for m := range p.Transport.OutputChan() {
+			// copied before any is sent, outputs change what they get
+			copies := make([]*Metric, len(p.Outputs))
+			copies[0] = m
+			for i := 1; i < len(copies); i++ {
+				copies[i] = m.Copy()
+			}
+			for i, out := range p.Outputs {
+				out.(*teeTransport).Output <- copies[i]
+			}
+		}
+		for _, out := range p.Outputs {
+			close(out.(*teeTransport).Output)
+		}
+	}()
+}
+
+// emitAfter passes metrics emitted by the i-th processor through the
+// processors following it into the transport
+func (p *Pipeline) emitAfter(i int) func(*Metric) {
+	return func(m *Metric) {
+		for _, proc := range p.Processors[i+1:] {
+			if !proc.Process(m) {
+				return
+			}
+		}
+		p.Transport.InputChan() <- m
+	}
+}
+
+// LogReport reports the transport and the processors keeping stats
+func (p *Pipeline) LogReport() {
+	p.Transport.LogReport()
+	for i, proc := range p.Processors {
+		if mm, ok := proc.(*MetricMath); ok {
+			p.Logger.Info("[pipeline:%s] processor '%s': %d/%d (derived/failed)",
+				p.Name,
+				p.Config.Processors[i],
+				mm.Derived.Total(),
+				mm.Failed.Total(),
+			)
+		}
+	}
+}
+
+// process runs the processors in order until one drops the metric
+func (p *Pipeline) process(m *Metric) bool {
+	for _, proc := range p.Processors {
+		if !proc.Process(m) {
+			return false
+		}
+	}
+	return true
+}
+
+// teeTransport is one output's share of a pipeline transport
+type teeTransport struct {
+	Transport
+	Output   chan *Metric
+	closeSrc *sync.Once
+}
+
+// the pipeline starts, stops and reports the transport itself
+func (t *teeTransport) Start()     {}
+func (t *teeTransport) Stop()      {}
+func (t *teeTransport) LogReport() {}
+
+func (t *teeTransport) CloseOutput() {
+	t.closeSrc.Do(t.Transport.CloseOutput)
+}
+
+func (t *teeTransport) OutputChan() <-chan *Metric {
+	return t.Output
+}
+
+func (t *teeTransport) OutputChanLen() int {
+	return len(t.Output) + t.Transport.OutputChanLen()
+}
+
+// NewProcessor builds the pipeline stage of the processor type:
+//   - "filter": drops metrics with names matching [match] ([action] "drop",
+//     default) or not matching it ([action] "keep")
+//   - "rewrite": renames metrics by rules of [file], like listener's rewrite_file
+//   - "script": runs Lua script of [file], like listener's script_file
+//   - "sample": keeps 1 in [keep] series of metrics matching [match]
+//   - "normalize": applies the [preset], like writer's normalize
+//   - "math": derives metrics by the [expression], see MetricMath
+func NewProcessor(c ProcessorConfig) (Processor, error) {
+	switch c.Type {
+	case "filter":
+		re, err := regexp.Compile(c.Match)
+		if err != nil {
+			return nil, err
+		}
+		switch c.Action {
+		case "", "drop":
+			return filterProcessor{re, false}, nil
+		case "keep":
+			return filterProcessor{re, true}, nil
+		}
+		return nil, fmt.Errorf("unknown filter action '%s'", c.Action)
+	case "rewrite":
+		rules, err := NewRewriteRules(c.File)
+		if err != nil {
+			return nil, err
+		}
+		return rewriteProcessor(rules), nil
+	case "script":
+		return NewScript(c.File)
+	case "sample":
+		sampler, err := NewSampler(SamplingConfig{Rules: []SamplingRuleConfig{{Match: c.Match, Keep: c.Keep}}})
+		if err != nil {
+			return nil, err
+		}
+		return sampler, nil
+	case "normalize":
+		preset, err := NewNormalizePreset(c.Preset)
+		if err != nil {
+			return nil, err
+		}
+		if preset == nil {
+			return nil, fmt.Errorf("missing normalization preset")
+		}
+		return preset, nil
+	case "math":
+		return NewMetricMath(c)
+	}
+	return nil, fmt.Errorf("unknown processor type '%s'", c.Type)
+}
+
+type filterProcessor struct {
+	match *regexp.Regexp
+	keep  bool
+}
+
+func (f filterProcessor) Process(m *Metric) bool {
+	return f.match.MatchString(m.Name) == f.keep
+}
+
+type rewriteProcessor []RewriteRule
+
+func (r rewriteProcessor) Process(m *Metric) bool {
+	m.Name = rewriteName(r, m.Name)
+	return true
+}
+
+func (s *Script) Process(m *Metric) bool {
+	return s.Apply(m)
+}
+
+func (s *Sampler) Process(m *Metric) bool {
+	return s.Keep(m)
+}
+
+func (p *NormalizePreset) Process(m *Metric) bool {
+	*m = *p.Normalize(m)
+	return true
+}
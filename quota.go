@@ -0,0 +1,69 @@
+package metcap
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Quota is a token bucket capping the ingestion rate in metrics per second
+// with a burst allowance. Metrics over the quota are either dropped or
+// deferred, the latter slows the senders down through TCP backpressure.
+type Quota struct {
+	rate   float64
+	burst  float64
+	policy string
+	tokens float64
+	last   time.Time
+	mux    *sync.Mutex
+}
+
+func NewQuota(c QuotaConfig) (*Quota, error) {
+	if c.Rate <= 0 {
+		return nil, nil
+	}
+	if c.Burst <= 0 {
+		c.Burst = c.Rate
+	}
+	if c.Policy == "" {
+		c.Policy = "drop"
+	}
+	if c.Policy != "drop" && c.Policy != "defer" {
+		return nil, fmt.Errorf("unknown quota policy '%s'", c.Policy)
+	}
+	return &Quota{
+		rate:   c.Rate,
+		burst:  c.Burst,
+		policy: c.Policy,
+		tokens: c.Burst,
+		last:   time.Now(),
+		mux:    &sync.Mutex{},
+	}, nil
+}
+
+// Take returns true if the metric fits the quota. With defer policy it
+// waits for the token instead and the returned wait is non-zero.
+func (q *Quota) Take() (ok bool, wait time.Duration) {
+	q.mux.Lock()
+	now := time.Now()
+	q.tokens += now.Sub(q.last).Seconds() * q.rate
+	if q.tokens > q.burst {
+		q.tokens = q.burst
+	}
+	q.last = now
+	if q.tokens >= 1 {
+		q.tokens--
+		q.mux.Unlock()
+		return true, 0
+	}
+	if q.policy == "drop" {
+		q.mux.Unlock()
+		return false, 0
+	}
+	// reserve the token, the debt is paid off while sleeping
+	wait = time.Duration((1 - q.tokens) / q.rate * float64(time.Second))
+	q.tokens--
+	q.mux.Unlock()
+	time.Sleep(wait)
+	return true, wait
+}
@@ -0,0 +1,290 @@
+package metcap
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// TenantQuotas enforce [[quota.tenant]] quotas on metrics by the tenant the
+// listener assigned to their connection (SNI route's [tenant]), never by
+// fields the sender could make up to get fresh quotas; tenants are thus
+// as many as routes, so are the quotas kept. [rate] points per second
+// (with [burst]), [max_series] distinct series and [max_bytes] per day
+// (UTC). Metrics over any of them get the [action]: "drop" (default),
+// "throttle" (metrics over the rate wait for it, slowing the senders down;
+// over the others they're dropped), "sample" (1 in [keep] series kept) or
+// "alert" (kept, alerted only). Every quota exceeded is alerted once a
+// day. Tenant "*" sets the quotas of each tenant without ones of its own.
+// Usage of the day and the previous one is served by the admin API.
+type TenantQuotas struct {
+	rules     map[string]TenantQuotaConfig
+	quotas    map[string]*tenantQuota
+	Dropped   *StatsCounter
+	Deferred  *StatsCounter
+	Sampled   *StatsCounter
+	Logger    *Logger
+	day       string
+	usage     map[string]*TenantUsage
+	prevDay   string
+	prevUsage map[string]*TenantUsage
+	mux       *sync.Mutex
+}
+
+type tenantQuota struct {
+	rate      *Quota
+	maxSeries int
+	maxBytes  uint64
+	action    string
+	keep      uint32
+}
+
+// TenantUsage is the tenant's usage of the day, points and bytes of the
+// metrics let through; series are counted with [max_series] only
+type TenantUsage struct {
+	Points     uint64 `json:"points"`
+	Bytes      uint64 `json:"bytes"`
+	Series     int    `json:"series"`
+	OverRate   uint64 `json:"over_rate"`
+	OverSeries uint64 `json:"over_series"`
+	OverBytes  uint64 `json:"over_bytes"`
+
+	series  map[uint64]struct{}
+	alerted map[string]bool
+}
+
+func NewTenantQuotas(c QuotaConfig, logger *Logger) (*TenantQuotas, error) {
+	if len(c.Tenants) == 0 {
+		return nil, nil
+	}
+	t := &TenantQuotas{
+		rules:    make(map[string]TenantQuotaConfig),
+		quotas:   make(map[string]*tenantQuota),
+		Dropped:  NewStatsCounter(time.Now()),
+		Deferred: NewStatsCounter(time.Now()),
+		Sampled:  NewStatsCounter(time.Now()),
+		Logger:   logger,
+		usage:    make(map[string]*TenantUsage),
+		mux:      &sync.Mutex{},
+	}
+	for _, r := range c.Tenants {
+		if r.Tenant == "" {
+			return nil, errors.New("tenant quota without tenant")
+		}
+		if _, dup := t.rules[r.Tenant]; dup {
+			return nil, fmt.Errorf("duplicate quota of tenant '%s'", r.Tenant)
+		}
+		switch r.Action {
+		case "":
+			r.Action = "drop"
+		case "drop", "throttle", "alert":
+		case "sample":
+			if r.Keep < 1 {
+				return nil, fmt.Errorf("sample action of tenant '%s' quota requires keep", r.Tenant)
+			}
+		default:
+			return nil, fmt.Errorf("unknown action '%s' of tenant '%s' quota", r.Action, r.Tenant)
+		}
+		t.rules[r.Tenant] = r
+	}
+	return t, nil
+}
+
+// quota returns the quota of the tenant, set up from its rule or the "*"
+// one on first use; nil if there's none
+func (t *TenantQuotas) quota(tenant string) (*tenantQuota, error) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if q, ok := t.quotas[tenant]; ok {
+		return q, nil
+	}
+	r, ok := t.rules[tenant]
+	if !ok {
+		r, ok = t.rules["*"]
+	}
+	if !ok {
+		t.quotas[tenant] = nil
+		return nil, nil
+	}
+	policy := "drop"
+	if r.Action == "throttle" {
+		policy = "defer"
+	}
+	rate, err := NewQuota(QuotaConfig{Rate: r.Rate, Burst: r.Burst, Policy: policy})
+	if err != nil {
+		return nil, err
+	}
+	q := &tenantQuota{
+		rate:      rate,
+		maxSeries: r.MaxSeries,
+		maxBytes:  r.MaxBytes,
+		action:    r.Action,
+		keep:      uint32(r.Keep),
+	}
+	t.quotas[tenant] = q
+	return q, nil
+}
+
+// Allow accounts the metric to the tenant of its connection and tells
+// whether it's let through; the returned wait is non-zero if it was
+// throttled
+func (t *TenantQuotas) Allow(m *Metric, tenant string) (bool, time.Duration) {
+	if tenant == "" {
+		return true, 0
+	}
+	q, err := t.quota(tenant)
+	if err != nil {
+		t.Logger.Error("[quota] Invalid quota of tenant '%s': %v", tenant, err)
+		return true, 0
+	}
+	overRate, wait := false, time.Duration(0)
+	if q != nil && q.rate != nil {
+		var ok bool
+		ok, wait = q.rate.Take()
+		overRate = !ok || wait > 0 // throttled ones are taken, deferred
+		if wait > 0 {
+			t.Deferred.Increment(1)
+		}
+	}
+	size := metricSize(m)
+
+	t.mux.Lock()
+	u := t.usageOf(tenant, time.Now())
+	var over string
+	if overRate {
+		u.OverRate++
+		over = "rate"
+	}
+	var seriesHash uint64
+	if q != nil && q.maxSeries > 0 {
+		h := fnv.New64a()
+		h.Write([]byte(m.SeriesID()))
+		seriesHash = h.Sum64()
+		if _, seen := u.series[seriesHash]; !seen {
+			if len(u.series) >= q.maxSeries {
+				u.OverSeries++
+				over = "series"
+			} else {
+				u.series[seriesHash] = struct{}{}
+			}
+		}
+	}
+	if q != nil && q.maxBytes > 0 && u.Bytes+size > q.maxBytes {
+		u.OverBytes++
+		over = "bytes"
+	}
+	alert := over != "" && !u.alerted[over]
+	if alert {
+		u.alerted[over] = true
+	}
+	keep := over == "" || q.action == "alert" || (over == "rate" && q.action == "throttle")
+	if !keep && q.action == "sample" {
+		if seriesHash == 0 {
+			h := fnv.New64a()
+			h.Write([]byte(m.SeriesID()))
+			seriesHash = h.Sum64()
+		}
+		keep = seriesHash%uint64(q.keep) == 0
+	}
+	if keep {
+		u.Points++
+		u.Bytes += size
+	}
+	t.mux.Unlock()
+
+	if alert {
+		t.Logger.Alert("[quota] Tenant '%s' is over its %s quota, action: %s", tenant, over, q.action)
+	}
+	if !keep {
+		if q.action == "sample" {
+			t.Sampled.Increment(1)
+		} else {
+			t.Dropped.Increment(1)
+		}
+	}
+	return keep, wait
+}
+
+// usageOf returns the usage of the tenant of the day, the usage of the
+// previous day is kept once it's over; call with the lock held
+func (t *TenantQuotas) usageOf(tenant string, now time.Time) *TenantUsage {
+	if day := now.UTC().Format("2006-01-02"); day != t.day {
+		if t.day != "" {
+			t.prevDay, t.prevUsage = t.day, t.usage
+		}
+		t.day, t.usage = day, make(map[string]*TenantUsage)
+	}
+	u, ok := t.usage[tenant]
+	if !ok {
+		u = &TenantUsage{series: make(map[uint64]struct{}), alerted: make(map[string]bool)}
+		t.usage[tenant] = u
+	}
+	return u
+}
+
+// metricSize approximates the size of the metric: name, fields and 16
+// bytes of value and timestamp
+func metricSize(m *Metric) uint64 {
+	size := len(m.Name) + 16
+	for k, v := range m.Fields {
+		size += len(k) + len(v)
+	}
+	return uint64(size)
+}
+
+type tenantUsageReport struct {
+	Day           string                 `json:"day"`
+	Usage         map[string]TenantUsage `json:"usage"`
+	PreviousDay   string                 `json:"previous_day,omitempty"`
+	PreviousUsage map[string]TenantUsage `json:"previous_usage,omitempty"`
+}
+
+func (t *TenantQuotas) report() tenantUsageReport {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	copyUsage := func(usage map[string]*TenantUsage) map[string]TenantUsage {
+		out := make(map[string]TenantUsage, len(usage))
+		for tenant, u := range usage {
+			c := *u
+			c.Series = len(u.series)
+			out[tenant] = c
+		}
+		return out
+	}
+	r := tenantUsageReport{Day: t.day, Usage: copyUsage(t.usage)}
+	if t.prevDay != "" {
+		r.PreviousDay, r.PreviousUsage = t.prevDay, copyUsage(t.prevUsage)
+	}
+	return r
+}
+
+// Register serves the usage of the day and the previous one at
+// /tenants/usage
+func (t *TenantQuotas) Register(a *Admin) {
+	a.HandleJSON("/tenants/usage", func() interface{} { return t.report() })
+}
+
+func (t *TenantQuotas) LogReport() {
+	t.Logger.Info("[quota] tenants: %d/%d/%d (dropped/deferred/sampled_out)",
+		t.Dropped.Total(),
+		t.Deferred.Total(),
+		t.Sampled.Total(),
+	)
+}
+
+// SelfSource reports the usage of the day per tenant
+func (t *TenantQuotas) SelfSource() SelfSource {
+	return func(emit func(string, float64, map[string]string)) {
+		emit("quota.tenant.dropped", float64(t.Dropped.Total()), nil)
+		emit("quota.tenant.deferred", float64(t.Deferred.Total()), nil)
+		emit("quota.tenant.sampled_out", float64(t.Sampled.Total()), nil)
+		for tenant, u := range t.report().Usage {
+			fields := map[string]string{"tenant": tenant}
+			emit("quota.tenant.points", float64(u.Points), fields)
+			emit("quota.tenant.bytes", float64(u.Bytes), fields)
+			emit("quota.tenant.series", float64(u.Series), fields)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package metcap
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Render is a minimal Graphite-compatible query API over the writer's
+// indices, so Grafana's Graphite datasource can read metcap directly while
+// migrating off carbon. Targets are plain metric paths with Graphite globs
+// (`*`, `?`, `[...]`, `{a,b}`), no functions; every series is averaged into
+// buckets of the step.
+type Render struct {
+	Config *RenderConfig
+	Writer *Writer
+	Logger *Logger
+}
+
+func NewRender(c *RenderConfig, w *Writer, logger *Logger) *Render {
+	if c.MaxSeries <= 0 {
+		c.MaxSeries = 100
+	}
+	if c.MaxPoints <= 0 {
+		c.MaxPoints = 1000
+	}
+	return &Render{Config: c, Writer: w, Logger: logger}
+}
+
+// Register adds the render endpoints to the admin API
+func (r *Render) Register(a *Admin) {
+	a.Handle("/render", r.handleRender)
+	a.Handle("/metrics/find", r.handleFind)
+}
+
+// searchIndex is the writer's [read_alias] or its indices pattern
+func (r *Render) searchIndex() string {
+	if r.Writer.Config.ReadAlias != "" {
+		return r.Writer.Config.ReadAlias
+	}
+	return r.Writer.Config.Index + "*"
+}
+
+type renderSeries struct {
+	Target     string           `json:"target"`
+	Datapoints [][2]interface{} `json:"datapoints"`
+}
+
+// handleRender: GET/POST /render?target=a.*.b&from=-1h&until=now&format=json
+func (r *Render) handleRender(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if f := req.Form.Get("format"); f != "" && f != "json" {
+		http.Error(w, "only json format is supported", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	from, err := parseGraphiteTime(req.Form.Get("from"), now, now.Add(-24*time.Hour))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	until, err := parseGraphiteTime(req.Form.Get("until"), now, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !until.After(from) {
+		http.Error(w, "until must be after from", http.StatusBadRequest)
+		return
+	}
+	points := r.Config.MaxPoints
+	if n, err := strconv.Atoi(req.Form.Get("maxDataPoints")); err == nil && n > 0 && n < points {
+		points = n
+	}
+	step := until.Sub(from) / time.Duration(points)
+	if step < time.Second {
+		step = time.Second
+	}
+	step = step.Truncate(time.Second)
+
+	out := []renderSeries{}
+	for _, target := range req.Form["target"] {
+		series, err := r.query(target, from, until, step)
+		if err != nil {
+			r.Logger.Error("[render] Query of '%s' failed: %v", target, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		out = append(out, series...)
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// query runs date histogram of average value per step for every name
+// matching the target
+func (r *Render) query(target string, from, until time.Time, step time.Duration) ([]renderSeries, error) {
+	es, flavor := r.Writer.Client()
+	if es == nil {
+		return nil, fmt.Errorf("not connected to ElasticSearch yet")
+	}
+	interval := "interval"
+	if flavor.Distribution != "opensearch" && flavor.Major >= 7 {
+		interval = "fixed_interval"
+	}
+	body := map[string]interface{}{
+		"size":  0,
+		"query": nameQuery(target, from, until),
+		"aggs": map[string]interface{}{
+			"series": map[string]interface{}{
+				"terms": map[string]interface{}{"field": "name", "size": r.Config.MaxSeries},
+				"aggs": map[string]interface{}{
+					"points": map[string]interface{}{
+						"date_histogram": map[string]interface{}{
+							"field":         "@timestamp",
+							interval:        fmt.Sprintf("%ds", int64(step/time.Second)),
+							"min_doc_count": 0,
+							"extended_bounds": map[string]interface{}{
+								"min": from.UnixNano() / 1e6,
+								"max": until.UnixNano() / 1e6,
+							},
+						},
+						"aggs": map[string]interface{}{
+							"value": map[string]interface{}{"avg": map[string]interface{}{"field": "value"}},
+						},
+					},
+				},
+			},
+		},
+	}
+	res, err := es.PerformRequest("POST", "/"+r.searchIndex()+"/_search", nil, body)
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Aggregations struct {
+			Series struct {
+				Buckets []struct {
+					Key    string `json:"key"`
+					Points struct {
+						Buckets []struct {
+							Key   int64 `json:"key"`
+							Value struct {
+								Value *float64 `json:"value"`
+							} `json:"value"`
+						} `json:"buckets"`
+					} `json:"points"`
+				} `json:"buckets"`
+			} `json:"series"`
+		} `json:"aggregations"`
+	}
+	if err := json.Unmarshal(res.Body, &result); err != nil {
+		return nil, err
+	}
+	var out []renderSeries
+	for _, s := range result.Aggregations.Series.Buckets {
+		series := renderSeries{Target: s.Key, Datapoints: make([][2]interface{}, 0, len(s.Points.Buckets))}
+		for _, p := range s.Points.Buckets {
+			// Graphite wants null for empty buckets, avg of none is null too
+			var v interface{}
+			if p.Value.Value != nil {
+				v = *p.Value.Value
+			}
+			series.Datapoints = append(series.Datapoints, [2]interface{}{v, p.Key / 1000})
+		}
+		out = append(out, series)
+	}
+	return out, nil
+}
+
+type findNode struct {
+	Text          string `json:"text"`
+	ID            string `json:"id"`
+	Leaf          int    `json:"leaf"`
+	Expandable    int    `json:"expandable"`
+	AllowChildren int    `json:"allowChildren"`
+}
+
+// handleFind: GET /metrics/find?query=a.*.b lists path nodes matching the
+// query, for Grafana's query editor and template variables
+func (r *Render) handleFind(w http.ResponseWriter, req *http.Request) {
+	query := req.FormValue("query")
+	if query == "" {
+		http.Error(w, "missing query", http.StatusBadRequest)
+		return
+	}
+	es, _ := r.Writer.Client()
+	if es == nil {
+		http.Error(w, "not connected to ElasticSearch yet", http.StatusServiceUnavailable)
+		return
+	}
+	depth := strings.Count(query, ".") + 1
+	body := map[string]interface{}{
+		"size": 0,
+		"query": map[string]interface{}{
+			"regexp": map[string]interface{}{"name": graphiteGlobRegexp(query) + `(\..*)?`},
+		},
+		"aggs": map[string]interface{}{
+			"names": map[string]interface{}{
+				"terms": map[string]interface{}{"field": "name", "size": r.Config.MaxSeries * 10},
+			},
+		},
+	}
+	res, err := es.PerformRequest("POST", "/"+r.searchIndex()+"/_search", nil, body)
+	if err != nil {
+		r.Logger.Error("[render] Find of '%s' failed: %v", query, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	var result struct {
+		Aggregations struct {
+			Names struct {
+				Buckets []struct {
+					Key string `json:"key"`
+				} `json:"buckets"`
+			} `json:"names"`
+		} `json:"aggregations"`
+	}
+	if err := json.Unmarshal(res.Body, &result); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	nodes := make(map[string]*findNode)
+	for _, b := range result.Aggregations.Names.Buckets {
+		parts := strings.Split(b.Key, ".")
+		if len(parts) < depth {
+			continue
+		}
+		id := strings.Join(parts[:depth], ".")
+		node, ok := nodes[id]
+		if !ok {
+			node = &findNode{Text: parts[depth-1], ID: id}
+			nodes[id] = node
+		}
+		if len(parts) == depth {
+			node.Leaf = 1
+		} else {
+			node.Expandable, node.AllowChildren = 1, 1
+		}
+	}
+	out := make([]*findNode, 0, len(nodes))
+	for _, node := range nodes {
+		out = append(out, node)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	writeJSON(w, http.StatusOK, out)
+}
+
+func nameQuery(target string, from, until time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"bool": map[string]interface{}{
+			"filter": []interface{}{
+				map[string]interface{}{"regexp": map[string]interface{}{"name": graphiteGlobRegexp(target)}},
+				map[string]interface{}{"range": map[string]interface{}{"@timestamp": map[string]interface{}{
+					"gte":    from.UnixNano() / 1e6,
+					"lte":    until.UnixNano() / 1e6,
+					"format": "epoch_millis",
+				}}},
+			},
+		},
+	}
+}
+
+// graphiteGlobRegexp turns a Graphite path glob into Lucene regexp, whose
+// matches are anchored to the whole term. Globs don't cross path nodes.
+func graphiteGlobRegexp(glob string) string {
+	var re strings.Builder
+	inClass := false
+	for _, c := range glob {
+		switch {
+		case inClass:
+			if c == ']' {
+				inClass = false
+			}
+			re.WriteRune(c)
+		case c == '[':
+			inClass = true
+			re.WriteRune(c)
+		case c == '*':
+			re.WriteString(`[^.]*`)
+		case c == '?':
+			re.WriteString(`[^.]`)
+		case c == '{':
+			re.WriteRune('(')
+		case c == '}':
+			re.WriteRune(')')
+		case c == ',':
+			re.WriteRune('|')
+		case strings.ContainsRune(`.+|()"\#@&<>~`, c):
+			re.WriteRune('\\')
+			re.WriteRune(c)
+		default:
+			re.WriteRune(c)
+		}
+	}
+	return re.String()
+}
+
+// graphiteTimeUnits in order of precedence, "m" is minutes
+var graphiteTimeUnits = []struct {
+	name string
+	unit time.Duration
+}{
+	{"s", time.Second},
+	{"min", time.Minute},
+	{"h", time.Hour},
+	{"d", 24 * time.Hour},
+	{"w", 7 * 24 * time.Hour},
+	{"mon", 30 * 24 * time.Hour},
+	{"y", 365 * 24 * time.Hour},
+}
+
+// parseGraphiteTime reads "now", relative "-1h"/"-10min" style offsets and
+// Unix timestamps, empty value is the default
+func parseGraphiteTime(s string, now, def time.Time) (time.Time, error) {
+	switch {
+	case s == "":
+		return def, nil
+	case s == "now":
+		return now, nil
+	case strings.HasPrefix(s, "-"):
+		n := 1
+		for n < len(s) && s[n] >= '0' && s[n] <= '9' {
+			n++
+		}
+		count, err := strconv.Atoi(s[1:n])
+		if err != nil {
+			return def, fmt.Errorf("invalid relative time '%s'", s)
+		}
+		unit := s[n:]
+		for _, u := range graphiteTimeUnits {
+			// abbreviated or spelled out, ie. "m", "min", "minutes"
+			if unit != "" && (strings.HasPrefix(u.name, unit) || strings.HasPrefix(unit, u.name)) {
+				return now.Add(-time.Duration(count) * u.unit), nil
+			}
+		}
+		return def, fmt.Errorf("invalid relative time unit in '%s'", s)
+	default:
+		ts, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return def, fmt.Errorf("invalid time '%s'", s)
+		}
+		return time.Unix(ts, 0), nil
+	}
+}
@@ -0,0 +1,58 @@
+package metcap
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// RewriteRule replaces the final metric name matching regex with a template,
+// which can reference capture groups as $1 or ${name}
+type RewriteRule struct {
+	match   *regexp.Regexp
+	replace string
+}
+
+// NewRewriteRules reads rules in the `regex|||replacement` format
+func NewRewriteRules(rwFile string) ([]RewriteRule, error) {
+	var rules []RewriteRule
+
+	if rwFile == "" {
+		return rules, nil
+	}
+
+	f, err := os.Open(rwFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scn := bufio.NewScanner(f)
+	for scn.Scan() {
+		rule := strings.SplitN(scn.Text(), "|||", 2)
+		if len(rule) != 2 {
+			continue
+		}
+		ruleRe, err := regexp.Compile(rule[0])
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, RewriteRule{ruleRe, rule[1]})
+	}
+	if err := scn.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// rewriteName applies the rules in order, each one to the result of the previous
+func rewriteName(rules []RewriteRule, name string) string {
+	for _, rule := range rules {
+		if rule.match.MatchString(name) {
+			name = rule.match.ReplaceAllString(name, rule.replace)
+		}
+	}
+	return name
+}
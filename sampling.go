@@ -0,0 +1,73 @@
+package metcap
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+)
+
+// Sampler keeps 1 in [keep] series of metrics matching a rule. The decision
+// is made by hash of the series identity, so a kept series stays kept and
+// dashboards of the sampled series don't get gaps.
+type Sampler struct {
+	tenantField string
+	rules       []SamplingRule
+	onDemand    bool
+	State       *OpState
+}
+
+// SamplingRule applies to metrics with names matching the pattern (all, if
+// not set) and tenant field equal to the tenant (any, if not set)
+type SamplingRule struct {
+	match  *regexp.Regexp
+	tenant string
+	keep   uint32
+}
+
+func NewSampler(c SamplingConfig) (*Sampler, error) {
+	if len(c.Rules) == 0 {
+		return nil, nil
+	}
+	s := &Sampler{tenantField: c.TenantField, onDemand: c.OnDemand}
+	if s.tenantField == "" {
+		s.tenantField = "tenant"
+	}
+	for _, r := range c.Rules {
+		if r.Keep < 1 {
+			return nil, fmt.Errorf("sampling rule keep must be at least 1, got %d", r.Keep)
+		}
+		rule := SamplingRule{tenant: r.Tenant, keep: uint32(r.Keep)}
+		if r.Match != "" {
+			re, err := regexp.Compile(r.Match)
+			if err != nil {
+				return nil, err
+			}
+			rule.match = re
+		}
+		s.rules = append(s.rules, rule)
+	}
+	return s, nil
+}
+
+// Keep decides by the first matching rule, metrics matching none are kept.
+// On-demand rules apply only while the "sampling" state is on.
+func (s *Sampler) Keep(m *Metric) bool {
+	if s.onDemand && !s.State.Get("sampling") {
+		return true
+	}
+	for _, rule := range s.rules {
+		if rule.match != nil && !rule.match.MatchString(m.Name) {
+			continue
+		}
+		if rule.tenant != "" && m.Fields[s.tenantField] != rule.tenant {
+			continue
+		}
+		if rule.keep == 1 {
+			return true
+		}
+		h := fnv.New32a()
+		h.Write([]byte(m.SeriesID()))
+		return h.Sum32()%rule.keep == 0
+	}
+	return true
+}
@@ -0,0 +1,117 @@
+package metcap
+
+import (
+	"fmt"
+	"math"
+	"time"
+	"unicode/utf8"
+)
+
+// ValuePolicy decides what happens to NaN/infinite values, zero/negative
+// timestamps and overlong names and field values (ie. a whole SQL query in
+// a tag), none of which ElasticSearch indexes sensibly
+type ValuePolicy struct {
+	NaN            string // drop, zero
+	Inf            string // drop, clamp, zero
+	Timestamp      string // drop, now
+	Length         string // truncate, drop
+	MaxNameLength  int    // bytes, 0 unlimited
+	MaxFieldLength int    // bytes of field values, 0 unlimited
+}
+
+func NewValuePolicy(c ListenerConfig) (ValuePolicy, error) {
+	p := ValuePolicy{c.NaNPolicy, c.InfPolicy, c.TimestampPolicy, c.LengthPolicy, c.MaxNameLength, c.MaxFieldLength}
+	if p.NaN == "" {
+		p.NaN = "drop"
+	}
+	if p.Inf == "" {
+		p.Inf = "drop"
+	}
+	if p.Timestamp == "" {
+		p.Timestamp = "drop"
+	}
+	if p.Length == "" {
+		p.Length = "truncate"
+	}
+	switch {
+	case p.NaN != "drop" && p.NaN != "zero":
+		return p, fmt.Errorf("unknown nan_policy '%s'", p.NaN)
+	case p.Inf != "drop" && p.Inf != "clamp" && p.Inf != "zero":
+		return p, fmt.Errorf("unknown inf_policy '%s'", p.Inf)
+	case p.Timestamp != "drop" && p.Timestamp != "now":
+		return p, fmt.Errorf("unknown timestamp_policy '%s'", p.Timestamp)
+	case p.Length != "truncate" && p.Length != "drop":
+		return p, fmt.Errorf("unknown length_policy '%s'", p.Length)
+	}
+	return p, nil
+}
+
+// apply fixes up the metric in place, returns false if it's to be dropped
+func (p ValuePolicy) apply(m *Metric, stats *ListenerStats) bool {
+	switch {
+	case math.IsNaN(m.Value):
+		stats.BadValues.Increment(1)
+		if p.NaN == "drop" {
+			return false
+		}
+		m.Value = 0
+	case math.IsInf(m.Value, 0):
+		stats.BadValues.Increment(1)
+		switch p.Inf {
+		case "drop":
+			return false
+		case "clamp":
+			if m.Value > 0 {
+				m.Value = math.MaxFloat64
+			} else {
+				m.Value = -math.MaxFloat64
+			}
+		case "zero":
+			m.Value = 0
+		}
+	}
+	if m.Aggregate != nil && m.Aggregate.Valid() != nil {
+		// no sensible fix-up of the tuple
+		stats.BadValues.Increment(1)
+		return false
+	}
+	if m.Timestamp.Unix() <= 0 {
+		stats.BadTimestamps.Increment(1)
+		if p.Timestamp == "drop" {
+			return false
+		}
+		m.Timestamp = time.Now()
+	}
+	return p.applyLength(m, stats)
+}
+
+// applyLength truncates the overlong name and field values, returns false
+// if the metric is to be dropped instead
+func (p ValuePolicy) applyLength(m *Metric, stats *ListenerStats) bool {
+	tooLong := false
+	if p.MaxNameLength > 0 && len(m.Name) > p.MaxNameLength {
+		tooLong = true
+		m.Name = truncateUTF8(m.Name, p.MaxNameLength)
+	}
+	if p.MaxFieldLength > 0 {
+		for k, v := range m.Fields {
+			if len(v) > p.MaxFieldLength {
+				tooLong = true
+				m.Fields[k] = truncateUTF8(v, p.MaxFieldLength)
+			}
+		}
+	}
+	if !tooLong {
+		return true
+	}
+	stats.TooLong.Increment(1)
+	return p.Length != "drop"
+}
+
+// truncateUTF8 cuts s to at most n bytes, not splitting a character
+func truncateUTF8(s string, n int) string {
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
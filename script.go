@@ -0,0 +1,131 @@
+package metcap
+
+import (
+	"io/ioutil"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// Script runs a Lua script for every metric. The script sees and may change
+// globals `name`, `value`, `timestamp` (Unix seconds) and table `fields`,
+// calling `drop()` drops the metric. Only base, string, math and table
+// libraries are available. Lua states aren't thread-safe, so each goroutine
+// borrows one from a pool.
+type Script struct {
+	File    string
+	source  string
+	pool    *sync.Pool
+	Dropped *StatsCounter
+	Failed  *StatsCounter
+}
+
+type scriptState struct {
+	L       *lua.LState
+	fn      *lua.LFunction
+	dropped bool
+}
+
+func NewScript(file string) (*Script, error) {
+	source, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	s := &Script{
+		File:    file,
+		source:  string(source),
+		Dropped: NewStatsCounter(time.Now()),
+		Failed:  NewStatsCounter(time.Now()),
+	}
+	// compile once up front to fail on start rather than on the first metric
+	state, err := s.newState()
+	if err != nil {
+		return nil, err
+	}
+	s.pool = &sync.Pool{New: func() interface{} {
+		state, _ := s.newState()
+		return state
+	}}
+	s.pool.Put(state)
+	return s, nil
+}
+
+func (s *Script) newState() (*scriptState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for name, open := range map[string]lua.LGFunction{
+		lua.BaseLibName:   lua.OpenBase,
+		lua.StringLibName: lua.OpenString,
+		lua.MathLibName:   lua.OpenMath,
+		lua.TabLibName:    lua.OpenTable,
+	} {
+		L.Push(L.NewFunction(open))
+		L.Push(lua.LString(name))
+		L.Call(1, 0)
+	}
+	fn, err := L.LoadString(s.source)
+	if err != nil {
+		L.Close()
+		return nil, err
+	}
+	state := &scriptState{L: L, fn: fn}
+	L.SetGlobal("drop", L.NewFunction(func(*lua.LState) int {
+		state.dropped = true
+		return 0
+	}))
+	return state, nil
+}
+
+// Apply runs the script on the metric, returns false if it's to be dropped.
+// Metrics the script failed on pass unchanged.
+func (s *Script) Apply(m *Metric) bool {
+	state := s.pool.Get().(*scriptState)
+	defer s.pool.Put(state)
+	L := state.L
+
+	fields := L.NewTable()
+	for k, v := range m.Fields {
+		fields.RawSetString(k, lua.LString(v))
+	}
+	L.SetGlobal("name", lua.LString(m.Name))
+	L.SetGlobal("value", lua.LNumber(m.Value))
+	L.SetGlobal("timestamp", lua.LNumber(float64(m.Timestamp.UnixNano())/1e9))
+	L.SetGlobal("fields", fields)
+	state.dropped = false
+
+	L.Push(state.fn)
+	if err := L.PCall(0, 0, nil); err != nil {
+		s.Failed.Increment(1)
+		return true
+	}
+	if state.dropped {
+		s.Dropped.Increment(1)
+		return false
+	}
+
+	if name, ok := L.GetGlobal("name").(lua.LString); ok {
+		m.Name = string(name)
+	}
+	if value, ok := L.GetGlobal("value").(lua.LNumber); ok {
+		m.Value = float64(value)
+	}
+	if ts, ok := L.GetGlobal("timestamp").(lua.LNumber); ok {
+		sec, frac := math.Modf(float64(ts))
+		m.Timestamp = time.Unix(int64(sec), int64(frac*1e9))
+	}
+	if fields, ok := L.GetGlobal("fields").(*lua.LTable); ok {
+		m.Fields = make(map[string]string)
+		fields.ForEach(func(k, v lua.LValue) {
+			if v != lua.LNil {
+				m.Fields[k.String()] = v.String()
+			}
+		})
+	}
+	return true
+}
+
+// BeforeIndex makes the script a WriterHook
+func (s *Script) BeforeIndex(m *Metric) (*Metric, bool) {
+	return m, s.Apply(m)
+}
@@ -0,0 +1,229 @@
+package metcap
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"time"
+)
+
+// SelfReporter publishes metcap's own health metrics into the pipeline
+// every [interval], so they end up in the same indices and dashboards as
+// everything else. Metrics are named [prefix].{module}.{stat} and carry the
+// host name in the [host_field] field. Counters are cumulative totals.
+type SelfReporter struct {
+	Config    *SelfConfig
+	Transport Transport
+	Logger    *Logger
+	Dropped   *StatsCounter
+
+	host    string
+	sources []SelfSource
+}
+
+// SelfSource adds its stats to the report by calling emit for every one,
+// fields, if any, are added to the host field
+type SelfSource func(emit func(name string, value float64, fields map[string]string))
+
+func NewSelfReporter(c *SelfConfig, t Transport, logger *Logger) *SelfReporter {
+	if c.Prefix == "" {
+		c.Prefix = "metcap"
+	}
+	if c.HostField == "" {
+		c.HostField = "host"
+	}
+	host, _ := os.Hostname()
+	return &SelfReporter{
+		Config:    c,
+		Transport: t,
+		Logger:    logger,
+		Dropped:   NewStatsCounter(time.Now()),
+		host:      host,
+	}
+}
+
+// Add registers a source of stats
+func (s *SelfReporter) Add(source SelfSource) {
+	s.sources = append(s.sources, source)
+}
+
+// Run reports every [interval] until exitFlag is raised
+func (s *SelfReporter) Run(exitFlag *Flag) {
+	s.Logger.Info("[self] Reporting own metrics every %v as '%s.*'", s.Config.Interval.Duration, s.Config.Prefix)
+	next := time.Now().Add(s.Config.Interval.Duration)
+	for !exitFlag.Get() {
+		if time.Now().Before(next) {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		next = next.Add(s.Config.Interval.Duration)
+		s.report()
+	}
+}
+
+// report never blocks on the transport, the pipeline being stuck is what
+// the metrics are likely to be about
+func (s *SelfReporter) report() {
+	now := time.Now()
+	for _, source := range s.sources {
+		source(func(name string, value float64, fields map[string]string) {
+			m := &Metric{
+				Name:      s.Config.Prefix + "." + name,
+				Timestamp: now,
+				Value:     value,
+				Fields:    map[string]string{s.Config.HostField: s.host},
+				OK:        true,
+			}
+			for k, v := range fields {
+				m.Fields[k] = v
+			}
+			select {
+			case s.Transport.InputChan() <- m:
+			default:
+				s.Dropped.Increment(1)
+			}
+		})
+	}
+}
+
+func (s *SelfReporter) LogReport() {
+	if n := s.Dropped.Total(); n > 0 {
+		s.Logger.Info("[self] dropped: %d", n)
+	}
+}
+
+// SelfSource reports the listener's connection and codec stats
+func (l *Listener) SelfSource() SelfSource {
+	return func(emit func(string, float64, map[string]string)) {
+		p := "listener." + l.Name + "."
+		emit(p+"connections.open", float64(l.Stats.ConnOpen.Get()), nil)
+		emit(p+"connections.processed", float64(l.Stats.ConnProcessed.Total()), nil)
+		emit(p+"connections.failed", float64(l.Stats.ConnFailed.Total()), nil)
+		emit(p+"connections.rejected", float64(l.Stats.ConnRejected.Total()), nil)
+		emit(p+"metrics.decoded", float64(l.Stats.CodecDecodedMetrics.Total()), nil)
+		emit(p+"metrics.failed", float64(l.Stats.CodecFailedMetrics.Total()), nil)
+		for i, c := range l.Stats.CodecErrors {
+			if n := c.Total(); n > 0 {
+				emit(p+"errors."+CodecErrorCategory(i).String(), float64(n), nil)
+			}
+		}
+		emit(p+"errors.overflowed", float64(l.Stats.CodecErrorsOverflowed.Total()), nil)
+		emit(p+"reads.resumed", float64(l.Stats.ReadsResumed.Total()), nil)
+		if l.Config.Ack {
+			emit(p+"acks.sent", float64(l.Stats.AcksSent.Total()), nil)
+		}
+		emit(p+"metrics.too_long", float64(l.Stats.TooLong.Total()), nil)
+		emit(p+"metrics.policy_dropped", float64(l.Stats.PolicyDropped.Total()), nil)
+		emit(p+"metrics.quota_dropped", float64(l.Stats.QuotaDropped.Total()), nil)
+		emit(p+"metrics.sampled_out", float64(l.Stats.SampledOut.Total()), nil)
+		emit(p+"codec.time_avg", l.Stats.CodecTime.Avg().Seconds(), nil)
+		if l.Arrival != nil {
+			emit(p+"metrics.arrival_overridden", float64(l.Arrival.Overridden.Total()), nil)
+			emit(p+"metrics.arrival_skewed", float64(l.Arrival.Skewed.Total()), nil)
+		}
+		if l.HMAC != nil {
+			emit(p+"hmac.verified", float64(l.HMAC.Verified.Total()), nil)
+			emit(p+"hmac.unsigned", float64(l.HMAC.Unsigned.Total()), nil)
+			for keyID, n := range l.HMAC.Failed() {
+				emit(p+"hmac.failed", float64(n), map[string]string{"key_id": keyID})
+			}
+		}
+		if l.Transcode != nil {
+			emit(p+"lines.transcoded", float64(l.Transcode.Transcoded.Total()), nil)
+			emit(p+"lines.sanitized", float64(l.Transcode.Sanitized.Total()), nil)
+		}
+		if l.Churn != nil {
+			emit(p+"connections.churned", float64(l.Stats.ConnChurned.Total()), nil)
+			for host, n := range l.Churn.Churners() {
+				emit(p+"connections.churn_per_minute", float64(n), map[string]string{"source": host})
+			}
+		}
+	}
+}
+
+// SelfSource reports the writer's commit and error stats
+func (w *Writer) SelfSource() SelfSource {
+	return func(emit func(string, float64, map[string]string)) {
+		emit("writer.flushes.running", float64(w.Stats.Running.Get()), nil)
+		emit("writer.flushes.total", float64(w.Stats.Flushed.Total()), nil)
+		emit("writer.metrics.committed", float64(w.Stats.Committed.Total()), nil)
+		emit("writer.metrics.succeeded", float64(w.Stats.Succeeded.Total()), nil)
+		emit("writer.metrics.failed", float64(w.Stats.Failed.Total()), nil)
+		emit("writer.metrics.dropped", float64(w.Stats.Dropped.Total()), nil)
+		for class, c := range w.Stats.FailedByClass {
+			emit("writer.errors."+class, float64(c.Total()), nil)
+		}
+		emit("writer.bulk.duration_avg", w.Stats.Duration.Avg().Seconds(), nil)
+		emit("writer.bulk.duration_max", w.Stats.Duration.Max().Seconds(), nil)
+		emit("writer.bulk.pending", float64(w.Stats.Pending.Get()), nil)
+		if w.Anonymizer != nil {
+			emit("writer.metrics.anonymized", float64(w.Anonymizer.Anonymized.Total()), nil)
+		}
+		if w.Dedup != nil && w.Dedup.Redis != nil {
+			emit("writer.metrics.duplicates", float64(w.Dedup.Duplicates.Total()), nil)
+		}
+		if w.Sketch != nil {
+			emit("writer.sketch.series", float64(w.Sketch.Series.Get()), nil)
+			emit("writer.sketch.percentiles", float64(w.Sketch.Emitted.Total()), nil)
+			emit("writer.sketch.skipped", float64(w.Sketch.Skipped.Total()), nil)
+		}
+		if w.Retrier != nil {
+			emit("writer.http.retried", float64(w.Retrier.Retried.Total()), nil)
+			emit("writer.http.gave_up", float64(w.Retrier.GaveUp.Total()), nil)
+		}
+		if w.Last != nil {
+			emit("writer.last.series", float64(w.Last.Series.Get()), nil)
+			emit("writer.last.skipped", float64(w.Last.Skipped.Total()), nil)
+		}
+	}
+}
+
+// transportSelfSource reports the depth of the buffers
+func transportSelfSource(t Transport) SelfSource {
+	return prefixedTransportSelfSource("transport.", t)
+}
+
+// SelfSource reports the depth of the pipeline's buffers
+func (p *Pipeline) SelfSource() SelfSource {
+	return prefixedTransportSelfSource("pipeline."+p.Name+".transport.", p.Transport)
+}
+
+func prefixedTransportSelfSource(prefix string, t Transport) SelfSource {
+	return func(emit func(string, float64, map[string]string)) {
+		emit(prefix+"input", float64(t.InputChanLen()), nil)
+		emit(prefix+"output", float64(t.OutputChanLen()), nil)
+		if rt, ok := t.(*RedisTransport); ok {
+			emit(prefix+"queue", float64(rt.Stats.QueueSize.Get()), nil)
+			if rt.Compactor != nil {
+				emit(prefix+"compacted", float64(rt.Compactor.Compacted.Total()), nil)
+			}
+		}
+	}
+}
+
+// runtimeSelfSource reports the Go runtime: goroutines (a leak shows up
+// there first), heap, GC, interned field strings and open file descriptors
+// (Linux only)
+func runtimeSelfSource() SelfSource {
+	return func(emit func(string, float64, map[string]string)) {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		emit("runtime.goroutines", float64(runtime.NumGoroutine()), nil)
+		emit("runtime.gomaxprocs", float64(runtime.GOMAXPROCS(0)), nil)
+		emit("runtime.heap.alloc", float64(ms.HeapAlloc), nil)
+		emit("runtime.heap.inuse", float64(ms.HeapInuse), nil)
+		emit("runtime.heap.objects", float64(ms.HeapObjects), nil)
+		emit("runtime.sys", float64(ms.Sys), nil)
+		emit("runtime.gc.count", float64(ms.NumGC), nil)
+		emit("runtime.gc.pause_total", time.Duration(ms.PauseTotalNs).Seconds(), nil)
+		if ms.NumGC > 0 {
+			emit("runtime.gc.pause_last", time.Duration(ms.PauseNs[(ms.NumGC+255)%256]).Seconds(), nil)
+		}
+		emit("runtime.intern.strings", float64(fieldInterner.Len()), nil)
+		emit("runtime.intern.hits", float64(fieldInterner.Hits()), nil)
+		emit("runtime.intern.misses", float64(fieldInterner.Misses()), nil)
+		if fds, err := ioutil.ReadDir("/proc/self/fd"); err == nil {
+			emit("runtime.fds", float64(len(fds)), nil)
+		}
+	}
+}
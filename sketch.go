@@ -0,0 +1,309 @@
+package metcap
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sketcher records the value distribution of every series with name
+// matching [match] into a DDSketch (sparse logarithmic histogram with
+// values accurate within [accuracy], default 1%) and every [interval]
+// emits the [percentiles] (default 50, 90, 99) of it as metrics named
+// {name}.p{percentile} (p99.9 -> p99_9) with the series' fields,
+// timestamped by the interval's start. Percentile queries are then
+// accurate without keeping every sample; with [drop_raw] the raw samples
+// of the sketched series aren't indexed at all. Samples are sketched by
+// the interval of their timestamp, those of intervals emitted already
+// (late), non-finite ones and those of series over [max_series] pass on
+// raw.
+type Sketcher struct {
+	*sync.Mutex
+	Match       []*regexp.Regexp
+	Interval    time.Duration
+	Accuracy    float64
+	Percentiles []float64
+	DropRaw     bool
+	MaxSeries   int
+	Logger      *Logger
+	Series      *StatsGauge
+	Emitted     *StatsCounter
+	Skipped     *StatsCounter // samples passed on raw
+	sketches    map[sketchKey]*seriesSketch
+	flushed     time.Time // intervals starting before are emitted already
+}
+
+type sketchKey struct {
+	series string
+	start  time.Time
+}
+
+type seriesSketch struct {
+	metric *Metric
+	sketch *DDSketch
+}
+
+func NewSketcher(c *SketchConfig, logger *Logger) (*Sketcher, error) {
+	if c.Interval.Duration <= 0 || len(c.Match) == 0 {
+		return nil, nil
+	}
+	s := &Sketcher{
+		Mutex:       &sync.Mutex{},
+		Interval:    c.Interval.Duration,
+		Accuracy:    c.Accuracy,
+		Percentiles: c.Percentiles,
+		DropRaw:     c.DropRaw,
+		MaxSeries:   c.MaxSeries,
+		Logger:      logger,
+		Series:      NewStatsGauge(),
+		Emitted:     NewStatsCounter(time.Now()),
+		Skipped:     NewStatsCounter(time.Now()),
+		sketches:    make(map[sketchKey]*seriesSketch),
+	}
+	if s.MaxSeries <= 0 {
+		s.MaxSeries = 100000
+	}
+	if s.Accuracy <= 0 || s.Accuracy >= 1 {
+		s.Accuracy = 0.01
+	}
+	if len(s.Percentiles) == 0 {
+		s.Percentiles = []float64{50, 90, 99}
+	}
+	for _, p := range s.Percentiles {
+		if p < 0 || p > 100 {
+			return nil, fmt.Errorf("invalid percentile %v", p)
+		}
+	}
+	for _, pattern := range c.Match {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		s.Match = append(s.Match, re)
+	}
+	return s, nil
+}
+
+func (s *Sketcher) matches(name string) bool {
+	for _, re := range s.Match {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Observe adds the values of the matching series to the sketches of their
+// intervals, returns the batch without them with [drop_raw]
+func (s *Sketcher) Observe(batch []*Metric) []*Metric {
+	kept := batch[:0:0]
+	s.Lock()
+	defer s.Unlock()
+	for _, m := range batch {
+		if !s.matches(m.Name) {
+			kept = append(kept, m)
+			continue
+		}
+		key := sketchKey{m.SeriesID(), m.Timestamp.Truncate(s.Interval)}
+		ss, ok := s.sketches[key]
+		if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) ||
+			!ok && (key.start.Before(s.flushed) || len(s.sketches) >= s.MaxSeries) {
+			s.Skipped.Increment(1)
+			kept = append(kept, m)
+			continue
+		}
+		if !ok {
+			ss = &seriesSketch{metric: m.Copy(), sketch: NewDDSketch(s.Accuracy)}
+			s.sketches[key] = ss
+		}
+		ss.sketch.Add(m.Value)
+		if !s.DropRaw {
+			kept = append(kept, m)
+		}
+	}
+	s.Series.Set(int64(len(s.sketches)))
+	return kept
+}
+
+// Flush emits the percentiles of the sketches of intervals ended by now,
+// or of all of them with all set (on shutdown), returns the number of
+// sketches flushed. Sketches without any value (ie. NaN only) emit nothing.
+func (s *Sketcher) Flush(emit func([]*Metric), all bool) int {
+	cutoff := time.Now().Truncate(s.Interval)
+	s.Lock()
+	ended := make(map[sketchKey]*seriesSketch)
+	for key, ss := range s.sketches {
+		if all || key.start.Before(cutoff) {
+			ended[key] = ss
+			delete(s.sketches, key)
+		}
+	}
+	if cutoff.After(s.flushed) {
+		s.flushed = cutoff
+	}
+	s.Series.Set(int64(len(s.sketches)))
+	s.Unlock()
+
+	keys := make([]sketchKey, 0, len(ended))
+	for key := range ended {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].start.Equal(keys[j].start) {
+			return keys[i].start.Before(keys[j].start)
+		}
+		return keys[i].series < keys[j].series
+	})
+	var batch []*Metric
+	flushed := 0
+	for _, key := range keys {
+		ss := ended[key]
+		if ss.sketch.Count() == 0 {
+			continue
+		}
+		flushed++
+		for _, p := range s.Percentiles {
+			m := ss.metric.Copy()
+			m.Name = ss.metric.Name + "." + percentileSuffix(p)
+			m.Timestamp = key.start
+			m.Value = ss.sketch.Quantile(p / 100)
+			m.Aggregate, m.Raw = nil, ""
+			batch = append(batch, m)
+		}
+	}
+	if len(batch) > 0 {
+		s.Emitted.Increment(len(batch))
+		emit(batch)
+	}
+	return flushed
+}
+
+// percentileSuffix names the percentile, ie. p99 or p99_9
+func percentileSuffix(p float64) string {
+	return "p" + strings.Replace(strconv.FormatFloat(p, 'f', -1, 64), ".", "_", 1)
+}
+
+// Run flushes at every interval boundary until stop is closed
+func (s *Sketcher) Run(emit func([]*Metric), stop <-chan struct{}) {
+	for {
+		next := time.Now().Truncate(s.Interval).Add(s.Interval)
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Until(next)):
+			if n := s.Flush(emit, false); n > 0 {
+				s.Logger.Debug("[sketch] Flushed percentiles of %d series", n)
+			}
+		}
+	}
+}
+
+// ----- DDSketch -----
+
+// DDSketch is a quantile sketch with relative accuracy: the value of any
+// quantile is within the accuracy of the exact one. Values fall into
+// logarithmic buckets kept sparse, so memory grows with the range of the
+// values rather than their count.
+type DDSketch struct {
+	gamma    float64
+	logGamma float64
+	positive map[int]uint64
+	negative map[int]uint64
+	zeros    uint64
+	count    uint64
+	min, max float64
+}
+
+func NewDDSketch(accuracy float64) *DDSketch {
+	gamma := (1 + accuracy) / (1 - accuracy)
+	return &DDSketch{
+		gamma:    gamma,
+		logGamma: math.Log(gamma),
+		positive: make(map[int]uint64),
+		negative: make(map[int]uint64),
+		min:      math.Inf(1),
+		max:      math.Inf(-1),
+	}
+}
+
+func (d *DDSketch) index(v float64) int {
+	return int(math.Ceil(math.Log(v) / d.logGamma))
+}
+
+func (d *DDSketch) value(index int) float64 {
+	return 2 * math.Pow(d.gamma, float64(index)) / (d.gamma + 1)
+}
+
+// Add records the value, NaN is ignored
+func (d *DDSketch) Add(v float64) {
+	switch {
+	case math.IsNaN(v):
+		return
+	case v > 0:
+		d.positive[d.index(v)]++
+	case v < 0:
+		d.negative[d.index(-v)]++
+	default:
+		d.zeros++
+	}
+	d.count++
+	d.min, d.max = math.Min(d.min, v), math.Max(d.max, v)
+}
+
+// Count is the number of values recorded
+func (d *DDSketch) Count() uint64 {
+	return d.count
+}
+
+// Quantile returns the q (0-1) quantile, NaN of an empty sketch
+func (d *DDSketch) Quantile(q float64) float64 {
+	if d.count == 0 {
+		return math.NaN()
+	}
+	if q <= 0 {
+		return d.min
+	}
+	if q >= 1 {
+		return d.max
+	}
+	rank := uint64(q * float64(d.count-1))
+	var seen uint64
+	// negative values from the most negative, ie. the largest index
+	for _, i := range sortedBuckets(d.negative, true) {
+		if seen += d.negative[i]; seen > rank {
+			return d.clamp(-d.value(i))
+		}
+	}
+	if seen += d.zeros; seen > rank {
+		return 0
+	}
+	for _, i := range sortedBuckets(d.positive, false) {
+		if seen += d.positive[i]; seen > rank {
+			return d.clamp(d.value(i))
+		}
+	}
+	return d.max
+}
+
+// clamp keeps the estimate within the values seen
+func (d *DDSketch) clamp(v float64) float64 {
+	return math.Max(d.min, math.Min(d.max, v))
+}
+
+func sortedBuckets(buckets map[int]uint64, desc bool) []int {
+	indices := make([]int, 0, len(buckets))
+	for i := range buckets {
+		indices = append(indices, i)
+	}
+	if desc {
+		sort.Sort(sort.Reverse(sort.IntSlice(indices)))
+	} else {
+		sort.Ints(indices)
+	}
+	return indices
+}
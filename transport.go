@@ -1,6 +1,9 @@
 package metcap
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 type Transport interface {
 	Start()
@@ -14,6 +17,32 @@ type Transport interface {
 	OutputChanLen() int
 }
 
+// ThrottledTransport stops reading its buffer while throttle says so, so
+// metrics the writer can't take stay in the buffer (ie. Redis) rather than
+// in the process memory
+type ThrottledTransport interface {
+	SetThrottle(throttle func() bool)
+}
+
+// BatchedTransport pops metrics off its buffer in batches of up to size,
+// handed over as popped rather than one by one over OutputChan, which stays
+// empty once the batches are asked for (before Start)
+type BatchedTransport interface {
+	OutputBatchChan(size int) <-chan []*Metric
+}
+
+// AckedTransport delivers metrics until the writer's done with them: Ack
+// once indexed (or dropped on purpose, taken by the aggregator or kept in
+// the snapshot), Nack once their bulk failed so they get delivered again.
+// Metrics not delivered by the transport are ignored.
+type AckedTransport interface {
+	Ack(metrics []*Metric)
+	Nack(metrics []*Metric)
+}
+
+// throttleWait is how long buffer readers wait before asking again
+const throttleWait = 100 * time.Millisecond
+
 type TransportError struct {
 	provider string
 	err      error
@@ -22,3 +51,27 @@ type TransportError struct {
 func (e *TransportError) Error() string {
 	return fmt.Sprintf("[%s] Error: %v", e.provider, e.err)
 }
+
+// NewTransport sets up transport of the configured type. Listener and writer
+// being enabled tell which of its ends are to be run.
+func NewTransport(c *TransportConfig, listenerEnabled, writerEnabled bool, exitFlag *Flag, logger *Logger) (Transport, error) {
+	switch c.Type {
+	case "channel":
+		if !listenerEnabled || !writerEnabled {
+			return nil, fmt.Errorf("channel transport requires you to have both listener and writer enabled")
+		}
+		return NewChannelTransport(c, logger), nil
+	case "direct":
+		if !listenerEnabled || !writerEnabled {
+			return nil, fmt.Errorf("direct transport requires you to have both listener and writer enabled")
+		}
+		return NewDirectTransport(logger), nil
+	case "redis":
+		return NewRedisTransport(c, listenerEnabled, writerEnabled, exitFlag, logger)
+	case "redis_stream":
+		return NewRedisStreamTransport(c, listenerEnabled, writerEnabled, exitFlag, logger)
+	case "amqp":
+		return NewAMQPTransport(c, listenerEnabled, writerEnabled, exitFlag, logger)
+	}
+	return nil, fmt.Errorf("transport '%s' not implemented", c.Type)
+}
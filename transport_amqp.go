@@ -18,6 +18,7 @@ type AMQPTransport struct {
 	Workers         int
 	Exchange        string
 	Queue           string
+	MetricCodec     MetricCodec
 	ListenerEnabled bool
 	WriterEnabled   bool
 	Input           chan *Metric
@@ -41,12 +42,16 @@ func NewAMQPTransport(c *TransportConfig, listenerEnabled bool, writerEnabled bo
 		c.BufferSize = 1000
 	}
 
+	codec, err := NewTransportMetricCodec(c)
+	if err != nil {
+		return nil, &TransportError{"amqp", err}
+	}
+
 	var (
 		inputConn     *amqp.Connection
 		inputChannel  *amqp.Channel
 		outputConn    *amqp.Connection
 		outputChannel *amqp.Channel
-		err           error
 	)
 
 	queue := "metcap:" + c.AMQPTag
@@ -111,6 +116,7 @@ func NewAMQPTransport(c *TransportConfig, listenerEnabled bool, writerEnabled bo
 		Workers:         c.AMQPWorkers,
 		Exchange:        exchange,
 		Queue:           queue,
+		MetricCodec:     codec,
 		ListenerEnabled: listenerEnabled,
 		WriterEnabled:   writerEnabled,
 		Input:           make(chan *Metric, c.BufferSize),
@@ -142,18 +148,22 @@ func amqpInit(c *TransportConfig) (*amqp.Connection, *amqp.Channel, error) {
 }
 
 func (t *AMQPTransport) publish(m *Metric) error {
+	data, err := t.MetricCodec.Marshal(m)
+	if err != nil {
+		return err
+	}
 	return t.InputChannel.Publish(
 		t.Exchange, // exchange
 		t.Exchange, // routing key
 		false,      // mandatory?
 		false,      // immediate?
 		amqp.Publishing{ // message definition
-			Headers:         amqp.Table{},          // AMQP message headers
-			ContentType:     "application/msgpack", // content type
-			ContentEncoding: "UTF-8",               // encoding
-			Body:            m.Serialize(),         // serialized metric data
-			DeliveryMode:    amqp.Transient,        // AMQP message delivery mode
-			Priority:        0,                     // AMQP message priority
+			Headers:         amqp.Table{},                // AMQP message headers
+			ContentType:     t.MetricCodec.ContentType(), // content type
+			ContentEncoding: "UTF-8",                     // encoding
+			Body:            data,                        // serialized metric data
+			DeliveryMode:    amqp.Transient,              // AMQP message delivery mode
+			Priority:        0,                           // AMQP message priority
 		},
 	)
 }
@@ -207,7 +217,7 @@ func (t *AMQPTransport) Start() {
 				for {
 					select {
 					case message := <-delivery:
-						metric, err := DeserializeMetric(string(message.Body))
+						metric, err := UnmarshalTransportMetric(t.MetricCodec, message.Body)
 						if err != nil {
 							message.Nack(false, false)
 							t.Logger.Error("[amqp] Failed to deserialize metric: %v", err)
@@ -217,7 +227,7 @@ func (t *AMQPTransport) Start() {
 						}
 					case <-t.ExitChan:
 						for message := range delivery { // drain delivery channel
-							metric, err := DeserializeMetric(string(message.Body))
+							metric, err := UnmarshalTransportMetric(t.MetricCodec, message.Body)
 							if err != nil {
 								message.Nack(false, false)
 								t.Logger.Error("[amqp] Failed to deserialize metric: %v", err)
@@ -45,3 +45,20 @@ func (t *ChannelTransport) OutputChanLen() int {
 func (t *ChannelTransport) LogReport() {
 	t.Logger.Info("[transport] channel: %d/%d (length/capacity)", len(t.Chan), t.Size)
 }
+
+// DirectTransport hands metrics from the listeners straight to the writer
+// over an unbuffered channel, for single-node installs not worth running
+// Redis. Nothing waits in between: a slow or unavailable ElasticSearch
+// blocks the listeners (and the senders, by TCP backpressure; UDP drops),
+// and what's in the writer's bulk queue is lost with the process.
+type DirectTransport struct {
+	*ChannelTransport
+}
+
+func NewDirectTransport(logger *Logger) *DirectTransport {
+	return &DirectTransport{&ChannelTransport{Chan: make(chan *Metric), Logger: logger}}
+}
+
+func (t *DirectTransport) LogReport() {
+	t.Logger.Info("[transport] direct: no buffer, listeners wait for the writer")
+}
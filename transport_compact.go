@@ -0,0 +1,239 @@
+package metcap
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// BufferCompactor trades resolution for survival when the redis buffer
+// piles up during long outages (ie. ElasticSearch down for hours). Once the
+// queue holds [compact_backlog] metrics, every [compact_interval] it goes
+// through the queue in chunks of [compact_chunk], rolling the points older
+// than [compact_age] up into one point per series and [compact_resolution]
+// (with the methods of [compact_rules_file], averaging by default). The
+// rolled up points carry the sum/count/min/max tuple of the merged ones, so
+// sums and counts stay right. Chunks are taken off the head of the queue
+// and put back to its tail; meanwhile they're kept in a processing list,
+// put back by the next pass should the compactor crash. Only the writer
+// holding the lock key compacts, the others skip the pass.
+type BufferCompactor struct {
+	Transport  *RedisTransport
+	Backlog    int64
+	Age        time.Duration
+	Resolution time.Duration
+	Interval   time.Duration
+	Chunk      int
+	Rules      []AggregationRule
+	Processing string // key of the chunk being compacted
+	Lock       string // key of the compactor's lock
+	Token      string // value of the lock key while ours
+	Logger     *Logger
+	Passes     *StatsCounter
+	Compacted  *StatsCounter // points merged
+	Emitted    *StatsCounter // points they got merged into
+}
+
+// compactLockTTL expires the lock of a crashed compactor, it's extended
+// with every chunk
+const compactLockTTL = 5 * time.Minute
+
+// Scripts run atomically, so no metric is ever only in the compactor's
+// memory. Lists are pushed by a thousand entries, unpack() can't take more.
+const (
+	// moves the chunk off the head of the queue (KEYS[1]) to the processing
+	// list (KEYS[2]), so writers popping meanwhile don't get the same metrics
+	compactTakeScript = `
+local chunk = redis.call('LRANGE', KEYS[1], 0, tonumber(ARGV[1]) - 1)
+if #chunk == 0 then
+  return chunk
+end
+redis.call('LTRIM', KEYS[1], #chunk, -1)
+for i = 1, #chunk, 1000 do
+  redis.call('RPUSH', KEYS[2], unpack(chunk, i, math.min(i + 999, #chunk)))
+end
+return chunk`
+	// pushes the compacted chunk (ARGV) to the tail of the queue (KEYS[1])
+	// and drops the processing list (KEYS[2])
+	compactPutScript = `
+for i = 1, #ARGV, 1000 do
+  redis.call('RPUSH', KEYS[1], unpack(ARGV, i, math.min(i + 999, #ARGV)))
+end
+redis.call('DEL', KEYS[2])
+return #ARGV`
+	// puts what a crashed pass left in the processing list (KEYS[2]) back
+	// to the queue (KEYS[1])
+	compactRecoverScript = `
+local left = redis.call('LRANGE', KEYS[2], 0, -1)
+for i = 1, #left, 1000 do
+  redis.call('RPUSH', KEYS[1], unpack(left, i, math.min(i + 999, #left)))
+end
+redis.call('DEL', KEYS[2])
+return #left`
+	// extends the lock (KEYS[1]) by ARGV[2] ms if it's still ours (ARGV[1])
+	compactExtendScript = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+  return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0`
+	// releases the lock (KEYS[1]) if it's still ours (ARGV[1])
+	compactUnlockScript = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+  return redis.call('DEL', KEYS[1])
+end
+return 0`
+)
+
+func NewBufferCompactor(c *TransportConfig, t *RedisTransport, logger *Logger) (*BufferCompactor, error) {
+	if c.CompactBacklog <= 0 {
+		return nil, nil
+	}
+	rules, err := readAggregationRules(c.CompactRulesFile)
+	if err != nil {
+		return nil, err
+	}
+	bc := &BufferCompactor{
+		Transport:  t,
+		Backlog:    int64(c.CompactBacklog),
+		Age:        c.CompactAge.Duration,
+		Resolution: c.CompactResolution.Duration,
+		Interval:   c.CompactInterval.Duration,
+		Chunk:      c.CompactChunk,
+		Rules:      rules,
+		Processing: t.Queue + ":compacting",
+		Lock:       t.Queue + ":compactor",
+		Logger:     logger,
+		Passes:     NewStatsCounter(time.Now()),
+		Compacted:  NewStatsCounter(time.Now()),
+		Emitted:    NewStatsCounter(time.Now()),
+	}
+	if bc.Age <= 0 {
+		bc.Age = time.Hour
+	}
+	if bc.Resolution <= 0 {
+		bc.Resolution = time.Minute
+	}
+	if bc.Interval <= 0 {
+		bc.Interval = 10 * time.Minute
+	}
+	if bc.Chunk <= 0 {
+		bc.Chunk = 100000
+	}
+	host, _ := os.Hostname()
+	bc.Token = fmt.Sprintf("%s:%d:%d", host, os.Getpid(), time.Now().UnixNano())
+	return bc, nil
+}
+
+// Run compacts the backlog every interval until exit
+func (bc *BufferCompactor) Run(exitFlag *Flag) {
+	for {
+		for wait := time.Duration(0); wait < bc.Interval; wait += time.Second {
+			if exitFlag.Get() {
+				return
+			}
+			time.Sleep(time.Second)
+		}
+		if err := bc.Compact(exitFlag); err != nil {
+			bc.Logger.Error("[redis] Failed to compact buffer: %v", err)
+		}
+	}
+}
+
+// Compact goes through the queue once if it's backlogged and no other
+// writer does
+func (bc *BufferCompactor) Compact(exitFlag *Flag) error {
+	t := bc.Transport
+	length, err := t.Redis.LLen(t.Queue).Result()
+	if err != nil {
+		return err
+	}
+	if length < bc.Backlog {
+		return nil
+	}
+	locked, err := t.Redis.SetNX(bc.Lock, bc.Token, compactLockTTL).Result()
+	if err != nil {
+		return err
+	}
+	if !locked {
+		bc.Logger.Debug("[redis] Buffer is being compacted by another writer")
+		return nil
+	}
+	defer t.Redis.Eval(compactUnlockScript, []string{bc.Lock}, bc.Token)
+
+	res, err := t.Redis.Eval(compactRecoverScript, []string{t.Queue, bc.Processing}).Result()
+	if err != nil {
+		return err
+	}
+	if n, _ := res.(int64); n > 0 {
+		bc.Logger.Info("[redis] Put back %d metrics left by an interrupted compaction", n)
+	}
+
+	bc.Logger.Info("[redis] Compacting %d metrics of backlog older than %v to %v resolution", length, bc.Age, bc.Resolution)
+	bc.Passes.Increment(1)
+	var before, after int64
+	for before < length && !exitFlag.Get() {
+		res, err := t.Redis.Eval(compactExtendScript, []string{bc.Lock}, bc.Token, int64(compactLockTTL/time.Millisecond)).Result()
+		if err != nil {
+			return err
+		}
+		if n, _ := res.(int64); n == 0 {
+			return fmt.Errorf("lost the compactor lock after %d metrics", before)
+		}
+		res, err = t.Redis.Eval(compactTakeScript, []string{t.Queue, bc.Processing}, bc.Chunk).Result()
+		if err != nil {
+			return err
+		}
+		chunk, _ := res.([]interface{})
+		if len(chunk) == 0 {
+			break
+		}
+		out := bc.compactChunk(chunk)
+		if err := t.Redis.Eval(compactPutScript, []string{t.Queue, bc.Processing}, out...).Err(); err != nil {
+			// the chunk stays in the processing list for the next pass
+			return fmt.Errorf("failed to put back %d metrics: %v", len(out), err)
+		}
+		before += int64(len(chunk))
+		after += int64(len(out))
+	}
+	bc.Logger.Info("[redis] Compacted %d metrics into %d", before, after)
+	return nil
+}
+
+// compactChunk rolls the old points of the chunk up, the rest (and what
+// fails to deserialize) is kept as it is
+func (bc *BufferCompactor) compactChunk(chunk []interface{}) []interface{} {
+	t := bc.Transport
+	agg := &Aggregator{
+		Mutex:    &sync.Mutex{},
+		Interval: bc.Resolution,
+		Rules:    bc.Rules,
+		Logger:   bc.Logger,
+		Tuples:   true,
+		buckets:  make(map[aggregationKey]*aggregationBucket),
+	}
+	out := make([]interface{}, 0, len(chunk))
+	cutoff := time.Now().Add(-bc.Age)
+	merged := 0
+	for _, entry := range chunk {
+		data, _ := entry.(string)
+		m, err := UnmarshalTransportMetric(t.MetricCodec, []byte(data))
+		if err != nil || !m.Timestamp.Before(cutoff) {
+			out = append(out, data)
+			continue
+		}
+		agg.Add(&m)
+		merged++
+	}
+	emitted := agg.Flush(func(m *Metric) {
+		data, err := t.MetricCodec.Marshal(m)
+		if err != nil {
+			bc.Logger.Error("[redis] Failed to serialize compacted metric: %v", err)
+			return
+		}
+		out = append(out, data)
+	}, true)
+	bc.Compacted.Increment(merged)
+	bc.Emitted.Increment(emitted)
+	return out
+}
@@ -14,34 +14,31 @@ type RedisTransport struct {
 	Size            int
 	Wait            int
 	Queue           string
+	Batch           int
+	BatchWait       time.Duration
+	MetricCodec     MetricCodec
 	ListenerEnabled bool
 	WriterEnabled   bool
 	Input           chan *Metric
 	Output          chan *Metric
+	Batches         chan []*Metric // see OutputBatchChan
+	PopBatch        int
 	ExitChan        chan bool
 	ExitFlag        *Flag
 	Wg              *sync.WaitGroup
+	Throttle        func() bool
+	Compactor       *BufferCompactor
 	Stats           *RedisTransportStats
 	Logger          *Logger
 }
 
 // NewRedisTransport
 func NewRedisTransport(c *TransportConfig, listenerEnabled bool, writerEnabled bool, exitFlag *Flag, logger *Logger) (*RedisTransport, error) {
-	connRe := regexp.MustCompile(`^(?P<network>(tcp|unix)):/{2,3}(?P<addr>[0-9a-zA-Z\._]+:[0-9]+)|(?P<db>1?[0-9])?$`)
-	connMatch := connRe.FindStringSubmatch(c.RedisURL)
-	connData := map[string]string{}
-	for i, n := range connRe.SubexpNames() {
-		connData[n] = connMatch[i]
-	}
-
 	if c.BufferSize == 0 {
 		c.BufferSize = 1000
 	}
 
-	if connData["db"] == "" {
-		connData["db"] = "0"
-	}
-	dbNum, err := strconv.Atoi(connData["db"])
+	codec, err := NewTransportMetricCodec(c)
 	if err != nil {
 		return nil, &TransportError{"redis", err}
 	}
@@ -50,25 +47,26 @@ func NewRedisTransport(c *TransportConfig, listenerEnabled bool, writerEnabled b
 		c.RedisQueue = "default"
 	}
 
-	conn := redis.NewClient(&redis.Options{
-		Network:     connData["network"],
-		Addr:        connData["addr"],
-		DB:          dbNum,
-		MaxRetries:  c.RedisRetries,
-		PoolSize:    c.RedisConnections,
-		PoolTimeout: time.Duration(c.RedisTimeout) * time.Second},
-	)
-
-	_, err = conn.Ping().Result()
+	conn, err := newRedisClient(c)
 	if err != nil {
 		return nil, &TransportError{"redis", err}
 	}
 
-	return &RedisTransport{
+	if c.RedisBatch <= 0 {
+		c.RedisBatch = 1
+	}
+	if c.RedisBatchWait.Duration <= 0 {
+		c.RedisBatchWait.Duration = 10 * time.Millisecond
+	}
+
+	t := &RedisTransport{
 		Redis:           conn,
 		Size:            c.BufferSize,
 		Queue:           "metcap:" + c.RedisQueue,
 		Wait:            c.RedisWait,
+		Batch:           c.RedisBatch,
+		BatchWait:       c.RedisBatchWait.Duration,
+		MetricCodec:     codec,
 		ListenerEnabled: listenerEnabled,
 		WriterEnabled:   writerEnabled,
 		Input:           make(chan *Metric, c.BufferSize),
@@ -78,7 +76,75 @@ func NewRedisTransport(c *TransportConfig, listenerEnabled bool, writerEnabled b
 		Wg:              &sync.WaitGroup{},
 		Stats:           NewRedisTransportStats(),
 		Logger:          logger,
-	}, nil
+	}
+	if writerEnabled {
+		t.Compactor, err = NewBufferCompactor(c, t, logger)
+		if err != nil {
+			return nil, &TransportError{"redis", err}
+		}
+	}
+	return t, nil
+}
+
+// newRedisClient connects to [redis_url] and checks the connection
+func newRedisClient(c *TransportConfig) (*redis.Client, error) {
+	connRe := regexp.MustCompile(`^(?P<network>(tcp|unix)):/{2,3}(?P<addr>[0-9a-zA-Z\._]+:[0-9]+)|(?P<db>1?[0-9])?$`)
+	connMatch := connRe.FindStringSubmatch(c.RedisURL)
+	connData := map[string]string{}
+	for i, n := range connRe.SubexpNames() {
+		connData[n] = connMatch[i]
+	}
+
+	if connData["db"] == "" {
+		connData["db"] = "0"
+	}
+	dbNum, err := strconv.Atoi(connData["db"])
+	if err != nil {
+		return nil, err
+	}
+
+	conn := redis.NewClient(&redis.Options{
+		Network:     connData["network"],
+		Addr:        connData["addr"],
+		DB:          dbNum,
+		MaxRetries:  c.RedisRetries,
+		PoolSize:    c.RedisConnections,
+		PoolTimeout: time.Duration(c.RedisTimeout) * time.Second},
+	)
+
+	if _, err := conn.Ping().Result(); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// redisPopScript takes up to ARGV[1] metrics off the head of the queue
+// (KEYS[1]) at once
+const redisPopScript = `
+local batch = redis.call('LRANGE', KEYS[1], 0, tonumber(ARGV[1]) - 1)
+if #batch > 0 then
+  redis.call('LTRIM', KEYS[1], #batch, -1)
+end
+return batch`
+
+// OutputBatchChan makes the writer's reader pop up to size metrics in one
+// go, handed over in batches
+func (t *RedisTransport) OutputBatchChan(size int) <-chan []*Metric {
+	if size < 1 {
+		size = 1
+	}
+	slots := t.Size / size
+	if slots < 1 {
+		slots = 1
+	}
+	t.PopBatch = size
+	t.Batches = make(chan []*Metric, slots)
+	return t.Batches
+}
+
+// SetThrottle makes the writer's reader stop popping while throttle is true
+func (t *RedisTransport) SetThrottle(throttle func() bool) {
+	t.Throttle = throttle
 }
 
 func (t *RedisTransport) Start() {
@@ -87,28 +153,36 @@ func (t *RedisTransport) Start() {
 		go func() {
 			t.Wg.Add(1)
 			defer t.Wg.Done()
+			batch := make([]interface{}, 0, t.Batch)
+			flush := time.NewTicker(t.BatchWait)
+			defer flush.Stop()
 			for {
 				select {
 				case m := <-t.Input:
-					err := t.Redis.RPush(t.Queue, m.Serialize()).Err()
-					if err != nil {
-						t.Logger.Error("[redis] Failed to push metric: %v - %v", err, err.Error())
-						continue
+					batch = t.appendBatch(batch, m)
+					if len(batch) >= t.Batch {
+						batch = t.push(batch)
 					}
+				case <-flush.C:
+					batch = t.push(batch)
 				case <-t.ExitChan:
 					for m := range t.Input {
-						err := t.Redis.RPush(t.Queue, m.Serialize()).Err()
-						if err != nil {
-							t.Logger.Error("[redis] Failed to push metric: %v - %v", err, err.Error())
-							continue
+						batch = t.appendBatch(batch, m)
+						if len(batch) >= t.Batch {
+							batch = t.push(batch)
 						}
 					}
+					t.push(batch)
 					return
 				}
 			}
 		}()
 	}
 
+	if t.Compactor != nil {
+		go t.Compactor.Run(t.ExitFlag)
+	}
+
 	if t.WriterEnabled {
 		go func() {
 			t.Wg.Add(1)
@@ -118,16 +192,24 @@ func (t *RedisTransport) Start() {
 					t.ExitChan <- true
 					return
 				}
+				if t.Throttle != nil && t.Throttle() {
+					time.Sleep(throttleWait)
+					continue
+				}
+				if t.Batches != nil {
+					t.popBatch()
+					continue
+				}
 				m, err := t.Redis.BLPop(time.Duration(t.Wait)*time.Second, t.Queue).Result()
 				if err != nil {
 					t.Logger.Error("[redis] Failed to get metric: %v - %v", err, err.Error())
 				}
 				if m != nil {
-					metric, err := DeserializeMetric(m[1])
+					metric, err := UnmarshalTransportMetric(t.MetricCodec, []byte(m[1]))
 					if err == nil {
 						t.Output <- &metric
 					} else {
-						t.Logger.Error("[redis] failed to DeserializeMetric(): %v - %v", err, err.Error())
+						t.Logger.Error("[redis] failed to deserialize metric: %v - %v", err, err.Error())
 					}
 				}
 			}
@@ -162,6 +244,75 @@ func (t *RedisTransport) Start() {
 	}()
 }
 
+// popBatch pops up to PopBatch metrics, if there are none it waits for
+// [redis_wait] for one
+func (t *RedisTransport) popBatch() {
+	res, err := t.Redis.Eval(redisPopScript, []string{t.Queue}, t.PopBatch).Result()
+	if err != nil {
+		t.Logger.Error("[redis] Failed to get metrics: %v", err)
+		time.Sleep(throttleWait)
+		return
+	}
+	items, _ := res.([]interface{})
+	if len(items) == 0 {
+		m, err := t.Redis.BLPop(time.Duration(t.Wait)*time.Second, t.Queue).Result()
+		if err != nil && err != redis.Nil {
+			t.Logger.Error("[redis] Failed to get metric: %v", err)
+		}
+		if m == nil {
+			return
+		}
+		items = []interface{}{m[1]}
+	}
+	batch := make([]*Metric, 0, len(items))
+	for _, item := range items {
+		data, _ := item.(string)
+		metric, err := UnmarshalTransportMetric(t.MetricCodec, []byte(data))
+		if err != nil {
+			t.Logger.Error("[redis] failed to deserialize metric: %v", err)
+			continue
+		}
+		batch = append(batch, &metric)
+	}
+	if len(batch) > 0 {
+		t.Batches <- batch
+	}
+}
+
+func (t *RedisTransport) appendBatch(batch []interface{}, m *Metric) []interface{} {
+	data, err := t.MetricCodec.Marshal(m)
+	if err != nil {
+		t.Logger.Error("[redis] Failed to serialize metric: %v", err)
+		return batch
+	}
+	return append(batch, data)
+}
+
+// push sends the batch in one RPUSH, returns the emptied batch
+func (t *RedisTransport) push(batch []interface{}) []interface{} {
+	if len(batch) == 0 {
+		return batch
+	}
+	err := t.Redis.RPush(t.Queue, batch...).Err()
+	if err != nil {
+		t.Logger.Error("[redis] Failed to push %d metrics: %v - %v", len(batch), err, err.Error())
+	}
+	return batch[:0]
+}
+
+// Requeue pushes the metrics back to the head of the queue, so they're
+// popped next (see Exporter)
+func (t *RedisTransport) Requeue(metrics []*Metric) error {
+	batch := make([]interface{}, 0, len(metrics))
+	for _, m := range metrics {
+		batch = t.appendBatch(batch, m)
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	return t.Redis.LPush(t.Queue, batch...).Err()
+}
+
 func (t *RedisTransport) Stop() {
 	t.Wg.Wait()
 	t.Redis.Close()
@@ -187,12 +338,19 @@ func (t *RedisTransport) InputChanLen() int {
 	return len(t.Input)
 }
 
+// OutputChanLen counts a batch waiting for the writer as one
 func (t *RedisTransport) OutputChanLen() int {
-	return len(t.Output)
+	return len(t.Output) + len(t.Batches)
 }
 
 func (t *RedisTransport) LogReport() {
-
+	if t.Compactor != nil {
+		t.Logger.Info("[redis] compaction: %d/%d/%d (passes/compacted/emitted)",
+			t.Compactor.Passes.Total(),
+			t.Compactor.Compacted.Total(),
+			t.Compactor.Emitted.Total(),
+		)
+	}
 }
 
 type RedisTransportStats struct {
@@ -0,0 +1,470 @@
+package metcap
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/redis.v4"
+)
+
+// RedisStreamTransport buffers metrics in a Redis Stream. Writers read it
+// through a consumer group, entries are acked once the writer's done with
+// their metrics (see AckedTransport); nacked ones are delivered again every
+// [redis_claim_idle], along with entries left pending by a crashed consumer
+// claimed from the others. The group can be rewound to replay the stream by
+// ID.
+type RedisStreamTransport struct {
+	Redis           *redis.Client
+	Stream          string
+	Group           string
+	Consumer        string
+	MaxLen          int
+	ClaimIdle       time.Duration
+	ReplayFrom      string
+	Wait            int
+	MetricCodec     MetricCodec
+	ListenerEnabled bool
+	WriterEnabled   bool
+	Input           chan *Metric
+	Output          chan *Metric
+	ExitChan        chan bool
+	ExitFlag        *Flag
+	Wg              *sync.WaitGroup
+	Throttle        func() bool
+	Stats           *RedisStreamTransportStats
+	Logger          *Logger
+
+	inflight map[*Metric]string // entry IDs of metrics delivered
+	nacked   []interface{}      // entry IDs to be delivered again
+	mux      *sync.Mutex
+}
+
+type redisStreamEntry struct {
+	id   string
+	data []byte
+}
+
+func NewRedisStreamTransport(c *TransportConfig, listenerEnabled bool, writerEnabled bool, exitFlag *Flag, logger *Logger) (*RedisStreamTransport, error) {
+	if c.BufferSize == 0 {
+		c.BufferSize = 1000
+	}
+	if c.RedisQueue == "" {
+		c.RedisQueue = "default"
+	}
+	if c.RedisGroup == "" {
+		c.RedisGroup = "metcap"
+	}
+	if c.RedisConsumer == "" {
+		c.RedisConsumer, _ = os.Hostname()
+	}
+	if c.RedisWait <= 0 {
+		// BLOCK 0 waits for good, the reader wouldn't notice the exit
+		c.RedisWait = 1
+	}
+	if c.RedisClaimIdle.Duration <= 0 {
+		c.RedisClaimIdle.Duration = time.Minute
+	}
+
+	codec, err := NewTransportMetricCodec(c)
+	if err != nil {
+		return nil, &TransportError{"redis", err}
+	}
+
+	conn, err := newRedisClient(c)
+	if err != nil {
+		return nil, &TransportError{"redis", err}
+	}
+
+	return &RedisStreamTransport{
+		Redis:           conn,
+		Stream:          "metcap:stream:" + c.RedisQueue,
+		Group:           c.RedisGroup,
+		Consumer:        c.RedisConsumer,
+		MaxLen:          c.RedisStreamMaxLen,
+		ClaimIdle:       c.RedisClaimIdle.Duration,
+		ReplayFrom:      c.RedisReplayFrom,
+		Wait:            c.RedisWait,
+		MetricCodec:     codec,
+		ListenerEnabled: listenerEnabled,
+		WriterEnabled:   writerEnabled,
+		Input:           make(chan *Metric, c.BufferSize),
+		Output:          make(chan *Metric, c.BufferSize),
+		ExitChan:        make(chan bool, 1),
+		ExitFlag:        exitFlag,
+		Wg:              &sync.WaitGroup{},
+		Stats:           NewRedisStreamTransportStats(),
+		Logger:          logger,
+		inflight:        make(map[*Metric]string),
+		mux:             &sync.Mutex{},
+	}, nil
+}
+
+// SetThrottle makes the writer's reader stop popping while throttle is true
+func (t *RedisStreamTransport) SetThrottle(throttle func() bool) {
+	t.Throttle = throttle
+}
+
+func (t *RedisStreamTransport) Start() {
+	if t.ListenerEnabled {
+		t.Wg.Add(1)
+		go func() {
+			defer t.Wg.Done()
+			for {
+				select {
+				case m := <-t.Input:
+					t.push(m)
+				case <-t.ExitChan:
+					for m := range t.Input {
+						t.push(m)
+					}
+					return
+				}
+			}
+		}()
+	}
+
+	if t.WriterEnabled {
+		if err := t.setupGroup(); err != nil {
+			t.Logger.Alert("[redis] Failed to set up consumer group '%s': %v", t.Group, err)
+			return
+		}
+		t.Wg.Add(1)
+		go func() {
+			defer t.Wg.Done()
+			// entries delivered to us before a restart come first
+			lastID := "0"
+			lastClaim := time.Now()
+			for {
+				if t.ExitFlag.Get() {
+					t.ExitChan <- true
+					return
+				}
+				if t.Throttle != nil && t.Throttle() {
+					time.Sleep(throttleWait)
+					continue
+				}
+				if time.Since(lastClaim) >= t.ClaimIdle {
+					t.claim()
+					lastClaim = time.Now()
+				}
+				entries, err := t.read(lastID)
+				if err != nil {
+					t.Logger.Error("[redis] Failed to read stream: %v", err)
+					time.Sleep(time.Second)
+					continue
+				}
+				if lastID == "0" && len(entries) == 0 {
+					lastID = ">"
+					continue
+				}
+				t.deliver(entries)
+			}
+		}()
+	}
+
+	go func() {
+		for {
+			select {
+			case <-time.After(time.Second):
+				t.updateStats()
+			case <-t.ExitChan:
+				return
+			}
+		}
+	}()
+}
+
+func (t *RedisStreamTransport) push(m *Metric) {
+	data, err := t.MetricCodec.Marshal(m)
+	if err != nil {
+		t.Logger.Error("[redis] Failed to serialize metric: %v", err)
+		return
+	}
+	args := []interface{}{"XADD", t.Stream}
+	if t.MaxLen > 0 {
+		args = append(args, "MAXLEN", "~", t.MaxLen)
+	}
+	args = append(args, "*", "m", data)
+	if err := t.Redis.Process(redis.NewCmd(args...)); err != nil {
+		t.Logger.Error("[redis] Failed to add metric to stream: %v", err)
+	}
+}
+
+// setupGroup creates the consumer group (and the stream) unless it exists,
+// and rewinds it to [redis_replay_from] if set
+func (t *RedisStreamTransport) setupGroup() error {
+	cmd := redis.NewCmd("XGROUP", "CREATE", t.Stream, t.Group, "$", "MKSTREAM")
+	t.Redis.Process(cmd)
+	if err := cmd.Err(); err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	if t.ReplayFrom != "" {
+		t.Logger.Info("[redis] Replaying stream '%s' from ID %s", t.Stream, t.ReplayFrom)
+		cmd = redis.NewCmd("XGROUP", "SETID", t.Stream, t.Group, t.ReplayFrom)
+		t.Redis.Process(cmd)
+		return cmd.Err()
+	}
+	return nil
+}
+
+// read gets entries past lastID of the group, ">" for new ones
+func (t *RedisStreamTransport) read(lastID string) ([]redisStreamEntry, error) {
+	cmd := redis.NewCmd("XREADGROUP", "GROUP", t.Group, t.Consumer,
+		"COUNT", 1000, "BLOCK", t.Wait*1000, "STREAMS", t.Stream, lastID)
+	t.Redis.Process(cmd)
+	res, err := cmd.Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	streams, _ := res.([]interface{})
+	for _, s := range streams {
+		stream, ok := s.([]interface{})
+		if !ok || len(stream) != 2 {
+			continue
+		}
+		return parseStreamEntries(stream[1])
+	}
+	return nil, nil
+}
+
+// claim takes over entries pending with other consumers for too long and
+// delivers the nacked ones again
+func (t *RedisStreamTransport) claim() {
+	t.redeliver()
+	cmd := redis.NewCmd("XPENDING", t.Stream, t.Group, "-", "+", 1000)
+	t.Redis.Process(cmd)
+	res, err := cmd.Result()
+	if err != nil {
+		return
+	}
+	args := []interface{}{"XCLAIM", t.Stream, t.Group, t.Consumer, int64(t.ClaimIdle / time.Millisecond)}
+	pending, _ := res.([]interface{})
+	for _, p := range pending {
+		// [id, consumer, idle ms, deliveries]
+		entry, ok := p.([]interface{})
+		if !ok || len(entry) < 3 {
+			continue
+		}
+		if consumer, _ := entry[1].(string); consumer == t.Consumer {
+			continue
+		}
+		if idle, _ := entry[2].(int64); time.Duration(idle)*time.Millisecond < t.ClaimIdle {
+			continue
+		}
+		args = append(args, entry[0])
+	}
+	if len(args) == 5 {
+		return
+	}
+	cmd = redis.NewCmd(args...)
+	t.Redis.Process(cmd)
+	res, err = cmd.Result()
+	if err != nil {
+		t.Logger.Error("[redis] Failed to claim pending entries: %v", err)
+		return
+	}
+	entries, err := parseStreamEntries(res)
+	if err != nil {
+		t.Logger.Error("[redis] Failed to read claimed entries: %v", err)
+		return
+	}
+	t.Logger.Info("[redis] Claimed %d entries pending with other consumers", len(entries))
+	t.Stats.Claimed.Increment(len(entries))
+	t.deliver(entries)
+}
+
+// redeliver claims the nacked entries back to us, they're delivered as if
+// new
+func (t *RedisStreamTransport) redeliver() {
+	t.mux.Lock()
+	ids := t.nacked
+	t.nacked = nil
+	t.mux.Unlock()
+	if len(ids) == 0 {
+		return
+	}
+	args := append([]interface{}{"XCLAIM", t.Stream, t.Group, t.Consumer, 0}, ids...)
+	cmd := redis.NewCmd(args...)
+	t.Redis.Process(cmd)
+	res, err := cmd.Result()
+	if err != nil {
+		t.Logger.Error("[redis] Failed to redeliver %d entries: %v", len(ids), err)
+		t.mux.Lock()
+		t.nacked = append(t.nacked, ids...)
+		t.mux.Unlock()
+		return
+	}
+	entries, err := parseStreamEntries(res)
+	if err != nil {
+		t.Logger.Error("[redis] Failed to read redelivered entries: %v", err)
+		return
+	}
+	t.Stats.Redelivered.Increment(len(entries))
+	t.deliver(entries)
+}
+
+// deliver hands the metrics to the writer, entries are acked once it's
+// done with them; ones failing to deserialize are acked right away, they
+// never will
+func (t *RedisStreamTransport) deliver(entries []redisStreamEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	var corrupt []interface{}
+	for _, e := range entries {
+		metric, err := UnmarshalTransportMetric(t.MetricCodec, e.data)
+		if err != nil {
+			t.Logger.Error("[redis] failed to deserialize metric %s: %v", e.id, err)
+			corrupt = append(corrupt, e.id)
+			continue
+		}
+		t.mux.Lock()
+		t.inflight[&metric] = e.id
+		t.mux.Unlock()
+		t.Output <- &metric
+	}
+	t.ack(corrupt)
+}
+
+// take removes the metrics from the ones in flight, returns their entry IDs
+func (t *RedisStreamTransport) take(metrics []*Metric) []interface{} {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	var ids []interface{}
+	for _, m := range metrics {
+		if id, ok := t.inflight[m]; ok {
+			delete(t.inflight, m)
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Ack acks the entries of the metrics, the writer's done with them
+func (t *RedisStreamTransport) Ack(metrics []*Metric) {
+	t.ack(t.take(metrics))
+}
+
+// Nack has the entries of the metrics delivered again with next claim
+func (t *RedisStreamTransport) Nack(metrics []*Metric) {
+	ids := t.take(metrics)
+	t.mux.Lock()
+	t.nacked = append(t.nacked, ids...)
+	t.mux.Unlock()
+}
+
+func (t *RedisStreamTransport) ack(ids []interface{}) {
+	if len(ids) == 0 {
+		return
+	}
+	args := append([]interface{}{"XACK", t.Stream, t.Group}, ids...)
+	if err := t.Redis.Process(redis.NewCmd(args...)); err != nil {
+		t.Logger.Error("[redis] Failed to ack %d entries: %v", len(ids), err)
+	}
+}
+
+func parseStreamEntries(v interface{}) ([]redisStreamEntry, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected stream reply %T", v)
+	}
+	var entries []redisStreamEntry
+	for _, item := range list {
+		// [id, [field, value, ...]]
+		entry, ok := item.([]interface{})
+		if !ok || len(entry) != 2 {
+			continue
+		}
+		id, _ := entry[0].(string)
+		kv, _ := entry[1].([]interface{})
+		for i := 0; i+1 < len(kv); i += 2 {
+			if k, _ := kv[i].(string); k == "m" {
+				data, _ := kv[i+1].(string)
+				entries = append(entries, redisStreamEntry{id, []byte(data)})
+			}
+		}
+	}
+	return entries, nil
+}
+
+func (t *RedisStreamTransport) updateStats() {
+	cmd := redis.NewCmd("XLEN", t.Stream)
+	t.Redis.Process(cmd)
+	if n, err := cmd.Result(); err == nil {
+		if l, ok := n.(int64); ok {
+			t.Stats.StreamLength.Set(l)
+		}
+	}
+	if !t.WriterEnabled {
+		return
+	}
+	cmd = redis.NewCmd("XPENDING", t.Stream, t.Group)
+	t.Redis.Process(cmd)
+	if res, err := cmd.Result(); err == nil {
+		if summary, ok := res.([]interface{}); ok && len(summary) > 0 {
+			if n, ok := summary[0].(int64); ok {
+				t.Stats.Pending.Set(n)
+			}
+		}
+	}
+}
+
+func (t *RedisStreamTransport) Stop() {
+	t.Wg.Wait()
+	t.Redis.Close()
+}
+
+func (t *RedisStreamTransport) CloseOutput() {
+	return
+}
+
+func (t *RedisStreamTransport) CloseInput() {
+	return
+}
+
+func (t *RedisStreamTransport) InputChan() chan<- *Metric {
+	return t.Input
+}
+
+func (t *RedisStreamTransport) OutputChan() <-chan *Metric {
+	return t.Output
+}
+
+func (t *RedisStreamTransport) InputChanLen() int {
+	return len(t.Input)
+}
+
+func (t *RedisStreamTransport) OutputChanLen() int {
+	return len(t.Output)
+}
+
+func (t *RedisStreamTransport) LogReport() {
+	t.Logger.Info("[redis] stream: %d/%d/%d/%d (length/pending/claimed/redelivered)",
+		t.Stats.StreamLength.Get(),
+		t.Stats.Pending.Get(),
+		t.Stats.Claimed.Total(),
+		t.Stats.Redelivered.Total(),
+	)
+}
+
+type RedisStreamTransportStats struct {
+	StreamLength *StatsGauge
+	Pending      *StatsGauge
+	Claimed      *StatsCounter
+	Redelivered  *StatsCounter
+}
+
+func NewRedisStreamTransportStats() *RedisStreamTransportStats {
+	return &RedisStreamTransportStats{
+		StreamLength: NewStatsGauge(),
+		Pending:      NewStatsGauge(),
+		Claimed:      NewStatsCounter(time.Now()),
+		Redelivered:  NewStatsCounter(time.Now()),
+	}
+}
@@ -0,0 +1,36 @@
+package metcap
+
+import (
+	"regexp"
+	"time"
+)
+
+// TTLRule stamps metrics with names matching the pattern with expire_at,
+// so delete-by-query/ILM can expire them sooner than the whole index
+type TTLRule struct {
+	match *regexp.Regexp
+	ttl   time.Duration
+}
+
+func NewTTLRules(c []TTLConfig) ([]TTLRule, error) {
+	var rules []TTLRule
+	for _, r := range c {
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, TTLRule{re, r.TTL.Duration})
+	}
+	return rules, nil
+}
+
+// applyTTL sets expire_at by the first matching rule
+func applyTTL(rules []TTLRule, m *Metric) {
+	for _, rule := range rules {
+		if rule.match.MatchString(m.Name) {
+			expireAt := m.Timestamp.Add(rule.ttl)
+			m.ExpireAt = &expireAt
+			return
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package metcap
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Zero-downtime upgrades hand the listening sockets over to a new process.
+// On SIGHUP the engine starts the binary (replaced by the new version) with
+// the same arguments and all its listening sockets as inherited file
+// descriptors, named in METCAP_INHERITED_FDS in the order they follow fd 2.
+// The new process takes those over instead of binding, starts and reports
+// being ready by writing to the pipe in METCAP_READY_FD. Only then the old
+// process stops accepting and shuts down like on SIGTERM, draining its
+// buffers through its own writer; connections arriving meanwhile wait in
+// the shared sockets' backlog for the new process.
+const (
+	envInheritedFDs = "METCAP_INHERITED_FDS"
+	envReadyFD      = "METCAP_READY_FD"
+	readyMessage    = "ready"
+)
+
+// HandoffSocket is a listening socket passed to the new process
+type HandoffSocket struct {
+	Name string
+	File *os.File
+}
+
+var (
+	inherited    map[string][]*os.File
+	inheritedMux = &sync.Mutex{}
+)
+
+// takeInherited returns (once) the sockets of the name passed by the
+// previous process
+func takeInherited(name string) []*os.File {
+	inheritedMux.Lock()
+	defer inheritedMux.Unlock()
+	if inherited == nil {
+		inherited = make(map[string][]*os.File)
+		if spec := os.Getenv(envInheritedFDs); spec != "" {
+			for i, n := range strings.Split(spec, ",") {
+				inherited[n] = append(inherited[n], os.NewFile(uintptr(3+i), n))
+			}
+		}
+		os.Unsetenv(envInheritedFDs)
+	}
+	files := inherited[name]
+	delete(inherited, name)
+	return files
+}
+
+// inheritedListeners turns the inherited sockets of the name into
+// listeners, nil if there are none
+func inheritedListeners(name string) ([]net.Listener, error) {
+	var socks []net.Listener
+	for _, f := range takeInherited(name) {
+		sock, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		socks = append(socks, sock)
+	}
+	return socks, nil
+}
+
+// inheritedPacketConn turns the inherited socket of the name into a packet
+// connection, nil if there's none
+func inheritedPacketConn(name string) (net.PacketConn, error) {
+	files := takeInherited(name)
+	if len(files) == 0 {
+		return nil, nil
+	}
+	defer files[0].Close()
+	return net.FilePacketConn(files[0])
+}
+
+// listenerFiles duplicates the listening sockets for handing them over
+func listenerFiles(name string, socks []net.Listener) ([]HandoffSocket, error) {
+	var out []HandoffSocket
+	for _, sock := range socks {
+		tcp, ok := sock.(*net.TCPListener)
+		if !ok {
+			return nil, fmt.Errorf("can't hand %s socket over", sock.Addr().Network())
+		}
+		f, err := tcp.File()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, HandoffSocket{name, f})
+	}
+	return out, nil
+}
+
+// HandoffSockets are the listener's sockets to pass to the new process
+func (l *Listener) HandoffSockets() ([]HandoffSocket, error) {
+	name := "listener:" + l.Name
+	if l.Packet != nil {
+		udp, ok := l.Packet.(*net.UDPConn)
+		if !ok {
+			return nil, errors.New("can't hand packet socket over")
+		}
+		f, err := udp.File()
+		if err != nil {
+			return nil, err
+		}
+		return []HandoffSocket{{name, f}}, nil
+	}
+	return listenerFiles(name, l.Sockets)
+}
+
+// HandoffSockets is the admin API socket to pass to the new process
+func (a *Admin) HandoffSockets() ([]HandoffSocket, error) {
+	if a.Sock == nil {
+		return nil, nil
+	}
+	return listenerFiles("admin", []net.Listener{a.Sock})
+}
+
+// Upgrade starts the binary again with the sockets and waits for it to
+// report being ready, it's killed unless it does within timeout
+func Upgrade(sockets []HandoffSocket, timeout time.Duration, logger *Logger) (int, error) {
+	defer func() {
+		for _, s := range sockets {
+			s.File.Close()
+		}
+	}()
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer ready.Close()
+
+	var names []string
+	var files []*os.File
+	for _, s := range sockets {
+		names = append(names, s.Name)
+		files = append(files, s.File)
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(os.Environ(),
+		envInheritedFDs+"="+strings.Join(names, ","),
+		envReadyFD+"="+strconv.Itoa(3+len(files)),
+	)
+	logger.Info("[engine] Starting %s with %d sockets", exe, len(sockets))
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	done := make(chan bool, 1)
+	go func() {
+		// the pipe closes with nothing written if the process dies
+		buf := make([]byte, len(readyMessage))
+		_, err := io.ReadFull(ready, buf)
+		done <- err == nil && string(buf) == readyMessage
+	}()
+
+	select {
+	case ok := <-done:
+		if !ok {
+			cmd.Wait()
+			return 0, errors.New("new process exited before getting ready")
+		}
+		go cmd.Wait()
+		return cmd.Process.Pid, nil
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, fmt.Errorf("new process not ready within %v", timeout)
+	}
+}
+
+// notifyReady tells the previous process, if any, to hand over; sockets
+// it passed which no longer have a listener configured are closed
+func notifyReady(logger *Logger) {
+	inheritedMux.Lock()
+	for name, files := range inherited {
+		for _, f := range files {
+			f.Close()
+		}
+		delete(inherited, name)
+	}
+	inheritedMux.Unlock()
+
+	fd := os.Getenv(envReadyFD)
+	if fd == "" {
+		return
+	}
+	os.Unsetenv(envReadyFD)
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		logger.Error("[engine] Invalid %s: %v", envReadyFD, err)
+		return
+	}
+	f := os.NewFile(uintptr(n), "ready")
+	f.Write([]byte(readyMessage))
+	f.Close()
+	logger.Info("[engine] Took over from the previous process")
+}
@@ -0,0 +1,59 @@
+package metcap
+
+import (
+	"errors"
+	"fmt"
+	"unicode"
+)
+
+// Schema is the set of checks strict listeners run on decoded metrics, the
+// ones failing are reported as codec errors instead of being passed on
+type Schema struct {
+	MaxFields int
+}
+
+func NewSchema(c ListenerConfig) *Schema {
+	if !c.Strict && c.Conformance != "strict" {
+		return nil
+	}
+	s := &Schema{MaxFields: c.MaxFields}
+	if s.MaxFields <= 0 {
+		s.MaxFields = 64
+	}
+	return s
+}
+
+// Validate returns the reason the metric is rejected for
+func (s *Schema) Validate(m *Metric) error {
+	if m.Name == "" {
+		return errors.New("empty name")
+	}
+	if !isPrintable(m.Name) {
+		return fmt.Errorf("illegal characters in name '%s'", m.Name)
+	}
+	if len(m.Fields) > s.MaxFields {
+		return fmt.Errorf("%d fields, max. %d allowed", len(m.Fields), s.MaxFields)
+	}
+	for _, k := range sortedKeys(m.Fields) { // the same key is reported every time
+		switch {
+		case k == "":
+			return errors.New("empty field key")
+		case k[0] == '_':
+			return fmt.Errorf("field key '%s' starts with '_', reserved for meta fields", k)
+		case !isPrintable(k):
+			return fmt.Errorf("illegal characters in field key '%s'", k)
+		}
+	}
+	return nil
+}
+
+// isPrintable is false for strings with whitespace, control characters or
+// invalid UTF-8
+func isPrintable(s string) bool {
+	for _, r := range s {
+		if r == unicode.ReplacementChar || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
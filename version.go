@@ -0,0 +1,48 @@
+package metcap
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Build info, set at build time by the Makefile:
+//
+//	go build -ldflags "-X github.com/blufor/metcap.Version=0.7 \
+//	  -X github.com/blufor/metcap.Commit=$(git rev-parse --short HEAD) \
+//	  -X github.com/blufor/metcap.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
+
+// BuildInfo describes the running binary
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+}
+
+func GetBuildInfo() BuildInfo {
+	return BuildInfo{Version, Commit, BuildDate, runtime.Version()}
+}
+
+func (b BuildInfo) String() string {
+	return fmt.Sprintf("MetCap version %s (commit %s, built %s, %s)", b.Version, b.Commit, b.BuildDate, b.GoVersion)
+}
+
+// buildInfoSelfSource reports the build as fields of constant 1, so the
+// versions running across the fleet can be counted
+func buildInfoSelfSource() SelfSource {
+	b := GetBuildInfo()
+	fields := map[string]string{
+		"version":    b.Version,
+		"commit":     b.Commit,
+		"build_date": b.BuildDate,
+		"go_version": b.GoVersion,
+	}
+	return func(emit func(string, float64, map[string]string)) {
+		emit("build_info", 1, fields)
+	}
+}
@@ -1,6 +1,11 @@
 package metcap
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
 	"sync"
 	"time"
 
@@ -8,33 +13,333 @@ import (
 )
 
 type Writer struct {
-	Config    *WriterConfig
-	ModuleWg  *sync.WaitGroup
-	Transport Transport
-	Elastic   *elastic.Client
-	Processor *elastic.BulkProcessor
-	Logger    *Logger
-	ExitFlag  *Flag
-	Stats     *WriterStats
+	Config     *WriterConfig
+	ModuleWg   *sync.WaitGroup
+	Transport  Transport
+	Elastic    *elastic.Client
+	Flavor     esFlavor
+	Processor  *elastic.BulkProcessor
+	Ordered    *OrderedProcessors
+	Targets    *BulkTargets
+	Hooks      []WriterHook
+	Script     *Script
+	Aggregator *Aggregator
+	Hold       *SampleHold
+	Sketch     *Sketcher
+	Chaos      *Chaos
+	Last       *LastValues
+	Events     *EventEvaluator
+	TTLRules   []TTLRule
+	IndexRules []IndexRule
+	Health     *ClusterHealthGate
+	Resources  *ResourceVerifier
+	Shadow     *ShadowWriter
+	Maintainer *IndexMaintainer
+	WriteAlias *WriteAlias
+	Compressor *BulkCompressor
+	Retrier    *StatusRetrier
+	Snapshot   *WriterSnapshot
+	Dedup      *Dedup
+	Acks       AckedTransport
+	Batches    <-chan []*Metric // metrics popped in batches by the transport
+	Anonymizer *Anonymizer
+	State      *OpState
+	Logger     *Logger
+	ExitFlag   *Flag
+	Stats      *WriterStats
+
+	errSampler    *bulkErrorSampler
+	errSamplerMux *sync.Mutex
+	acking        map[elastic.BulkableRequest]*Metric // delivered metrics of queued requests
+	ackingMux     *sync.Mutex
+	connMux       *sync.RWMutex // what connect and Start set, read by reports and the admin API
 }
 
-func NewWriter(c *WriterConfig, t Transport, module_wg *sync.WaitGroup, logger *Logger, exitFlag *Flag) (Writer, error) {
+func NewWriter(c *WriterConfig, t Transport, chaos *Chaos, module_wg *sync.WaitGroup, logger *Logger, exitFlag *Flag) (Writer, error) {
 	logger.Info("[writer] Initializing module")
+	if c.Compat != "" && c.Compat != "opensearch" {
+		return Writer{}, fmt.Errorf("unknown compat mode '%s'", c.Compat)
+	}
+	if c.Startup == "" {
+		c.Startup = "fail"
+	}
+	if c.Startup != "fail" && c.Startup != "block" && c.Startup != "buffer" {
+		return Writer{}, fmt.Errorf("unknown startup mode '%s'", c.Startup)
+	}
+	if c.StartupRetry.Duration <= 0 {
+		c.StartupRetry.Duration = 10 * time.Second
+	}
+	if c.FieldsMapping != "" && c.FieldsMapping != "dynamic" && c.FieldsMapping != "flattened" {
+		return Writer{}, fmt.Errorf("unknown fields mapping '%s'", c.FieldsMapping)
+	}
+	if c.NameMapping != "" && c.NameMapping != "keyword" && c.NameMapping != "hierarchy" {
+		return Writer{}, fmt.Errorf("unknown name mapping '%s'", c.NameMapping)
+	}
+	if c.NameDelimiter == "" {
+		c.NameDelimiter = "."
+	}
+
+	var (
+		events *EventEvaluator
+		err    error
+	)
+	if len(c.Events.Thresholds) > 0 || c.Events.Annotations {
+		if c.Events.Index == "" {
+			c.Events.Index = "events_" + c.Index // mustn't match the metrics template
+		}
+		if c.Events.DocType == "" {
+			c.Events.DocType = "event"
+		}
+	}
+	if len(c.Events.Thresholds) > 0 {
+		events, err = NewEventEvaluator(&c.Events)
+		if err != nil {
+			logger.Alert("[writer] Failed to load event thresholds: %v", err)
+			return Writer{}, err
+		}
+	}
+
+	ttlRules, err := NewTTLRules(c.TTL)
+	if err != nil {
+		logger.Alert("[writer] Failed to load TTL rules: %v", err)
+		return Writer{}, err
+	}
+
+	indexRules, err := NewIndexRules(c.IndexRules)
+	if err != nil {
+		logger.Alert("[writer] Failed to load index rules: %v", err)
+		return Writer{}, err
+	}
+	if c.WriteAlias != "" && len(indexRules) > 0 {
+		return Writer{}, errors.New("write_alias can't be combined with index rules")
+	}
+
+	compressor, err := NewBulkCompressor(c)
+	if err != nil {
+		logger.Alert("[writer] %v", err)
+		return Writer{}, err
+	}
+
+	retrier, err := NewStatusRetrier(c)
+	if err != nil {
+		logger.Alert("[writer] %v", err)
+		return Writer{}, err
+	}
+
+	snapshot, err := NewWriterSnapshot(c, logger)
+	if err != nil {
+		logger.Alert("[writer] Invalid snapshot file: %v", err)
+		return Writer{}, err
+	}
 
-	logger.Debug("[writer] Connecting to ElasticSearch %v", c.URLs)
-	es, err := elastic.NewClient(elastic.SetURL(c.URLs...))
+	dedup, err := NewDedup(&c.Dedup, logger)
 	if err != nil {
-		logger.Alert("[writer] Can't connect to ElasticSearch: %v", err)
+		logger.Alert("[writer] Failed to set up deduplication: %v", err)
 		return Writer{}, err
 	}
-	logger.Debug("[writer] Successfully connected to ElasticSearch")
 
-	ESTemplate := `{"template":"` + c.Index + `*","mappings":{"raw":{"_source":{"enabled":false},"dynamic_templates":[{"fields":{"mapping":{"index":"not_analyzed","type":"string","copy_to":"@uniq"},"path_match":"fields.*"}}],"properties":{"@timestamp":{"type":"date","format":"strict_date_optional_time||epoch_millis"},"@uniq":{"type":"string","index":"not_analyzed"},"name":{"type":"string","index":"not_analyzed"},"value":{"type":"double","index":"not_analyzed"}}}}}`
+	hooks := registeredWriterHooks()
+	normalize, err := NewNormalizePreset(c.Normalize)
+	if err != nil {
+		logger.Alert("[writer] %v", err)
+		return Writer{}, err
+	}
+	var script *Script
+	if c.ScriptFile != "" {
+		script, err = NewScript(c.ScriptFile)
+		if err != nil {
+			logger.Alert("[writer] Failed to load script: %v", err)
+			return Writer{}, err
+		}
+		hooks = append(hooks, script)
+	}
+	if normalize != nil {
+		hooks = append(hooks, normalize)
+	}
+	// last, so whatever the script puts into the fields gets anonymized too
+	anonymizer, err := NewAnonymizer(&c.Anonymize)
+	if err != nil {
+		logger.Alert("[writer] Failed to set up anonymization: %v", err)
+		return Writer{}, err
+	}
+	if anonymizer != nil {
+		hooks = append(hooks, anonymizer)
+	}
+
+	w := Writer{
+		Config:     c,
+		ModuleWg:   module_wg,
+		Transport:  t,
+		Hooks:      hooks,
+		Script:     script,
+		Events:     events,
+		TTLRules:   ttlRules,
+		IndexRules: indexRules,
+		Compressor: compressor,
+		Retrier:    retrier,
+		Chaos:      chaos, // connect puts it into the transport
+		Snapshot:   snapshot,
+		Dedup:      dedup,
+		Anonymizer: anonymizer,
+		Logger:     logger,
+		ExitFlag:   exitFlag,
+		Stats:      NewWriterStats(),
+
+		errSampler:    newBulkErrorSampler(time.Minute),
+		errSamplerMux: &sync.Mutex{},
+		acking:        make(map[elastic.BulkableRequest]*Metric),
+		ackingMux:     &sync.Mutex{},
+		connMux:       &sync.RWMutex{},
+	}
+
+	if tt, ok := t.(ThrottledTransport); ok && c.BulkQueueMax > 0 {
+		tt.SetThrottle(w.congested)
+	}
+	if at, ok := t.(AckedTransport); ok {
+		w.Acks = at
+	}
+	if bt, ok := t.(BatchedTransport); ok {
+		w.Batches = bt.OutputBatchChan(c.BulkMax)
+	}
+
+	switch c.Startup {
+	case "fail":
+		if err := w.connect(); err != nil {
+			return Writer{}, err
+		}
+	case "block":
+		if !w.connectRetry() {
+			return Writer{}, errors.New("stopped before ElasticSearch became available")
+		}
+	case "buffer":
+		// Start connects before consuming the transport
+	}
+	return w, nil
+}
+
+// connect sets up the ElasticSearch client along with everything needing it
+func (w *Writer) connect() error {
+	c := w.Config
+	w.Logger.Debug("[writer] Connecting to ElasticSearch %v", c.URLs)
+	// compressor -> retrier -> chaos: the body's gzipped once and retried
+	// as is, the 503s of chaos get retried like real ones
+	var transport http.RoundTripper
+	if w.Chaos != nil {
+		transport = w.Chaos.RoundTripper(transport)
+	}
+	if w.Retrier != nil {
+		if transport != nil {
+			w.Retrier.Transport = transport
+		}
+		transport = w.Retrier
+	}
+	if w.Compressor != nil {
+		if transport != nil {
+			w.Compressor.Transport = transport
+		}
+		transport = w.Compressor
+	}
+	es, flavor, err := newESClient(c.URLs, c, transport, w.Logger)
+	if err != nil {
+		w.Logger.Alert("[writer] Can't connect to ElasticSearch: %v", err)
+		return err
+	}
+	w.Logger.Debug("[writer] Successfully connected to ElasticSearch")
+
+	if docType := flavor.docType(c.DocType); docType != c.DocType {
+		if c.DocType != "" {
+			w.Logger.Info("[writer] Cluster doesn't support document types, using '%s' instead of '%s'", docType, c.DocType)
+		}
+		c.DocType = docType
+	}
+	if flavor.typeless() {
+		c.Events.DocType = "_doc"
+	}
+
+	if c.VerifyInterval.Duration <= 0 {
+		c.VerifyInterval.Duration = time.Hour
+	}
+	resources := NewResourceVerifier(es, c, flavor, w.Logger)
+	if err := resources.Verify(); err != nil {
+		return err
+	}
+
+	var (
+		health     *ClusterHealthGate
+		shadow     *ShadowWriter
+		maintainer *IndexMaintainer
+		alias      *WriteAlias
+	)
+	if c.HealthCheck.Duration > 0 {
+		health = NewClusterHealthGate(es, c.HealthCheck.Duration, c.MaxRelocating, w.Logger)
+	}
+	if len(c.Shadow.URLs) > 0 && c.Shadow.Percent > 0 {
+		shadow, err = NewShadowWriter(c, w.Logger)
+		if err != nil {
+			return err
+		}
+	}
+	if c.Maintenance.Age.Duration > 0 {
+		maintainer = NewIndexMaintainer(es, c, w.Logger)
+	}
+	if c.WriteAlias != "" {
+		alias = NewWriteAlias(es, c, w.Logger)
+		if err := alias.Bootstrap(); err != nil {
+			w.Logger.Alert("[writer] Failed to bootstrap write alias '%s': %v", c.WriteAlias, err)
+			return err
+		}
+	}
+
+	// with startup = "buffer" this runs in Start, while reports and the
+	// admin API may read these already
+	w.connMux.Lock()
+	w.Resources = resources
+	w.Health = health
+	w.Shadow = shadow
+	w.Maintainer = maintainer
+	w.WriteAlias = alias
+	w.Flavor = flavor
+	w.Elastic = es
+	w.connMux.Unlock()
+	return nil
+}
+
+// Client returns the ElasticSearch client and its flavor, the client is nil
+// until connected
+func (w *Writer) Client() (*elastic.Client, esFlavor) {
+	w.connMux.RLock()
+	defer w.connMux.RUnlock()
+	return w.Elastic, w.Flavor
+}
+
+// connectRetry connects every [startup_retry] until it succeeds, returns
+// false if the exit flag got raised meanwhile
+func (w *Writer) connectRetry() bool {
+	for !w.ExitFlag.Get() {
+		if err := w.connect(); err == nil {
+			return true
+		}
+		w.Logger.Info("[writer] Retrying to connect in %v", w.Config.StartupRetry.Duration)
+		deadline := time.Now().Add(w.Config.StartupRetry.Duration)
+		for time.Now().Before(deadline) && !w.ExitFlag.Get() {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	return false
+}
+
+// ensureTemplate puts the index mapping template unless it already exists
+func ensureTemplate(es *elastic.Client, c *WriterConfig, flavor esFlavor, logger *Logger) error {
+	ESTemplate, err := esTemplate(c, flavor)
+	if err != nil {
+		logger.Alert("[writer] Failed to generate the index mapping template: %v", err)
+		return err
+	}
 
 	tmplExists, err := es.IndexTemplateExists(c.Index).Do()
 	if err != nil {
 		logger.Alert("[writer] Error checking index mapping template existence: %v", err)
-		return Writer{}, err
+		return err
 	}
 	if !tmplExists {
 		logger.Info("[writer] Index mapping template doesn't exits, creating '%s'", c.Index)
@@ -45,29 +350,141 @@ func NewWriter(c *WriterConfig, t Transport, module_wg *sync.WaitGroup, logger *
 		err := tmpl.Validate()
 		if err != nil {
 			logger.Alert("[writer] Failed to validate the index mapping template: %v", err)
-			return Writer{}, err
+			return err
 		}
 		res, err := tmpl.Do()
 		if err != nil {
 			logger.Alert("[writer] Failed to put the index mapping template: %v", err)
-			return Writer{}, err
+			return err
 		}
 		if !res.Acknowledged {
 			logger.Error("[writer] Failed to acknowledge the new index mapping template")
-			return Writer{}, err
+			return err
 		}
 		logger.Info("[writer] New index mapping template acknowledged")
 	}
+	return nil
+}
+
+// esTemplate generates the index mapping template including the index-level
+// settings, so new indices aren't created with cluster defaults tuned for search.
+// Typeless clusters get the mapping without the document type level.
+// Flattened [fields_mapping] maps all fields as one field, so no sender can
+// blow the mapping up with new field names. Hierarchy [name_mapping] adds
+// name.tree multi-field indexing every prefix of the name, so prefix
+// searches (name.tree:"os.cpu") are term lookups rather than wildcards.
+func esTemplate(c *WriterConfig, flavor esFlavor) (string, error) {
+	flattened := c.FieldsMapping == "flattened"
+	if flattened && !flavor.flattened() {
+		return "", errors.New("flattened fields mapping requires ElasticSearch 7.3+")
+	}
+	settings := map[string]interface{}{}
+	if c.Shards != nil {
+		settings["number_of_shards"] = *c.Shards
+	}
+	if c.Replicas != nil {
+		settings["number_of_replicas"] = *c.Replicas
+	}
+	if c.RefreshInterval != "" {
+		settings["refresh_interval"] = c.RefreshInterval
+	}
+	if c.IndexCodec != "" {
+		settings["codec"] = c.IndexCodec
+	}
+	for k, v := range c.IndexSettings {
+		settings[k] = v
+	}
+	if c.NameMapping == "hierarchy" {
+		settings["analysis"] = map[string]interface{}{
+			"analyzer": map[string]interface{}{
+				"metcap_name_tree": map[string]interface{}{"type": "custom", "tokenizer": "metcap_name_tree"},
+			},
+			"tokenizer": map[string]interface{}{
+				"metcap_name_tree": map[string]interface{}{"type": "path_hierarchy", "delimiter": c.NameDelimiter},
+			},
+		}
+	}
+
+	// raw input lines are kept for looking up (stored_fields=raw), never
+	// searched, _source being disabled
+	rawMapping := map[string]interface{}{"type": "string", "index": "no", "store": true}
+	if flavor.keywords() {
+		rawMapping = map[string]interface{}{"type": "keyword", "index": false, "doc_values": false, "store": true}
+	}
 
-	return Writer{
-		Config:    c,
-		ModuleWg:  module_wg,
-		Transport: t,
-		Elastic:   es,
-		Logger:    logger,
-		ExitFlag:  exitFlag,
-		Stats:     NewWriterStats(),
-	}, nil
+	keyword := func(extra map[string]interface{}) map[string]interface{} {
+		m := map[string]interface{}{"type": "string", "index": "not_analyzed"}
+		if flavor.keywords() {
+			m = map[string]interface{}{"type": "keyword"}
+		}
+		for k, v := range extra {
+			m[k] = v
+		}
+		return m
+	}
+	nameMapping := keyword(nil)
+	if c.NameMapping == "hierarchy" {
+		// searched by the whole prefix, not its own prefixes
+		tree := map[string]interface{}{"type": "string", "analyzer": "metcap_name_tree", "search_analyzer": "keyword"}
+		if flavor.keywords() {
+			tree["type"] = "text"
+		}
+		nameMapping = keyword(map[string]interface{}{"fields": map[string]interface{}{"tree": tree}})
+	}
+	mapping := map[string]interface{}{
+		"_source": map[string]interface{}{"enabled": false},
+		"dynamic_templates": []interface{}{
+			map[string]interface{}{
+				"fields": map[string]interface{}{
+					"mapping":    keyword(map[string]interface{}{"copy_to": "@uniq"}),
+					"path_match": "fields.*",
+				},
+			},
+		},
+		"properties": map[string]interface{}{
+			"@timestamp": map[string]interface{}{"type": "date", "format": "strict_date_optional_time||epoch_millis"},
+			"@uniq":      keyword(nil),
+			"name":       nameMapping,
+			"value":      map[string]interface{}{"type": "double"},
+			"expire_at":  map[string]interface{}{"type": "date", "format": "strict_date_optional_time||epoch_millis"},
+			"raw":        rawMapping,
+			"agg": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"sum":   map[string]interface{}{"type": "double"},
+					"count": map[string]interface{}{"type": "double"},
+					"min":   map[string]interface{}{"type": "double"},
+					"max":   map[string]interface{}{"type": "double"},
+				},
+			},
+		},
+	}
+	if flattened {
+		delete(mapping, "dynamic_templates")
+		mapping["properties"].(map[string]interface{})["fields"] = map[string]interface{}{"type": "flattened"}
+	}
+
+	tmpl := map[string]interface{}{
+		"template": c.Index + "*",
+		"settings": settings,
+		"mappings": map[string]interface{}{flavor.docType(c.DocType): mapping},
+	}
+	if flavor.typeless() {
+		// the legacy "template" pattern key is gone too
+		tmpl = map[string]interface{}{
+			"index_patterns": []string{c.Index + "*"},
+			"settings":       settings,
+			"mappings":       mapping,
+		}
+	}
+	if c.ReadAlias != "" {
+		tmpl["aliases"] = map[string]interface{}{c.ReadAlias: map[string]interface{}{}}
+	}
+
+	out, err := json.Marshal(tmpl)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
 }
 
 func (w *Writer) Start() {
@@ -75,34 +492,117 @@ func (w *Writer) Start() {
 	defer w.ModuleWg.Done()
 	w.Logger.Info("[writer] Starting writer module")
 
+	if w.Elastic == nil {
+		// startup = "buffer", metrics wait in the transport meanwhile
+		w.Logger.Info("[writer] Waiting for ElasticSearch, buffering metrics in the transport")
+		if !w.connectRetry() {
+			w.Logger.Info("[writer] Stopped")
+			return
+		}
+	}
+
 	exitTrigger := make(chan struct{}, 1)
 	exitFinished := make(chan struct{}, 1)
 
 	w.Logger.Debug("[writer] Setting up bulk-processor")
-	var err interface{}
-	w.Processor, err = elastic.NewBulkProcessorService(w.Elastic).
-		Name("metcap").
-		Workers(w.Config.Concurrency).
-		BulkActions(w.Config.BulkMax).
-		BulkSize(-1).
-		Before(w.hookBeforeCommit).
-		After(w.hookAfterCommit).
-		FlushInterval(w.Config.BulkWait.Duration).
-		Do()
-
+	var (
+		processor *elastic.BulkProcessor
+		ordered   *OrderedProcessors
+		err       error
+	)
+	if w.Config.Ordered {
+		w.Logger.Info("[writer] Keeping series in order over %d bulk-processors", w.Config.Concurrency)
+		ordered, err = NewOrderedProcessors("metcap", w.Config.Concurrency, w.newBulkProcessor)
+	} else {
+		processor, err = w.newBulkProcessor("metcap", w.Config.Concurrency)
+	}
 	if err != nil {
 		w.Logger.Alert("[writer] Failed to setup bulk-processor: %v", err)
 		return
 	}
+	w.connMux.Lock()
+	w.Processor = processor
+	w.Ordered = ordered
+	w.Targets = NewBulkTargets(w.Config, w.newBulkProcessor, w.Logger)
+	w.connMux.Unlock()
+	if w.Targets != nil {
+		go w.Targets.Run(w.ExitFlag)
+	}
+
+	if w.Health != nil {
+		go w.Health.Run(w.ExitFlag)
+	}
+	go w.Resources.Run(w.ExitFlag)
+	if w.Maintainer != nil {
+		go w.Maintainer.Run(w.ExitFlag)
+	}
+	if w.WriteAlias != nil {
+		go w.WriteAlias.Run(w.ExitFlag)
+	}
+	stopFlusher := make(chan struct{})
+	if w.Config.BulkWaitJitter.Duration > 0 && w.Config.BulkWait.Duration > 0 {
+		go w.flushJittered(stopFlusher)
+	}
+
+	if w.Shadow != nil {
+		go w.Shadow.Run()
+	}
+
+	stopAggregator := make(chan struct{})
+	if w.Aggregator != nil {
+		go w.Aggregator.Run(w.index, stopAggregator)
+	}
+	stopHold := make(chan struct{})
+	if w.Hold != nil {
+		go w.Hold.Run(w.forwardHeld, stopHold)
+	}
+	stopSketch := make(chan struct{})
+	if w.Sketch != nil {
+		go w.Sketch.Run(w.indexBatch, stopSketch)
+	}
+	if w.Snapshot != nil {
+		w.restoreSnapshot()
+	}
 
 	w.Logger.Info("[writer] Writer module started")
 
 	go func() {
 		for {
+			// paused writer leaves the metrics in the transport
+			output, batches := w.Transport.OutputChan(), w.Batches
+			paused, changed := w.State.Watch("paused")
+			if paused {
+				output, batches = nil, nil
+			}
+			var recheck <-chan time.Time
+			if !paused && w.congested() {
+				// congested processors would block in Add, the metrics
+				// are safer left in the transport meanwhile
+				output, batches = nil, nil
+				recheck = time.After(throttleWait)
+				w.Stats.Throttled.Increment(1)
+			}
 			select {
-			case metric, ok := <-w.Transport.OutputChan():
+			case metric, ok := <-output:
 				if ok {
-					w.add(metric)
+					if w.Chaos != nil {
+						w.Chaos.DelayPop()
+					}
+					w.add(w.popBatch(metric))
+				}
+			case batch, ok := <-batches:
+				if ok {
+					if w.Chaos != nil {
+						w.Chaos.DelayPop()
+					}
+					w.add(batch)
+				}
+			case <-recheck:
+			case <-changed:
+				if paused {
+					w.Logger.Info("[writer] Resumed")
+				} else {
+					w.Logger.Info("[writer] Paused, leaving metrics in the transport")
 				}
 			case <-exitTrigger:
 				w.Logger.Debug("[writer] Calling transport to stop retrieve loop...") // doesn't apply to channel transport
@@ -131,20 +631,107 @@ func (w *Writer) Start() {
 					drainingDone <- struct{}{}
 				}()
 
+				// with a snapshot, what's not drained in time is kept in it;
+				// metrics are added by a worker, as adding blocks while the
+				// bulk-processors can't commit (ie. ElasticSearch down)
+				var drainTimeout <-chan time.Time
+				if w.Snapshot != nil {
+					drainTimeout = time.After(w.Snapshot.DrainTimeout)
+				}
+				work := make(chan []*Metric)
+				workDone := make(chan struct{})
+				go func() {
+					defer close(workDone)
+					for batch := range work {
+						w.add(batch)
+					}
+				}()
+				var leftover []*Metric
+				timedOut := false
+				output, batches := w.Transport.OutputChan(), w.Batches
+			drain:
 				for {
+					var batch []*Metric
 					select {
+					case metric, ok := <-output:
+						if !ok {
+							output = nil
+							continue
+						}
+						batch = w.popBatch(metric)
+					case b, ok := <-batches:
+						if !ok {
+							batches = nil
+							continue
+						}
+						batch = b
+					case <-drainTimeout:
+						timedOut = true
+						break drain
 					case <-drainingDone:
 						w.Logger.Info("[writer] Draining done")
-						w.Logger.Info("[writer] Flushing bulk-processors...")
-						w.Processor.Close()
-						exitFinished <- struct{}{}
-						return
-					case metric, ok := <-w.Transport.OutputChan():
-						if ok {
-							w.add(metric)
-						}
+						break drain
+					}
+					select {
+					case work <- batch:
+					case <-drainTimeout:
+						leftover = batch
+						timedOut = true
+						break drain
+					}
+				}
+				close(work)
+				close(stopHold)
+				var buckets []AggregationSnapshot
+				if timedOut {
+					// the batch being added, if any, is in the bulk-processors
+					// already and isn't saved
+					leftover = append(leftover, w.Snapshot.drain(w.Transport.OutputChan(), w.Batches)...)
+					w.Logger.Info("[writer] Draining timed out, %d metrics left for the snapshot", len(leftover))
+				} else {
+					<-workDone
+				}
+				if w.Aggregator != nil {
+					close(stopAggregator)
+					switch {
+					case w.Snapshot == nil:
+						w.Logger.Info("[writer] Flushing %d aggregated metrics", w.Aggregator.Flush(w.index, true))
+					case timedOut:
+						// flushing would block as well, all intervals are saved
+						buckets = w.Aggregator.Snapshot()
+					default:
+						// unfinished intervals go to the snapshot rather than partial
+						w.Logger.Info("[writer] Flushing %d aggregated metrics", w.Aggregator.Flush(w.index, false))
+						buckets = w.Aggregator.Snapshot()
 					}
 				}
+				if w.Snapshot != nil && (len(leftover) > 0 || len(buckets) > 0) {
+					if err := w.Snapshot.Save(leftover, buckets); err != nil {
+						w.Logger.Alert("[writer] Failed to save snapshot of %d metrics and %d aggregation buckets: %v", len(leftover), len(buckets), err)
+					} else {
+						w.Logger.Info("[writer] Saved snapshot of %d metrics and %d aggregation buckets to %s", len(leftover), len(buckets), w.Snapshot.Path)
+						w.ack(leftover)
+					}
+				}
+				if w.Sketch != nil {
+					close(stopSketch)
+					w.Logger.Info("[writer] Flushing percentiles of %d sketched series", w.Sketch.Flush(w.indexBatch, true))
+				}
+				close(stopFlusher)
+				w.Logger.Info("[writer] Flushing bulk-processors...")
+				if w.Ordered != nil {
+					w.Ordered.Close()
+				} else {
+					w.Processor.Close()
+				}
+				if w.Targets != nil {
+					w.Targets.Close()
+				}
+				if w.Shadow != nil {
+					w.Shadow.Close()
+				}
+				exitFinished <- struct{}{}
+				return
 			}
 		}
 	}()
@@ -163,16 +750,298 @@ func (w *Writer) Start() {
 
 }
 
-func (w *Writer) add(m *Metric) {
-	w.Stats.Queued.Increment(1)
-	w.Processor.Add(elastic.NewBulkIndexRequest().
-		Index(m.Index(w.Config.Index)).
-		Type(w.Config.DocType).
-		Doc(string(m.JSON())))
+// newBulkProcessor sets up a bulk-processor committing through the writer's
+// hooks, flushed every [bulk_wait] unless flushJittered does it
+func (w *Writer) newBulkProcessor(name string, workers int) (*elastic.BulkProcessor, error) {
+	flushInterval := w.Config.BulkWait.Duration
+	if w.Config.BulkWaitJitter.Duration > 0 {
+		flushInterval = 0 // flushed by w.flushJittered
+	}
+	return elastic.NewBulkProcessorService(w.Elastic).
+		Name(name).
+		Workers(workers).
+		BulkActions(w.Config.BulkMax).
+		BulkSize(-1).
+		Before(w.hookBeforeCommit).
+		After(w.hookAfterCommit).
+		FlushInterval(flushInterval).
+		Do()
+}
+
+// flushJittered flushes the bulk-processor every [bulk_wait] +/- random
+// [bulk_wait_jitter], so writer nodes don't flush in lockstep
+func (w *Writer) flushJittered(stop chan struct{}) {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	jitter := int64(w.Config.BulkWaitJitter.Duration)
+	for {
+		wait := w.Config.BulkWait.Duration + time.Duration(rnd.Int63n(2*jitter+1)-jitter)
+		if wait < 0 {
+			wait = 0
+		}
+		select {
+		case <-time.After(wait):
+			if w.Ordered != nil {
+				if err := w.Ordered.Flush(); err != nil {
+					w.Logger.Error("[writer] Failed to flush bulk-processors: %v", err)
+				}
+			} else if err := w.Processor.Flush(); err != nil {
+				w.Logger.Error("[writer] Failed to flush bulk-processor: %v", err)
+			}
+			if w.Targets != nil {
+				if err := w.Targets.Flush(); err != nil {
+					w.Logger.Error("[writer] Failed to flush bulk-processors: %v", err)
+				}
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// popBatch takes whatever else is already buffered after the first metric,
+// up to [bulk_max], so the metrics are converted and queued in one pass
+// rather than one channel receive at a time
+func (w *Writer) popBatch(first *Metric) []*Metric {
+	batch := []*Metric{first}
+	for len(batch) < w.Config.BulkMax {
+		select {
+		case m, ok := <-w.Transport.OutputChan():
+			if !ok {
+				return batch
+			}
+			batch = append(batch, m)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+func (w *Writer) add(batch []*Metric) {
+	in := batch
+	if w.Acks != nil {
+		// Filter reuses the batch
+		in = append([]*Metric(nil), batch...)
+	}
+	batch = w.Dedup.Filter(batch)
+	w.ackDropped(in, batch)
+	if len(batch) == 0 {
+		return
+	}
+	if w.Hold != nil {
+		w.Hold.Observe(batch)
+	}
+	if w.Sketch != nil {
+		in = batch
+		batch = w.Sketch.Observe(batch)
+		w.ackDropped(in, batch)
+		if len(batch) == 0 {
+			return
+		}
+	}
+	w.forward(batch, true)
+}
+
+// forward passes the metrics on to the aggregator, if any, or indexes them;
+// delivered ones (by the transport, not re-emitted by hold) get remembered
+// by dedup and acked
+func (w *Writer) forward(batch []*Metric, delivered bool) {
+	if w.Aggregator != nil {
+		for _, m := range batch {
+			w.Aggregator.Add(m)
+		}
+		if delivered {
+			w.Dedup.Seen(batch)
+			w.ack(batch)
+		}
+		return
+	}
+	w.queueBatch(batch, delivered)
+}
+
+// forwardHeld forwards the metrics re-emitted by hold
+func (w *Writer) forwardHeld(batch []*Metric) {
+	w.forward(batch, false)
+}
+
+// ack tells the transport the writer's done with the metrics
+func (w *Writer) ack(batch []*Metric) {
+	if w.Acks != nil && len(batch) > 0 {
+		w.Acks.Ack(batch)
+	}
+}
+
+// ackDropped acks the metrics of before missing from after
+func (w *Writer) ackDropped(before, after []*Metric) {
+	if w.Acks == nil || len(before) == len(after) {
+		return
+	}
+	kept := make(map[*Metric]bool, len(after))
+	for _, m := range after {
+		kept[m] = true
+	}
+	var dropped []*Metric
+	for _, m := range before {
+		if !kept[m] {
+			dropped = append(dropped, m)
+		}
+	}
+	w.ack(dropped)
+}
+
+// committed acks the delivered metrics of the bulk items succeeded, the
+// failed ones are nacked to be delivered again; the items of the response
+// are in the order of the requests
+func (w *Writer) committed(reqs []elastic.BulkableRequest, res *elastic.BulkResponse) {
+	if w.Acks == nil {
+		return
+	}
+	var acked, nacked []*Metric
+	w.ackingMux.Lock()
+	for i, req := range reqs {
+		m, ok := w.acking[req]
+		if !ok {
+			continue
+		}
+		delete(w.acking, req)
+		succeeded := false
+		if res != nil && i < len(res.Items) {
+			succeeded = true
+			for _, item := range res.Items[i] {
+				if item.Status >= 300 || item.Error != nil {
+					succeeded = false
+				}
+			}
+		}
+		if succeeded {
+			acked = append(acked, m)
+		} else {
+			nacked = append(nacked, m)
+		}
+	}
+	w.ackingMux.Unlock()
+	w.ack(acked)
+	if len(nacked) > 0 {
+		w.Acks.Nack(nacked)
+	}
+}
+
+func (w *Writer) index(m *Metric) {
+	w.indexBatch([]*Metric{m})
+}
+
+// indexBatch indexes metrics made by the writer (aggregates, percentiles,
+// held values), which aren't remembered by dedup
+func (w *Writer) indexBatch(batch []*Metric) {
+	w.queueBatch(batch, false)
+}
+
+// queueBatch converts the metrics to bulk requests and queues them, dedup
+// remembers the metrics once committed if track is set
+func (w *Writer) queueBatch(batch []*Metric, track bool) {
+	reqs := make([]elastic.BulkableRequest, 0, len(batch))
+	indices := make([]string, 0, len(batch))
+	var series []string
+	var hooked []*Metric
+	if w.Ordered != nil {
+		series = make([]string, 0, len(batch))
+	}
+	for _, m := range batch {
+		var seen dedupKey
+		delivered := m
+		if track {
+			seen = w.Dedup.seenKey(m)
+		}
+		m, ok := runWriterHooks(w.Hooks, m)
+		if !ok {
+			w.Stats.Dropped.Increment(1)
+			if track {
+				w.ack([]*Metric{delivered})
+			}
+			continue
+		}
+		if w.Last != nil {
+			hooked = append(hooked, m)
+		}
+		applyTTL(w.TTLRules, m)
+		index := w.Config.WriteAlias
+		if index == "" {
+			index = routeIndex(w.IndexRules, m, w.Config.Index)
+		}
+		req := elastic.NewBulkIndexRequest().
+			Index(index).
+			Type(w.Config.DocType).
+			Doc(metricDocument(m, w.Config.FieldsMapping))
+		if id := w.Dedup.DocID(m); id != "" {
+			req.Id(id)
+		}
+		w.Dedup.Track(req, seen)
+		if track && w.Acks != nil {
+			w.ackingMux.Lock()
+			w.acking[req] = delivered
+			w.ackingMux.Unlock()
+		}
+		reqs = append(reqs, req)
+		indices = append(indices, index)
+		if series != nil {
+			series = append(series, m.SeriesID())
+		}
+		if w.Shadow != nil {
+			w.Shadow.Add(m)
+		}
+		if w.Events != nil {
+			for _, ev := range w.Events.Evaluate(m) {
+				w.Stats.Events.Increment(1)
+				evIndex := ev.Index(w.Config.Events.Index)
+				reqs = append(reqs, elastic.NewBulkIndexRequest().
+					Index(evIndex).
+					Type(w.Config.Events.DocType).
+					Doc(string(ev.JSON())))
+				indices = append(indices, evIndex)
+				if series != nil {
+					series = append(series, m.SeriesID())
+				}
+			}
+		}
+	}
+	if len(hooked) > 0 {
+		w.Last.Observe(hooked)
+	}
+	w.Stats.Queued.Increment(len(reqs))
+	w.Stats.Pending.Increment(len(reqs))
+	for i, req := range reqs {
+		if w.Targets == nil {
+			if w.Ordered != nil {
+				w.Ordered.Add(series[i], req)
+			} else {
+				w.Processor.Add(req)
+			}
+			continue
+		}
+		if err := w.Targets.Add(indices[i], req); err != nil {
+			w.Logger.Error("[writer] Failed to queue for bulk-processor of index '%s': %v", indices[i], err)
+			w.Dedup.Committed(reqs[i:i+1], nil)
+			w.committed(reqs[i:i+1], nil)
+			w.Stats.Dropped.Increment(1)
+			w.Stats.Pending.Decrement(1)
+		}
+	}
+}
+
+// congested tells whether more requests wait for the bulk processors than
+// [bulk_queue_max]
+func (w *Writer) congested() bool {
+	return w.Config.BulkQueueMax > 0 && w.Stats.Pending.Get() >= int64(w.Config.BulkQueueMax)
 }
 
 func (w *Writer) hookBeforeCommit(id int64, reqs []elastic.BulkableRequest) {
+	if w.Health != nil && w.Health.Held() {
+		start := time.Now()
+		w.Health.Wait()
+		w.Stats.Held.Add(time.Since(start))
+	}
 	w.Stats.Committed.Increment(len(reqs))
+	w.Stats.Pending.Decrement(len(reqs))
 	w.Logger.Debug("[writer] Committing %d metrics", len(reqs))
 	w.Stats.Running.Increment(1)
 	w.Stats.Queued.Reset()
@@ -180,53 +1049,180 @@ func (w *Writer) hookBeforeCommit(id int64, reqs []elastic.BulkableRequest) {
 
 func (w *Writer) hookAfterCommit(id int64, reqs []elastic.BulkableRequest, res *elastic.BulkResponse, err error) {
 	w.Stats.Running.Decrement(1)
+	w.Stats.Flushed.Increment(1)
+	w.Dedup.Committed(reqs, res)
+	w.committed(reqs, res)
+	if err != nil {
+		w.Logger.Error("[writer] %v", err.Error())
+	}
+	if res == nil {
+		if w.Health != nil && err != nil {
+			w.Health.Failed(err)
+		}
+		w.Stats.Failed.Increment(len(reqs))
+		w.Logger.Error("[writer] Failed to index %d metrics", len(reqs))
+		return
+	}
 	w.Stats.Succeeded.Increment(len(res.Succeeded()))
 	w.Stats.Duration.Add(time.Duration(res.Took) * time.Millisecond)
 	w.Logger.Debug("[writer] Successfully indexed %d metrics", len(res.Succeeded()))
 	if len(res.Failed()) > 0 {
 		w.Stats.Failed.Increment(len(res.Failed()))
 		w.Logger.Error("[writer] Failed to index %d metrics", len(res.Failed()))
+		w.classifyBulkResponse(reqs, res)
 	}
-	if err != nil {
-		w.Logger.Error("[writer] %v", err.Error())
-	}
-	w.Stats.Flushed.Increment(1)
 }
 
 func (w *Writer) LogReport() {
-	w.Logger.Info("[writer] flushes: %d/%d/%.3f (running/total/rate_per_m), metrics: %d/%d/%d/%.3f (committed/succeeded/failed/rate_per_sec), duration: %s/%s (avg/max)",
+	w.connMux.RLock()
+	health, shadow, maintainer, alias, targets := w.Health, w.Shadow, w.Maintainer, w.WriteAlias, w.Targets
+	w.connMux.RUnlock()
+	w.Logger.Info("[writer] flushes: %d/%d/%.3f (running/total/rate_per_m), metrics: %d/%d/%d/%d/%.3f (committed/succeeded/failed/dropped/rate_per_sec), duration: %s/%s (avg/max)",
 		w.Stats.Running.Get(),
 		w.Stats.Flushed.Total(),
 		w.Stats.Flushed.Rate(time.Minute),
 		w.Stats.Committed.Total(),
 		w.Stats.Succeeded.Total(),
 		w.Stats.Failed.Total(),
+		w.Stats.Dropped.Total(),
 		w.Stats.Committed.Rate(time.Second),
 		w.Stats.Duration.Avg(),
 		w.Stats.Duration.Max(),
 	)
+	if w.Stats.Failed.Total() > 0 {
+		w.Logger.Info("[writer] failures: %d/%d/%d/%d/%d (mapping_conflict/version_conflict/rejected/index_closed/other)",
+			w.Stats.FailedByClass[bulkErrMapping].Total(),
+			w.Stats.FailedByClass[bulkErrVersion].Total(),
+			w.Stats.FailedByClass[bulkErrRejected].Total(),
+			w.Stats.FailedByClass[bulkErrClosed].Total(),
+			w.Stats.FailedByClass[bulkErrOther].Total(),
+		)
+	}
+	if w.Config.BulkQueueMax > 0 {
+		w.Logger.Info("[writer] bulk queue: %d/%d/%s (pending/max/throttled)",
+			w.Stats.Pending.Get(),
+			w.Config.BulkQueueMax,
+			time.Duration(w.Stats.Throttled.Total())*throttleWait,
+		)
+	}
+	if health != nil {
+		w.Logger.Info("[writer] held: %v/%s/%s (now/avg/max)",
+			health.Held(),
+			w.Stats.Held.Avg(),
+			w.Stats.Held.Max(),
+		)
+	}
+	if w.Script != nil {
+		w.Logger.Info("[writer] script: %d/%d (dropped/failed)",
+			w.Script.Dropped.Total(),
+			w.Script.Failed.Total(),
+		)
+	}
+	if w.Hold != nil {
+		w.Logger.Info("[writer] hold: %d/%d/%.3f (series/reemitted/rate_per_sec)",
+			w.Hold.Series.Get(),
+			w.Hold.Emitted.Total(),
+			w.Hold.Emitted.Rate(time.Second),
+		)
+	}
+	if w.Sketch != nil {
+		w.Logger.Info("[writer] sketch: %d/%d/%d/%.3f (series/skipped/percentiles/rate_per_sec)",
+			w.Sketch.Series.Get(),
+			w.Sketch.Skipped.Total(),
+			w.Sketch.Emitted.Total(),
+			w.Sketch.Emitted.Rate(time.Second),
+		)
+	}
+	if w.Last != nil {
+		w.Logger.Info("[writer] last values: %d/%d (series/skipped)",
+			w.Last.Series.Get(),
+			w.Last.Skipped.Total(),
+		)
+	}
+	if targets != nil {
+		queued := 0
+		for _, n := range targets.Queued() {
+			queued += n
+		}
+		w.Logger.Info("[writer] index targets: %d/%d (processors/queued)", targets.Len(), queued)
+	}
+	if w.Compressor != nil {
+		w.Logger.Info("[writer] bulk gzip: %d/%d/%.3f (raw_bytes/sent_bytes/ratio)",
+			w.Compressor.Raw.Total(),
+			w.Compressor.Compressed.Total(),
+			w.Compressor.Ratio(),
+		)
+	}
+	if w.Retrier != nil {
+		w.Logger.Info("[writer] status retries: %d/%d (retried/gave_up)",
+			w.Retrier.Retried.Total(),
+			w.Retrier.GaveUp.Total(),
+		)
+	}
+	if shadow != nil {
+		shadow.LogReport()
+	}
+	if alias != nil {
+		w.Logger.Info("[writer] write alias: %s/%s/%d (alias/index/rollovers)",
+			alias.Alias,
+			alias.Current(),
+			alias.Rolled.Total(),
+		)
+	}
+	if maintainer != nil {
+		maintainer.LogReport()
+	}
+	if w.Events != nil {
+		w.Logger.Info("[writer] events: %d (total)", w.Stats.Events.Total())
+	}
+	if w.Anonymizer != nil {
+		w.Logger.Info("[writer] anonymized: %d", w.Anonymizer.Anonymized.Total())
+	}
+	if w.Dedup != nil && w.Dedup.Redis != nil {
+		w.Logger.Info("[writer] dedup: %d/%d/%d (duplicates/unchecked/failed)",
+			w.Dedup.Duplicates.Total(),
+			w.Dedup.Unchecked.Total(),
+			w.Dedup.Failed.Total(),
+		)
+	}
 }
 
 type WriterStats struct {
-	Running   *StatsGauge
-	Flushed   *StatsCounter
-	Committed *StatsCounter
-	Succeeded *StatsCounter
-	Failed    *StatsCounter
-	Queued    *StatsCounter
-	Duration  *StatsTimer
+	Running       *StatsGauge
+	Flushed       *StatsCounter
+	Committed     *StatsCounter
+	Succeeded     *StatsCounter
+	Failed        *StatsCounter
+	FailedByClass map[string]*StatsCounter
+	Queued        *StatsCounter
+	Pending       *StatsGauge
+	Dropped       *StatsCounter
+	Events        *StatsCounter
+	Duration      *StatsTimer
+	Held          *StatsTimer
+	Throttled     *StatsCounter // throttleWait periods
 }
 
 func NewWriterStats() *WriterStats {
 	now := time.Now()
+	failedByClass := make(map[string]*StatsCounter)
+	for _, class := range bulkErrClasses {
+		failedByClass[class] = NewStatsCounter(now)
+	}
 	return &WriterStats{
-		Running:   NewStatsGauge(),
-		Flushed:   NewStatsCounter(now),
-		Committed: NewStatsCounter(now),
-		Succeeded: NewStatsCounter(now),
-		Failed:    NewStatsCounter(now),
-		Queued:    NewStatsCounter(now),
-		Duration:  NewStatsTimer(1000),
+		FailedByClass: failedByClass,
+		Running:       NewStatsGauge(),
+		Flushed:       NewStatsCounter(now),
+		Committed:     NewStatsCounter(now),
+		Succeeded:     NewStatsCounter(now),
+		Failed:        NewStatsCounter(now),
+		Queued:        NewStatsCounter(now),
+		Pending:       NewStatsGauge(),
+		Dropped:       NewStatsCounter(now),
+		Events:        NewStatsCounter(now),
+		Duration:      NewStatsTimer(1000),
+		Held:          NewStatsTimer(1000),
+		Throttled:     NewStatsCounter(now),
 	}
 }
 
@@ -0,0 +1,123 @@
+package metcap
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"gopkg.in/olivere/elastic.v3"
+)
+
+// WriteAlias keeps [write_alias] pointed at the current day's index, the
+// writer indexes into the alias only. At midnight (UTC) the next index gets
+// created and the alias is moved to it in a single atomic _aliases request,
+// so no bulk ever hits a missing or stale target.
+type WriteAlias struct {
+	Elastic *elastic.Client
+	Alias   string
+	Index   string
+	Logger  *Logger
+	Rolled  *StatsCounter
+
+	current string
+	mux     *sync.Mutex
+}
+
+func NewWriteAlias(es *elastic.Client, c *WriterConfig, logger *Logger) *WriteAlias {
+	return &WriteAlias{
+		Elastic: es,
+		Alias:   c.WriteAlias,
+		Index:   c.Index,
+		Logger:  logger,
+		Rolled:  NewStatsCounter(time.Now()),
+		mux:     &sync.Mutex{},
+	}
+}
+
+// Bootstrap finds the index the alias points at and rolls it over to the
+// current one if it's missing or stale
+func (a *WriteAlias) Bootstrap() error {
+	if err := a.lookup(); err != nil {
+		return err
+	}
+	if a.current != "" {
+		a.Logger.Info("[writer] Write alias '%s' points at '%s'", a.Alias, a.current)
+	}
+	return a.Rollover(time.Now())
+}
+
+// lookup reads the (latest) index the alias points at
+func (a *WriteAlias) lookup() error {
+	res, err := a.Elastic.PerformRequest("GET", "/_alias/"+a.Alias, nil, nil, 404)
+	if err != nil {
+		return err
+	}
+	a.current = ""
+	if res.StatusCode == 404 {
+		return nil
+	}
+	var indices map[string]interface{}
+	if err := json.Unmarshal(res.Body, &indices); err != nil {
+		return err
+	}
+	for index := range indices {
+		if index > a.current {
+			a.current = index
+		}
+	}
+	return nil
+}
+
+// Rollover moves the alias to the index of the day t falls into, unless
+// it's there already
+func (a *WriteAlias) Rollover(t time.Time) error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	next := (&Metric{Timestamp: t}).Index(a.Index)
+	if next == a.current {
+		return nil
+	}
+	// an index already created (ie. by another writer) is fine
+	if _, err := a.Elastic.PerformRequest("PUT", "/"+next, nil, nil, 400); err != nil {
+		return err
+	}
+	actions := []interface{}{}
+	if a.current != "" {
+		actions = append(actions, map[string]interface{}{
+			"remove": map[string]string{"index": a.current, "alias": a.Alias},
+		})
+	}
+	actions = append(actions, map[string]interface{}{
+		"add": map[string]string{"index": next, "alias": a.Alias},
+	})
+	body := map[string]interface{}{"actions": actions}
+	if _, err := a.Elastic.PerformRequest("POST", "/_aliases", nil, body); err != nil {
+		// another writer may have moved it already, retry from its state
+		if lerr := a.lookup(); lerr != nil {
+			a.Logger.Error("[writer] Failed to read write alias '%s': %v", a.Alias, lerr)
+		}
+		return err
+	}
+	a.Logger.Info("[writer] Write alias '%s' moved from '%s' to '%s'", a.Alias, a.current, next)
+	a.current = next
+	a.Rolled.Increment(1)
+	return nil
+}
+
+// Run rolls the alias over when the day changes until exitFlag is raised,
+// failures are retried every second
+func (a *WriteAlias) Run(exitFlag *Flag) {
+	for !exitFlag.Get() {
+		if err := a.Rollover(time.Now()); err != nil {
+			a.Logger.Error("[writer] Failed to roll write alias '%s' over: %v", a.Alias, err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// Current is the index the alias points at
+func (a *WriteAlias) Current() string {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return a.current
+}
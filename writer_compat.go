@@ -0,0 +1,126 @@
+package metcap
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gopkg.in/olivere/elastic.v3"
+)
+
+// esFlavor tells which mapping dialect the cluster speaks
+type esFlavor struct {
+	Distribution string
+	Major        int
+	Minor        int
+}
+
+// typeless clusters (ES 7+, OpenSearch) take neither custom mapping types
+// nor the type level in template mappings, documents are "_doc"
+func (f esFlavor) typeless() bool {
+	return f.Distribution == "opensearch" || f.Major >= 7
+}
+
+// keywords replaced not_analyzed strings in ES 5
+func (f esFlavor) keywords() bool {
+	return f.Distribution == "opensearch" || f.Major >= 5
+}
+
+// flattened field type came with ES 7.3 (OpenSearch has none)
+func (f esFlavor) flattened() bool {
+	return f.Distribution != "opensearch" && (f.Major > 7 || f.Major == 7 && f.Minor >= 3)
+}
+
+// docType picks the document type, configured one is kept for typed clusters
+func (f esFlavor) docType(configured string) string {
+	switch {
+	case f.typeless():
+		return "_doc"
+	case configured == "":
+		return "raw"
+	default:
+		return configured
+	}
+}
+
+// newESClient connects to the cluster. OpenSearch compat mode doesn't sniff
+// the nodes (their publish addresses are rarely reachable behind the usual
+// proxies), [username]/[password] do basic auth, ie. for the security plugin.
+// Compressor, if set, gzips the bulk requests.
+func newESClient(urls []string, c *WriterConfig, transport http.RoundTripper, logger *Logger) (*elastic.Client, esFlavor, error) {
+	opts := []elastic.ClientOptionFunc{elastic.SetURL(urls...)}
+	sniff := c.Compat != "opensearch"
+	if c.Sniff != nil {
+		sniff = *c.Sniff
+	}
+	opts = append(opts, elastic.SetSniff(sniff))
+	if c.Username != "" {
+		opts = append(opts, elastic.SetBasicAuth(c.Username, c.Password))
+	}
+	if transport != nil {
+		opts = append(opts, elastic.SetHttpClient(&http.Client{Transport: transport}))
+	}
+	es, err := elastic.NewClient(opts...)
+	if err != nil {
+		return nil, esFlavor{}, err
+	}
+
+	flavor := esFlavor{Distribution: c.Compat}
+	distribution, version, err := esDistribution(es)
+	if err != nil {
+		logger.Error("[writer] Failed to detect cluster version: %v", err)
+		return es, flavor, nil
+	}
+	logger.Info("[writer] Connected to %s %s", distribution, version)
+	if distribution == "opensearch" && c.Compat != "opensearch" {
+		logger.Error("[writer] Cluster is OpenSearch, consider setting compat = \"opensearch\"")
+	}
+	flavor.Distribution = distribution
+	parts := strings.SplitN(version, ".", 3)
+	flavor.Major, _ = strconv.Atoi(parts[0])
+	if len(parts) > 1 {
+		flavor.Minor, _ = strconv.Atoi(parts[1])
+	}
+	return es, flavor, nil
+}
+
+// flattenedDoc carries @uniq explicitly, flattened fields can't copy_to it
+type flattenedDoc struct {
+	*Metric
+	Uniq string `json:"@uniq"`
+}
+
+// metricDocument renders the metric for the [fields_mapping]
+func metricDocument(m *Metric, fieldsMapping string) string {
+	if fieldsMapping != "flattened" {
+		return string(m.JSON())
+	}
+	out, err := json.Marshal(flattenedDoc{m, m.SeriesID()})
+	if err != nil {
+		panic(err) // REFACTOR: throw error and do checking
+	}
+	return string(out)
+}
+
+// esDistribution reads the root endpoint, OpenSearch reports itself in
+// version.distribution and its version numbers restart from 1.0
+func esDistribution(es *elastic.Client) (string, string, error) {
+	res, err := es.PerformRequest("GET", "/", nil, nil)
+	if err != nil {
+		return "", "", err
+	}
+	var info struct {
+		Version struct {
+			Number       string `json:"number"`
+			Distribution string `json:"distribution"`
+		} `json:"version"`
+	}
+	if err := json.Unmarshal(res.Body, &info); err != nil {
+		return "", "", err
+	}
+	if info.Version.Distribution == "" {
+		info.Version.Distribution = "elasticsearch"
+	}
+	return info.Version.Distribution, info.Version.Number, nil
+}
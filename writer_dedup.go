@@ -0,0 +1,222 @@
+package metcap
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/olivere/elastic.v3"
+	"gopkg.in/redis.v4"
+)
+
+// Dedup keeps metrics delivered again by the transport (stream rewound by
+// [redis_replay_from], entries claimed from a crashed writer, AMQP
+// redeliveries after a partial failure) from being indexed twice, which
+// would double-count them in sums. Mode "id" indexes every metric under an
+// _id derived from its series and timestamp, so a replayed one overwrites
+// the document already indexed. Mode "redis" remembers the metrics indexed
+// in a Redis key per metric until [window] after their timestamp and drops
+// the replayed ones before the aggregator and hold see them; older metrics
+// are beyond the window and pass unchecked. Metrics are remembered once
+// their bulk item succeeded (or once the aggregator took them, it doesn't
+// keep track of its inputs), so the ones lost to failed bulks or crashes
+// get through again when redelivered.
+type Dedup struct {
+	Mode       string
+	Redis      *redis.Client
+	Prefix     string
+	Window     time.Duration
+	Logger     *Logger
+	Duplicates *StatsCounter
+	Unchecked  *StatsCounter
+	Failed     *StatsCounter
+
+	pending map[elastic.BulkableRequest]dedupKey
+	mux     *sync.Mutex
+}
+
+// dedupKey is the key of an indexed metric to be remembered
+type dedupKey struct {
+	key    string
+	expire time.Time
+}
+
+func NewDedup(c *DedupConfig, logger *Logger) (*Dedup, error) {
+	now := time.Now()
+	d := &Dedup{
+		Mode:       c.Mode,
+		Prefix:     c.Key,
+		Window:     c.Window.Duration,
+		Logger:     logger,
+		Duplicates: NewStatsCounter(now),
+		Unchecked:  NewStatsCounter(now),
+		Failed:     NewStatsCounter(now),
+		pending:    make(map[elastic.BulkableRequest]dedupKey),
+		mux:        &sync.Mutex{},
+	}
+	if d.Prefix == "" {
+		d.Prefix = "metcap:seen:"
+	}
+	if d.Window <= 0 {
+		d.Window = time.Hour
+	}
+	switch c.Mode {
+	case "":
+		return nil, nil
+	case "id":
+		return d, nil
+	case "redis":
+		if c.RedisURL == "" {
+			return nil, fmt.Errorf("dedup mode 'redis' needs redis_url")
+		}
+		conn, err := newRedisClient(&TransportConfig{RedisURL: c.RedisURL})
+		if err != nil {
+			return nil, err
+		}
+		d.Redis = conn
+		return d, nil
+	}
+	return nil, fmt.Errorf("unknown dedup mode '%s'", c.Mode)
+}
+
+// dedupID identifies the metric's point, same series and timestamp give the
+// same ID whichever writer indexes it
+func dedupID(m *Metric) string {
+	sum := sha1.Sum([]byte(m.SeriesID() + "@" + strconv.FormatInt(m.Timestamp.UnixNano(), 10)))
+	return hex.EncodeToString(sum[:])
+}
+
+// DocID is the _id to index the metric under, empty for ES to pick one
+func (d *Dedup) DocID(m *Metric) string {
+	if d == nil || d.Mode != "id" {
+		return ""
+	}
+	return dedupID(m)
+}
+
+// Filter drops the metrics of the batch indexed already, all of them are
+// kept if Redis can't be reached, as losing metrics is worse than doubling
+// them
+func (d *Dedup) Filter(batch []*Metric) []*Metric {
+	if d == nil || d.Redis == nil {
+		return batch
+	}
+	now := time.Now()
+	pipe := d.Redis.Pipeline()
+	defer pipe.Close()
+	cmds := make([]*redis.BoolCmd, len(batch))
+	queued := 0
+	for i, m := range batch {
+		if !m.Timestamp.Add(d.Window).After(now) {
+			d.Unchecked.Increment(1)
+			continue
+		}
+		cmds[i] = pipe.Exists(d.Prefix + dedupID(m))
+		queued++
+	}
+	if queued == 0 {
+		return batch
+	}
+	if _, err := pipe.Exec(); err != nil {
+		d.Failed.Increment(len(batch))
+		d.Logger.Error("[writer] Failed to check %d metrics for duplicates: %v", len(batch), err)
+		return batch
+	}
+	kept := batch[:0]
+	for i, m := range batch {
+		if cmds[i] != nil {
+			if seen, _ := cmds[i].Result(); seen {
+				d.Duplicates.Increment(1)
+				continue
+			}
+		}
+		kept = append(kept, m)
+	}
+	return kept
+}
+
+// seenKey is the key to remember the metric under once indexed, taken
+// before writer hooks rewrite the metric; zero unless in mode "redis"
+func (d *Dedup) seenKey(m *Metric) dedupKey {
+	if d == nil || d.Redis == nil {
+		return dedupKey{}
+	}
+	return dedupKey{d.Prefix + dedupID(m), m.Timestamp.Add(d.Window)}
+}
+
+// Track remembers the key of the bulk request's metric until committed
+func (d *Dedup) Track(req elastic.BulkableRequest, k dedupKey) {
+	if d == nil || k.key == "" {
+		return
+	}
+	d.mux.Lock()
+	d.pending[req] = k
+	d.mux.Unlock()
+}
+
+// Committed marks the metrics of the bulk items succeeded as seen, the
+// failed ones are forgotten; the items of the response are in the order of
+// the requests
+func (d *Dedup) Committed(reqs []elastic.BulkableRequest, res *elastic.BulkResponse) {
+	if d == nil || d.Redis == nil {
+		return
+	}
+	var keys []dedupKey
+	d.mux.Lock()
+	for i, req := range reqs {
+		k, ok := d.pending[req]
+		if !ok {
+			continue
+		}
+		delete(d.pending, req)
+		if res == nil || i >= len(res.Items) {
+			continue
+		}
+		for _, item := range res.Items[i] {
+			if item.Status < 300 && item.Error == nil {
+				keys = append(keys, k)
+			}
+		}
+	}
+	d.mux.Unlock()
+	d.mark(keys)
+}
+
+// Seen marks the metrics as seen right away, for the ones taken by the
+// aggregator
+func (d *Dedup) Seen(batch []*Metric) {
+	if d == nil || d.Redis == nil {
+		return
+	}
+	keys := make([]dedupKey, 0, len(batch))
+	for _, m := range batch {
+		keys = append(keys, d.seenKey(m))
+	}
+	d.mark(keys)
+}
+
+func (d *Dedup) mark(keys []dedupKey) {
+	if len(keys) == 0 {
+		return
+	}
+	now := time.Now()
+	pipe := d.Redis.Pipeline()
+	defer pipe.Close()
+	queued := 0
+	for _, k := range keys {
+		if ttl := k.expire.Sub(now); ttl > 0 {
+			pipe.Set(k.key, 1, ttl)
+			queued++
+		}
+	}
+	if queued == 0 {
+		return
+	}
+	if _, err := pipe.Exec(); err != nil {
+		d.Failed.Increment(queued)
+		d.Logger.Error("[writer] Failed to remember %d indexed metrics: %v", queued, err)
+	}
+}
@@ -0,0 +1,91 @@
+package metcap
+
+import (
+	"time"
+
+	"gopkg.in/olivere/elastic.v3"
+)
+
+// classes of per-item bulk errors
+const (
+	bulkErrMapping  = "mapping_conflict"
+	bulkErrVersion  = "version_conflict"
+	bulkErrRejected = "rejected"
+	bulkErrClosed   = "index_closed"
+	bulkErrOther    = "other"
+)
+
+var bulkErrClasses = []string{bulkErrMapping, bulkErrVersion, bulkErrRejected, bulkErrClosed, bulkErrOther}
+
+// classifyBulkError sorts a failed bulk item into one of the error classes
+func classifyBulkError(item *elastic.BulkResponseItem) string {
+	var errType string
+	if item.Error != nil {
+		errType = item.Error.Type
+	}
+	switch {
+	case item.Status == 429 || errType == "es_rejected_execution_exception":
+		return bulkErrRejected
+	case item.Status == 409 || errType == "version_conflict_engine_exception":
+		return bulkErrVersion
+	case errType == "index_closed_exception":
+		return bulkErrClosed
+	case errType == "mapper_parsing_exception",
+		errType == "mapper_exception",
+		errType == "strict_dynamic_mapping_exception",
+		errType == "illegal_argument_exception":
+		return bulkErrMapping
+	default:
+		return bulkErrOther
+	}
+}
+
+// bulkErrorSampler lets through one sample per error class and interval,
+// so a flood of identical failures doesn't flood the log
+type bulkErrorSampler struct {
+	interval time.Duration
+	last     map[string]time.Time
+}
+
+func newBulkErrorSampler(interval time.Duration) *bulkErrorSampler {
+	return &bulkErrorSampler{interval, make(map[string]time.Time)}
+}
+
+func (s *bulkErrorSampler) sample(class string) bool {
+	now := time.Now()
+	if now.Sub(s.last[class]) < s.interval {
+		return false
+	}
+	s.last[class] = now
+	return true
+}
+
+// classifyBulkResponse counts failed items per class and logs a sample of
+// the offending document for each class
+func (w *Writer) classifyBulkResponse(reqs []elastic.BulkableRequest, res *elastic.BulkResponse) {
+	w.errSamplerMux.Lock()
+	defer w.errSamplerMux.Unlock()
+	for i, items := range res.Items {
+		for _, item := range items {
+			if item.Status < 300 && item.Error == nil {
+				continue
+			}
+			class := classifyBulkError(item)
+			if w.Resources != nil && isMissingResourceError(item) {
+				w.Resources.Invalidate()
+			}
+			w.Stats.FailedByClass[class].Increment(1)
+			if !w.errSampler.sample(class) {
+				continue
+			}
+			var reason, doc string
+			if item.Error != nil {
+				reason = item.Error.Type + ": " + item.Error.Reason
+			}
+			if i < len(reqs) {
+				doc = reqs[i].String()
+			}
+			w.Logger.Error("[writer] Bulk item failed (%s) in index '%s' with status %d: %s; document: %s", class, item.Index, item.Status, reason, doc)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package metcap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BulkCompressor is a http.RoundTripper gzipping bodies of bulk requests,
+// ElasticSearch decompresses any request with Content-Encoding: gzip
+type BulkCompressor struct {
+	Transport  http.RoundTripper
+	Level      int
+	Raw        *StatsCounter
+	Compressed *StatsCounter
+
+	pool *sync.Pool
+}
+
+func NewBulkCompressor(c *WriterConfig) (*BulkCompressor, error) {
+	if !c.BulkGzip {
+		return nil, nil
+	}
+	level := gzip.DefaultCompression
+	if c.BulkGzipLevel != 0 {
+		level = c.BulkGzipLevel
+	}
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return nil, fmt.Errorf("invalid bulk_gzip_level %d", level)
+	}
+	now := time.Now()
+	return &BulkCompressor{
+		Transport:  http.DefaultTransport,
+		Level:      level,
+		Raw:        NewStatsCounter(now),
+		Compressed: NewStatsCounter(now),
+		pool: &sync.Pool{New: func() interface{} {
+			zw, _ := gzip.NewWriterLevel(nil, level)
+			return zw
+		}},
+	}, nil
+}
+
+func (b *BulkCompressor) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || !strings.HasSuffix(req.URL.Path, "/_bulk") {
+		return b.Transport.RoundTrip(req)
+	}
+	raw, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	zw := b.pool.Get().(*gzip.Writer)
+	zw.Reset(&buf)
+	_, err = zw.Write(raw)
+	if err == nil {
+		err = zw.Close()
+	}
+	b.pool.Put(zw)
+	if err != nil {
+		return nil, err
+	}
+	b.Raw.Increment(len(raw))
+	b.Compressed.Increment(buf.Len())
+
+	// RoundTrippers mustn't modify the request
+	body := buf.Bytes()
+	zreq := new(http.Request)
+	*zreq = *req
+	zreq.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		zreq.Header[k] = v
+	}
+	zreq.Header.Set("Content-Encoding", "gzip")
+	zreq.ContentLength = int64(len(body))
+	zreq.Body = ioutil.NopCloser(bytes.NewReader(body))
+	zreq.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	return b.Transport.RoundTrip(zreq)
+}
+
+// Ratio is the compressed to raw size of all the bulk bodies sent
+func (b *BulkCompressor) Ratio() float64 {
+	raw := b.Raw.Total()
+	if raw == 0 {
+		return 0
+	}
+	return float64(b.Compressed.Total()) / float64(raw)
+}
@@ -0,0 +1,101 @@
+package metcap
+
+import (
+	"sync"
+	"time"
+
+	"gopkg.in/olivere/elastic.v3"
+)
+
+// ClusterHealthGate holds back bulk submission while ElasticSearch cluster
+// is red, relocating too many shards at once or failing bulk requests as a
+// whole. Blocked bulk workers make the writer stop consuming the transport,
+// so the backlog piles up there and gets caught up once the cluster recovers.
+type ClusterHealthGate struct {
+	Elastic       *elastic.Client
+	Interval      time.Duration
+	MaxRelocating int
+	Logger        *Logger
+
+	mux     *sync.Mutex
+	cond    *sync.Cond
+	held    bool
+	stopped bool
+}
+
+func NewClusterHealthGate(es *elastic.Client, interval time.Duration, maxRelocating int, logger *Logger) *ClusterHealthGate {
+	mux := &sync.Mutex{}
+	return &ClusterHealthGate{
+		Elastic:       es,
+		Interval:      interval,
+		MaxRelocating: maxRelocating,
+		Logger:        logger,
+		mux:           mux,
+		cond:          sync.NewCond(mux),
+	}
+}
+
+// Run polls the cluster health until exitFlag is raised, the gate stays
+// open afterwards as nothing would be left to reopen it
+func (g *ClusterHealthGate) Run(exitFlag *Flag) {
+	for !exitFlag.Get() {
+		g.check()
+		time.Sleep(g.Interval)
+	}
+	g.mux.Lock()
+	g.stopped = true
+	g.mux.Unlock()
+	g.set(false, "") // release workers blocked in Wait so they can flush
+}
+
+func (g *ClusterHealthGate) check() {
+	res, err := g.Elastic.ClusterHealth().Do()
+	switch {
+	case err != nil:
+		g.set(true, "health check failed: "+err.Error())
+	case res.Status == "red":
+		g.set(true, "cluster is red")
+	case g.MaxRelocating > 0 && res.RelocatingShards > g.MaxRelocating:
+		g.set(true, "relocating too many shards")
+	default:
+		g.set(false, "")
+	}
+}
+
+// Failed holds the submission until the next health check passes
+func (g *ClusterHealthGate) Failed(err error) {
+	g.set(true, "bulk request failed: "+err.Error())
+}
+
+// Wait blocks while the gate is held
+func (g *ClusterHealthGate) Wait() {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	for g.held {
+		g.cond.Wait()
+	}
+}
+
+func (g *ClusterHealthGate) Held() bool {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	return g.held
+}
+
+func (g *ClusterHealthGate) set(held bool, reason string) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	if held && g.stopped {
+		return
+	}
+	if held && !g.held {
+		g.Logger.Error("[writer] Holding back bulk submission, %s", reason)
+	}
+	if !held && g.held {
+		g.Logger.Info("[writer] Resuming bulk submission")
+	}
+	g.held = held
+	if !held {
+		g.cond.Broadcast()
+	}
+}
@@ -0,0 +1,46 @@
+package metcap
+
+import "sync"
+
+// WriterHook can mutate or drop a metric right before it's indexed;
+// returning false drops the metric
+type WriterHook interface {
+	BeforeIndex(*Metric) (*Metric, bool)
+}
+
+// WriterHookFunc adapts a function to WriterHook
+type WriterHookFunc func(*Metric) (*Metric, bool)
+
+func (f WriterHookFunc) BeforeIndex(m *Metric) (*Metric, bool) {
+	return f(m)
+}
+
+var (
+	writerHooksMux sync.Mutex
+	writerHooks    []WriterHook
+)
+
+// RegisterWriterHook adds hook to every writer created afterwards. Meant to be
+// called from init() of compiled-in plugins; hooks run in registration order
+func RegisterWriterHook(h WriterHook) {
+	writerHooksMux.Lock()
+	defer writerHooksMux.Unlock()
+	writerHooks = append(writerHooks, h)
+}
+
+func registeredWriterHooks() []WriterHook {
+	writerHooksMux.Lock()
+	defer writerHooksMux.Unlock()
+	return append([]WriterHook{}, writerHooks...)
+}
+
+// runWriterHooks passes the metric through the hooks in order
+func runWriterHooks(hooks []WriterHook, m *Metric) (*Metric, bool) {
+	for _, hook := range hooks {
+		var ok bool
+		if m, ok = hook.BeforeIndex(m); !ok || m == nil {
+			return nil, false
+		}
+	}
+	return m, true
+}
@@ -0,0 +1,149 @@
+package metcap
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/olivere/elastic.v3"
+)
+
+// IndexMaintainer makes indices older than [age] read-only and force-merges
+// them down to [max_segments], so the segments of past days' indexing get
+// merged once for good instead of piling up
+type IndexMaintainer struct {
+	Config  *MaintenanceConfig
+	Elastic *elastic.Client
+	Index   string
+	Logger  *Logger
+	Stats   *MaintenanceStats
+}
+
+func NewIndexMaintainer(es *elastic.Client, c *WriterConfig, logger *Logger) *IndexMaintainer {
+	mc := &c.Maintenance
+	if mc.Interval.Duration <= 0 {
+		mc.Interval.Duration = time.Hour
+	}
+	if mc.MaxSegments <= 0 {
+		mc.MaxSegments = 1
+	}
+	return &IndexMaintainer{
+		Config:  mc,
+		Elastic: es,
+		Index:   c.Index,
+		Logger:  logger,
+		Stats:   NewMaintenanceStats(),
+	}
+}
+
+// Run maintains the indices every [interval] until exitFlag is raised
+func (m *IndexMaintainer) Run(exitFlag *Flag) {
+	next := time.Now()
+	for !exitFlag.Get() {
+		if time.Now().Before(next) {
+			time.Sleep(time.Second)
+			continue
+		}
+		next = time.Now().Add(m.Config.Interval.Duration)
+		if err := m.Maintain(); err != nil {
+			m.Logger.Error("[writer] Index maintenance failed: %v", err)
+		}
+	}
+}
+
+// Maintain blocks writes to and force-merges every index of the writer
+// which ended more than [age] ago and isn't read-only yet
+func (m *IndexMaintainer) Maintain() error {
+	res, err := m.Elastic.PerformRequest("GET", "/"+m.Index+"-*/_settings", nil, nil)
+	if err != nil {
+		return err
+	}
+	var indices map[string]struct {
+		Settings struct {
+			Index struct {
+				Blocks struct {
+					Write string `json:"write"`
+				} `json:"blocks"`
+			} `json:"index"`
+		} `json:"settings"`
+	}
+	if err := json.Unmarshal(res.Body, &indices); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for name, index := range indices {
+		end, ok := indexPeriodEnd(m.Index, name)
+		if !ok || now.Sub(end) < m.Config.Age.Duration || index.Settings.Index.Blocks.Write == "true" {
+			continue
+		}
+		m.Logger.Info("[writer] Making index '%s' read-only and merging it to %d segments", name, m.Config.MaxSegments)
+		body := map[string]interface{}{"index.blocks.write": true}
+		if _, err := m.Elastic.PerformRequest("PUT", "/"+name+"/_settings", nil, body); err != nil {
+			m.Stats.Failed.Increment(1)
+			m.Logger.Error("[writer] Failed to make index '%s' read-only: %v", name, err)
+			continue
+		}
+		m.Stats.ReadOnly.Increment(1)
+		params := url.Values{"max_num_segments": []string{strconv.Itoa(m.Config.MaxSegments)}}
+		start := time.Now()
+		if _, err := m.Elastic.PerformRequest("POST", "/"+name+"/_forcemerge", params, nil); err != nil {
+			m.Stats.Failed.Increment(1)
+			m.Logger.Error("[writer] Failed to force-merge index '%s': %v", name, err)
+			continue
+		}
+		m.Stats.Merged.Increment(1)
+		m.Stats.Duration.Add(time.Since(start))
+	}
+	return nil
+}
+
+// indexPeriodEnd reads the end of the day, month or year the index is for
+// from its name
+func indexPeriodEnd(prefix, name string) (time.Time, bool) {
+	date := strings.TrimPrefix(name, prefix+"-")
+	for _, p := range []struct {
+		layout string
+		years  int
+		months int
+		days   int
+	}{
+		{"2006.01.02", 0, 0, 1},
+		{"2006.01", 0, 1, 0},
+		{"2006", 1, 0, 0},
+	} {
+		if t, err := time.Parse(p.layout, date); err == nil {
+			return t.AddDate(p.years, p.months, p.days), true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (m *IndexMaintainer) LogReport() {
+	m.Logger.Info("[writer] maintenance: %d/%d/%d (read_only/merged/failed), merge duration: %s/%s (avg/max)",
+		m.Stats.ReadOnly.Total(),
+		m.Stats.Merged.Total(),
+		m.Stats.Failed.Total(),
+		m.Stats.Duration.Avg(),
+		m.Stats.Duration.Max(),
+	)
+}
+
+type MaintenanceStats struct {
+	ReadOnly *StatsCounter
+	Merged   *StatsCounter
+	Failed   *StatsCounter
+	Duration *StatsTimer
+}
+
+func NewMaintenanceStats() *MaintenanceStats {
+	now := time.Now()
+	return &MaintenanceStats{
+		ReadOnly: NewStatsCounter(now),
+		Merged:   NewStatsCounter(now),
+		Failed:   NewStatsCounter(now),
+		Duration: NewStatsTimer(100),
+	}
+}
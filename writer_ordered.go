@@ -0,0 +1,63 @@
+package metcap
+
+import (
+	"hash/fnv"
+	"strconv"
+
+	"gopkg.in/olivere/elastic.v3"
+)
+
+// OrderedProcessors keeps the points of every series in order, for
+// consumers computing deltas downstream. Workers of one bulk processor
+// commit their bulks concurrently, so two points of a series may get
+// indexed out of order; with [ordered] the writer runs [concurrency]
+// single-worker processors instead and a series always goes to the same
+// one, picked by hash of the series.
+type OrderedProcessors struct {
+	processors []*elastic.BulkProcessor
+}
+
+func NewOrderedProcessors(name string, workers int, newProcessor func(string, int) (*elastic.BulkProcessor, error)) (*OrderedProcessors, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	o := &OrderedProcessors{}
+	for i := 0; i < workers; i++ {
+		p, err := newProcessor(name+"-"+strconv.Itoa(i), 1)
+		if err != nil {
+			o.Close()
+			return nil, err
+		}
+		o.processors = append(o.processors, p)
+	}
+	return o, nil
+}
+
+// Add queues the request to the processor of the series
+func (o *OrderedProcessors) Add(series string, req elastic.BulkableRequest) {
+	h := fnv.New32a()
+	h.Write([]byte(series))
+	o.processors[h.Sum32()%uint32(len(o.processors))].Add(req)
+}
+
+// Flush commits all the processors, the first error is returned
+func (o *OrderedProcessors) Flush() error {
+	var failed error
+	for _, p := range o.processors {
+		if err := p.Flush(); err != nil && failed == nil {
+			failed = err
+		}
+	}
+	return failed
+}
+
+// Close flushes and stops all the processors
+func (o *OrderedProcessors) Close() error {
+	var failed error
+	for _, p := range o.processors {
+		if err := p.Close(); err != nil && failed == nil {
+			failed = err
+		}
+	}
+	return failed
+}
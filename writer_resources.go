@@ -0,0 +1,110 @@
+package metcap
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/olivere/elastic.v3"
+)
+
+// ResourceVerifier makes sure the cluster resources the writer depends on
+// exist: the index template (put if missing) and the configured aliases, ILM
+// policy and data streams (only reported, they aren't ours to define).
+// Result is cached for [verify_interval], bulk errors hinting at a missing
+// resource invalidate it.
+type ResourceVerifier struct {
+	Elastic *elastic.Client
+	Config  *WriterConfig
+	Flavor  esFlavor
+	Logger  *Logger
+
+	verified time.Time
+	mux      *sync.Mutex
+}
+
+func NewResourceVerifier(es *elastic.Client, c *WriterConfig, flavor esFlavor, logger *Logger) *ResourceVerifier {
+	return &ResourceVerifier{
+		Elastic: es,
+		Config:  c,
+		Flavor:  flavor,
+		Logger:  logger,
+		mux:     &sync.Mutex{},
+	}
+}
+
+// Verify checks the resources unless they were verified recently. Only the
+// template is fatal, others missing get logged.
+func (r *ResourceVerifier) Verify() error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if !r.verified.IsZero() && time.Since(r.verified) < r.Config.VerifyInterval.Duration {
+		return nil
+	}
+	if err := ensureTemplate(r.Elastic, r.Config, r.Flavor, r.Logger); err != nil {
+		return err
+	}
+	for _, alias := range r.Config.Aliases {
+		r.check("alias", alias, "/_alias/"+alias)
+	}
+	if r.Config.ILMPolicy != "" {
+		r.check("ILM policy", r.Config.ILMPolicy, "/_ilm/policy/"+r.Config.ILMPolicy)
+	}
+	for _, stream := range r.Config.DataStreams {
+		r.check("data stream", stream, "/_data_stream/"+stream)
+	}
+	r.verified = time.Now()
+	return nil
+}
+
+// Invalidate makes the next Verify check the cluster again
+func (r *ResourceVerifier) Invalidate() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.verified = time.Time{}
+}
+
+// Run re-verifies when due until exitFlag is raised, failures are retried
+// after 10 seconds
+func (r *ResourceVerifier) Run(exitFlag *Flag) {
+	for !exitFlag.Get() {
+		wait := time.Second
+		if err := r.Verify(); err != nil {
+			r.Logger.Error("[writer] Failed to verify index template: %v", err)
+			wait = 10 * time.Second
+		}
+		time.Sleep(wait)
+	}
+}
+
+func (r *ResourceVerifier) check(kind, name, path string) {
+	res, err := r.Elastic.PerformRequest("GET", path, nil, nil, 404)
+	switch {
+	case err != nil:
+		r.Logger.Error("[writer] Failed to verify %s '%s': %v", kind, name, err)
+	case res.StatusCode == 404:
+		r.Logger.Alert("[writer] The %s '%s' doesn't exist", kind, name)
+	default:
+		r.Logger.Debug("[writer] The %s '%s' exists", kind, name)
+	}
+}
+
+// isMissingResourceError tells bulk item errors caused by missing index,
+// alias or data stream
+func isMissingResourceError(item *elastic.BulkResponseItem) bool {
+	if item.Error == nil {
+		return item.Status == 404
+	}
+	switch item.Error.Type {
+	case "index_not_found_exception", "resource_not_found_exception":
+		return true
+	case "illegal_argument_exception":
+		reason := strings.ToLower(item.Error.Reason)
+		for _, hint := range []string{"alias", "data stream", "write index"} {
+			if strings.Contains(reason, hint) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package metcap
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// StatusRetrier is a http.RoundTripper retrying requests ElasticSearch (or
+// rather the load balancer in front of it) answered by one of
+// [retry_statuses], ie. 502 and 503 while a node restarts, so those don't
+// fail whole bulks. It retries up to [retry_max] times (default 3), waiting
+// [retry_backoff] (default "100ms") doubled every retry up to
+// [retry_backoff_max] (default "5s"), randomized by ±25% so writers don't
+// retry in lockstep; Retry-After of the response is honored up to the max.
+// The client of elastic.v3 has no retries on status of its own.
+type StatusRetrier struct {
+	Transport  http.RoundTripper
+	Statuses   map[int]bool
+	MaxRetries int
+	Backoff    time.Duration
+	BackoffMax time.Duration
+	Retried    *StatsCounter
+	GaveUp     *StatsCounter
+
+	rnd *rand.Rand
+	mux *sync.Mutex
+}
+
+func NewStatusRetrier(c *WriterConfig) (*StatusRetrier, error) {
+	if len(c.RetryStatuses) == 0 {
+		return nil, nil
+	}
+	r := &StatusRetrier{
+		Transport:  http.DefaultTransport,
+		Statuses:   make(map[int]bool),
+		MaxRetries: c.RetryMax,
+		Backoff:    c.RetryBackoff.Duration,
+		BackoffMax: c.RetryBackoffMax.Duration,
+		Retried:    NewStatsCounter(time.Now()),
+		GaveUp:     NewStatsCounter(time.Now()),
+		rnd:        rand.New(rand.NewSource(time.Now().UnixNano())),
+		mux:        &sync.Mutex{},
+	}
+	for _, status := range c.RetryStatuses {
+		if status < 400 || status > 599 {
+			return nil, fmt.Errorf("invalid retry status %d", status)
+		}
+		r.Statuses[status] = true
+	}
+	if r.MaxRetries <= 0 {
+		r.MaxRetries = 3
+	}
+	if r.Backoff <= 0 {
+		r.Backoff = 100 * time.Millisecond
+	}
+	if r.BackoffMax <= 0 {
+		r.BackoffMax = 5 * time.Second
+	}
+	return r, nil
+}
+
+func (r *StatusRetrier) RoundTrip(req *http.Request) (*http.Response, error) {
+	// the body is read for every attempt
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	wait := r.Backoff
+	for attempt := 0; ; attempt++ {
+		// RoundTrippers mustn't modify the request
+		areq := new(http.Request)
+		*areq = *req
+		if body != nil {
+			areq.Body = ioutil.NopCloser(bytes.NewReader(body))
+			areq.GetBody = func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader(body)), nil
+			}
+		}
+		res, err := r.Transport.RoundTrip(areq)
+		if err != nil || !r.Statuses[res.StatusCode] {
+			return res, err
+		}
+		if attempt >= r.MaxRetries {
+			r.GaveUp.Increment(1)
+			return res, nil
+		}
+		delay := r.delay(wait, res.Header.Get("Retry-After"))
+		io.Copy(ioutil.Discard, res.Body) // lets the connection be reused
+		res.Body.Close()
+		r.Retried.Increment(1)
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		if wait *= 2; wait > r.BackoffMax {
+			wait = r.BackoffMax
+		}
+	}
+}
+
+// delay is the wait randomized by ±25%, or Retry-After seconds if longer,
+// capped by the max
+func (r *StatusRetrier) delay(wait time.Duration, retryAfter string) time.Duration {
+	r.mux.Lock()
+	delay := wait*3/4 + time.Duration(r.rnd.Int63n(int64(wait)/2+1))
+	r.mux.Unlock()
+	if secs, err := strconv.Atoi(retryAfter); err == nil && time.Duration(secs)*time.Second > delay {
+		delay = time.Duration(secs) * time.Second
+	}
+	if delay > r.BackoffMax {
+		delay = r.BackoffMax
+	}
+	return delay
+}
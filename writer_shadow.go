@@ -0,0 +1,212 @@
+package metcap
+
+import (
+	"hash/fnv"
+	"time"
+
+	"gopkg.in/olivere/elastic.v3"
+)
+
+// ShadowWriter mirrors a share of the indexed metrics to a second cluster,
+// ie. to validate a new ElasticSearch version against production load. It
+// never holds the main writer back: it connects in the background (retried
+// every [startup_retry] while the cluster is unreachable), metrics it can't
+// keep up with are dropped and its failures are only logged and counted.
+type ShadowWriter struct {
+	Config    *ShadowConfig
+	Writer    WriterConfig // main writer's config with the shadow's cluster
+	Elastic   *elastic.Client
+	Processor *elastic.BulkProcessor
+	DocType   string
+	Mapping   string
+	Rules     []IndexRule
+	Input     chan *Metric
+	Normalize *NormalizePreset
+	Logger    *Logger
+	Stats     *ShadowStats
+
+	closed chan struct{}
+	done   chan struct{}
+}
+
+// shadowCloseTimeout bounds the final flush on shutdown, the shadow
+// cluster may be down
+const shadowCloseTimeout = 30 * time.Second
+
+func NewShadowWriter(c *WriterConfig, logger *Logger) (*ShadowWriter, error) {
+	sc := &c.Shadow
+	if sc.Index == "" {
+		sc.Index = c.Index
+	}
+	if sc.Concurrency <= 0 {
+		sc.Concurrency = 1
+	}
+	if sc.BulkMax <= 0 {
+		sc.BulkMax = c.BulkMax
+	}
+	if sc.BulkWait.Duration <= 0 {
+		sc.BulkWait = c.BulkWait
+	}
+	if sc.Buffer <= 0 {
+		sc.Buffer = 10000
+	}
+
+	rules, err := NewIndexRules(c.IndexRules)
+	if err != nil {
+		return nil, err
+	}
+	normalize, err := NewNormalizePreset(sc.Normalize)
+	if err != nil {
+		logger.Alert("[writer] Shadow: %v", err)
+		return nil, err
+	}
+
+	logger.Info("[writer] Shadowing %.1f%% of series to %v", sc.Percent, sc.URLs)
+	tc := *c
+	tc.Index = sc.Index
+	tc.Compat, tc.Username, tc.Password, tc.Sniff = sc.Compat, sc.Username, sc.Password, sc.Sniff
+	return &ShadowWriter{
+		Config:    sc,
+		Writer:    tc,
+		Mapping:   tc.FieldsMapping,
+		Rules:     rules,
+		Input:     make(chan *Metric, sc.Buffer),
+		Normalize: normalize,
+		Logger:    logger,
+		Stats:     NewShadowStats(),
+		closed:    make(chan struct{}),
+		done:      make(chan struct{}),
+	}, nil
+}
+
+// connect sets up the client and the template of the shadow cluster
+func (s *ShadowWriter) connect() error {
+	tc := s.Writer
+	es, flavor, err := newESClient(s.Config.URLs, &tc, nil, s.Logger)
+	if err != nil {
+		return err
+	}
+	tc.DocType = flavor.docType(tc.DocType)
+	if err := ensureTemplate(es, &tc, flavor, s.Logger); err != nil {
+		return err
+	}
+	s.Elastic, s.DocType = es, tc.DocType
+	return nil
+}
+
+// Run connects and feeds the shadow bulk-processor until closed, metrics
+// coming while it's not connected are dropped once the buffer is full
+func (s *ShadowWriter) Run() {
+	defer close(s.done)
+	for {
+		err := s.connect()
+		if err == nil {
+			break
+		}
+		s.Logger.Error("[writer] Can't connect to shadow ElasticSearch, retrying in %v: %v", s.Writer.StartupRetry.Duration, err)
+		select {
+		case <-time.After(s.Writer.StartupRetry.Duration):
+		case <-s.closed:
+			for range s.Input {
+				s.Stats.Dropped.Increment(1)
+			}
+			return
+		}
+	}
+	var err error
+	s.Processor, err = elastic.NewBulkProcessorService(s.Elastic).
+		Name("metcap-shadow").
+		Workers(s.Config.Concurrency).
+		BulkActions(s.Config.BulkMax).
+		BulkSize(-1).
+		After(s.hookAfterCommit).
+		FlushInterval(s.Config.BulkWait.Duration).
+		Do()
+	if err != nil {
+		s.Logger.Error("[writer] Failed to setup shadow bulk-processor: %v", err)
+		for range s.Input {
+			s.Stats.Dropped.Increment(1)
+		}
+		return
+	}
+	for m := range s.Input {
+		s.Processor.Add(elastic.NewBulkIndexRequest().
+			Index(routeIndex(s.Rules, m, s.Config.Index)).
+			Type(s.DocType).
+			Doc(metricDocument(m, s.Mapping)))
+	}
+	s.Processor.Close()
+}
+
+// Add mirrors the metric if its series falls into the shadowed share
+func (s *ShadowWriter) Add(m *Metric) {
+	h := fnv.New32a()
+	h.Write([]byte(m.SeriesID()))
+	if float64(h.Sum32()%10000) >= s.Config.Percent*100 {
+		return
+	}
+	if s.Normalize != nil {
+		m = s.Normalize.Normalize(m)
+	}
+	select {
+	case s.Input <- m:
+		s.Stats.Queued.Increment(1)
+	default:
+		s.Stats.Dropped.Increment(1)
+	}
+}
+
+// Close stops the shadow writer once it flushed what it has, or gave up
+// after shadowCloseTimeout
+func (s *ShadowWriter) Close() {
+	close(s.closed)
+	close(s.Input)
+	select {
+	case <-s.done:
+	case <-time.After(shadowCloseTimeout):
+		s.Logger.Error("[writer] Gave up flushing shadow bulk-processor after %v", shadowCloseTimeout)
+	}
+}
+
+func (s *ShadowWriter) hookAfterCommit(id int64, reqs []elastic.BulkableRequest, res *elastic.BulkResponse, err error) {
+	if res == nil {
+		s.Stats.Failed.Increment(len(reqs))
+		if err != nil {
+			s.Logger.Debug("[writer] Shadow bulk failed: %v", err)
+		}
+		return
+	}
+	s.Stats.Succeeded.Increment(len(res.Succeeded()))
+	s.Stats.Failed.Increment(len(res.Failed()))
+	s.Stats.Duration.Add(time.Duration(res.Took) * time.Millisecond)
+}
+
+func (s *ShadowWriter) LogReport() {
+	s.Logger.Info("[writer] shadow: %d/%d/%d/%d (queued/succeeded/failed/dropped), duration: %s/%s (avg/max)",
+		s.Stats.Queued.Total(),
+		s.Stats.Succeeded.Total(),
+		s.Stats.Failed.Total(),
+		s.Stats.Dropped.Total(),
+		s.Stats.Duration.Avg(),
+		s.Stats.Duration.Max(),
+	)
+}
+
+type ShadowStats struct {
+	Queued    *StatsCounter
+	Succeeded *StatsCounter
+	Failed    *StatsCounter
+	Dropped   *StatsCounter
+	Duration  *StatsTimer
+}
+
+func NewShadowStats() *ShadowStats {
+	now := time.Now()
+	return &ShadowStats{
+		Queued:    NewStatsCounter(now),
+		Succeeded: NewStatsCounter(now),
+		Failed:    NewStatsCounter(now),
+		Dropped:   NewStatsCounter(now),
+		Duration:  NewStatsTimer(1000),
+	}
+}
@@ -0,0 +1,159 @@
+package metcap
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// WriterSnapshot keeps what the writer holds in memory across restarts in
+// [snapshot_file]: on shutdown, draining the buffer gives up after
+// [drain_timeout] (default "30s") and whatever's left in the writer's
+// channel is saved along with the aggregator's unfinished intervals (rather
+// than flushing those partial), on start they're loaded back and the file
+// removed. Restarts during a backlog (ie. ElasticSearch down) then don't
+// lose the in-flight window; what's queued in the bulk-processors already
+// isn't saved.
+type WriterSnapshot struct {
+	Path         string
+	DrainTimeout time.Duration
+	Logger       *Logger
+}
+
+// writerSnapshot is the gob encoded content of the file
+type writerSnapshot struct {
+	Version int
+	Taken   time.Time
+	Metrics []*Metric
+	Buckets []AggregationSnapshot
+}
+
+const writerSnapshotVersion = 1
+
+func NewWriterSnapshot(c *WriterConfig, logger *Logger) (*WriterSnapshot, error) {
+	if c.SnapshotFile == "" {
+		return nil, nil
+	}
+	s := &WriterSnapshot{
+		Path:         c.SnapshotFile,
+		DrainTimeout: c.DrainTimeout.Duration,
+		Logger:       logger,
+	}
+	if s.DrainTimeout <= 0 {
+		s.DrainTimeout = 30 * time.Second
+	}
+	// fail on start rather than on shutdown
+	dir := filepath.Dir(s.Path)
+	if fi, err := os.Stat(dir); err != nil {
+		return nil, err
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("snapshot directory %s isn't a directory", dir)
+	}
+	return s, nil
+}
+
+// Save writes the metrics and aggregation buckets, the file is replaced
+// only once written completely
+func (s *WriterSnapshot) Save(metrics []*Metric, buckets []AggregationSnapshot) error {
+	tmp := s.Path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(writerSnapshot{
+		Version: writerSnapshotVersion,
+		Taken:   time.Now(),
+		Metrics: metrics,
+		Buckets: buckets,
+	})
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, s.Path)
+}
+
+// Load reads and removes the snapshot, none is no error
+func (s *WriterSnapshot) Load() ([]*Metric, []AggregationSnapshot, time.Time, error) {
+	f, err := os.Open(s.Path)
+	if os.IsNotExist(err) {
+		return nil, nil, time.Time{}, nil
+	}
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	defer f.Close()
+	var snap writerSnapshot
+	if err := gob.NewDecoder(f).Decode(&snap); err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	if snap.Version != writerSnapshotVersion {
+		return nil, nil, time.Time{}, fmt.Errorf("%s: unknown snapshot version %d", s.Path, snap.Version)
+	}
+	// loaded metrics are the writer's again, a crash mustn't load them twice
+	if err := os.Remove(s.Path); err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	return snap.Metrics, snap.Buckets, snap.Taken, nil
+}
+
+// drain takes whatever's left in the channels without waiting
+func (s *WriterSnapshot) drain(output <-chan *Metric, batches <-chan []*Metric) []*Metric {
+	var metrics []*Metric
+	for output != nil || batches != nil {
+		select {
+		case m, ok := <-output:
+			if !ok {
+				output = nil
+				continue
+			}
+			metrics = append(metrics, m)
+		case batch, ok := <-batches:
+			if !ok {
+				batches = nil
+				continue
+			}
+			metrics = append(metrics, batch...)
+		default:
+			return metrics
+		}
+	}
+	return metrics
+}
+
+// restoreSnapshot loads the snapshot of the previous run, the aggregation
+// buckets get indexed as means if the aggregator's been disabled since
+func (w *Writer) restoreSnapshot() {
+	metrics, buckets, taken, err := w.Snapshot.Load()
+	if err != nil {
+		w.Logger.Error("[writer] Failed to load snapshot: %v", err)
+		return
+	}
+	if len(metrics) == 0 && len(buckets) == 0 {
+		return
+	}
+	w.Logger.Info("[writer] Loaded snapshot of %d metrics and %d aggregation buckets taken %v ago",
+		len(metrics), len(buckets), time.Since(taken).Truncate(time.Second))
+	if w.Aggregator != nil {
+		w.Aggregator.Restore(buckets)
+	} else if len(buckets) > 0 {
+		batch := make([]*Metric, 0, len(buckets))
+		for _, b := range buckets {
+			b.Metric.Value = b.Sum / b.Count
+			b.Metric.Aggregate = &Aggregate{Sum: b.Sum, Count: b.Count, Min: b.Min, Max: b.Max}
+			batch = append(batch, b.Metric)
+		}
+		w.indexBatch(batch)
+	}
+	if len(metrics) > 0 {
+		w.add(metrics)
+	}
+}
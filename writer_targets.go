@@ -0,0 +1,204 @@
+package metcap
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"gopkg.in/olivere/elastic.v3"
+)
+
+// BulkTargets gives every index written to a bulk processor of its own with
+// [index_concurrency] workers, fed through a queue of [index_queue] requests.
+// A slow index (ie. being force-merged) then only backs up its own queue
+// instead of holding the bulks of all the others; the writer blocks only
+// once that queue is full. Processors of indices not written to for
+// [index_idle] (yesterday's, typically) are closed.
+type BulkTargets struct {
+	Config  *WriterConfig
+	New     func(name string, workers int) (*elastic.BulkProcessor, error)
+	Logger  *Logger
+	targets map[string]*bulkTarget
+	closed  bool
+	mux     *sync.Mutex
+}
+
+type bulkTarget struct {
+	queue     chan elastic.BulkableRequest
+	processor *elastic.BulkProcessor
+	used      time.Time
+	adding    sync.WaitGroup // requests between the lookup and the queue
+	done      chan struct{}
+	closed    bool
+	mux       sync.Mutex // flushing vs. closing
+}
+
+func NewBulkTargets(c *WriterConfig, newProcessor func(string, int) (*elastic.BulkProcessor, error), logger *Logger) *BulkTargets {
+	if !c.IndexProcessors {
+		return nil
+	}
+	if c.IndexConcurrency <= 0 {
+		c.IndexConcurrency = c.Concurrency
+	}
+	if c.Ordered {
+		c.IndexConcurrency = 1 // concurrent workers would reorder the series
+	}
+	if c.IndexQueue <= 0 {
+		c.IndexQueue = 10000
+	}
+	if c.IndexIdle.Duration <= 0 {
+		c.IndexIdle.Duration = time.Hour
+	}
+	return &BulkTargets{
+		Config:  c,
+		New:     newProcessor,
+		Logger:  logger,
+		targets: make(map[string]*bulkTarget),
+		mux:     &sync.Mutex{},
+	}
+}
+
+// Add queues the request for the processor of the index, starting one if
+// there's none yet, fails once the targets are closed
+func (b *BulkTargets) Add(index string, req elastic.BulkableRequest) error {
+	b.mux.Lock()
+	if b.closed {
+		b.mux.Unlock()
+		return errors.New("bulk-processors closed")
+	}
+	t, ok := b.targets[index]
+	if !ok {
+		p, err := b.New("metcap-"+index, b.Config.IndexConcurrency)
+		if err != nil {
+			b.mux.Unlock()
+			return err
+		}
+		b.Logger.Debug("[writer] Started bulk-processor for index '%s'", index)
+		t = &bulkTarget{
+			queue:     make(chan elastic.BulkableRequest, b.Config.IndexQueue),
+			processor: p,
+			done:      make(chan struct{}),
+		}
+		go t.run()
+		b.targets[index] = t
+	}
+	t.used = time.Now()
+	t.adding.Add(1)
+	b.mux.Unlock()
+
+	t.queue <- req
+	t.adding.Done()
+	return nil
+}
+
+func (t *bulkTarget) run() {
+	for req := range t.queue {
+		t.processor.Add(req)
+	}
+	t.processor.Close()
+	close(t.done)
+}
+
+// close flushes what's queued and stops the processor, the target has to
+// be out of the map already so no more requests get added
+func (t *bulkTarget) close() {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.adding.Wait()
+	close(t.queue)
+	<-t.done
+	t.closed = true
+}
+
+// flush flushes the processor unless it's closed (and flushed) already
+func (t *bulkTarget) flush() error {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.closed {
+		return nil
+	}
+	return t.processor.Flush()
+}
+
+// Flush flushes processors of all the indices, outside of the lock so
+// requests of other indices get queued meanwhile
+func (b *BulkTargets) Flush() error {
+	var err error
+	for _, t := range b.snapshot() {
+		if ferr := t.flush(); ferr != nil {
+			err = ferr
+		}
+	}
+	return err
+}
+
+// CloseIdle closes processors of indices not written to for [index_idle]
+func (b *BulkTargets) CloseIdle() {
+	idle := make(map[string]*bulkTarget)
+	b.mux.Lock()
+	for index, t := range b.targets {
+		// full queue means the writer is blocked on it rather than idle
+		if time.Since(t.used) > b.Config.IndexIdle.Duration && len(t.queue) == 0 {
+			idle[index] = t
+			delete(b.targets, index)
+		}
+	}
+	b.mux.Unlock()
+	for index, t := range idle {
+		b.Logger.Debug("[writer] Closing idle bulk-processor of index '%s'", index)
+		t.close()
+	}
+}
+
+// Run closes idle processors every minute until exitFlag is raised
+func (b *BulkTargets) Run(exitFlag *Flag) {
+	next := time.Now().Add(time.Minute)
+	for !exitFlag.Get() {
+		if time.Now().After(next) {
+			b.CloseIdle()
+			next = time.Now().Add(time.Minute)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// Close flushes and stops all the processors, requests added later fail
+func (b *BulkTargets) Close() {
+	b.mux.Lock()
+	b.closed = true
+	targets := b.targets
+	b.targets = make(map[string]*bulkTarget)
+	b.mux.Unlock()
+	for _, t := range targets {
+		t.close()
+	}
+}
+
+// snapshot copies the targets for use outside of the lock
+func (b *BulkTargets) snapshot() []*bulkTarget {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	targets := make([]*bulkTarget, 0, len(b.targets))
+	for _, t := range b.targets {
+		targets = append(targets, t)
+	}
+	return targets
+}
+
+// Len is the number of indices with a processor running
+func (b *BulkTargets) Len() int {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return len(b.targets)
+}
+
+// Queued is the number of requests waiting in the queues, by index
+func (b *BulkTargets) Queued() map[string]int {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	queued := make(map[string]int, len(b.targets))
+	for index, t := range b.targets {
+		queued[index] = len(t.queue)
+	}
+	return queued
+}
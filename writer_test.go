@@ -0,0 +1,66 @@
+package metcap
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func testLogger() *Logger {
+	syslog := false
+	logger := NewLogger(&syslog, &Flag{Mutex: &sync.Mutex{}})
+	go logger.Run()
+	return logger
+}
+
+// fakeElastic answers everything a connecting writer asks for and counts the
+// bulk requests reaching it
+func fakeElastic(bulks *int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `{"version":{"number":"5.6.16"}}`)
+		case "/_bulk":
+			atomic.AddInt64(bulks, 1)
+			fmt.Fprint(w, `{"took":1,"errors":false,"items":[]}`)
+		default:
+			fmt.Fprint(w, `{}`)
+		}
+	}))
+}
+
+func TestWriterChaosStartup(t *testing.T) {
+	var bulks int64
+	es := fakeElastic(&bulks)
+	defer es.Close()
+
+	logger := testLogger()
+	chaos, err := NewChaos(&ChaosConfig{Enabled: true, BulkFailPercent: 100}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sniff := false
+	c := &WriterConfig{URLs: []string{es.URL}, Index: "metrics", Sniff: &sniff}
+	w, err := NewWriter(c, nil, chaos, &sync.WaitGroup{}, logger, &Flag{Mutex: &sync.Mutex{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Startup != "fail" {
+		t.Fatalf("startup mode is '%s', not the default", c.Startup)
+	}
+
+	client, _ := w.Client()
+	if _, err := client.PerformRequest("POST", "/_bulk", nil, "{}\n"); err == nil {
+		t.Error("bulk request went through with every bulk failed by chaos")
+	}
+	if n := atomic.LoadInt64(&bulks); n != 0 {
+		t.Errorf("%d bulk requests reached ElasticSearch past chaos", n)
+	}
+	if n := chaos.BulksFailed.Total(); n != 1 {
+		t.Errorf("chaos failed %d bulk requests, not 1", n)
+	}
+}